@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// OpenLiveCapture is only implemented on Linux; use a pcap file elsewhere
+func OpenLiveCapture(iface string) (PacketSource, error) {
+	return nil, errors.New("live capture requires Linux AF_PACKET sockets")
+}
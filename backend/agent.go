@@ -0,0 +1,415 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// AgentBatch is what an agent pushes to the aggregator after every scan
+type AgentBatch struct {
+	AgentID     string       `json:"agentId"`
+	Hostname    string       `json:"hostname"`
+	Addresses   []string     `json:"addresses"` // the agent's interface addresses
+	Location    *Location    `json:"location,omitempty"`
+	Timestamp   time.Time    `json:"timestamp"`
+	Connections []Connection `json:"connections"`
+}
+
+// OriginDescriber is implemented by collectors that know more about the
+// origin nodes they report than their IP address
+type OriginDescriber interface {
+	DescribeOrigin(id string) *NetworkNode
+}
+
+// maxAgentBatchSize is the default bound on a single batch message from
+// an agent
+const maxAgentBatchSize = 16 << 20
+
+// agentNodeID is the store key of the node representing an agent's host
+func agentNodeID(agentID string) string {
+	return "agent:" + agentID
+}
+
+// runAgent runs the collector and pushes its results to the aggregator
+// instead of serving the map itself
+func runAgent(cfg *Config) {
+	if cfg.AggregatorURL == "" {
+		fatal("Agent mode requires NETOPS_AGGREGATOR_URL", "component", "agent")
+	}
+
+	agentID := cfg.AgentID
+	hostname, _ := os.Hostname()
+	if agentID == "" {
+		agentID = hostname
+	}
+
+	collector, err := NewCollector(cfg, true)
+	if err != nil {
+		fatal("Invalid NETOPS_COLLECTOR", "component", "collector", "error", err)
+	}
+
+	var location *Location
+	if cfg.AgentLat != 0 || cfg.AgentLng != 0 {
+		location = &Location{Lat: cfg.AgentLat, Lng: cfg.AgentLng}
+	}
+
+	logger := slog.With("component", "agent", "agent_id", agentID)
+	logger.Info("NetOps agent starting", "aggregator", cfg.AggregatorURL, "interval", cfg.AgentInterval)
+
+	var conn *websocket.Conn
+	backoff := time.Second
+	ticker := time.NewTicker(cfg.AgentInterval)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		connections, err := collector.Collect()
+		if err != nil {
+			logger.Error("Failed to capture connections", "error", err)
+			continue
+		}
+
+		if conn == nil {
+			conn, err = dialAggregator(cfg, agentID)
+			if err != nil {
+				logger.Warn("Cannot reach aggregator", "aggregator", cfg.AggregatorURL, "retry", backoff, "error", err)
+				time.Sleep(backoff)
+				backoff = min(backoff*2, 30*time.Second)
+				continue
+			}
+			backoff = time.Second
+			logger.Info("Connected to aggregator", "aggregator", cfg.AggregatorURL)
+		}
+
+		batch := AgentBatch{
+			AgentID:     agentID,
+			Hostname:    hostname,
+			Addresses:   interfaceAddresses(),
+			Location:    location,
+			Timestamp:   time.Now(),
+			Connections: connections,
+		}
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := conn.WriteJSON(batch); err != nil {
+			logger.Warn("Lost connection to aggregator", "error", err)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+// dialAggregator opens the authenticated agent WebSocket
+func dialAggregator(cfg *Config, agentID string) (*websocket.Conn, error) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+cfg.AgentToken)
+	header.Set("X-NetOps-Agent", agentID)
+
+	tlsConfig, err := agentTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	conn, resp, err := dialer.Dial(cfg.AggregatorURL, header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("%w (HTTP %d)", err, resp.StatusCode)
+		}
+		return nil, err
+	}
+
+	// Drain control frames so pings and close messages are handled
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	return conn, nil
+}
+
+// interfaceAddresses lists this host's non-loopback addresses
+func interfaceAddresses() []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var out []string
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+			out = append(out, ipnet.IP.String())
+		}
+	}
+	return out
+}
+
+type agentState struct {
+	batch    AgentBatch
+	received time.Time
+	remote   string
+	conn     *websocket.Conn
+}
+
+// AgentCollector is the aggregator side: it accepts batches from agents and
+// presents their latest connections as a Collector, with each agent's host
+// as the origin of its edges
+type AgentCollector struct {
+	tokens   map[string]string // token -> agent ID it is bound to, "" until first use
+	maxAge   time.Duration     // batches older than this are ignored
+	maxBatch int64             // largest batch message accepted, in bytes
+	agents   map[string]*agentState
+	mu       sync.RWMutex
+}
+
+// NewAgentCollector parses tokens of the form "token" or "agentID:token".
+// A bare token is bound to the first agent ID that presents it.
+func NewAgentCollector(tokens []string, maxAge time.Duration) *AgentCollector {
+	a := &AgentCollector{
+		tokens:   make(map[string]string),
+		maxAge:   maxAge,
+		maxBatch: maxAgentBatchSize,
+		agents:   make(map[string]*agentState),
+	}
+	for _, t := range tokens {
+		if id, token, ok := strings.Cut(t, ":"); ok {
+			a.tokens[token] = id
+		} else if t != "" {
+			a.tokens[t] = ""
+		}
+	}
+	return a
+}
+
+// validAgentID reports whether id is a plain name. Agent IDs become part of
+// node IDs, where a "/" separates the agent from a LAN client behind it, and
+// of certificate file names.
+func validAgentID(id string) bool {
+	return id != "" && !strings.Contains(id, "..") && !strings.ContainsAny(id, `/\`)
+}
+
+// authorize checks the agent's client certificate or bearer token and
+// returns the agent ID it may report as. A certificate verified against the
+// client CA identifies the agent by its common name. A bare token not yet
+// bound is returned as pin, for bind once the connection is accepted.
+func (a *AgentCollector) authorize(r *http.Request) (agentID, pin string, ok bool) {
+	claimed := r.Header.Get("X-NetOps-Agent")
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		certID := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if !validAgentID(certID) || (claimed != "" && claimed != certID) {
+			return "", "", false
+		}
+		return certID, "", true
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !validAgentID(claimed) {
+		return "", "", false
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for known, boundID := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			if boundID == "" {
+				return claimed, known, true
+			}
+			return claimed, "", boundID == claimed
+		}
+	}
+	return "", "", false
+}
+
+// bind pins a bare token to the agent ID that first connected with it, so
+// nobody else holding it can report as another agent. It fails when another
+// agent bound the token in the meantime.
+func (a *AgentCollector) bind(token, agentID string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if boundID := a.tokens[token]; boundID != "" {
+		return boundID == agentID
+	}
+	a.tokens[token] = agentID
+	slog.Info("Agent token bound", "component", "agent", "agent_id", agentID)
+	return true
+}
+
+// Accept registers an agent connection that has already been authorized
+// and reads its batches until it disconnects
+func (a *AgentCollector) Accept(conn *websocket.Conn, agentID, remote string) {
+	slog.Info("Agent connected", "component", "agent", "agent_id", agentID, "remote", remote)
+	defer func() {
+		conn.Close()
+		a.mu.Lock()
+		// A reconnect may already have replaced this connection's state
+		if state, ok := a.agents[agentID]; ok && state.conn == conn {
+			delete(a.agents, agentID)
+		}
+		a.mu.Unlock()
+		slog.Info("Agent disconnected", "component", "agent", "agent_id", agentID)
+	}()
+
+	conn.SetReadLimit(a.maxBatch)
+	for {
+		var batch AgentBatch
+		if err := conn.ReadJSON(&batch); err != nil {
+			return
+		}
+		// The authenticated identity wins over whatever the batch claims
+		batch.AgentID = agentID
+
+		a.mu.Lock()
+		a.agents[agentID] = &agentState{batch: batch, received: time.Now(), remote: remote, conn: conn}
+		a.mu.Unlock()
+	}
+}
+
+// HandleAgent is the aggregator's /agent WebSocket endpoint
+func (a *AgentCollector) HandleAgent() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		agentID, pin, ok := a.authorize(r)
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			slog.Warn("Agent WebSocket upgrade failed", "component", "agent", "agent_id", agentID, "error", err)
+			return
+		}
+		if pin != "" && !a.bind(pin, agentID) {
+			slog.Warn("Agent token already bound to another agent", "component", "agent", "agent_id", agentID)
+			conn.Close()
+			return
+		}
+		go a.Accept(conn, agentID, r.RemoteAddr)
+	}
+}
+
+func (a *AgentCollector) Name() string { return "agents" }
+
+// live returns the agents that reported recently
+func (a *AgentCollector) live() map[string]*agentState {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	cutoff := time.Now().Add(-a.maxAge)
+	live := make(map[string]*agentState, len(a.agents))
+	for id, state := range a.agents {
+		if state.received.After(cutoff) {
+			live[id] = state
+		}
+	}
+	return live
+}
+
+// Collect returns every live agent's connections. Connections to another
+// agent's address become internal edges between the two agent nodes,
+// oriented from client to server so both ends' reports collapse into one.
+func (a *AgentCollector) Collect() ([]Connection, error) {
+	live := a.live()
+
+	owners := make(map[string]string) // address -> agent node ID
+	for id, state := range live {
+		for _, addr := range state.batch.Addresses {
+			owners[addr] = agentNodeID(id)
+		}
+	}
+
+	connections := []Connection{}
+	for id, state := range live {
+		nodeID := agentNodeID(id)
+		for _, conn := range state.batch.Connections {
+			if conn.Origin != "" {
+				// An agent running the conntrack collector reports LAN clients
+				conn.Origin = nodeID + "/" + conn.Origin
+			} else {
+				conn.Origin = nodeID
+			}
+
+			if owner, ok := owners[conn.RemoteIP]; ok && owner != nodeID {
+				if conn.RemotePort > conn.LocalPort {
+					// This is the server's view; flip it to start at the client
+					conn.Origin, conn.Target = owner, conn.Origin
+					conn.LocalIP, conn.RemoteIP = conn.RemoteIP, conn.LocalIP
+					conn.LocalPort, conn.RemotePort = conn.RemotePort, conn.LocalPort
+					conn.Process = ""
+				} else {
+					conn.Target = owner
+				}
+				connections = append(connections, conn)
+				continue
+			}
+
+			if shouldInclude(&conn) {
+				connections = append(connections, conn)
+			}
+		}
+	}
+	return connections, nil
+}
+
+// DescribeOrigin builds the node for an agent's host, or for a LAN client
+// behind an agent ("agent:<id>/<ip>")
+func (a *AgentCollector) DescribeOrigin(id string) *NetworkNode {
+	rest, ok := strings.CutPrefix(id, "agent:")
+	if !ok {
+		return nil
+	}
+	agentID, lanIP, behind := strings.Cut(rest, "/")
+
+	a.mu.RLock()
+	state, ok := a.agents[agentID]
+	a.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	node := &NetworkNode{
+		ID:       id,
+		Type:     "endpoint",
+		Status:   "online",
+		Internal: true,
+		Agent:    agentID,
+	}
+	if state.batch.Location != nil {
+		node.Location = *state.batch.Location
+	}
+	if behind {
+		node.Name = lanIP
+		node.IPAddress = lanIP
+		return node
+	}
+
+	node.Name = state.batch.Hostname
+	if node.Name == "" {
+		node.Name = agentID
+	}
+	node.IPAddress = primaryAddress(state.batch.Addresses, state.remote)
+	return node
+}
+
+// primaryAddress prefers the agent's first IPv4 interface address, falling
+// back to the address it connected from
+func primaryAddress(addrs []string, remote string) string {
+	for _, addr := range addrs {
+		if ip, err := netip.ParseAddr(addr); err == nil && ip.Is4() {
+			return addr
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs[0]
+	}
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return remote
+	}
+	return host
+}
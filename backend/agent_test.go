@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func agentRequest(token, agentID string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/agent", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("X-NetOps-Agent", agentID)
+	return r
+}
+
+func TestAgentAuthorize(t *testing.T) {
+	a := NewAgentCollector([]string{"web-1:bound", "shared"}, time.Minute)
+
+	tests := []struct {
+		token, agent string
+		ok           bool
+	}{
+		{"bound", "web-1", true},
+		{"bound", "web-2", false},
+		{"wrong", "web-1", false},
+		{"bound", "", false},
+		// IDs that would be misread as an agent and a LAN client behind it
+		{"shared", "a/10.0.0.5", false},
+		{"shared", `a\b`, false},
+		{"shared", "..", false},
+		// A bare token is pinned to the first agent that uses it
+		{"shared", "db-1", true},
+		{"shared", "db-2", false},
+		{"shared", "db-1", true},
+	}
+	for _, tt := range tests {
+		id, pin, ok := a.authorize(agentRequest(tt.token, tt.agent))
+		if ok != tt.ok || (ok && id != tt.agent) {
+			t.Errorf("authorize(%q, %q) = %q, %v; want ok=%v", tt.token, tt.agent, id, ok, tt.ok)
+		}
+		if pin != "" && !a.bind(pin, id) {
+			t.Errorf("bind(%q, %q) failed", pin, id)
+		}
+	}
+}
+
+func TestAgentTokenBoundOnAccept(t *testing.T) {
+	a := NewAgentCollector([]string{"shared"}, time.Minute)
+	server := httptest.NewServer(a.HandleAgent())
+	defer server.Close()
+
+	// A plain GET authorizes but never upgrades, and doesn't pin the token
+	r, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header = agentRequest("shared", "db-1").Header
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || a.tokens["shared"] != "" {
+		t.Fatalf("status %d, token bound to %q after a failed upgrade", resp.StatusCode, a.tokens["shared"])
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer shared")
+	header.Set("X-NetOps-Agent", "db-2")
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	a.mu.RLock()
+	bound := a.tokens["shared"]
+	a.mu.RUnlock()
+	if bound != "db-2" {
+		t.Errorf("token bound to %q, want db-2", bound)
+	}
+	if _, _, ok := a.authorize(agentRequest("shared", "db-1")); ok {
+		t.Error("another agent authorized with the bound token")
+	}
+}
+
+func TestAgentDisconnectPrunes(t *testing.T) {
+	a := NewAgentCollector([]string{"web-1:s3cret"}, time.Minute)
+	server := httptest.NewServer(a.HandleAgent())
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer s3cret")
+	header.Set("X-NetOps-Agent", "web-1")
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(AgentBatch{Hostname: "web-1", Addresses: []string{"10.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { return len(a.live()) == 1 })
+	if node := a.DescribeOrigin(agentNodeID("web-1")); node == nil || node.IPAddress != "10.0.0.1" {
+		t.Fatalf("DescribeOrigin = %+v", node)
+	}
+
+	conn.Close()
+	waitFor(t, func() bool {
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+		return len(a.agents) == 0
+	})
+}
+
+func TestAgentReadLimit(t *testing.T) {
+	a := NewAgentCollector([]string{"web-1:s3cret"}, time.Minute)
+	a.maxBatch = 64 << 10
+	server := httptest.NewServer(a.HandleAgent())
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer s3cret")
+	header.Set("X-NetOps-Agent", "web-1")
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Write from another goroutine: the aggregator stops reading at the
+	// limit, so the write may never complete
+	go conn.WriteMessage(websocket.TextMessage, bytes.Repeat([]byte(" "), int(a.maxBatch)+1))
+
+	// The aggregator drops the connection instead of buffering the batch
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatalf("connection still open after an oversized batch: %v", err)
+	}
+	if len(a.live()) != 0 {
+		t.Error("oversized batch was accepted")
+	}
+}
+
+// waitFor polls cond for up to two seconds
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// writeJSON encodes v as the response body
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Error writing JSON response", "component", "api", "error", err)
+	}
+}
+
+// HandleTopTalkers lists the remote peers with the highest throughput.
+// GET /api/traffic/top?limit=10
+func HandleTopTalkers(meter *TrafficMeter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if meter == nil {
+			http.Error(w, "traffic accounting is not enabled", http.StatusNotFound)
+			return
+		}
+		limit := 10
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		writeJSON(w, http.StatusOK, meter.TopTalkers(limit))
+	}
+}
+
+// HandleThreatIntelReload re-reads the threat feeds immediately instead of
+// waiting for the next refresh.
+// POST /api/threatintel/reload
+func HandleThreatIntelReload(intel *ThreatIntel, hub *WSHub, store *NodeStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if intel == nil {
+			http.Error(w, "threat intel is not enabled", http.StatusNotFound)
+			return
+		}
+		changed, err := reloadThreatIntel(intel, hub, store)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		feeds, entries := intel.Stats()
+		writeJSON(w, http.StatusOK, map[string]any{"changed": changed, "feeds": feeds, "entries": entries})
+	}
+}
+
+// HandleTrace traces the route to a peer now and returns it. The protocol
+// defaults to NETOPS_TRACE_PROTOCOL; port sets the TCP destination.
+// POST /api/trace?ip=203.0.113.7&protocol=tcp&port=443
+func HandleTrace(tracer *Tracer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if tracer == nil {
+			http.Error(w, "traceroute is not enabled", http.StatusNotFound)
+			return
+		}
+		query := r.URL.Query()
+		ip := query.Get("ip")
+		if _, err := netip.ParseAddr(ip); err != nil {
+			http.Error(w, "ip must be an IP address", http.StatusBadRequest)
+			return
+		}
+		protocol := query.Get("protocol")
+		if protocol == "" {
+			protocol = tracer.protocol
+		}
+		if err := checkTraceProtocol(protocol); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		port := 0
+		if v := query.Get("port"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 65535 {
+				http.Error(w, "port must be between 1 and 65535", http.StatusBadRequest)
+				return
+			}
+			port = n
+		}
+		path, err := tracer.Trace(ip, protocol, port)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, path)
+	}
+}
+
+// HandleLogQuery searches the kept log messages, newest last.
+// GET /api/logs?level=warn&component=dns&q=timeout&since=15m&after=120&limit=100
+func HandleLogQuery(logHub *LogHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseLogFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit := 100
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		writeJSON(w, http.StatusOK, logHub.Query(filter, limit))
+	}
+}
+
+// HandleEgressViolations lists the flows breaking the egress policy seen
+// in the last hour, newest first.
+// GET /api/egress/violations
+func HandleEgressViolations(egress *EgressMonitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if egress == nil || egress.Policy == nil {
+			http.Error(w, "egress policy is not enabled", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, egress.Violations())
+	}
+}
+
+// HandleEgressLearn proposes an egress policy allowing every flow recorded
+// over the last days.
+// GET /api/egress/learn?days=7
+func HandleEgressLearn(egress *EgressMonitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if egress == nil || egress.History == nil {
+			http.Error(w, "egress history is not enabled", http.StatusNotFound)
+			return
+		}
+		since, err := parseHistoryDays(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		flows, err := egress.History.Flows(since)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, proposeEgressPolicy(flows, since))
+	}
+}
+
+// HandleEgressDryRun evaluates the flows recorded over the last days
+// against the policy in the request body, or the loaded one when the body
+// is empty, and lists the flows it would not allow.
+// POST /api/egress/dryrun?days=7
+func HandleEgressDryRun(egress *EgressMonitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if egress == nil || egress.History == nil {
+			http.Error(w, "egress history is not enabled", http.StatusNotFound)
+			return
+		}
+		since, err := parseHistoryDays(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 4<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var rules []compiledEgressRule
+		loaded := false
+		if len(bytes.TrimSpace(body)) > 0 {
+			if rules, err = parseEgressPolicy(body); err != nil {
+				http.Error(w, "invalid policy: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			loaded = true
+		} else if egress.Policy != nil {
+			rules, loaded = egress.Policy.Rules()
+		}
+		if !loaded {
+			http.Error(w, "no policy given and none is loaded", http.StatusBadRequest)
+			return
+		}
+		flows, err := egress.History.Flows(since)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		violations := dryRunEgress(rules, flows)
+		writeJSON(w, http.StatusOK, map[string]any{"flows": len(flows), "violations": violations})
+	}
+}
+
+// parseHistoryDays reads the days parameter, 7 unless given, as the start
+// of the history to use
+func parseHistoryDays(r *http.Request) (time.Time, error) {
+	days := 7
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return time.Time{}, errors.New("days must be a positive integer")
+		}
+		days = n
+	}
+	return time.Now().AddDate(0, 0, -days), nil
+}
+
+// HandleBaseline describes what each host and process usually does: its
+// outbound connections by hour of the day and its mix of destination
+// ASNs, countries and ports.
+// GET /api/baseline
+func HandleBaseline(baseline *Baseline) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if baseline == nil {
+			http.Error(w, "baseline learning is not enabled", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, baseline.Profiles())
+	}
+}
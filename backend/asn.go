@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RoutingInfo is what the offline routing data says about a node's address
+type RoutingInfo struct {
+	Prefix    string   `json:"prefix"`              // longest announced prefix covering the address
+	Origin    []uint32 `json:"origin"`              // origin ASNs, more than one when multi-origin
+	Name      string   `json:"name,omitempty"`      // name of the (first) origin AS
+	Country   string   `json:"country,omitempty"`   // where the origin AS is registered
+	RIR       string   `json:"rir,omitempty"`       // registry that delegated the origin AS
+	Upstreams []ASPeer `json:"upstreams,omitempty"` // transit providers of the origin AS
+}
+
+// ASPeer names a neighboring AS
+type ASPeer struct {
+	ASN  uint32 `json:"asn"`
+	Name string `json:"name,omitempty"`
+}
+
+// Routing data formats understood by the ASN index loader
+const (
+	ASNFormatPfx2AS    = "pfx2as"    // CAIDA Routeviews prefix-to-AS: "prefix<TAB>length<TAB>asn"
+	ASNFormatMRT       = "mrt"       // MRT TABLE_DUMP_V2 RIB dumps (RIPE RIS, Route Views)
+	ASNFormatRelations = "as-rel"    // CAIDA AS relationships: "provider|customer|-1", "peer|peer|0"
+	ASNFormatNames     = "asnames"   // "15169 GOOGLE, US", as in RIPE's asn.txt
+	ASNFormatDelegated = "delegated" // RIR delegated stats: "arin|US|asn|15169|1|20000328|assigned"
+)
+
+// asRegistration is the name and registry details of one AS
+type asRegistration struct {
+	name    string
+	country string
+	rir     string
+}
+
+// asnTables is one build of the index from a set of files
+type asnTables struct {
+	prefixes  PrefixTrie[int] // index into origins
+	origins   [][]uint32      // distinct origin sets, shared between prefixes
+	ases      map[uint32]*asRegistration
+	upstreams map[uint32][]uint32
+	interned  map[string]int // origin set -> index, while building
+}
+
+// ASNIndex maps addresses to their announced prefix and origin AS using
+// routing and registry files from a directory, rebuilt when they change
+type ASNIndex struct {
+	dir    string
+	files  string // names, sizes and mtimes of the files the tables came from
+	tables *asnTables
+	mu     sync.RWMutex
+}
+
+// NewASNIndex creates an index over the files in dir
+func NewASNIndex(dir string) *ASNIndex {
+	return &ASNIndex{dir: dir}
+}
+
+// Reload rebuilds the index if any file was added, changed or removed,
+// and reports whether it did
+func (x *ASNIndex) Reload() (bool, error) {
+	paths, files, err := dataFiles(x.dir)
+	if err != nil {
+		return false, fmt.Errorf("read ASN data dir: %w", err)
+	}
+
+	x.mu.RLock()
+	unchanged := x.tables != nil && x.files == files
+	x.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	started := time.Now()
+	tables := newASNTables()
+	for _, path := range paths {
+		format, err := tables.load(path)
+		if err != nil {
+			slog.Warn("Skipping ASN data file", "component", "asn", "path", path, "error", err)
+			continue
+		}
+		slog.Debug("Loaded ASN data file", "component", "asn", "path", path, "format", format)
+	}
+	tables.finish()
+	slog.Info("ASN index built", "component", "asn", "prefixes", tables.prefixes.Len(), "ases", len(tables.ases), "duration", time.Since(started))
+
+	x.mu.Lock()
+	x.tables, x.files = tables, files
+	x.mu.Unlock()
+	return true, nil
+}
+
+// Lookup returns the routing details of ip, or nil when no announced
+// prefix covers it
+func (x *ASNIndex) Lookup(ip string) *RoutingInfo {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	x.mu.RLock()
+	t := x.tables
+	x.mu.RUnlock()
+	if t == nil {
+		return nil
+	}
+
+	prefix, i, ok := t.prefixes.Lookup(addr)
+	if !ok {
+		return nil
+	}
+	info := &RoutingInfo{Prefix: prefix.String(), Origin: slices.Clone(t.origins[i])}
+	origin := info.Origin[0]
+	if as := t.ases[origin]; as != nil {
+		info.Name, info.Country, info.RIR = as.name, as.country, as.rir
+	}
+	for _, asn := range t.upstreams[origin] {
+		peer := ASPeer{ASN: asn}
+		if as := t.ases[asn]; as != nil {
+			peer.Name = as.name
+		}
+		info.Upstreams = append(info.Upstreams, peer)
+	}
+	return info
+}
+
+// Stats returns the number of prefixes and named ASes indexed
+func (x *ASNIndex) Stats() (prefixes, ases int) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if x.tables == nil {
+		return 0, 0
+	}
+	return x.tables.prefixes.Len(), len(x.tables.ases)
+}
+
+// dataFiles lists the files in dir, skipping hidden ones, with a
+// signature of their names, sizes and mtimes that changes when any of them
+// does
+func dataFiles(dir string) ([]string, string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	var paths []string
+	var signature strings.Builder
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, entry.Name()))
+		fmt.Fprintf(&signature, "%s %d %d\n", entry.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return paths, signature.String(), nil
+}
+
+func newASNTables() *asnTables {
+	return &asnTables{
+		ases:      make(map[uint32]*asRegistration),
+		upstreams: make(map[uint32][]uint32),
+		interned:  make(map[string]int),
+	}
+}
+
+// load reads one file, detecting its compression and format
+func (t *asnTables) load(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	r, err := decompress(bufio.NewReader(f))
+	if err != nil {
+		return "", err
+	}
+	head, _ := r.Peek(512)
+	format := detectASNFormat(head)
+	switch format {
+	case ASNFormatMRT:
+		err = t.loadMRT(r)
+	case ASNFormatPfx2AS, ASNFormatRelations, ASNFormatNames, ASNFormatDelegated:
+		err = t.loadText(r, format)
+	default:
+		return "", fmt.Errorf("unrecognized format")
+	}
+	return format, err
+}
+
+// decompress unwraps gzip and bzip2 by their magic bytes
+func decompress(r *bufio.Reader) (*bufio.Reader, error) {
+	magic, _ := r.Peek(3)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return bufio.NewReader(gz), nil
+	case bytes.Equal(magic, []byte("BZh")):
+		return bufio.NewReader(bzip2.NewReader(r)), nil
+	}
+	return r, nil
+}
+
+// detectASNFormat looks at the start of a decompressed file
+func detectASNFormat(head []byte) string {
+	// MRT records start with a timestamp and the record type
+	if len(head) >= 12 && head[4] == 0 && head[5] == mrtTableDumpV2 {
+		return ASNFormatMRT
+	}
+	for _, line := range strings.Split(string(head), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if fields := strings.Split(line, "|"); len(fields) >= 3 {
+			if fields[2] == "-1" || fields[2] == "0" {
+				return ASNFormatRelations
+			}
+			return ASNFormatDelegated // from its "2|arin|..." version line on
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 3 {
+			if _, err := netip.ParseAddr(fields[0]); err == nil {
+				return ASNFormatPfx2AS
+			}
+		}
+		if len(fields) >= 2 {
+			if _, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+				return ASNFormatNames
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+func (t *asnTables) loadText(r io.Reader, format string) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		switch format {
+		case ASNFormatPfx2AS:
+			t.addPfx2AS(line)
+		case ASNFormatRelations:
+			t.addRelation(line)
+		case ASNFormatNames:
+			t.addName(line)
+		case ASNFormatDelegated:
+			t.addDelegation(line)
+		}
+	}
+	return scanner.Err()
+}
+
+// addPfx2AS parses "1.0.0.0	24	13335". The AS field is "701_702" for
+// multi-origin prefixes and "{64512,64513}" for AS sets.
+func (t *asnTables) addPfx2AS(line string) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return
+	}
+	addr, err := netip.ParseAddr(fields[0])
+	if err != nil {
+		return
+	}
+	bits, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return
+	}
+	var origins []uint32
+	for _, part := range strings.FieldsFunc(fields[2], func(r rune) bool { return r == '_' || r == ',' || r == '{' || r == '}' }) {
+		if asn, err := strconv.ParseUint(part, 10, 32); err == nil {
+			origins = append(origins, uint32(asn))
+		}
+	}
+	t.addOrigins(netip.PrefixFrom(addr, bits), origins)
+}
+
+// addRelation parses "provider|customer|-1" and "peer|peer|0", with an
+// optional fourth source field
+func (t *asnTables) addRelation(line string) {
+	fields := strings.Split(line, "|")
+	if len(fields) < 3 || fields[2] != "-1" {
+		return // peering links aren't upstreams
+	}
+	provider, err1 := strconv.ParseUint(fields[0], 10, 32)
+	customer, err2 := strconv.ParseUint(fields[1], 10, 32)
+	if err1 != nil || err2 != nil {
+		return
+	}
+	t.addUpstream(uint32(customer), uint32(provider))
+}
+
+// addName parses "15169 GOOGLE, US"
+func (t *asnTables) addName(line string) {
+	num, name, _ := strings.Cut(line, " ")
+	asn, err := strconv.ParseUint(num, 10, 32)
+	if err != nil {
+		return
+	}
+	as := t.registration(uint32(asn))
+	name = strings.TrimSpace(name)
+	if i := strings.LastIndex(name, ", "); i >= 0 && len(name)-i == 4 {
+		if as.country == "" {
+			as.country = name[i+2:]
+		}
+		name = name[:i]
+	}
+	as.name = name
+}
+
+// addDelegation parses RIR delegated stats, taking the registry and
+// country of assigned AS numbers
+func (t *asnTables) addDelegation(line string) {
+	fields := strings.Split(line, "|")
+	if len(fields) < 7 || fields[2] != "asn" {
+		return
+	}
+	if status := fields[6]; status != "assigned" && status != "allocated" {
+		return
+	}
+	start, err1 := strconv.ParseUint(fields[3], 10, 32)
+	count, err2 := strconv.ParseUint(fields[4], 10, 32)
+	if err1 != nil || err2 != nil || count > 1<<16 {
+		return
+	}
+	for asn := start; asn < start+count; asn++ {
+		as := t.registration(uint32(asn))
+		as.rir = fields[0]
+		if fields[1] != "" && fields[1] != "ZZ" {
+			as.country = fields[1] // the registry's record wins over asn.txt
+		}
+	}
+}
+
+// loadMRT takes origins and upstreams from the AS paths of a RIB dump
+func (t *asnTables) loadMRT(r io.Reader) error {
+	seen := make(map[netip.Prefix][]uint32)
+	err := readMRT(r, func(route mrtRoute) {
+		origins := seen[route.prefix]
+		for _, asn := range route.origins() {
+			if !slices.Contains(origins, asn) {
+				origins = append(origins, asn)
+			}
+		}
+		seen[route.prefix] = origins
+		if up := route.upstream(); up != 0 {
+			for _, asn := range route.origins() {
+				t.addUpstream(asn, up)
+			}
+		}
+	})
+	for prefix, origins := range seen {
+		t.addOrigins(prefix, origins)
+	}
+	return err
+}
+
+func (t *asnTables) registration(asn uint32) *asRegistration {
+	as := t.ases[asn]
+	if as == nil {
+		as = &asRegistration{}
+		t.ases[asn] = as
+	}
+	return as
+}
+
+// addOrigins records the origin ASes of a prefix, merging with any already
+// known from another file
+func (t *asnTables) addOrigins(prefix netip.Prefix, origins []uint32) {
+	if len(origins) == 0 {
+		return
+	}
+	if i, ok := t.prefixes.Get(prefix); ok {
+		origins = slices.Clone(origins)
+		for _, asn := range t.origins[i] {
+			if !slices.Contains(origins, asn) {
+				origins = append(origins, asn)
+			}
+		}
+	}
+	key := fmt.Sprint(origins)
+	i, ok := t.interned[key]
+	if !ok {
+		i = len(t.origins)
+		t.origins = append(t.origins, origins)
+		t.interned[key] = i
+	}
+	t.prefixes.Insert(prefix, i)
+}
+
+func (t *asnTables) addUpstream(customer, provider uint32) {
+	if customer == provider || slices.Contains(t.upstreams[customer], provider) {
+		return
+	}
+	t.upstreams[customer] = append(t.upstreams[customer], provider)
+}
+
+// finish drops build state and sorts upstreams
+func (t *asnTables) finish() {
+	t.interned = nil
+	for _, ups := range t.upstreams {
+		slices.Sort(ups)
+	}
+}
+
+// ApplyRouting sets a node's routing details, replacing the ASN taken from
+// GeoIP with the origin AS seen in routing data, and restoring the GeoIP
+// ASN and owner when the prefix leaves the table. It reports whether the
+// node changed.
+func ApplyRouting(node *NetworkNode, info *RoutingInfo) bool {
+	if reflect.DeepEqual(node.Routing, info) {
+		return false
+	}
+	switch {
+	case info != nil:
+		if node.Routing == nil {
+			node.preRoutingASN, node.preRoutingOwner = node.ASN, node.Owner
+		}
+		node.ASN = fmt.Sprintf("AS%d", info.Origin[0])
+		node.Owner = node.preRoutingOwner
+		if node.Owner == "" {
+			node.Owner = info.Name
+		}
+	case node.Routing != nil:
+		node.ASN, node.Owner = node.preRoutingASN, node.preRoutingOwner
+		node.preRoutingASN, node.preRoutingOwner = "", ""
+	}
+	node.Routing = info
+	return true
+}
+
+// refreshASNIndex periodically rebuilds the index when its files change
+func refreshASNIndex(index *ASNIndex, interval time.Duration, hub *WSHub, store *NodeStore) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		changed, err := index.Reload()
+		if err != nil {
+			slog.Error("ASN index reload failed", "component", "asn", "error", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		out := hub.NewOutbox()
+		store.mu.Lock()
+		for _, node := range store.Nodes {
+			if node.ID != "local" && ApplyRouting(node, index.Lookup(node.IPAddress)) {
+				out.BroadcastNodeUpdate(node)
+			}
+		}
+		store.mu.Unlock()
+		out.Flush()
+	}
+}
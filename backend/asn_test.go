@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDetectASNFormat(t *testing.T) {
+	tests := map[string]string{
+		"pfx2as.txt":            ASNFormatPfx2AS,
+		"as-rel.txt":            ASNFormatRelations,
+		"asn.txt":               ASNFormatNames,
+		"delegated-ripencc.txt": ASNFormatDelegated,
+	}
+	for name, want := range tests {
+		data, err := os.ReadFile(filepath.Join("testdata", "asn", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := detectASNFormat(data); got != want {
+			t.Errorf("%s: detected %q, want %q", name, got, want)
+		}
+	}
+	if got := detectASNFormat(readRIBFixture(t)); got != ASNFormatMRT {
+		t.Errorf("RIB dump detected as %q", got)
+	}
+	pcap, err := os.ReadFile("testdata/capture/tls-http.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := detectASNFormat(pcap); got != "" {
+		t.Errorf("pcap detected as %q", got)
+	}
+}
+
+func TestASNIndexLookup(t *testing.T) {
+	index := NewASNIndex(filepath.Join("testdata", "asn"))
+	if changed, err := index.Reload(); err != nil || !changed {
+		t.Fatalf("Reload = %v, %v", changed, err)
+	}
+	transit := ASPeer{ASN: 64600, Name: "Transit Two, Inc."}
+
+	tests := []struct {
+		ip   string
+		want *RoutingInfo
+	}{
+		// From the RIB, with origins seen by two peers merged
+		{"203.0.113.5", &RoutingInfo{Prefix: "203.0.113.0/24", Origin: []uint32{64510, 64511},
+			Name: "DOC-AS", Country: "US", Upstreams: []ASPeer{{ASN: 64601, Name: "TRANSIT-ONE"}}}},
+		// The RIB's origin merged with pfx2as for the same prefix
+		{"192.0.2.55", &RoutingInfo{Prefix: "192.0.2.0/24", Origin: []uint32{64520, 64500}, Upstreams: []ASPeer{transit}}},
+		// Delegated stats override the asn.txt country
+		{"192.0.2.200", &RoutingInfo{Prefix: "192.0.2.128/25", Origin: []uint32{64500},
+			Name: "EXAMPLE-NET", Country: "FR", RIR: "ripencc", Upstreams: []ASPeer{transit}}},
+		{"198.51.100.9", &RoutingInfo{Prefix: "198.51.100.0/24", Origin: []uint32{64503}}},
+		{"::ffff:198.51.100.9", &RoutingInfo{Prefix: "198.51.100.0/24", Origin: []uint32{64503}}},
+		// A multi-origin prefix; the peering link isn't an upstream
+		{"198.51.7.1", &RoutingInfo{Prefix: "198.51.0.0/16", Origin: []uint32{64501, 64502}, Country: "FR", RIR: "ripencc"}},
+		// A trailing AS_SET is the origin and hides the upstream
+		{"198.19.0.1", &RoutingInfo{Prefix: "198.18.0.0/15", Origin: []uint32{64530, 64531}}},
+		{"2001:db8:1::1", &RoutingInfo{Prefix: "2001:db8:1::/48", Origin: []uint32{64540},
+			Upstreams: []ASPeer{transit, {ASN: 64602}}}},
+		{"2001:db8:2::1", &RoutingInfo{Prefix: "2001:db8::/32", Origin: []uint32{64504, 64505}}},
+		{"10.0.0.1", nil},
+		{"not an address", nil},
+	}
+	for _, tt := range tests {
+		if got := index.Lookup(tt.ip); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Lookup(%s) = %+v, want %+v", tt.ip, got, tt.want)
+		}
+	}
+	if prefixes, ases := index.Stats(); prefixes != 8 || ases != 5 {
+		t.Errorf("Stats = %d prefixes, %d ASes; want 8, 5", prefixes, ases)
+	}
+}
+
+func TestApplyRouting(t *testing.T) {
+	node := &NetworkNode{ID: "203.0.113.5", IPAddress: "203.0.113.5", ASN: "AS64999"}
+	doc := &RoutingInfo{Prefix: "203.0.113.0/24", Origin: []uint32{64510, 64511}, Name: "DOC-AS"}
+	other := &RoutingInfo{Prefix: "203.0.113.0/24", Origin: []uint32{64520}, Name: "OTHER-AS"}
+
+	steps := []struct {
+		info       *RoutingInfo
+		changed    bool
+		asn, owner string
+	}{
+		{doc, true, "AS64510", "DOC-AS"},
+		{doc, false, "AS64510", "DOC-AS"},
+		// A new origin replaces the name it filled in
+		{other, true, "AS64520", "OTHER-AS"},
+		// The prefix left the table: back to GeoIP's ASN and no owner
+		{nil, true, "AS64999", ""},
+		{nil, false, "AS64999", ""},
+	}
+	for i, step := range steps {
+		changed := ApplyRouting(node, step.info)
+		if changed != step.changed || node.ASN != step.asn || node.Owner != step.owner || node.Routing != step.info {
+			t.Errorf("step %d: changed %v, ASN %q, owner %q, routing %+v", i, changed, node.ASN, node.Owner, node.Routing)
+		}
+	}
+
+	// An owner from GeoIP is kept throughout
+	node = &NetworkNode{ASN: "AS64999", Owner: "Example Hosting"}
+	ApplyRouting(node, doc)
+	if node.ASN != "AS64510" || node.Owner != "Example Hosting" {
+		t.Errorf("with routing: ASN %q, owner %q", node.ASN, node.Owner)
+	}
+	ApplyRouting(node, nil)
+	if node.ASN != "AS64999" || node.Owner != "Example Hosting" {
+		t.Errorf("after routing: ASN %q, owner %q", node.ASN, node.Owner)
+	}
+}
+
+func TestASNIndexReload(t *testing.T) {
+	dir := t.TempDir()
+	index := NewASNIndex(dir)
+	write := func(data string, mtime time.Time) {
+		path := filepath.Join(dir, "pfx2as.txt")
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mtime, mtime)
+	}
+	now := time.Now()
+	write("192.0.2.0\t24\t64500\n", now)
+	if changed, err := index.Reload(); err != nil || !changed {
+		t.Fatalf("first Reload = %v, %v", changed, err)
+	}
+	if changed, _ := index.Reload(); changed {
+		t.Error("Reload rebuilt unchanged files")
+	}
+
+	write("192.0.2.0\t24\t64501\n", now.Add(time.Minute))
+	if changed, _ := index.Reload(); !changed {
+		t.Fatal("Reload missed a changed file")
+	}
+	if info := index.Lookup("192.0.2.1"); info == nil || info.Origin[0] != 64501 {
+		t.Errorf("Lookup after reload = %+v", info)
+	}
+
+	// Unrecognized files are skipped, not fatal
+	os.WriteFile(filepath.Join(dir, "README"), []byte("not routing data\n"), 0o644)
+	if changed, err := index.Reload(); err != nil || !changed {
+		t.Errorf("Reload with an unknown file = %v, %v", changed, err)
+	}
+	if index.Lookup("192.0.2.1") == nil {
+		t.Error("lost the prefix after adding an unknown file")
+	}
+
+	if _, err := NewASNIndex(filepath.Join(dir, "missing")).Reload(); err == nil {
+		t.Error("Reload of a missing dir succeeded")
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role is what an authenticated client may do
+type Role int
+
+const (
+	RoleViewer Role = iota + 1 // read the map, logs and stats
+	RoleAdmin                  // also change server state
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+// parseRole accepts "viewer" or "admin"
+func parseRole(s string) (Role, bool) {
+	switch strings.ToLower(s) {
+	case "viewer":
+		return RoleViewer, true
+	case "admin":
+		return RoleAdmin, true
+	}
+	return 0, false
+}
+
+// Identity is an authenticated client
+type Identity struct {
+	Subject string
+	Method  string // "token", "basic", "jwt" or "anonymous"
+	Role    Role
+}
+
+var errUnauthorized = errors.New("missing or invalid credentials")
+
+// Auth authenticates HTTP and WebSocket clients and checks their Origin.
+// With no authentication method configured every client is an anonymous
+// admin, as before authentication existed.
+type Auth struct {
+	tokens  map[string]*Identity // static API token -> identity
+	users   map[string][]byte    // username -> bcrypt hash
+	jwt     *JWTVerifier
+	admins  map[string]bool // usernames and JWT subjects granted admin
+	origins []string        // allowed Origin values, "*" for any
+}
+
+// NewAuth builds the authenticator described by cfg
+func NewAuth(cfg *Config) (*Auth, error) {
+	a := &Auth{
+		tokens:  make(map[string]*Identity),
+		users:   make(map[string][]byte),
+		admins:  make(map[string]bool),
+		origins: cfg.AllowedOrigins,
+	}
+	for _, name := range cfg.AuthAdmins {
+		a.admins[name] = true
+	}
+
+	for i, entry := range cfg.APITokens {
+		role := RoleViewer
+		token := entry
+		if prefix, rest, ok := strings.Cut(entry, ":"); ok {
+			if r, ok := parseRole(prefix); ok {
+				role, token = r, rest
+			}
+		}
+		a.tokens[token] = &Identity{Subject: fmt.Sprintf("token-%d", i+1), Method: "token", Role: role}
+	}
+
+	if cfg.AuthHtpasswd != "" {
+		users, err := loadHtpasswd(cfg.AuthHtpasswd)
+		if err != nil {
+			return nil, err
+		}
+		a.users = users
+	}
+
+	if cfg.JWKSFile != "" {
+		verifier, err := NewJWTVerifier(cfg.JWKSFile, cfg.JWTIssuer, cfg.JWTAudience)
+		if err != nil {
+			return nil, err
+		}
+		verifier.RolesClaim = cfg.JWTRolesClaim
+		a.jwt = verifier
+	}
+	return a, nil
+}
+
+// Enabled reports whether any authentication method is configured
+func (a *Auth) Enabled() bool {
+	return len(a.tokens) > 0 || len(a.users) > 0 || a.jwt != nil
+}
+
+// Identify authenticates a request. Browsers cannot set headers on a
+// WebSocket handshake, so a bearer token is also accepted as the
+// access_token query parameter.
+func (a *Auth) Identify(r *http.Request) (*Identity, error) {
+	if !a.Enabled() {
+		return &Identity{Subject: "anonymous", Method: "anonymous", Role: RoleAdmin}, nil
+	}
+
+	if user, pass, ok := r.BasicAuth(); ok {
+		return a.basic(user, pass)
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("access_token")
+	}
+	if token == "" {
+		return nil, errUnauthorized
+	}
+
+	for known, id := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return id, nil
+		}
+	}
+	if a.jwt != nil && strings.Count(token, ".") == 2 {
+		claims, err := a.jwt.Verify(token)
+		if err != nil {
+			return nil, err
+		}
+		role := RoleViewer
+		if claims.HasRole("admin") || a.admins[claims.Subject] {
+			role = RoleAdmin
+		}
+		return &Identity{Subject: claims.Subject, Method: "jwt", Role: role}, nil
+	}
+	return nil, errUnauthorized
+}
+
+func (a *Auth) basic(user, pass string) (*Identity, error) {
+	hash, ok := a.users[user]
+	if !ok {
+		// Compare anyway so unknown users take as long as wrong passwords
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(pass))
+		return nil, errUnauthorized
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(pass)) != nil {
+		return nil, errUnauthorized
+	}
+	role := RoleViewer
+	if a.admins[user] {
+		role = RoleAdmin
+	}
+	return &Identity{Subject: user, Method: "basic", Role: role}, nil
+}
+
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("netops"), bcrypt.DefaultCost)
+	return hash
+})
+
+// Require wraps a handler so it only runs for allowed origins and clients
+// holding at least role
+func (a *Auth) Require(role Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.CheckOrigin(r) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		id, err := a.Identify(r)
+		if err != nil {
+			if len(a.users) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="netops"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if id.Role < role {
+			slog.Warn("Request denied", "component", "auth", "method", r.Method, "path", r.URL.Path, "subject", id.Subject, "role", id.Role)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// CheckOrigin decides whether a browser on another site may call us. Requests
+// without an Origin header (agents, curl) are always allowed. Without an
+// allowlist, same-host and loopback origins are, which covers the
+// development frontend.
+func (a *Auth) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(a.origins) > 0 {
+		for _, allowed := range a.origins {
+			if allowed == "*" || strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+		return false
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// loadHtpasswd reads "user:hash" lines. Only bcrypt hashes (htpasswd -B)
+// are accepted.
+func loadHtpasswd(path string) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open htpasswd file: %w", err)
+	}
+	defer file.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: user %s: only bcrypt hashes are supported", path, line, user)
+		}
+		users[user] = []byte(hash)
+	}
+	return users, scanner.Err()
+}
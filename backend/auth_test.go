@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeHtpasswd(t *testing.T, users map[string]string) string {
+	t.Helper()
+	data := "# test users\n"
+	for user, pass := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data += user + ":" + string(hash) + "\n"
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuthDisabled(t *testing.T) {
+	auth, err := NewAuth(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := auth.Identify(httptest.NewRequest(http.MethodGet, "/api/topology", nil))
+	if err != nil || id.Role != RoleAdmin || id.Method != "anonymous" {
+		t.Errorf("Identify = %+v, %v; want anonymous admin", id, err)
+	}
+}
+
+func TestAuthIdentify(t *testing.T) {
+	keys := newTestKeys(t)
+	auth, err := NewAuth(&Config{
+		APITokens:     []string{"plain-token", "admin:admin-token", "viewer:viewer-token"},
+		AuthHtpasswd:  writeHtpasswd(t, map[string]string{"alice": "wonderland", "bob": "builder"}),
+		AuthAdmins:    []string{"alice", "carol"},
+		JWKSFile:      keys.jwks,
+		JWTIssuer:     "https://idp.example.com",
+		JWTAudience:   "netops",
+		JWTRolesClaim: "groups",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwtFor := func(sub string, groups ...string) string {
+		claims := validClaims()
+		claims["sub"] = sub
+		claims["groups"] = groups
+		return signJWT(t, "ES256", "p256", keys.p256, claims)
+	}
+
+	tests := []struct {
+		name    string
+		prepare func(r *http.Request)
+		subject string
+		method  string
+		role    Role
+	}{
+		{"plain token", bearer("plain-token"), "token-1", "token", RoleViewer},
+		{"admin token", bearer("admin-token"), "token-2", "token", RoleAdmin},
+		{"viewer token", bearer("viewer-token"), "token-3", "token", RoleViewer},
+		{"query token", func(r *http.Request) { r.URL.RawQuery = "access_token=admin-token" }, "token-2", "token", RoleAdmin},
+		{"basic admin", basic("alice", "wonderland"), "alice", "basic", RoleAdmin},
+		{"basic viewer", basic("bob", "builder"), "bob", "basic", RoleViewer},
+		{"jwt viewer", bearer(jwtFor("dave")), "dave", "jwt", RoleViewer},
+		{"jwt admin role", bearer(jwtFor("erin", "admin")), "erin", "jwt", RoleAdmin},
+		{"jwt admin subject", bearer(jwtFor("carol")), "carol", "jwt", RoleAdmin},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/topology", nil)
+		tt.prepare(r)
+		id, err := auth.Identify(r)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if id.Subject != tt.subject || id.Method != tt.method || id.Role != tt.role {
+			t.Errorf("%s: identity = %+v, want %s/%s/%s", tt.name, id, tt.subject, tt.method, tt.role)
+		}
+	}
+
+	rejected := map[string]func(r *http.Request){
+		"no credentials": func(*http.Request) {},
+		"wrong token":    bearer("nope"),
+		"wrong password": basic("alice", "looking-glass"),
+		"unknown user":   basic("mallory", "wonderland"),
+		"expired jwt": bearer(signJWT(t, "ES256", "p256", keys.p256, map[string]any{
+			"iss": "https://idp.example.com", "aud": "netops", "sub": "dave", "exp": 1,
+		})),
+	}
+	for name, prepare := range rejected {
+		r := httptest.NewRequest(http.MethodGet, "/api/topology", nil)
+		prepare(r)
+		if id, err := auth.Identify(r); err == nil {
+			t.Errorf("%s: accepted as %+v", name, id)
+		}
+	}
+}
+
+func TestAuthRequire(t *testing.T) {
+	auth, err := NewAuth(&Config{
+		APITokens:    []string{"viewer-token", "admin:admin-token"},
+		AuthHtpasswd: writeHtpasswd(t, map[string]string{"bob": "builder"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := auth.Require(RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name    string
+		prepare func(r *http.Request)
+		status  int
+	}{
+		{"admin", bearer("admin-token"), http.StatusNoContent},
+		{"viewer", bearer("viewer-token"), http.StatusForbidden},
+		{"anonymous", func(*http.Request) {}, http.StatusUnauthorized},
+		{"foreign origin", func(r *http.Request) {
+			bearer("admin-token")(r)
+			r.Header.Set("Origin", "https://evil.example.com")
+		}, http.StatusForbidden},
+		{"loopback origin", func(r *http.Request) {
+			bearer("admin-token")(r)
+			r.Header.Set("Origin", "http://localhost:5173")
+		}, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/threatintel/reload", nil)
+		tt.prepare(r)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: missing basic auth challenge", tt.name)
+		}
+	}
+}
+
+func TestLoadHtpasswdRejectsNonBcrypt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	// An Apache MD5 hash, as written by htpasswd without -B
+	if err := os.WriteFile(path, []byte("alice:$apr1$hR5gsMmq$H1xBJ6QXcCuDyGzVOVKkV/\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadHtpasswd(path); err == nil {
+		t.Error("expected an error for a non-bcrypt hash")
+	}
+}
+
+func bearer(token string) func(r *http.Request) {
+	return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+}
+
+func basic(user, pass string) func(r *http.Request) {
+	return func(r *http.Request) { r.SetBasicAuth(user, pass) }
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// baselineStateVersion is the format of the saved model
+const baselineStateVersion = 1
+
+// baselineMinSamples is how many scans an hour of the day needs before the
+// counts in it are scored
+const baselineMinSamples = 60
+
+// baselineNovelWeight is the weight below which a destination or port
+// counts as new: one sighting fades to it in about two thirds of the window
+const baselineNovelWeight = 0.5
+
+// baselineSaveInterval is how often the model is written to its state file
+const baselineSaveInterval = time.Minute
+
+// Anomaly kinds
+const (
+	anomalyConnections = "connections" // more outbound connections than usual at this hour
+	anomalyASN         = "asn"         // a destination AS not in the baseline
+	anomalyCountry     = "country"     // a destination country not in the baseline
+	anomalyPort        = "port"        // a destination port not in the baseline
+)
+
+var anomalySeq atomic.Uint64
+
+// Anomaly is a scan that doesn't fit a host or process's baseline
+type Anomaly struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	NodeID    string    `json:"nodeId"` // the process node, or the host the flows start at
+	Origin    string    `json:"origin"`
+	Process   string    `json:"process,omitempty"`
+	Kind      string    `json:"kind"`
+	Value     string    `json:"value"`              // the new ASN, country or port, or the connection count
+	Score     float64   `json:"score"`              // z-score of a count, or how surprising a new value is in bits
+	Expected  float64   `json:"expected,omitempty"` // usual connection count at this hour
+	Severity  string    `json:"severity"`           // low, medium or high
+	Message   string    `json:"message"`
+}
+
+// hourlyStat is an exponentially weighted mean and variance of the
+// connection counts scanned in one hour of the day
+type hourlyStat struct {
+	Mean    float64 `json:"mean"`
+	Var     float64 `json:"var"`
+	Samples int     `json:"samples"`
+}
+
+// add folds a count in. Until there are enough samples for alpha to take
+// over, it is a plain running mean.
+func (s *hourlyStat) add(x, alpha float64) {
+	s.Samples++
+	a := max(alpha, 1/float64(s.Samples))
+	diff := x - s.Mean
+	incr := a * diff
+	s.Mean += incr
+	s.Var = (1 - a) * (s.Var + diff*incr)
+}
+
+// zscore is how many deviations x is above the mean. The deviation is at
+// least the square root of the mean, as for a Poisson count, and at least
+// 1, so quiet hours don't turn a few connections into an anomaly.
+func (s *hourlyStat) zscore(x float64) float64 {
+	return (x - s.Mean) / s.stddev()
+}
+
+func (s *hourlyStat) stddev() float64 {
+	return math.Sqrt(max(s.Var, s.Mean, 1))
+}
+
+// decayedWeight counts how often a value was seen, fading exponentially
+// over the baseline window
+type decayedWeight struct {
+	Weight  float64   `json:"weight"`
+	Updated time.Time `json:"updated"`
+}
+
+func (w decayedWeight) at(now time.Time, window time.Duration) float64 {
+	if w.Updated.IsZero() {
+		return 0
+	}
+	return w.Weight * math.Exp(-float64(now.Sub(w.Updated))/float64(window))
+}
+
+// baselineProfile is what one host or process usually does. Hours are in
+// the backend's local time.
+type baselineProfile struct {
+	Origin    string                   `json:"origin"`
+	Process   string                   `json:"process,omitempty"`
+	FirstSeen time.Time                `json:"firstSeen"`
+	LastSeen  time.Time                `json:"lastSeen"`
+	Hourly    [24]hourlyStat           `json:"hourly"`
+	ASNs      map[string]decayedWeight `json:"asns"`
+	Countries map[string]decayedWeight `json:"countries"`
+	Ports     map[string]decayedWeight `json:"ports"`
+
+	spiking bool // a connections anomaly was raised and the count is still high
+}
+
+func newBaselineProfile(origin, process string, now time.Time) *baselineProfile {
+	return &baselineProfile{
+		Origin:    origin,
+		Process:   process,
+		FirstSeen: now,
+		LastSeen:  now,
+		ASNs:      make(map[string]decayedWeight),
+		Countries: make(map[string]decayedWeight),
+		Ports:     make(map[string]decayedWeight),
+	}
+}
+
+// label names the profile's subject in messages
+func (p *baselineProfile) label() string {
+	if p.Process != "" {
+		return p.Process + " on " + p.Origin
+	}
+	return p.Origin
+}
+
+// baselineKey identifies the profile of a host and process
+func baselineKey(origin, process string) string {
+	return origin + "|" + process
+}
+
+// baselineScan is what one host or process did in a scan
+type baselineScan struct {
+	origin      string
+	process     string
+	node        string // node the flows are drawn from
+	connections int
+	asns        map[string]float64
+	countries   map[string]float64
+	ports       map[string]float64
+}
+
+// Baseline learns per local host and process which destination ASNs,
+// countries and ports are usual and how many outbound connections each
+// hour of the day brings, and scores every scan against that
+type Baseline struct {
+	path      string        // state file, "" to keep the model in memory only
+	window    time.Duration // how long the model remembers
+	warmup    time.Duration // learning time before a profile is scored
+	threshold float64       // z-score of a connection count that is anomalous
+	alpha     float64       // weight of one scan in an hour's mean
+
+	profiles map[string]*baselineProfile // by baselineKey
+	mu       sync.Mutex
+}
+
+// NewBaseline creates a model remembering about window of scans taken
+// every interval
+func NewBaseline(path string, window, warmup time.Duration, threshold float64, interval time.Duration) *Baseline {
+	return &Baseline{
+		path:      path,
+		window:    window,
+		warmup:    warmup,
+		threshold: threshold,
+		// Each hour of the day gets an hour of scans a day
+		alpha:    min(1, 24*float64(interval)/float64(window)),
+		profiles: make(map[string]*baselineProfile),
+	}
+}
+
+// Observe scores a scan's outbound flows against the baseline, then learns
+// from them, and returns what didn't fit. Hosts and processes with no
+// flows count as scans of zero connections.
+func (b *Baseline) Observe(flows []EgressFlow, now time.Time) []*Anomaly {
+	scans := make(map[string]*baselineScan)
+	for i := range flows {
+		flow := &flows[i]
+		key := baselineKey(flow.Origin, flow.Process)
+		scan, ok := scans[key]
+		if !ok {
+			scan = &baselineScan{
+				origin:    flow.Origin,
+				process:   flow.Process,
+				node:      flow.edge.from,
+				asns:      make(map[string]float64),
+				countries: make(map[string]float64),
+				ports:     make(map[string]float64),
+			}
+			scans[key] = scan
+		}
+		scan.connections++
+		if asn := normalizeASN(flow.ASN); asn != "" {
+			scan.asns["AS"+asn]++
+		}
+		if flow.Country != "" {
+			scan.countries[flow.Country]++
+		}
+		scan.ports[strconv.Itoa(flow.Port)]++
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, scan := range scans {
+		if _, ok := b.profiles[key]; !ok {
+			b.profiles[key] = newBaselineProfile(scan.origin, scan.process, now)
+		}
+	}
+
+	var anomalies []*Anomaly
+	hour := now.Hour()
+	for key, profile := range b.profiles {
+		scan := scans[key]
+		count := 0
+		if scan != nil {
+			count = scan.connections
+		}
+		warm := now.Sub(profile.FirstSeen) >= b.warmup
+		slot := &profile.Hourly[hour]
+		if scan != nil && warm && slot.Samples >= baselineMinSamples {
+			z := slot.zscore(float64(count))
+			if z >= b.threshold && !profile.spiking {
+				anomalies = append(anomalies, b.countAnomaly(profile, scan.node, count, slot, z, now))
+			}
+			profile.spiking = z >= b.threshold
+		} else {
+			profile.spiking = false
+		}
+		slot.add(float64(count), b.alpha)
+
+		if scan == nil {
+			if now.Sub(profile.LastSeen) > 4*b.window {
+				delete(b.profiles, key)
+			}
+			continue
+		}
+		profile.LastSeen = now
+		for _, set := range []struct {
+			kind    string
+			weights map[string]decayedWeight
+			seen    map[string]float64
+		}{
+			{anomalyASN, profile.ASNs, scan.asns},
+			{anomalyCountry, profile.Countries, scan.countries},
+			{anomalyPort, profile.Ports, scan.ports},
+		} {
+			novel := learnValues(set.weights, set.seen, now, b.window)
+			if !warm {
+				continue
+			}
+			for _, value := range slices.Sorted(maps.Keys(novel)) {
+				anomalies = append(anomalies, b.noveltyAnomaly(profile, scan.node, set.kind, value, novel[value], now))
+			}
+		}
+	}
+	return anomalies
+}
+
+// learnValues adds a scan's counts to the weights and returns the values
+// that had hardly been seen, with how surprising each is in bits. Nothing
+// is new to a profile that hasn't seen anything yet.
+func learnValues(weights map[string]decayedWeight, seen map[string]float64, now time.Time, window time.Duration) map[string]float64 {
+	total := 0.0
+	for _, w := range weights {
+		total += w.at(now, window)
+	}
+	novel := make(map[string]float64)
+	for value, n := range seen {
+		prior := weights[value].at(now, window)
+		if prior < baselineNovelWeight && total >= 1 {
+			novel[value] = math.Log2((total + 1) / (prior + 1))
+		}
+		weights[value] = decayedWeight{Weight: prior + n, Updated: now}
+	}
+	return novel
+}
+
+func (b *Baseline) countAnomaly(profile *baselineProfile, node string, count int, slot *hourlyStat, z float64, now time.Time) *Anomaly {
+	severity := "medium"
+	if z >= 2*b.threshold {
+		severity = "high"
+	}
+	return &Anomaly{
+		ID:        fmt.Sprintf("anomaly-%d", anomalySeq.Add(1)),
+		Timestamp: now,
+		NodeID:    node,
+		Origin:    profile.Origin,
+		Process:   profile.Process,
+		Kind:      anomalyConnections,
+		Value:     strconv.Itoa(count),
+		Score:     math.Round(z*100) / 100,
+		Expected:  math.Round(slot.Mean*100) / 100,
+		Severity:  severity,
+		Message: fmt.Sprintf("%s has %d outbound connections, usually %.1f ± %.1f at %02d:00 (z-score %.1f)",
+			profile.label(), count, slot.Mean, slot.stddev(), now.Hour(), z),
+	}
+}
+
+func (b *Baseline) noveltyAnomaly(profile *baselineProfile, node, kind, value string, bits float64, now time.Time) *Anomaly {
+	var what string
+	severity := "medium"
+	switch kind {
+	case anomalyASN:
+		what = "a network it doesn't usually reach, " + value
+	case anomalyCountry:
+		what = "a country it doesn't usually reach, " + value
+	case anomalyPort:
+		what = "port " + value + ", which it doesn't usually use"
+		severity = "low"
+	}
+	return &Anomaly{
+		ID:        fmt.Sprintf("anomaly-%d", anomalySeq.Add(1)),
+		Timestamp: now,
+		NodeID:    node,
+		Origin:    profile.Origin,
+		Process:   profile.Process,
+		Kind:      kind,
+		Value:     value,
+		Score:     math.Round(bits*100) / 100,
+		Severity:  severity,
+		Message:   fmt.Sprintf("%s connected to %s", profile.label(), what),
+	}
+}
+
+// BaselineSummary describes a profile for the REST API
+type BaselineSummary struct {
+	Origin    string             `json:"origin"`
+	Process   string             `json:"process,omitempty"`
+	FirstSeen time.Time          `json:"firstSeen"`
+	LastSeen  time.Time          `json:"lastSeen"`
+	Learning  bool               `json:"learning"` // still warming up, so not scored
+	Hourly    []BaselineHour     `json:"hourly"`
+	ASNs      map[string]float64 `json:"asns"`      // share of connections
+	Countries map[string]float64 `json:"countries"` // share of connections
+	Ports     map[string]float64 `json:"ports"`     // share of connections
+}
+
+// BaselineHour is the usual number of outbound connections in an hour of
+// the day
+type BaselineHour struct {
+	Hour    int     `json:"hour"`
+	Mean    float64 `json:"mean"`
+	StdDev  float64 `json:"stddev"`
+	Samples int     `json:"samples"`
+}
+
+// Profiles summarizes every profile, ordered by host and process
+func (b *Baseline) Profiles() []BaselineSummary {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	summaries := make([]BaselineSummary, 0, len(b.profiles))
+	for _, p := range b.profiles {
+		summary := BaselineSummary{
+			Origin:    p.Origin,
+			Process:   p.Process,
+			FirstSeen: p.FirstSeen,
+			LastSeen:  p.LastSeen,
+			Learning:  now.Sub(p.FirstSeen) < b.warmup,
+			Hourly:    make([]BaselineHour, 24),
+			ASNs:      shares(p.ASNs, now, b.window),
+			Countries: shares(p.Countries, now, b.window),
+			Ports:     shares(p.Ports, now, b.window),
+		}
+		for hour, slot := range p.Hourly {
+			summary.Hourly[hour] = BaselineHour{Hour: hour, Mean: round2(slot.Mean), StdDev: round2(math.Sqrt(slot.Var)), Samples: slot.Samples}
+		}
+		summaries = append(summaries, summary)
+	}
+	slices.SortFunc(summaries, func(a, b BaselineSummary) int {
+		return cmp.Or(cmp.Compare(a.Origin, b.Origin), cmp.Compare(a.Process, b.Process))
+	})
+	return summaries
+}
+
+// shares turns weights into each value's share of the total
+func shares(weights map[string]decayedWeight, now time.Time, window time.Duration) map[string]float64 {
+	total := 0.0
+	for _, w := range weights {
+		total += w.at(now, window)
+	}
+	out := make(map[string]float64, len(weights))
+	for value, w := range weights {
+		if total > 0 {
+			out[value] = round2(w.at(now, window) / total)
+		}
+	}
+	return out
+}
+
+func round2(x float64) float64 {
+	return math.Round(x*100) / 100
+}
+
+// baselineState is the JSON the model is saved as
+type baselineState struct {
+	Version  int                `json:"version"`
+	Saved    time.Time          `json:"saved"`
+	Profiles []*baselineProfile `json:"profiles"`
+}
+
+// Load reads the model saved by an earlier run. A missing file leaves it
+// empty.
+func (b *Baseline) Load() error {
+	if b.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(b.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state baselineState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("%s: %w", b.path, err)
+	}
+	if state.Version != baselineStateVersion {
+		return fmt.Errorf("%s: version %d is not supported (expected %d)", b.path, state.Version, baselineStateVersion)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, p := range state.Profiles {
+		for _, m := range []*map[string]decayedWeight{&p.ASNs, &p.Countries, &p.Ports} {
+			if *m == nil {
+				*m = make(map[string]decayedWeight)
+			}
+		}
+		b.profiles[baselineKey(p.Origin, p.Process)] = p
+	}
+	slog.Info("Baseline loaded", "component", "baseline", "profiles", len(state.Profiles), "saved", state.Saved)
+	return nil
+}
+
+// Save writes the model to its state file, dropping values that have
+// faded out
+func (b *Baseline) Save() error {
+	if b.path == "" {
+		return nil
+	}
+	now := time.Now()
+	b.mu.Lock()
+	state := baselineState{Version: baselineStateVersion, Saved: now, Profiles: []*baselineProfile{}}
+	for _, p := range b.profiles {
+		for _, weights := range []map[string]decayedWeight{p.ASNs, p.Countries, p.Ports} {
+			maps.DeleteFunc(weights, func(_ string, w decayedWeight) bool { return w.at(now, b.window) < 0.01 })
+		}
+		state.Profiles = append(state.Profiles, p)
+	}
+	data, err := json.Marshal(state)
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), b.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// saveBaseline writes the model to its state file every interval
+func saveBaseline(baseline *Baseline, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := baseline.Save(); err != nil {
+			slog.Error("Saving baseline failed", "component", "baseline", "error", err)
+		}
+	}
+}
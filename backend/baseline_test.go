@@ -0,0 +1,213 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHourlyStatAdd(t *testing.T) {
+	var s hourlyStat
+	// Early samples weigh 1/n, a plain mean and population variance
+	for x := 1; x <= 10; x++ {
+		s.add(float64(x), 0.1)
+	}
+	if math.Abs(s.Mean-5.5) > 1e-9 || math.Abs(s.Var-8.25) > 1e-9 || s.Samples != 10 {
+		t.Errorf("after 1..10: %+v, want mean 5.5, var 8.25", s)
+	}
+
+	// Then alpha takes over, and old samples fade
+	s.add(100, 0.1)
+	if math.Abs(s.Mean-(5.5+0.1*94.5)) > 1e-9 {
+		t.Errorf("mean %v after an outlier, want alpha's share of it", s.Mean)
+	}
+	for range 500 {
+		s.add(20, 0.1)
+	}
+	if math.Abs(s.Mean-20) > 1e-6 || s.Var > 1e-6 {
+		t.Errorf("after a steady 20: mean %v, var %v", s.Mean, s.Var)
+	}
+}
+
+func TestHourlyStatZscore(t *testing.T) {
+	tests := []struct {
+		stat hourlyStat
+		x    float64
+		want float64
+	}{
+		{hourlyStat{Mean: 100, Var: 400}, 160, 3},
+		// The deviation is at least the square root of the mean...
+		{hourlyStat{Mean: 4, Var: 1}, 10, 3},
+		// ...and at least 1
+		{hourlyStat{Mean: 0.2}, 3, 2.8},
+		{hourlyStat{Mean: 10, Var: 25}, 5, -1},
+	}
+	for _, tt := range tests {
+		if got := tt.stat.zscore(tt.x); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%+v: zscore(%v) = %v, want %v", tt.stat, tt.x, got, tt.want)
+		}
+	}
+}
+
+func TestLearnValues(t *testing.T) {
+	window := 7 * 24 * time.Hour
+	now := time.Date(2026, 10, 19, 14, 0, 0, 0, time.UTC)
+	weights := make(map[string]decayedWeight)
+
+	// Nothing is new without history
+	if novel := learnValues(weights, map[string]float64{"AS64500": 3}, now, window); len(novel) != 0 {
+		t.Errorf("novel with no history: %v", novel)
+	}
+	if w := weights["AS64500"]; w.Weight != 3 || !w.Updated.Equal(now) {
+		t.Errorf("weight = %+v", w)
+	}
+
+	novel := learnValues(weights, map[string]float64{"AS64500": 1, "AS64501": 1}, now, window)
+	if want := map[string]float64{"AS64501": 2}; !reflect.DeepEqual(novel, want) {
+		t.Errorf("novel = %v, want %v (log2 of 4 over 1)", novel, want)
+	}
+	if novel := learnValues(weights, map[string]float64{"AS64501": 1}, now, window); len(novel) != 0 {
+		t.Errorf("a value seen before is novel again: %v", novel)
+	}
+
+	// A value fades out over a few windows and becomes new again, while
+	// one seen since is still known
+	later := now.Add(window)
+	if novel := learnValues(weights, map[string]float64{"AS64500": 1}, later, window); len(novel) != 0 {
+		t.Errorf("novel after a window: %v", novel)
+	}
+	if novel := learnValues(weights, map[string]float64{"AS64501": 1}, later.Add(window), window); len(novel) != 1 {
+		t.Errorf("faded value not novel: %v", novel)
+	}
+	// Once everything has faded there is no history to compare with
+	if novel := learnValues(weights, map[string]float64{"AS64502": 1}, later.Add(20*window), window); len(novel) != 0 {
+		t.Errorf("novel against faded history: %v", novel)
+	}
+}
+
+// baselineFlows is a scan of n connections from curl to one destination
+func baselineFlows(n int) []EgressFlow {
+	flows := make([]EgressFlow, n)
+	for i := range flows {
+		flows[i] = EgressFlow{Origin: "local", Process: "curl", IP: "203.0.113.9", Port: 443,
+			ASN: "AS64500", Country: "DE", edge: edgeKey{from: "proc:curl", to: "203.0.113.9"}}
+	}
+	return flows
+}
+
+func TestBaselineSpikeDebounce(t *testing.T) {
+	b := NewBaseline("", 7*24*time.Hour, 0, 3, time.Minute)
+	start := time.Date(2026, 10, 19, 14, 0, 0, 0, time.UTC)
+	scan := 0
+	observe := func(n int) []*Anomaly {
+		scan++
+		return b.Observe(baselineFlows(n), start.Add(time.Duration(scan)*time.Second))
+	}
+	for range baselineMinSamples {
+		if anomalies := observe(5); len(anomalies) != 0 {
+			t.Fatalf("scan %d of a steady 5: %+v", scan, anomalies)
+		}
+	}
+
+	steps := []struct {
+		count     int
+		anomalies int
+	}{
+		{50, 1},
+		{50, 0}, // still spiking
+		{60, 0},
+		{5, 0}, // back to normal
+		{50, 1},
+	}
+	for i, step := range steps {
+		anomalies := observe(step.count)
+		if len(anomalies) != step.anomalies {
+			t.Fatalf("step %d (%d connections): %d anomalies, want %d", i, step.count, len(anomalies), step.anomalies)
+		}
+		for _, a := range anomalies {
+			if a.Kind != anomalyConnections || a.Value != "50" || a.NodeID != "proc:curl" || a.Process != "curl" {
+				t.Errorf("step %d: %+v", i, a)
+			}
+			if !strings.Contains(a.Message, "curl on local has 50 outbound connections") {
+				t.Errorf("message %q", a.Message)
+			}
+		}
+	}
+}
+
+func TestBaselineNoveltyAfterWarmup(t *testing.T) {
+	start := time.Date(2026, 10, 19, 14, 0, 0, 0, time.UTC)
+	b := NewBaseline("", 7*24*time.Hour, time.Hour, 3, time.Minute)
+	b.Observe(baselineFlows(3), start)
+
+	flows := baselineFlows(1)
+	flows[0].Port, flows[0].ASN = 8443, "AS64511"
+	// Still learning
+	if anomalies := b.Observe(flows, start.Add(time.Minute)); len(anomalies) != 0 {
+		t.Errorf("anomalies while warming up: %+v", anomalies)
+	}
+	flows[0].Port, flows[0].ASN, flows[0].Country = 22, "AS64512", "FR"
+	var kinds []string
+	for _, a := range b.Observe(flows, start.Add(2*time.Hour)) {
+		kinds = append(kinds, a.Kind+" "+a.Value)
+	}
+	if want := []string{"asn AS64512", "country FR", "port 22"}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("anomalies %q, want %q", kinds, want)
+	}
+}
+
+func TestBaselineSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "baseline.json")
+	window := 7 * 24 * time.Hour
+	now := time.Now().UTC().Truncate(time.Second)
+	b := NewBaseline(path, window, 0, 3, time.Minute)
+	for i := range 5 {
+		b.Observe(baselineFlows(2+i), now.Add(time.Duration(i)*time.Second))
+	}
+	other := baselineFlows(1)
+	other[0].Origin, other[0].Process, other[0].Port = "agent-1", "", 22
+	b.Observe(other, now)
+	// A value seen long ago has faded out and isn't saved
+	b.profiles[baselineKey("local", "curl")].Ports["25"] = decayedWeight{Weight: 1, Updated: now.Add(-10 * window)}
+
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.profiles[baselineKey("local", "curl")].Ports["25"]; ok {
+		t.Error("faded port kept")
+	}
+	loaded := NewBaseline(path, window, 0, 3, time.Minute)
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.profiles, b.profiles) {
+		t.Errorf("loaded profiles differ:\n got %+v\nwant %+v", loaded.profiles, b.profiles)
+	}
+
+	// A state file written without value maps loads with empty ones
+	os.WriteFile(path, []byte(`{"version": 1, "profiles": [{"origin": "local", "asns": null}]}`), 0o644)
+	sparse := NewBaseline(path, window, 0, 3, time.Minute)
+	if err := sparse.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if p := sparse.profiles[baselineKey("local", "")]; p == nil || p.ASNs == nil || p.Countries == nil || p.Ports == nil {
+		t.Errorf("sparse profile = %+v", p)
+	}
+
+	for data, want := range map[string]string{
+		`{"version": 2, "profiles": []}`: "version 2",
+		`not json`:                       "invalid character",
+	} {
+		os.WriteFile(path, []byte(data), 0o644)
+		if err := NewBaseline(path, window, 0, 3, time.Minute).Load(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error %v, want %q", data, err, want)
+		}
+	}
+	if err := NewBaseline(filepath.Join(t.TempDir(), "missing.json"), window, 0, 3, time.Minute).Load(); err != nil {
+		t.Errorf("missing state file: %v", err)
+	}
+}
@@ -3,23 +3,37 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"log/slog"
 	"net"
 	"os/exec"
 	"strconv"
 	"strings"
 )
 
-// CaptureConnections captures active network connections
+// CaptureConnections captures active connections to public addresses
 func CaptureConnections() ([]Connection, error) {
+	return captureSockets(shouldInclude)
+}
+
+// CaptureAllConnections captures active connections including those to
+// private addresses, which agents need to report traffic inside the fleet
+func CaptureAllConnections() ([]Connection, error) {
+	return captureSockets(isPeerConnection)
+}
+
+// captureSockets lists sockets with ss and keeps those accepted by include
+func captureSockets(include func(*Connection) bool) ([]Connection, error) {
 	// Use ss (socket statistics) to get connections
-	// ss is the modern replacement for netstat on Linux
-	cmd := exec.Command("ss", "-tan")
+	// ss is the modern replacement for netstat on Linux. -p names the
+	// owning process, for sockets this user may inspect.
+	cmd := exec.Command("ss", "-tanp")
 	output, err := cmd.Output()
 	if err != nil {
 		return nil, fmt.Errorf("ss command failed: %w", err)
 	}
 
 	connections := []Connection{}
+	units := make(map[int]string) // PID -> systemd unit, for this scan
 	scanner := bufio.NewScanner(strings.NewReader(string(output)))
 
 	lineCount := 0
@@ -43,14 +57,22 @@ func CaptureConnections() ([]Connection, error) {
 		conn := parseNetstatLine(line)
 		if conn != nil {
 			parsedCount++
-			if shouldInclude(conn) {
+			if include(conn) {
+				if conn.PID != 0 {
+					unit, ok := units[conn.PID]
+					if !ok {
+						unit = processUnit(conn.PID)
+						units[conn.PID] = unit
+					}
+					conn.Unit = unit
+				}
 				connections = append(connections, *conn)
 				includedCount++
 			}
 		}
 	}
 
-	fmt.Printf("Debug: processed %d lines, parsed %d connections, included %d after filtering\n", lineCount, parsedCount, includedCount)
+	slog.Debug("Parsed ss output", "component", "collector", "lines", lineCount, "parsed", parsedCount, "included", includedCount)
 
 	return connections, nil
 }
@@ -81,13 +103,36 @@ func parseNetstatLine(line string) *Connection {
 		return nil
 	}
 
-	return &Connection{
+	conn := &Connection{
 		LocalIP:    localIP,
 		LocalPort:  localPort,
 		RemoteIP:   remoteIP,
 		RemotePort: remotePort,
 		State:      state,
 	}
+	if i := strings.Index(line, "users:("); i >= 0 {
+		conn.Process, conn.PID = parseSSUsers(line[i:])
+	}
+	return conn
+}
+
+// parseSSUsers takes the first process from ss's process column,
+// users:(("firefox",pid=1234,fd=55),...)
+func parseSSUsers(users string) (string, int) {
+	_, rest, ok := strings.Cut(users, `(("`)
+	if !ok {
+		return "", 0
+	}
+	name, rest, ok := strings.Cut(rest, `",pid=`)
+	if !ok {
+		return "", 0
+	}
+	end := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+	if end < 0 {
+		end = len(rest)
+	}
+	pid, _ := strconv.Atoi(rest[:end])
+	return name, pid
 }
 
 // parseAddress splits IP:port or IP.port
@@ -126,6 +171,16 @@ func parseAddress(addr string) (string, int) {
 
 // shouldInclude filters out local/private connections
 func shouldInclude(conn *Connection) bool {
+	if !isPeerConnection(conn) {
+		return false
+	}
+
+	// Skip private IP ranges
+	return !isPrivateIP(net.ParseIP(conn.RemoteIP))
+}
+
+// isPeerConnection filters out loopback, wildcard and listening sockets
+func isPeerConnection(conn *Connection) bool {
 	// Skip localhost
 	if conn.RemoteIP == "127.0.0.1" || conn.RemoteIP == "::1" || conn.RemoteIP == "localhost" {
 		return false
@@ -136,13 +191,8 @@ func shouldInclude(conn *Connection) bool {
 		return false
 	}
 
-	// Skip private IP ranges
 	ip := net.ParseIP(conn.RemoteIP)
-	if ip == nil {
-		return false
-	}
-
-	if isPrivateIP(ip) {
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
 		return false
 	}
 
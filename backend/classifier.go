@@ -1,6 +1,10 @@
 package main
 
-import "strings"
+import (
+	"slices"
+	"strings"
+	"unicode"
+)
 
 // ClassifyNode determines the type of network node
 func ClassifyNode(port int, asn, owner, hostname string) string {
@@ -8,8 +12,9 @@ func ClassifyNode(port int, asn, owner, hostname string) string {
 	asnLower := strings.ToLower(asn + " " + owner)
 	hostLower := strings.ToLower(hostname)
 
-	// Cloud providers
-	if strings.Contains(asnLower, "amazon") || strings.Contains(hostLower, "amazonaws") || strings.Contains(asnLower, "aws") {
+	// Cloud providers. Short names must be whole words: "aws" is in
+	// "lawson" too.
+	if strings.Contains(asnLower, "amazon") || strings.Contains(hostLower, "amazonaws") || hasWord(asnLower, "aws") {
 		return "server" // AWS cloud server
 	}
 	if strings.Contains(asnLower, "google") && (strings.Contains(hostLower, "google") || strings.Contains(asnLower, "cloud")) {
@@ -50,6 +55,31 @@ func ClassifyNode(port int, asn, owner, hostname string) string {
 	return "server"
 }
 
+// ClassifyCloud determines the type of a node in a published cloud range
+// from the provider and service
+func ClassifyCloud(info *CloudInfo) string {
+	service := strings.ToLower(info.Service)
+	switch {
+	case info.Provider == "cloudflare" || info.Provider == "fastly" || info.Provider == "akamai":
+		return "load-balancer" // CDN edge
+	case strings.Contains(service, "cloudfront"), strings.Contains(service, "frontdoor"),
+		strings.Contains(service, "cdn"), strings.Contains(service, "globalaccelerator"),
+		strings.Contains(service, "trafficmanager"):
+		return "load-balancer"
+	case strings.Contains(service, "route53"), strings.Contains(service, "dns"):
+		return "router" // DNS
+	}
+	return "server"
+}
+
+// hasWord reports whether word appears in s between non-alphanumeric
+// characters
+func hasWord(s, word string) bool {
+	return slices.Contains(strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), word)
+}
+
 // GetNodeIcon returns emoji icon for node type
 func GetNodeIcon(nodeType string) string {
 	switch nodeType {
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Scanner runs the capture, GeoIP and classification pipeline without the
+// server, for the scan, watch and tail commands. It tracks nodes across
+// scans the way the server does and reports the changes as events.
+type Scanner struct {
+	collector Collector
+	enrich    *Enrichers
+	nodes     map[string]*NetworkNode
+}
+
+// NewScanner uses the configured collector and, when their directories
+// or files are set, threat intel, the ASN index, cloud ranges and zones
+func NewScanner(cfg *Config) (*Scanner, error) {
+	collector, err := NewCollector(cfg, false)
+	if err != nil {
+		return nil, fmt.Errorf("NETOPS_COLLECTOR: %w", err)
+	}
+	enrich := &Enrichers{}
+	if cfg.ThreatIntelDir != "" {
+		intel := NewThreatIntel(cfg.ThreatIntelDir)
+		if _, err := intel.Reload(); err != nil {
+			slog.Warn("Threat intel disabled", "component", "threatintel", "error", err)
+		} else {
+			enrich.Intel = intel
+		}
+	}
+	if cfg.ASNDir != "" {
+		index := NewASNIndex(cfg.ASNDir)
+		if _, err := index.Reload(); err != nil {
+			slog.Warn("ASN index disabled", "component", "asn", "error", err)
+		} else {
+			enrich.ASN = index
+		}
+	}
+	if cfg.CloudDir != "" {
+		ranges := NewCloudRanges(cfg.CloudDir)
+		if _, err := ranges.Reload(); err != nil {
+			slog.Warn("Cloud ranges disabled", "component", "cloud", "error", err)
+		} else {
+			enrich.Cloud = ranges
+		}
+	}
+	if cfg.ZonesFile != "" {
+		zones := NewZonePolicy(cfg.ZonesFile)
+		if _, err := zones.Reload(); err != nil {
+			slog.Warn("Security zones disabled", "component", "zones", "error", err)
+		} else {
+			enrich.Zones = zones
+		}
+	}
+	return &Scanner{collector: collector, enrich: enrich, nodes: make(map[string]*NetworkNode)}, nil
+}
+
+// Scan collects connections once, updates the nodes and returns what
+// changed as node_add, node_update and node_remove messages
+func (s *Scanner) Scan() ([]WSMessage, error) {
+	connections, err := s.collector.Collect()
+	if err != nil {
+		return nil, err
+	}
+
+	// One connection per peer is enough to build its node
+	now := time.Now()
+	counts := make(map[string]int)
+	first := make(map[string]Connection)
+	for _, conn := range connections {
+		// Traffic between two internal hosts has no remote peer to show
+		if conn.Target != "" {
+			continue
+		}
+		if counts[conn.RemoteIP] == 0 {
+			first[conn.RemoteIP] = conn
+		}
+		counts[conn.RemoteIP]++
+	}
+
+	var events []WSMessage
+	for ip, count := range counts {
+		if node, ok := s.nodes[ip]; ok {
+			node.LastSeen = now
+			if node.Status != "online" || node.Connections != count {
+				node.Status = "online"
+				node.Connections = count
+				events = append(events, WSMessage{Type: "node_update", Node: copyNode(node)})
+			}
+			continue
+		}
+
+		geoInfo, err := LookupGeoIP(ip)
+		if err != nil {
+			slog.Warn("GeoIP lookup failed", "component", "monitor", "ip", ip, "error", err)
+			continue
+		}
+		node := newRemoteNode(first[ip], geoInfo)
+		node.Connections = count
+		s.enrich.Enrich(node)
+		s.nodes[ip] = node
+		events = append(events, WSMessage{Type: "node_add", Node: copyNode(node)})
+	}
+
+	for ip, node := range s.nodes {
+		if _, seen := counts[ip]; seen {
+			continue
+		}
+		if now.Sub(node.LastSeen) > nodeRemoveAfter {
+			delete(s.nodes, ip)
+			events = append(events, WSMessage{Type: "node_remove", ID: ip})
+		} else if now.Sub(node.LastSeen) > nodeOfflineAfter && node.Status != "offline" {
+			node.Status = "offline"
+			events = append(events, WSMessage{Type: "node_update", Node: copyNode(node)})
+		}
+	}
+	slices.SortFunc(events, func(a, b WSMessage) int { return cmp.Compare(eventNodeID(a), eventNodeID(b)) })
+	return events, nil
+}
+
+// Nodes returns copies of the tracked nodes
+func (s *Scanner) Nodes() []*NetworkNode {
+	nodes := make([]*NetworkNode, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		nodes = append(nodes, copyNode(node))
+	}
+	return nodes
+}
+
+func eventNodeID(msg WSMessage) string {
+	if msg.Node != nil {
+		return msg.Node.ID
+	}
+	return msg.ID
+}
+
+// nodeColumn is a column of the node table, and a key it can be sorted by
+type nodeColumn struct {
+	name    string
+	value   func(*NetworkNode) string
+	compare func(a, b *NetworkNode) int // nil to compare values as text
+	numeric bool                        // sorted largest first
+}
+
+var nodeColumns = []nodeColumn{
+	{name: "ip", value: func(n *NetworkNode) string { return n.IPAddress }, compare: compareIP},
+	{name: "name", value: func(n *NetworkNode) string { return n.Name }},
+	{name: "type", value: func(n *NetworkNode) string { return n.Type }},
+	{name: "status", value: func(n *NetworkNode) string { return n.Status }},
+	{name: "conns", value: func(n *NetworkNode) string { return strconv.Itoa(n.Connections) },
+		compare: func(a, b *NetworkNode) int { return cmp.Compare(a.Connections, b.Connections) }, numeric: true},
+	{name: "country", value: func(n *NetworkNode) string { return n.Country }},
+	{name: "city", value: func(n *NetworkNode) string { return n.City }},
+	{name: "asn", value: func(n *NetworkNode) string { return n.ASN }},
+	{name: "owner", value: func(n *NetworkNode) string { return n.Owner }},
+	{name: "seen", value: func(n *NetworkNode) string { return n.LastSeen.Format(time.TimeOnly) },
+		compare: func(a, b *NetworkNode) int { return a.LastSeen.Compare(b.LastSeen) }, numeric: true},
+}
+
+func compareIP(a, b *NetworkNode) int {
+	x, errX := netip.ParseAddr(a.IPAddress)
+	y, errY := netip.ParseAddr(b.IPAddress)
+	if errX != nil || errY != nil {
+		return strings.Compare(a.IPAddress, b.IPAddress)
+	}
+	return x.Compare(y)
+}
+
+func findColumn(name string) (int, error) {
+	for i, col := range nodeColumns {
+		if col.name == name {
+			return i, nil
+		}
+	}
+	names := make([]string, len(nodeColumns))
+	for i, col := range nodeColumns {
+		names[i] = col.name
+	}
+	return 0, fmt.Errorf("unknown sort column %q (expected one of %s)", name, strings.Join(names, ", "))
+}
+
+// sortNodes orders nodes by a column: text ascending, numbers and times
+// largest first, reversed on request. Ties fall back to the IP.
+func sortNodes(nodes []*NetworkNode, column int, reverse bool) {
+	col := nodeColumns[column]
+	slices.SortStableFunc(nodes, func(a, b *NetworkNode) int {
+		var c int
+		if col.compare != nil {
+			c = col.compare(a, b)
+		} else {
+			c = strings.Compare(strings.ToLower(col.value(a)), strings.ToLower(col.value(b)))
+		}
+		if col.numeric {
+			c = -c
+		}
+		if reverse {
+			c = -c
+		}
+		if c == 0 {
+			c = compareIP(a, b)
+		}
+		return c
+	})
+}
+
+// writeNodeTable writes nodes as aligned columns
+func writeNodeTable(w io.Writer, nodes []*NetworkNode) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := make([]string, len(nodeColumns))
+	for i, col := range nodeColumns {
+		header[i] = strings.ToUpper(col.name)
+	}
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, node := range nodes {
+		row := make([]string, len(nodeColumns))
+		for i, col := range nodeColumns {
+			row[i] = col.value(node)
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// runScan implements "netops-backend scan": one capture, printed as a
+// table, a JSON array or NDJSON
+func runScan(cfg *Config, args []string) {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	format := flags.String("format", "table", "output format: table, json or ndjson")
+	sortBy := flags.String("sort", "conns", "column to sort by")
+	reverse := flags.Bool("reverse", false, "reverse the sort order")
+	flags.Parse(args)
+
+	column, err := findColumn(*sortBy)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if *format != "table" && *format != "json" && *format != "ndjson" {
+		fatal(fmt.Sprintf("unknown format %q (expected table, json or ndjson)", *format))
+	}
+	scanner, err := NewScanner(cfg)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if _, err := scanner.Scan(); err != nil {
+		fatal("Failed to capture connections", "component", "monitor", "error", err)
+	}
+	nodes := scanner.Nodes()
+	sortNodes(nodes, column, *reverse)
+
+	switch *format {
+	case "table":
+		err = writeNodeTable(os.Stdout, nodes)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(nodes)
+	case "ndjson":
+		enc := json.NewEncoder(os.Stdout)
+		for _, node := range nodes {
+			if err = enc.Encode(node); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		fatal("Failed to write output", "error", err)
+	}
+}
+
+// runTail implements "netops-backend tail": it scans on an interval and
+// prints every node event, as text or NDJSON
+func runTail(cfg *Config, args []string) {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	format := flags.String("format", "text", "output format: text or ndjson")
+	interval := flags.Duration("interval", 5*time.Second, "time between scans")
+	flags.Parse(args)
+	if *format != "text" && *format != "ndjson" {
+		fatal(fmt.Sprintf("unknown format %q (expected text or ndjson)", *format))
+	}
+
+	scanner, err := NewScanner(cfg)
+	if err != nil {
+		fatal(err.Error())
+	}
+	enc := json.NewEncoder(os.Stdout)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		events, err := scanner.Scan()
+		if err != nil {
+			slog.Error("Failed to capture connections", "component", "monitor", "error", err)
+			continue
+		}
+		for _, event := range events {
+			if *format == "ndjson" {
+				enc.Encode(event)
+			} else {
+				fmt.Println(formatEvent(event))
+			}
+		}
+	}
+}
+
+// formatEvent renders an event as one line of text
+func formatEvent(msg WSMessage) string {
+	at := time.Now().Format(time.TimeOnly)
+	if msg.Node == nil {
+		return fmt.Sprintf("%s %-11s %s", at, msg.Type, msg.ID)
+	}
+	n := msg.Node
+	place := strings.Trim(n.City+", "+n.Country, ", ")
+	return fmt.Sprintf("%s %-11s %-15s %-8s %-7s conns=%d %s %s %s", at, msg.Type, n.IPAddress, n.Type, n.Status,
+		n.Connections, n.Name, place, n.ASN)
+}
+
+// runWatch implements "netops-backend watch": a live table of nodes that
+// redraws after every scan. Keys: s cycles the sort column, r reverses
+// it, q quits.
+func runWatch(cfg *Config, args []string) {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	interval := flags.Duration("interval", 5*time.Second, "time between scans")
+	sortBy := flags.String("sort", "conns", "column to sort by")
+	flags.Parse(args)
+
+	column, err := findColumn(*sortBy)
+	if err != nil {
+		fatal(err.Error())
+	}
+	fd := int(os.Stdout.Fd())
+	if !term.IsTerminal(fd) || !term.IsTerminal(int(os.Stdin.Fd())) {
+		fatal("watch needs a terminal; use scan or tail to write to a pipe")
+	}
+	scanner, err := NewScanner(cfg)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	// Log records would scribble over the table; only the status line
+	// reports problems
+	if err := setupLogging(cfg, nil, io.Discard); err != nil {
+		fatal(err.Error())
+	}
+
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		fatal("Cannot use the terminal", "error", err)
+	}
+	// Alternate screen, hidden cursor; both undone on exit
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	restore := func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		term.Restore(int(os.Stdin.Fd()), state)
+	}
+	defer restore()
+
+	type scanResult struct {
+		nodes []*NetworkNode
+		err   error
+		at    time.Time
+	}
+	results := make(chan scanResult, 1)
+	go func() {
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		for ; ; <-ticker.C {
+			_, err := scanner.Scan()
+			results <- scanResult{nodes: scanner.Nodes(), err: err, at: time.Now()}
+		}
+	}()
+
+	keys := make(chan byte)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if n, err := os.Stdin.Read(buf); err != nil || n == 0 {
+				close(keys)
+				return
+			}
+			keys <- buf[0]
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+
+	view := watchView{column: column, status: "scanning..."}
+	view.draw(fd)
+	for {
+		select {
+		case result := <-results:
+			view.nodes = result.nodes
+			view.status = "last scan " + result.at.Format(time.TimeOnly)
+			if result.err != nil {
+				view.status = "scan failed: " + result.err.Error()
+			}
+		case key, ok := <-keys:
+			switch {
+			case !ok || key == 'q' || key == 3: // 3 is Ctrl-C in raw mode
+				return
+			case key == 's':
+				view.column = (view.column + 1) % len(nodeColumns)
+			case key == 'r':
+				view.reverse = !view.reverse
+			}
+		case <-signals:
+			return
+		}
+		view.draw(fd)
+	}
+}
+
+// watchView is what the watch command shows
+type watchView struct {
+	nodes   []*NetworkNode
+	column  int
+	reverse bool
+	status  string
+}
+
+// draw redraws the screen, cutting the table to the terminal's size
+func (v *watchView) draw(fd int) {
+	width, height, err := term.GetSize(fd)
+	if err != nil {
+		width, height = 120, 40
+	}
+	sortNodes(v.nodes, v.column, v.reverse)
+
+	online := 0
+	for _, node := range v.nodes {
+		if node.Status == "online" {
+			online++
+		}
+	}
+	order := "↑"
+	if nodeColumns[v.column].numeric != v.reverse {
+		order = "↓"
+	}
+
+	var table bytes.Buffer
+	writeNodeTable(&table, v.nodes)
+	lines := strings.Split(strings.TrimSuffix(table.String(), "\n"), "\n")
+
+	var out strings.Builder
+	out.WriteString("\x1b[H\x1b[2J")
+	header := fmt.Sprintf("netops watch  %d nodes, %d online  sort: %s %s  [s] sort  [r] reverse  [q] quit",
+		len(v.nodes), online, nodeColumns[v.column].name, order)
+	out.WriteString("\x1b[7m" + fitLine(header, width) + "\x1b[0m\r\n")
+	for i, line := range lines {
+		if i >= height-3 {
+			fmt.Fprintf(&out, "... %d more\r\n", len(lines)-i)
+			break
+		}
+		if i == 0 {
+			line = "\x1b[1m" + fitLine(line, width) + "\x1b[0m"
+		} else {
+			line = fitLine(line, width)
+		}
+		out.WriteString(line + "\r\n")
+	}
+	fmt.Fprintf(&out, "\x1b[%d;1H%s", height, fitLine(v.status, width))
+	os.Stdout.WriteString(out.String())
+}
+
+// fitLine cuts s to width runes and pads it so it fills the line
+func fitLine(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+	return s + strings.Repeat(" ", width-len(runes))
+}
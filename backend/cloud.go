@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CloudInfo is the published cloud or CDN range a node's address is in
+type CloudInfo struct {
+	Provider string `json:"provider"`          // aws, azure, google, cloudflare, fastly, oracle, github, ...
+	Service  string `json:"service,omitempty"` // S3, CLOUDFRONT, AzureStorage, OBJECT_STORAGE, actions, ...
+	Region   string `json:"region,omitempty"`
+	Prefix   string `json:"prefix"` // the published range containing the address
+}
+
+// Range file formats understood by the cloud range loader
+const (
+	CloudFormatAWS        = "aws"        // ip-ranges.json
+	CloudFormatGoogle     = "google"     // cloud.json and goog.json
+	CloudFormatAzure      = "azure"      // ServiceTags_Public_*.json
+	CloudFormatCloudflare = "cloudflare" // the /client/v4/ips API response
+	CloudFormatFastly     = "fastly"     // public-ip-list
+	CloudFormatOracle     = "oracle"     // public_ip_ranges.json
+	CloudFormatGitHub     = "github"     // the /meta API response
+	CloudFormatList       = "list"       // one CIDR per line, provider taken from the file name
+)
+
+// cloudRange is what a published range says, shared by every prefix that
+// says the same
+type cloudRange struct {
+	provider string
+	service  string
+	region   string
+}
+
+// detail ranks how much a range says, so the same prefix listed both under
+// a catch-all tag and under a service keeps the service
+func (r *cloudRange) detail() int {
+	n := 0
+	if r.service != "" {
+		n += 2
+	}
+	if r.region != "" {
+		n++
+	}
+	return n
+}
+
+// cloudTables is one build of the ranges from a set of files
+type cloudTables struct {
+	prefixes PrefixTrie[*cloudRange]
+	interned map[cloudRange]*cloudRange // while building
+}
+
+// CloudRanges maps addresses to the cloud provider, service and region
+// whose published ranges contain them, using range files from a directory
+// that are reloaded when they change
+type CloudRanges struct {
+	dir    string
+	files  string // names, sizes and mtimes of the files the tables came from
+	tables *cloudTables
+	mu     sync.RWMutex
+}
+
+// NewCloudRanges creates an index over the range files in dir
+func NewCloudRanges(dir string) *CloudRanges {
+	return &CloudRanges{dir: dir}
+}
+
+// Reload rebuilds the index if any file was added, changed or removed,
+// and reports whether it did
+func (c *CloudRanges) Reload() (bool, error) {
+	paths, files, err := dataFiles(c.dir)
+	if err != nil {
+		return false, fmt.Errorf("read cloud ranges dir: %w", err)
+	}
+
+	c.mu.RLock()
+	unchanged := c.tables != nil && c.files == files
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	tables := &cloudTables{interned: make(map[cloudRange]*cloudRange)}
+	for _, path := range paths {
+		format, err := tables.load(path)
+		if err != nil {
+			slog.Warn("Skipping cloud range file", "component", "cloud", "path", path, "error", err)
+			continue
+		}
+		slog.Debug("Loaded cloud range file", "component", "cloud", "path", path, "format", format)
+	}
+	tables.interned = nil
+	slog.Info("Cloud ranges loaded", "component", "cloud", "prefixes", tables.prefixes.Len())
+
+	c.mu.Lock()
+	c.tables, c.files = tables, files
+	c.mu.Unlock()
+	return true, nil
+}
+
+// Lookup returns the most specific published range containing ip, or nil
+func (c *CloudRanges) Lookup(ip string) *CloudInfo {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	c.mu.RLock()
+	t := c.tables
+	c.mu.RUnlock()
+	if t == nil {
+		return nil
+	}
+	prefix, r, ok := t.prefixes.Lookup(addr)
+	if !ok {
+		return nil
+	}
+	return &CloudInfo{Provider: r.provider, Service: r.service, Region: r.region, Prefix: prefix.String()}
+}
+
+// Len returns the number of prefixes loaded
+func (c *CloudRanges) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.tables == nil {
+		return 0
+	}
+	return c.tables.prefixes.Len()
+}
+
+// load reads one range file, detecting its compression and format
+func (t *cloudTables) load(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	r, err := decompress(bufio.NewReader(f))
+	if err != nil {
+		return "", err
+	}
+
+	head, _ := r.Peek(64)
+	if trimmed := strings.TrimSpace(string(head)); !strings.HasPrefix(trimmed, "{") {
+		return CloudFormatList, t.loadList(r, listProvider(path))
+	}
+	var doc map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return "", err
+	}
+	format := detectCloudFormat(doc)
+	switch format {
+	case CloudFormatAWS:
+		err = t.loadAWS(doc)
+	case CloudFormatGoogle:
+		err = t.loadGoogle(doc)
+	case CloudFormatAzure:
+		err = t.loadAzure(doc)
+	case CloudFormatCloudflare:
+		err = t.loadCloudflare(doc)
+	case CloudFormatFastly:
+		err = t.loadFastly(doc)
+	case CloudFormatOracle:
+		err = t.loadOracle(doc)
+	case CloudFormatGitHub:
+		t.loadGitHub(doc)
+	default:
+		return "", fmt.Errorf("unrecognized format")
+	}
+	return format, err
+}
+
+// detectCloudFormat tells the JSON range files apart by their top-level
+// keys
+func detectCloudFormat(doc map[string]json.RawMessage) string {
+	has := func(key string) bool {
+		_, ok := doc[key]
+		return ok
+	}
+	switch {
+	case has("prefixes") && has("createDate"):
+		return CloudFormatAWS
+	case has("prefixes"):
+		return CloudFormatGoogle
+	case has("values") && has("changeNumber"):
+		return CloudFormatAzure
+	case has("result"):
+		return CloudFormatCloudflare
+	case has("addresses"):
+		return CloudFormatFastly
+	case has("regions"):
+		return CloudFormatOracle
+	case has("hooks") || has("git") || has("actions"):
+		return CloudFormatGitHub
+	}
+	return ""
+}
+
+// listProvider names the provider of a plain CIDR list after its file:
+// "cloudflare-ips-v4.txt" is cloudflare
+func listProvider(path string) string {
+	name := strings.ToLower(filepath.Base(path))
+	if i := strings.IndexAny(name, "-_. "); i > 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// add records a range, keeping the more detailed entry when a prefix is
+// listed twice
+func (t *cloudTables) add(cidr string, r cloudRange) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+	if err != nil {
+		addr, err := netip.ParseAddr(strings.TrimSpace(cidr))
+		if err != nil {
+			return
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	if existing, ok := t.prefixes.Get(prefix); ok && existing.detail() >= r.detail() {
+		return
+	}
+	shared, ok := t.interned[r]
+	if !ok {
+		shared = &r
+		t.interned[r] = shared
+	}
+	t.prefixes.Insert(prefix, shared)
+}
+
+func (t *cloudTables) loadList(r io.Reader, provider string) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		t.add(line, cloudRange{provider: provider})
+	}
+	return scanner.Err()
+}
+
+// loadAWS reads ip-ranges.json. Every range is listed under AMAZON as well
+// as its service, so AMAZON only names ranges no service claims.
+func (t *cloudTables) loadAWS(doc map[string]json.RawMessage) error {
+	type entry struct {
+		IPv4    string `json:"ip_prefix"`
+		IPv6    string `json:"ipv6_prefix"`
+		Region  string `json:"region"`
+		Service string `json:"service"`
+	}
+	var v4, v6 []entry
+	if err := json.Unmarshal(doc["prefixes"], &v4); err != nil {
+		return err
+	}
+	if raw, ok := doc["ipv6_prefixes"]; ok {
+		if err := json.Unmarshal(raw, &v6); err != nil {
+			return err
+		}
+	}
+	for _, e := range append(v4, v6...) {
+		r := cloudRange{provider: "aws", service: e.Service, region: e.Region}
+		if r.service == "AMAZON" {
+			r.service = ""
+		}
+		if r.region == "GLOBAL" {
+			r.region = ""
+		}
+		t.add(e.IPv4+e.IPv6, r)
+	}
+	return nil
+}
+
+// loadGoogle reads cloud.json, whose ranges have a service and scope, and
+// goog.json, whose ranges have neither
+func (t *cloudTables) loadGoogle(doc map[string]json.RawMessage) error {
+	var entries []struct {
+		IPv4    string `json:"ipv4Prefix"`
+		IPv6    string `json:"ipv6Prefix"`
+		Service string `json:"service"`
+		Scope   string `json:"scope"`
+	}
+	if err := json.Unmarshal(doc["prefixes"], &entries); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		r := cloudRange{provider: "google", service: e.Service, region: e.Scope}
+		if r.region == "global" {
+			r.region = ""
+		}
+		t.add(e.IPv4+e.IPv6, r)
+	}
+	return nil
+}
+
+// loadAzure reads the service tags file. Tags without a system service,
+// like AzureCloud.westus, cover every service in a region.
+func (t *cloudTables) loadAzure(doc map[string]json.RawMessage) error {
+	var values []struct {
+		Properties struct {
+			Region          string   `json:"region"`
+			SystemService   string   `json:"systemService"`
+			AddressPrefixes []string `json:"addressPrefixes"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(doc["values"], &values); err != nil {
+		return err
+	}
+	for _, v := range values {
+		r := cloudRange{provider: "azure", service: v.Properties.SystemService, region: v.Properties.Region}
+		for _, cidr := range v.Properties.AddressPrefixes {
+			t.add(cidr, r)
+		}
+	}
+	return nil
+}
+
+func (t *cloudTables) loadCloudflare(doc map[string]json.RawMessage) error {
+	var result struct {
+		IPv4 []string `json:"ipv4_cidrs"`
+		IPv6 []string `json:"ipv6_cidrs"`
+	}
+	if err := json.Unmarshal(doc["result"], &result); err != nil {
+		return err
+	}
+	for _, cidr := range append(result.IPv4, result.IPv6...) {
+		t.add(cidr, cloudRange{provider: "cloudflare"})
+	}
+	return nil
+}
+
+func (t *cloudTables) loadFastly(doc map[string]json.RawMessage) error {
+	var v4, v6 []string
+	if err := json.Unmarshal(doc["addresses"], &v4); err != nil {
+		return err
+	}
+	if raw, ok := doc["ipv6_addresses"]; ok {
+		if err := json.Unmarshal(raw, &v6); err != nil {
+			return err
+		}
+	}
+	for _, cidr := range append(v4, v6...) {
+		t.add(cidr, cloudRange{provider: "fastly"})
+	}
+	return nil
+}
+
+// loadOracle reads public_ip_ranges.json. A range's tags go from general
+// to specific ("OSN", "OBJECT_STORAGE"), so the last one is the service.
+func (t *cloudTables) loadOracle(doc map[string]json.RawMessage) error {
+	var regions []struct {
+		Region string `json:"region"`
+		CIDRs  []struct {
+			CIDR string   `json:"cidr"`
+			Tags []string `json:"tags"`
+		} `json:"cidrs"`
+	}
+	if err := json.Unmarshal(doc["regions"], &regions); err != nil {
+		return err
+	}
+	for _, region := range regions {
+		for _, c := range region.CIDRs {
+			r := cloudRange{provider: "oracle", region: region.Region}
+			if len(c.Tags) > 0 {
+				r.service = c.Tags[len(c.Tags)-1]
+			}
+			t.add(c.CIDR, r)
+		}
+	}
+	return nil
+}
+
+// loadGitHub reads the meta API response, where each list of ranges is
+// keyed by the service using it. Keys holding anything else, like
+// ssh_keys or domains, are skipped.
+func (t *cloudTables) loadGitHub(doc map[string]json.RawMessage) {
+	for _, service := range slices.Sorted(maps.Keys(doc)) {
+		var cidrs []string
+		if json.Unmarshal(doc[service], &cidrs) != nil {
+			continue
+		}
+		for _, cidr := range cidrs {
+			t.add(cidr, cloudRange{provider: "github", service: service})
+		}
+	}
+}
+
+// ApplyCloud sets the cloud range of a node and reclassifies it from the
+// service, restoring the earlier type when the address leaves the
+// published ranges. Routers found by traceroute and internal hosts keep
+// their type. It reports whether the node changed.
+func ApplyCloud(node *NetworkNode, info *CloudInfo) bool {
+	if reflect.DeepEqual(node.Cloud, info) {
+		return false
+	}
+	if !node.Hop && !node.Internal && node.ID != "local" {
+		switch {
+		case info != nil:
+			if node.Cloud == nil {
+				node.preCloudType = node.Type
+			}
+			node.Type = ClassifyCloud(info)
+		case node.preCloudType != "":
+			node.Type, node.preCloudType = node.preCloudType, ""
+		}
+	}
+	node.Cloud = info
+	return true
+}
+
+// refreshCloudRanges periodically reloads the range files when they change
+func refreshCloudRanges(ranges *CloudRanges, interval time.Duration, hub *WSHub, store *NodeStore) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		changed, err := ranges.Reload()
+		if err != nil {
+			slog.Error("Cloud range reload failed", "component", "cloud", "error", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		out := hub.NewOutbox()
+		store.mu.Lock()
+		for _, node := range store.Nodes {
+			if node.ID != "local" && ApplyCloud(node, ranges.Lookup(node.IPAddress)) {
+				out.BroadcastNodeUpdate(node)
+			}
+		}
+		store.mu.Unlock()
+		out.Flush()
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDetectCloudFormat(t *testing.T) {
+	tests := map[string]string{
+		"aws-ip-ranges.json":           CloudFormatAWS,
+		"google-cloud.json":            CloudFormatGoogle,
+		"azure-servicetags.json":       CloudFormatAzure,
+		"cloudflare-ips.json":          CloudFormatCloudflare,
+		"fastly-public-ip-list.json":   CloudFormatFastly,
+		"oracle-public-ip-ranges.json": CloudFormatOracle,
+		"github-meta.json":             CloudFormatGitHub,
+	}
+	for name, want := range tests {
+		data, err := os.ReadFile(filepath.Join("testdata", "cloud", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc map[string]json.RawMessage
+		if err := json.Unmarshal(data, &doc); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := detectCloudFormat(doc); got != want {
+			t.Errorf("%s: detected %q, want %q", name, got, want)
+		}
+	}
+	if got := detectCloudFormat(map[string]json.RawMessage{"hello": json.RawMessage(`"world"`)}); got != "" {
+		t.Errorf("unknown document detected as %q", got)
+	}
+}
+
+func TestCloudRangesLookup(t *testing.T) {
+	ranges := NewCloudRanges(filepath.Join("testdata", "cloud"))
+	if changed, err := ranges.Reload(); err != nil || !changed {
+		t.Fatalf("Reload = %v, %v", changed, err)
+	}
+
+	tests := []struct {
+		ip   string
+		want *CloudInfo
+	}{
+		// AMAZON only names ranges no service claims, in either order
+		{"198.51.100.7", &CloudInfo{Provider: "aws", Service: "EC2", Region: "eu-west-1", Prefix: "198.51.100.0/24"}},
+		{"198.51.100.200", &CloudInfo{Provider: "aws", Service: "CLOUDFRONT", Prefix: "198.51.100.128/25"}},
+		{"2001:db8:a::1", &CloudInfo{Provider: "aws", Service: "S3", Region: "us-east-1", Prefix: "2001:db8:a::/48"}},
+		{"192.0.2.1", &CloudInfo{Provider: "google", Service: "Google Cloud", Region: "europe-west4", Prefix: "192.0.2.0/26"}},
+		{"2001:db8:b::1", &CloudInfo{Provider: "google", Service: "Google Cloud", Prefix: "2001:db8:b::/48"}},
+		{"192.0.2.70", &CloudInfo{Provider: "azure", Region: "westeurope", Prefix: "192.0.2.64/26"}},
+		{"192.0.2.100", &CloudInfo{Provider: "azure", Service: "AzureStorage", Region: "westeurope", Prefix: "192.0.2.96/27"}},
+		{"2001:db8:c::1", &CloudInfo{Provider: "azure", Region: "westeurope", Prefix: "2001:db8:c::/48"}},
+		{"203.0.113.1", &CloudInfo{Provider: "cloudflare", Prefix: "203.0.113.0/26"}},
+		{"2001:db8:d::1", &CloudInfo{Provider: "cloudflare", Prefix: "2001:db8:d::/48"}},
+		{"203.0.113.65", &CloudInfo{Provider: "fastly", Prefix: "203.0.113.64/26"}},
+		{"2001:db8:e::1", &CloudInfo{Provider: "fastly", Prefix: "2001:db8:e::/48"}},
+		{"203.0.113.130", &CloudInfo{Provider: "oracle", Service: "OCI", Region: "eu-frankfurt-1", Prefix: "203.0.113.128/26"}},
+		{"203.0.113.170", &CloudInfo{Provider: "oracle", Service: "OBJECT_STORAGE", Region: "eu-frankfurt-1", Prefix: "203.0.113.160/27"}},
+		{"192.0.2.130", &CloudInfo{Provider: "github", Service: "hooks", Prefix: "192.0.2.128/27"}},
+		{"2001:db8:f::1", &CloudInfo{Provider: "github", Service: "web", Prefix: "2001:db8:f::/48"}},
+		{"192.0.2.200", &CloudInfo{Provider: "github", Service: "actions", Prefix: "192.0.2.192/26"}},
+		// Plain lists, named by their file; a bare address is a host route
+		{"203.0.113.200", &CloudInfo{Provider: "akamai", Prefix: "203.0.113.192/26"}},
+		{"203.0.113.250", &CloudInfo{Provider: "akamai", Prefix: "203.0.113.250/32"}},
+		{"::ffff:203.0.113.250", &CloudInfo{Provider: "akamai", Prefix: "203.0.113.250/32"}},
+		{"198.19.0.1", &CloudInfo{Provider: "akamai", Prefix: "198.18.0.0/15"}}, // gzipped
+		{"10.0.0.1", nil},
+		{"not an address", nil},
+	}
+	for _, tt := range tests {
+		if got := ranges.Lookup(tt.ip); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Lookup(%s) = %+v, want %+v", tt.ip, got, tt.want)
+		}
+	}
+	if changed, _ := ranges.Reload(); changed {
+		t.Error("Reload rebuilt unchanged files")
+	}
+}
+
+func TestListProvider(t *testing.T) {
+	for path, want := range map[string]string{
+		"/data/cloudflare-ips-v4.txt": "cloudflare",
+		"Akamai_ranges.txt":           "akamai",
+		"fastly":                      "fastly",
+	} {
+		if got := listProvider(path); got != want {
+			t.Errorf("listProvider(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestApplyCloud(t *testing.T) {
+	cdn := &CloudInfo{Provider: "cloudflare", Prefix: "203.0.113.0/26"}
+	vm := &CloudInfo{Provider: "aws", Service: "EC2", Prefix: "198.51.100.0/24"}
+	node := &NetworkNode{ID: "203.0.113.1", Type: "database"}
+
+	steps := []struct {
+		info     *CloudInfo
+		changed  bool
+		wantType string
+	}{
+		{cdn, true, "load-balancer"},
+		{cdn, false, "load-balancer"},
+		{vm, true, "server"},
+		// Leaving the ranges restores the type from before the first one
+		{nil, true, "database"},
+		{nil, false, "database"},
+		{vm, true, "server"},
+		{nil, true, "database"},
+	}
+	for i, step := range steps {
+		if changed := ApplyCloud(node, step.info); changed != step.changed {
+			t.Errorf("step %d: changed = %v, want %v", i, changed, step.changed)
+		}
+		if node.Type != step.wantType || node.Cloud != step.info {
+			t.Errorf("step %d: type %s, cloud %+v; want %s", i, node.Type, node.Cloud, step.wantType)
+		}
+	}
+
+	for _, node := range []*NetworkNode{
+		{ID: "10.0.0.5", Type: "server", Internal: true},
+		{ID: "198.51.100.1", Type: "router", Hop: true},
+		{ID: "local", Type: "endpoint"},
+	} {
+		want := node.Type
+		ApplyCloud(node, cdn)
+		ApplyCloud(node, nil)
+		if node.Type != want {
+			t.Errorf("%s: type %s after a cloud range came and went, want %s", node.ID, node.Type, want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Collector produces the current set of connections to map
+type Collector interface {
+	Name() string
+	Collect() ([]Connection, error)
+}
+
+// NewCollector builds the collectors named by cfg.Collector: "ss" for
+// this host's sockets, "conntrack" for flows tracked by netfilter
+// (including forwarded traffic on a gateway), "containers" for the sockets
+// of containers in their own network namespaces, "netns" for the sockets
+// of every network namespace on the host, a comma-separated list
+// such as "ss,containers" for several, or "none" for an aggregator that
+// only maps what agents report. includePrivate keeps sockets to private
+// addresses, which agents report so the aggregator can find traffic
+// between them.
+func NewCollector(cfg *Config, includePrivate bool) (Collector, error) {
+	collectors := multiCollector{}
+	kinds := strings.Split(cfg.Collector, ",")
+	for i := range kinds {
+		kinds[i] = strings.TrimSpace(kinds[i])
+	}
+	// Both would report each container's sockets, under different nodes
+	if slices.Contains(kinds, "containers") && slices.Contains(kinds, "netns") {
+		return nil, errors.New("the containers and netns collectors can't be combined")
+	}
+	for _, name := range kinds {
+		switch name {
+		case "none":
+		case "", "ss":
+			collectors = append(collectors, ssCollector{includePrivate: includePrivate})
+		case "conntrack":
+			collectors = append(collectors, NewConntrackCollector(cfg.ConntrackPath))
+		case "containers":
+			source := NewWorkloadSource(cfg.CRISocket, cfg.PodDir, cfg.DockerRoot)
+			collectors = append(collectors, NewContainerCollector(source, cfg.Netns, includePrivate))
+		case "netns":
+			collectors = append(collectors, NewNetnsCollector(cfg.Netns, includePrivate))
+		default:
+			return nil, fmt.Errorf("unknown collector %q", name)
+		}
+	}
+	return collectors, nil
+}
+
+// ssCollector reads this host's sockets with ss
+type ssCollector struct {
+	includePrivate bool
+}
+
+func (ssCollector) Name() string { return "ss" }
+
+func (c ssCollector) Collect() ([]Connection, error) {
+	if c.includePrivate {
+		return CaptureAllConnections()
+	}
+	return CaptureConnections()
+}
+
+// multiCollector merges the results of several collectors. A flow seen by
+// more than one (a local socket is also in conntrack) is reported once.
+type multiCollector []Collector
+
+func (m multiCollector) Name() string {
+	names := make([]string, len(m))
+	for i, c := range m {
+		names[i] = c.Name()
+	}
+	return strings.Join(names, "+")
+}
+
+func (m multiCollector) Collect() ([]Connection, error) {
+	var all []Connection
+	var errs []error
+	seen := make(map[string]bool)
+	for _, c := range m {
+		conns, err := c.Collect()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.Name(), err))
+			continue
+		}
+		for _, conn := range conns {
+			key := fmt.Sprintf("%s %s:%d>%s:%d", conn.Origin, conn.LocalIP, conn.LocalPort, conn.RemoteIP, conn.RemotePort)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			all = append(all, conn)
+		}
+	}
+	if len(all) == 0 && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return all, nil
+}
+
+// DescribeOrigin asks each member collector in turn
+func (m multiCollector) DescribeOrigin(id string) *NetworkNode {
+	for _, c := range m {
+		if d, ok := c.(OriginDescriber); ok {
+			if node := d.DescribeOrigin(id); node != nil {
+				return node
+			}
+		}
+	}
+	return nil
+}
+
+// ConntrackCollector reports the flows netfilter is tracking. On a router
+// most of these are forwarded traffic from LAN clients, which never appear
+// as local sockets; each becomes a connection whose Origin is the internal
+// client rather than this host.
+type ConntrackCollector struct {
+	path  string
+	local *localAddrs
+}
+
+// NewConntrackCollector reads the conntrack table at path
+func NewConntrackCollector(path string) *ConntrackCollector {
+	return &ConntrackCollector{path: path, local: newLocalAddrs()}
+}
+
+func (c *ConntrackCollector) Name() string { return "conntrack" }
+
+func (c *ConntrackCollector) Collect() ([]Connection, error) {
+	entries, err := ReadConntrack(c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	connections := []Connection{}
+	for i := range entries {
+		conn, ok := c.connection(&entries[i])
+		if ok && shouldInclude(&conn) {
+			connections = append(connections, conn)
+		}
+	}
+	return connections, nil
+}
+
+// connection maps a conntrack entry onto a Connection from the internal
+// side's point of view.
+//
+// For an outbound flow the original tuple's source is the internal client
+// and the reply tuple's source is the real server. After SNAT the reply is
+// addressed to the translated source, recorded as the NAT address.
+//
+// For an inbound flow (a public client, possibly DNATed to an internal
+// server) the reply tuple's source is the internal server.
+func (c *ConntrackCollector) connection(e *ConntrackEntry) (Connection, bool) {
+	if e.Protocol != "tcp" && e.Protocol != "udp" {
+		return Connection{}, false
+	}
+	if e.Protocol == "tcp" && e.State != "ESTABLISHED" {
+		return Connection{}, false
+	}
+
+	var conn Connection
+	var internal netip.Addr
+	switch {
+	case c.isInternal(e.Orig.Src):
+		internal = e.Orig.Src
+		conn = Connection{
+			LocalIP:    e.Orig.Src.String(),
+			LocalPort:  e.Orig.SrcPort,
+			RemoteIP:   e.Reply.Src.String(),
+			RemotePort: e.Reply.SrcPort,
+		}
+		if e.Reply.Dst != e.Orig.Src {
+			conn.NATIP = e.Reply.Dst.String()
+			conn.NATPort = e.Reply.DstPort
+		}
+	case c.isInternal(e.Reply.Src):
+		internal = e.Reply.Src
+		conn = Connection{
+			LocalIP:    e.Reply.Src.String(),
+			LocalPort:  e.Reply.SrcPort,
+			RemoteIP:   e.Orig.Src.String(),
+			RemotePort: e.Orig.SrcPort,
+		}
+		if e.Orig.Dst != e.Reply.Src {
+			conn.NATIP = e.Orig.Dst.String()
+			conn.NATPort = e.Orig.DstPort
+		}
+	default:
+		return Connection{}, false
+	}
+
+	conn.State = e.State
+	if conn.State == "" {
+		conn.State = strings.ToUpper(e.Protocol)
+	}
+	if !c.local.contains(internal) {
+		conn.Origin = internal.String()
+	}
+	return conn, true
+}
+
+// isInternal reports whether addr is this host or a private LAN address
+func (c *ConntrackCollector) isInternal(addr netip.Addr) bool {
+	return c.local.contains(addr) || isPrivateIP(addr.AsSlice())
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds backend settings read from NETOPS_* environment variables
+type Config struct {
+	Port      string
+	Collector string   // comma-separated: "ss", "conntrack", "containers", "netns" or "none"
+	Processes bool     // draw each local application as a node between this host and its peers
+	Netns     []string // network namespaces the netns and containers collectors read, empty for all
+
+	// Logging
+	LogLevel  string // debug, info, warn or error
+	LogFormat string // console format, "text" or "json"
+	LogBuffer int    // log messages kept for /logs clients and /api/logs
+
+	// WebSocket stream
+	WSBacklog     int  // /ws events kept for clients resuming after a reconnect
+	WSCompression bool // negotiate permessage-deflate with WebSocket clients
+
+	// Container attribution
+	CRISocket  string // CRI runtime socket, empty to look for containerd's, CRI-O's or cri-dockerd's
+	PodDir     string // directory of JSON pod manifests
+	DockerRoot string // Docker's data directory
+
+	// Threat intelligence
+	ThreatIntelDir     string        // directory of feed files, empty disables matching
+	ThreatIntelRefresh time.Duration // how often feed files are checked for changes
+
+	// Offline ASN and prefix data
+	ASNDir     string        // directory of pfx2as, MRT RIB, AS name and relationship files
+	ASNRefresh time.Duration // how often the files are checked for changes
+
+	// Published cloud and CDN ranges
+	CloudDir     string        // directory of AWS, GCP, Azure, Cloudflare, Fastly, Oracle and GitHub range files
+	CloudRefresh time.Duration // how often the files are checked for changes
+
+	// Security zones
+	ZonesFile    string        // JSON zone rules and zone-pair policy, empty disables zones
+	ZonesRefresh time.Duration // how often the file is checked for changes
+
+	// Egress policy
+	EgressPolicy    string        // versioned JSON allowlist of expected egress, empty disables checks
+	EgressMode      string        // "enforce" alerts on flows the policy doesn't allow, "learn" only records them
+	EgressHistory   string        // JSON-lines log of the flows seen, for learning and dry runs
+	EgressRetention time.Duration // how long history is kept
+	EgressRefresh   time.Duration // how often the policy file is checked for changes
+
+	// Behavioural baseline
+	Baseline          bool          // learn each host and process's usual egress and score scans against it
+	BaselineState     string        // file the model is saved to, empty to keep it in memory
+	BaselineWindow    time.Duration // how long the model remembers
+	BaselineWarmup    time.Duration // learning time before a host or process is scored
+	BaselineThreshold float64       // z-score of a connection count that is anomalous
+
+	// Name attribution
+	ReverseDNS bool   // perform PTR lookups for new nodes
+	DNSServer  string // "host:port" used for PTR lookups, empty for the system resolver
+	DNSWorkers int    // concurrent PTR lookups
+	DNSLog     string // dnsmasq query log to learn forward names from
+
+	// Passive packet capture
+	CaptureInterface string // interface for AF_PACKET capture
+	CapturePcap      string // pcap file to replay instead of a live interface
+
+	// Bandwidth accounting
+	TrafficSource string // "capture", "conntrack", or empty for capture when available
+	ConntrackPath string // conntrack table for counters and the conntrack collector
+
+	// Active connection-quality probing
+	Probe         bool          // measure latency and loss to remote peers
+	ProbeInterval time.Duration // time between rounds for each peer, jittered by 20%
+	ProbeCount    int           // probes per method in a round
+	ProbeRate     float64       // probes per second across all peers
+	ProbeTimeout  time.Duration // wait for a single reply
+	ProbeICMP     bool          // also send ICMP echoes where ping sockets are permitted
+
+	// Traceroute path discovery
+	Trace         bool          // trace routes to remote peers and draw their hops
+	TraceProtocol string        // "udp", "icmp" or "tcp"
+	TraceInterval time.Duration // time between traces of each peer, jittered by 20%
+	TraceMaxHops  int
+	TraceQueries  int           // probes per hop
+	TraceTimeout  time.Duration // wait for each probe
+
+	// Agent mode
+	AggregatorURL string        // ws(s)://host:port/agent of the central backend
+	AgentID       string        // defaults to the hostname
+	AgentToken    string        // bearer token presented to the aggregator
+	AgentInterval time.Duration // how often batches are pushed
+	AgentLat      float64       // optional location of this host on the map
+	AgentLng      float64
+	AgentCA       string // CA bundle to verify a wss:// aggregator with
+	AgentCert     string // client certificate for mTLS to the aggregator
+	AgentKey      string
+
+	// Aggregator side
+	AgentTokens []string // accepted agent tokens, "token" or "agentID:token"; empty disables /agent
+
+	// Authentication; with none of these set every client is an admin
+	APITokens      []string // static bearer tokens, "token", "viewer:token" or "admin:token"
+	AuthHtpasswd   string   // htpasswd file of bcrypt hashes for HTTP basic auth
+	AuthAdmins     []string // basic auth users and JWT subjects granted admin
+	JWKSFile       string   // JWKS file of the OIDC provider's signing keys
+	JWTIssuer      string   // required "iss" claim
+	JWTAudience    string   // required "aud" claim
+	JWTRolesClaim  string   // claim listing roles; "admin" grants admin
+	AllowedOrigins []string // browser origins allowed to connect, "*" for any
+
+	// TLS; without a certificate the server speaks plain HTTP
+	TLSCert     string // PEM certificate chain
+	TLSKey      string // PEM private key
+	TLSClientCA string // CA bundle that signs agent client certificates
+	TLSDev      bool   // generate a local CA and server certificate
+	TLSDevDir   string // where dev mode keeps its CA and certificates
+}
+
+// LoadConfig reads the configuration from the environment
+func LoadConfig() *Config {
+	return &Config{
+		Port:               envString("PORT", "8081"),
+		LogLevel:           envString("NETOPS_LOG_LEVEL", "info"),
+		LogFormat:          envString("NETOPS_LOG_FORMAT", "text"),
+		LogBuffer:          envInt("NETOPS_LOG_BUFFER", 5000),
+		WSBacklog:          envInt("NETOPS_WS_BACKLOG", 4096),
+		WSCompression:      envBool("NETOPS_WS_COMPRESSION", true),
+		Collector:          envString("NETOPS_COLLECTOR", "ss"),
+		Processes:          envBool("NETOPS_PROCESS_NODES", false),
+		Netns:              envList("NETOPS_NETNS"),
+		CRISocket:          envString("NETOPS_CRI_SOCKET", ""),
+		PodDir:             envString("NETOPS_POD_DIR", ""),
+		DockerRoot:         envString("NETOPS_DOCKER_ROOT", "/var/lib/docker"),
+		ThreatIntelDir:     envString("NETOPS_THREATINTEL_DIR", ""),
+		ThreatIntelRefresh: envDuration("NETOPS_THREATINTEL_REFRESH", 15*time.Minute),
+		ASNDir:             envString("NETOPS_ASN_DIR", ""),
+		ASNRefresh:         envDuration("NETOPS_ASN_REFRESH", time.Hour),
+		CloudDir:           envString("NETOPS_CLOUD_DIR", ""),
+		CloudRefresh:       envDuration("NETOPS_CLOUD_REFRESH", time.Hour),
+		ZonesFile:          envString("NETOPS_ZONES", ""),
+		ZonesRefresh:       envDuration("NETOPS_ZONES_REFRESH", time.Minute),
+		EgressPolicy:       envString("NETOPS_EGRESS_POLICY", ""),
+		EgressMode:         envString("NETOPS_EGRESS_MODE", egressEnforce),
+		EgressHistory:      envString("NETOPS_EGRESS_HISTORY", ""),
+		EgressRetention:    envDuration("NETOPS_EGRESS_RETENTION", 30*24*time.Hour),
+		EgressRefresh:      envDuration("NETOPS_EGRESS_REFRESH", time.Minute),
+		Baseline:           envBool("NETOPS_BASELINE", false),
+		BaselineState:      envString("NETOPS_BASELINE_STATE", "netops-baseline.json"),
+		BaselineWindow:     envDuration("NETOPS_BASELINE_WINDOW", 7*24*time.Hour),
+		BaselineWarmup:     envDuration("NETOPS_BASELINE_WARMUP", 24*time.Hour),
+		BaselineThreshold:  envFloat("NETOPS_BASELINE_THRESHOLD", 3),
+		ReverseDNS:         envBool("NETOPS_REVERSE_DNS", true),
+		DNSServer:          envString("NETOPS_DNS_SERVER", ""),
+		DNSWorkers:         envInt("NETOPS_DNS_WORKERS", 4),
+		DNSLog:             envString("NETOPS_DNS_LOG", ""),
+		CaptureInterface:   envString("NETOPS_CAPTURE_INTERFACE", ""),
+		CapturePcap:        envString("NETOPS_CAPTURE_PCAP", ""),
+		TrafficSource:      envString("NETOPS_TRAFFIC_SOURCE", ""),
+		ConntrackPath:      envString("NETOPS_CONNTRACK_PATH", DefaultConntrackPath),
+		Probe:              envBool("NETOPS_PROBE", false),
+		ProbeInterval:      envDuration("NETOPS_PROBE_INTERVAL", time.Minute),
+		ProbeCount:         envInt("NETOPS_PROBE_COUNT", 5),
+		ProbeRate:          envFloat("NETOPS_PROBE_RATE", 20),
+		ProbeTimeout:       envDuration("NETOPS_PROBE_TIMEOUT", 2*time.Second),
+		ProbeICMP:          envBool("NETOPS_PROBE_ICMP", true),
+		Trace:              envBool("NETOPS_TRACE", false),
+		TraceProtocol:      envString("NETOPS_TRACE_PROTOCOL", "udp"),
+		TraceInterval:      envDuration("NETOPS_TRACE_INTERVAL", 10*time.Minute),
+		TraceMaxHops:       envInt("NETOPS_TRACE_MAX_HOPS", 30),
+		TraceQueries:       envInt("NETOPS_TRACE_QUERIES", 3),
+		TraceTimeout:       envDuration("NETOPS_TRACE_TIMEOUT", time.Second),
+		AggregatorURL:      envString("NETOPS_AGGREGATOR_URL", ""),
+		AgentID:            envString("NETOPS_AGENT_ID", ""),
+		AgentToken:         envString("NETOPS_AGENT_TOKEN", ""),
+		AgentInterval:      envDuration("NETOPS_AGENT_INTERVAL", 5*time.Second),
+		AgentLat:           envFloat("NETOPS_AGENT_LAT", 0),
+		AgentLng:           envFloat("NETOPS_AGENT_LNG", 0),
+		AgentCA:            envString("NETOPS_AGENT_CA", ""),
+		AgentCert:          envString("NETOPS_AGENT_CERT", ""),
+		AgentKey:           envString("NETOPS_AGENT_KEY", ""),
+		AgentTokens:        envList("NETOPS_AGENT_TOKENS"),
+		APITokens:          envList("NETOPS_API_TOKENS"),
+		AuthHtpasswd:       envString("NETOPS_AUTH_HTPASSWD", ""),
+		AuthAdmins:         envList("NETOPS_AUTH_ADMINS"),
+		JWKSFile:           envString("NETOPS_JWKS_FILE", ""),
+		JWTIssuer:          envString("NETOPS_JWT_ISSUER", ""),
+		JWTAudience:        envString("NETOPS_JWT_AUDIENCE", ""),
+		JWTRolesClaim:      envString("NETOPS_JWT_ROLES_CLAIM", "roles"),
+		AllowedOrigins:     envList("NETOPS_ALLOWED_ORIGINS"),
+		TLSCert:            envString("NETOPS_TLS_CERT", ""),
+		TLSKey:             envString("NETOPS_TLS_KEY", ""),
+		TLSClientCA:        envString("NETOPS_TLS_CLIENT_CA", ""),
+		TLSDev:             envBool("NETOPS_TLS_DEV", false),
+		TLSDevDir:          envString("NETOPS_TLS_DEV_DIR", "netops-dev-ca"),
+	}
+}
+
+// envString returns the value of key, or def when it is unset
+func envString(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// envDuration parses key as a time.Duration, falling back to def
+func envDuration(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
+// envInt parses key as an integer, falling back to def
+func envInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+// envFloat parses key as a float, falling back to def
+func envFloat(key string, def float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return def
+}
+
+// envList splits a comma-separated value, dropping empty items
+func envList(key string) []string {
+	var out []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// envBool parses key as a boolean, falling back to def
+func envBool(key string, def bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultConntrackPath is where netfilter exposes its connection table
+const DefaultConntrackPath = "/proc/net/nf_conntrack"
+
+// ConntrackTuple is one direction of a conntrack entry. Packet and byte
+// counters are only present when net.netfilter.nf_conntrack_acct is enabled.
+type ConntrackTuple struct {
+	Src     netip.Addr
+	Dst     netip.Addr
+	SrcPort int
+	DstPort int
+	Packets uint64
+	Bytes   uint64
+}
+
+// ConntrackEntry is a tracked flow with its original and reply tuples. For
+// NATed flows the two differ: the original tuple holds the internal client,
+// the reply tuple the translated addresses.
+type ConntrackEntry struct {
+	Protocol string // tcp, udp, icmp, ...
+	State    string // TCP state, empty for stateless protocols
+	Orig     ConntrackTuple
+	Reply    ConntrackTuple
+}
+
+// Key identifies the flow across reads of the table
+func (e *ConntrackEntry) Key() string {
+	return fmt.Sprintf("%s %s:%d>%s:%d", e.Protocol, e.Orig.Src, e.Orig.SrcPort, e.Orig.Dst, e.Orig.DstPort)
+}
+
+// ReadConntrack parses the conntrack table at path
+func ReadConntrack(path string) ([]ConntrackEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open conntrack table: %w", err)
+	}
+	defer file.Close()
+
+	var entries []ConntrackEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 4096), 64*1024)
+	for scanner.Scan() {
+		if entry, ok := parseConntrackLine(scanner.Text()); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// parseConntrackLine parses a /proc/net/nf_conntrack line such as
+//
+//	ipv4 2 tcp 6 431999 ESTABLISHED src=192.168.1.50 dst=140.82.112.5 sport=37518 dport=443 packets=10 bytes=1234 src=140.82.112.5 dst=203.0.113.7 sport=443 dport=37518 packets=8 bytes=5678 [ASSURED] mark=0 use=2
+//
+// The first src/dst/sport/dport/packets/bytes group is the original
+// direction, the second the reply direction.
+func parseConntrackLine(line string) (ConntrackEntry, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 6 {
+		return ConntrackEntry{}, false
+	}
+
+	entry := ConntrackEntry{Protocol: fields[2]}
+	rest := fields[5:]
+	if !strings.Contains(rest[0], "=") {
+		entry.State = rest[0]
+		rest = rest[1:]
+	}
+
+	tuple := &entry.Orig
+	seenSrc := 0
+	for _, field := range rest {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "src":
+			seenSrc++
+			if seenSrc == 2 {
+				tuple = &entry.Reply
+			}
+			tuple.Src, _ = netip.ParseAddr(value)
+		case "dst":
+			tuple.Dst, _ = netip.ParseAddr(value)
+		case "sport":
+			tuple.SrcPort, _ = strconv.Atoi(value)
+		case "dport":
+			tuple.DstPort, _ = strconv.Atoi(value)
+		case "packets":
+			tuple.Packets, _ = strconv.ParseUint(value, 10, 64)
+		case "bytes":
+			tuple.Bytes, _ = strconv.ParseUint(value, 10, 64)
+		}
+	}
+
+	if !entry.Orig.Src.IsValid() || !entry.Reply.Src.IsValid() {
+		return ConntrackEntry{}, false
+	}
+	entry.Orig.Src = entry.Orig.Src.Unmap()
+	entry.Orig.Dst = entry.Orig.Dst.Unmap()
+	entry.Reply.Src = entry.Reply.Src.Unmap()
+	entry.Reply.Dst = entry.Reply.Dst.Unmap()
+	return entry, true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadConntrack(t *testing.T) {
+	entries, err := ReadConntrack(filepath.Join("testdata", "conntrack", "nf_conntrack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuple := func(src string, sport int, dst string, dport int, packets, bytes uint64) ConntrackTuple {
+		return ConntrackTuple{Src: netip.MustParseAddr(src), SrcPort: sport, Dst: netip.MustParseAddr(dst), DstPort: dport,
+			Packets: packets, Bytes: bytes}
+	}
+
+	// Unreplied flows and lines too short to hold a flow are skipped
+	if len(entries) != 9 {
+		t.Fatalf("%d entries, want 9", len(entries))
+	}
+	tests := []struct {
+		line int
+		want ConntrackEntry
+	}{
+		// SNAT, with accounting
+		{0, ConntrackEntry{Protocol: "tcp", State: "ESTABLISHED",
+			Orig:  tuple("192.168.1.50", 37518, "140.82.112.5", 443, 10, 1234),
+			Reply: tuple("140.82.112.5", 443, "203.0.113.7", 37518, 8, 5678)}},
+		// No state, and a translated port
+		{1, ConntrackEntry{Protocol: "udp",
+			Orig:  tuple("192.168.1.52", 6000, "1.1.1.1", 53, 0, 0),
+			Reply: tuple("1.1.1.1", 53, "203.0.113.7", 61000, 0, 0)}},
+		{4, ConntrackEntry{Protocol: "tcp", State: "ESTABLISHED",
+			Orig:  tuple("2001:db8::7", 44000, "2606:4700::1111", 443, 0, 0),
+			Reply: tuple("2606:4700::1111", 443, "2001:db8::7", 44000, 0, 0)}},
+		// ICMP has no ports
+		{6, ConntrackEntry{Protocol: "icmp",
+			Orig:  tuple("192.168.1.50", 0, "8.8.8.8", 0, 0, 0),
+			Reply: tuple("8.8.8.8", 0, "203.0.113.7", 0, 0, 0)}},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(entries[tt.line], tt.want) {
+			t.Errorf("entry %d:\n got %+v\nwant %+v", tt.line, entries[tt.line], tt.want)
+		}
+	}
+	if key := entries[0].Key(); key != "tcp 192.168.1.50:37518>140.82.112.5:443" {
+		t.Errorf("Key = %q", key)
+	}
+
+	if _, err := ReadConntrack(filepath.Join("testdata", "conntrack", "missing")); err == nil {
+		t.Error("reading a missing table succeeded")
+	}
+}
+
+func TestParseConntrackLine(t *testing.T) {
+	tests := []struct {
+		line string
+		ok   bool
+	}{
+		{"ipv4 2 tcp 6 431999 ESTABLISHED src=10.0.0.1 dst=192.0.2.1 sport=1 dport=2 src=192.0.2.1 dst=10.0.0.1 sport=2 dport=1", true},
+		{"ipv6 10 udp 17 29 src=::ffff:10.0.0.1 dst=2001:db8::1 sport=1 dport=2 src=2001:db8::1 dst=::ffff:10.0.0.1 sport=2 dport=1", true},
+		{"ipv4 2 tcp 6 431999 ESTABLISHED src=10.0.0.1 dst=192.0.2.1 sport=1 dport=2 [UNREPLIED]", false},
+		{"ipv4 2 tcp 6 431999 ESTABLISHED src=10.0.0.1 dst=192.0.2.1 sport=1 dport=2 src=bogus dst=10.0.0.1 sport=2 dport=1", false},
+		{"ipv4 2 tcp 6 431999", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		entry, ok := parseConntrackLine(tt.line)
+		if ok != tt.ok {
+			t.Errorf("%q: ok = %v, want %v", tt.line, ok, tt.ok)
+		}
+		// Mapped IPv4 addresses are unmapped
+		if ok && (!entry.Orig.Src.Is4() || entry.Reply.Dst != entry.Orig.Src) {
+			t.Errorf("%q: %+v", tt.line, entry)
+		}
+	}
+}
+
+func TestConntrackCollector(t *testing.T) {
+	c := NewConntrackCollector(filepath.Join("testdata", "conntrack", "nf_conntrack"))
+	c.local = testLocalAddrs("203.0.113.7", "2001:db8::7")
+	got, err := c.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Connection{
+		// A LAN client behind SNAT
+		{LocalIP: "192.168.1.50", LocalPort: 37518, RemoteIP: "140.82.112.5", RemotePort: 443, State: "ESTABLISHED",
+			Origin: "192.168.1.50", NATIP: "203.0.113.7", NATPort: 37518},
+		{LocalIP: "192.168.1.52", LocalPort: 6000, RemoteIP: "1.1.1.1", RemotePort: 53, State: "UDP",
+			Origin: "192.168.1.52", NATIP: "203.0.113.7", NATPort: 61000},
+		// A public client DNATed to an internal server
+		{LocalIP: "192.168.1.60", LocalPort: 80, RemoteIP: "198.51.100.20", RemotePort: 40000, State: "ESTABLISHED",
+			Origin: "192.168.1.60", NATIP: "203.0.113.7", NATPort: 8080},
+		// This host's own connections have no origin and no NAT
+		{LocalIP: "203.0.113.7", LocalPort: 52000, RemoteIP: "93.184.215.14", RemotePort: 443, State: "ESTABLISHED"},
+		{LocalIP: "2001:db8::7", LocalPort: 44000, RemoteIP: "2606:4700::1111", RemotePort: 443, State: "ESTABLISHED"},
+		// Closing TCP flows, ICMP, LAN-only and transit flows are left out
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("connections:\n got %+v\nwant %+v", got, want)
+	}
+}
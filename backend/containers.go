@@ -0,0 +1,462 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ContainerInfo is what the container runtime and Kubernetes say about a
+// container
+type ContainerInfo struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name,omitempty"`
+	Image     string            `json:"image,omitempty"`
+	Runtime   string            `json:"runtime,omitempty"` // docker, containerd, crio or podman
+	Pod       string            `json:"pod,omitempty"`
+	Namespace string            `json:"namespace,omitempty"` // Kubernetes namespace
+	Labels    map[string]string `json:"labels,omitempty"`    // pod labels, or container labels outside Kubernetes
+}
+
+// merge fills fields that are still empty from other
+func (c *ContainerInfo) merge(other *ContainerInfo) {
+	if other == nil {
+		return
+	}
+	c.Name = cmp.Or(c.Name, other.Name)
+	c.Image = cmp.Or(c.Image, other.Image)
+	c.Pod = cmp.Or(c.Pod, other.Pod)
+	c.Namespace = cmp.Or(c.Namespace, other.Namespace)
+	if len(c.Labels) == 0 {
+		c.Labels = other.Labels
+	}
+}
+
+// WorkloadSource looks up a container's name, image and pod. podUID is
+// the pod the container's cgroup places it in, "" outside Kubernetes.
+// Sources return nil for containers they don't know.
+type WorkloadSource interface {
+	Container(id, podUID string) *ContainerInfo
+}
+
+// containerRuntimes maps cgroup path prefixes to the runtime using them
+var containerRuntimes = []struct{ prefix, runtime string }{
+	{"docker-", "docker"},
+	{"cri-containerd-", "containerd"},
+	{"crio-", "crio"},
+	{"libpod-", "podman"},
+}
+
+// parseContainerCgroup finds the container ID, runtime and Kubernetes pod
+// UID in a cgroup path such as
+//
+//	/system.slice/docker-<id>.scope
+//	/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod<uid>.slice/cri-containerd-<id>.scope
+//	/kubepods/burstable/pod<uid>/<id>
+//	/docker/<id>
+func parseContainerCgroup(path string) (id, runtime, podUID string) {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		part = strings.TrimSuffix(strings.TrimSuffix(part, ".scope"), ".slice")
+		if j := strings.LastIndex(part, "-pod"); j >= 0 && strings.HasPrefix(part, "kubepods") {
+			podUID = strings.ReplaceAll(part[j+len("-pod"):], "_", "-")
+		} else if uid, ok := strings.CutPrefix(part, "pod"); ok && len(uid) == 36 {
+			podUID = uid
+		}
+		for _, r := range containerRuntimes {
+			if rest, ok := strings.CutPrefix(part, r.prefix); ok && isContainerID(rest) {
+				id, runtime = rest, r.runtime
+			}
+		}
+		if isContainerID(part) {
+			id = part
+			if i > 0 && parts[i-1] == "docker" {
+				runtime = "docker"
+			}
+		}
+	}
+	return id, runtime, podUID
+}
+
+// isContainerID reports whether s is a full 64-digit hex container ID
+func isContainerID(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// processContainer returns the container a process runs in, from its
+// cgroup, with the pod UID when it is part of a Kubernetes pod
+func processContainer(pid int) (id, runtime, podUID string) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", "", ""
+	}
+	for line := range strings.Lines(string(data)) {
+		fields := strings.SplitN(strings.TrimSpace(line), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if id, runtime, podUID = parseContainerCgroup(fields[2]); id != "" {
+			return id, runtime, podUID
+		}
+	}
+	return "", "", ""
+}
+
+// containerIDPrefix starts the node ID of every container
+const containerIDPrefix = "container:"
+
+// containerNodeID is the node ID of a container: its short ID
+func containerNodeID(id string) string {
+	return containerIDPrefix + id[:12]
+}
+
+// ContainerCollector reports the connections of containers on this host.
+// It reads the socket table of every network namespace other than the
+// host's, so it sees containers without running inside them, and
+// attributes each socket to the container of the process holding it. Each
+// container is the origin of its connections.
+type ContainerCollector struct {
+	source         WorkloadSource
+	netns          []string // NETOPS_NETNS, empty for all
+	includePrivate bool
+
+	containers map[string]*ContainerInfo // by container ID, kept while running
+	nodes      map[string]*NetworkNode   // by node ID, for DescribeOrigin
+	mu         sync.RWMutex
+}
+
+// NewContainerCollector resolves container metadata from source and
+// captures the namespaces in netns, or all when it is empty.
+// includePrivate keeps connections to private addresses outside this host.
+func NewContainerCollector(source WorkloadSource, netns []string, includePrivate bool) *ContainerCollector {
+	return &ContainerCollector{
+		source:         source,
+		netns:          netns,
+		includePrivate: includePrivate,
+		containers:     make(map[string]*ContainerInfo),
+		nodes:          make(map[string]*NetworkNode),
+	}
+}
+
+func (c *ContainerCollector) Name() string { return "containers" }
+
+func (c *ContainerCollector) Collect() ([]Connection, error) {
+	namespaces, err := listNamespaces(c.netns)
+	if err != nil {
+		return nil, fmt.Errorf("list network namespaces: %w", err)
+	}
+	host := hostNetns()
+
+	seen := make(map[string]bool) // container IDs running now
+	var sockets []nsSocket
+	for _, ns := range namespaces {
+		if ns.Inode == host {
+			continue // this host's sockets are the ss collector's
+		}
+		// Each process's container, and the one that owns the namespace's
+		// unattributed sockets: the lowest ID, so it stays the same
+		containers := make(map[int]string, len(ns.PIDs))
+		owner := ""
+		for _, pid := range ns.PIDs {
+			id, runtime, podUID := processContainer(pid)
+			if id == "" {
+				continue
+			}
+			containers[pid] = id
+			if owner == "" || id < owner {
+				owner = id
+			}
+			if !seen[id] {
+				seen[id] = true
+				c.resolve(id, runtime, podUID)
+			}
+		}
+		if owner == "" {
+			continue // not a container's namespace
+		}
+
+		table, err := readNamespaceSockets(ns)
+		if err != nil {
+			slog.Debug("Reading namespace sockets failed", "component", "collector", "netns", ns.Label(), "error", err)
+			continue
+		}
+		owners := socketOwners(ns.PIDs)
+		for _, s := range table {
+			sock := nsSocket{procSocket: s, origin: containerNodeID(owner), netns: ns.Label()}
+			if pid, ok := owners[s.Inode]; ok {
+				sock.pid = pid
+				if id, ok := containers[pid]; ok {
+					sock.origin = containerNodeID(id)
+				}
+			}
+			sockets = append(sockets, sock)
+		}
+	}
+
+	addrs := namespaceAddrs(sockets)
+	c.mu.Lock()
+	for id := range c.containers {
+		if !seen[id] {
+			delete(c.containers, id)
+		}
+	}
+	c.nodes = make(map[string]*NetworkNode, len(seen))
+	for id := range seen {
+		info := c.containers[id]
+		node := &NetworkNode{
+			ID:        containerNodeID(id),
+			Name:      containerNodeName(info),
+			Type:      "container",
+			Status:    "online",
+			Internal:  true,
+			Container: info,
+		}
+		node.IPAddress = nodeAddress(addrs, node.ID)
+		c.nodes[node.ID] = node
+	}
+	c.mu.Unlock()
+
+	return namespaceConnections(sockets, c.includePrivate), nil
+}
+
+// resolve looks a new container up in the workload sources
+func (c *ContainerCollector) resolve(id, runtime, podUID string) {
+	c.mu.RLock()
+	_, known := c.containers[id]
+	c.mu.RUnlock()
+	if known {
+		return
+	}
+	info := &ContainerInfo{ID: id, Runtime: runtime}
+	if c.source != nil {
+		info.merge(c.source.Container(id, podUID))
+	}
+	slog.Info("Container found", "component", "collector", "id", id[:12], "name", info.Name, "image", info.Image, "pod", info.Pod, "namespace", info.Namespace)
+	c.mu.Lock()
+	c.containers[id] = info
+	c.mu.Unlock()
+}
+
+// containerNodeName is "namespace/pod/container" for Kubernetes and the
+// container name elsewhere
+func containerNodeName(info *ContainerInfo) string {
+	if info.Pod != "" {
+		return strings.Join(slices.DeleteFunc([]string{info.Namespace, info.Pod, info.Name}, func(s string) bool { return s == "" }), "/")
+	}
+	return cmp.Or(info.Name, info.ID[:12])
+}
+
+// DescribeOrigin builds the node for a container
+func (c *ContainerCollector) DescribeOrigin(id string) *NetworkNode {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if node, ok := c.nodes[id]; ok {
+		n := *node
+		return &n
+	}
+	return nil
+}
+
+// workloadSources asks each source in turn, filling in what earlier ones
+// left out
+type workloadSources []WorkloadSource
+
+func (s workloadSources) Container(id, podUID string) *ContainerInfo {
+	var info *ContainerInfo
+	for _, source := range s {
+		found := source.Container(id, podUID)
+		if found == nil {
+			continue
+		}
+		if info == nil {
+			copied := *found // sources may cache what they return
+			info = &copied
+		} else {
+			info.merge(found)
+		}
+	}
+	return info
+}
+
+// NewWorkloadSource combines the CRI socket and kubelet pod directory,
+// when there are ones, with the state files Docker, containerd and CRI-O
+// keep on disk. An empty criSocket is looked for in the usual places.
+func NewWorkloadSource(criSocket, podDir, dockerRoot string) WorkloadSource {
+	sources := workloadSources{}
+	if criSocket == "" {
+		criSocket = findCRISocket()
+	}
+	if criSocket != "" {
+		sources = append(sources, NewCRIClient(criSocket))
+	}
+	if podDir != "" {
+		sources = append(sources, podManifestSource{dir: podDir})
+	}
+	return append(sources, dockerSource{root: dockerRoot}, ociBundleSource{})
+}
+
+// dockerSource reads the config Docker keeps for each container
+type dockerSource struct {
+	root string // usually /var/lib/docker
+}
+
+func (d dockerSource) Container(id, _ string) *ContainerInfo {
+	data, err := os.ReadFile(filepath.Join(d.root, "containers", id, "config.v2.json"))
+	if err != nil {
+		return nil
+	}
+	var config struct {
+		Name   string
+		Config struct {
+			Image  string
+			Labels map[string]string
+		}
+	}
+	if json.Unmarshal(data, &config) != nil {
+		return nil
+	}
+	info := &ContainerInfo{
+		ID:     id,
+		Name:   strings.TrimPrefix(config.Name, "/"),
+		Image:  config.Config.Image,
+		Labels: config.Config.Labels,
+	}
+	// Kubernetes on Docker (cri-dockerd) labels its containers
+	if pod := config.Config.Labels["io.kubernetes.pod.name"]; pod != "" {
+		info.Pod = pod
+		info.Namespace = config.Config.Labels["io.kubernetes.pod.namespace"]
+		info.Name = cmp.Or(config.Config.Labels["io.kubernetes.container.name"], info.Name)
+		info.Labels = nil // container labels, not the pod's
+	}
+	return info
+}
+
+// ociBundleSource reads the annotations containerd and CRI-O write into
+// each container's OCI runtime config. They name the pod but don't carry
+// its labels.
+type ociBundleSource struct{}
+
+// ociBundlePaths are where the runtimes keep the config, with %s for the ID
+var ociBundlePaths = []string{
+	"/run/containerd/io.containerd.runtime.v2.task/*/%s/config.json",
+	"/run/containers/storage/overlay-containers/%s/userdata/config.json",
+}
+
+func (ociBundleSource) Container(id, _ string) *ContainerInfo {
+	for _, pattern := range ociBundlePaths {
+		matches, _ := filepath.Glob(fmt.Sprintf(pattern, id))
+		for _, path := range matches {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			var spec struct {
+				Annotations map[string]string `json:"annotations"`
+			}
+			if json.Unmarshal(data, &spec) != nil {
+				continue
+			}
+			a := spec.Annotations
+			return &ContainerInfo{
+				ID:        id,
+				Name:      cmp.Or(a["io.kubernetes.cri.container-name"], a["io.kubernetes.container.name"], a["nerdctl/name"]),
+				Image:     cmp.Or(a["io.kubernetes.cri.image-name"], a["io.kubernetes.cri-o.ImageName"]),
+				Pod:       cmp.Or(a["io.kubernetes.cri.sandbox-name"], a["io.kubernetes.pod.name"]),
+				Namespace: cmp.Or(a["io.kubernetes.cri.sandbox-namespace"], a["io.kubernetes.pod.namespace"]),
+			}
+		}
+	}
+	return nil
+}
+
+// containerSocketPaths are the CRI sockets looked for when none is
+// configured
+var containerSocketPaths = []string{
+	"/run/containerd/containerd.sock",
+	"/run/crio/crio.sock",
+	"/run/cri-dockerd.sock",
+}
+
+// findCRISocket returns the first CRI socket present on this host
+func findCRISocket() string {
+	for _, path := range containerSocketPaths {
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			return path
+		}
+	}
+	return ""
+}
+
+// podManifestSource reads pods from a directory of JSON Pod or PodList
+// manifests, such as a kubelet's static pods or saved "kubectl get pods
+// -o json" output. A container is matched by the container ID in the pod
+// status, or else by the pod UID from its cgroup.
+type podManifestSource struct {
+	dir string
+}
+
+// podManifest is the part of a Pod kept
+type podManifest struct {
+	Metadata struct {
+		Name      string            `json:"name"`
+		Namespace string            `json:"namespace"`
+		UID       string            `json:"uid"`
+		Labels    map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Status struct {
+		ContainerStatuses []struct {
+			Name        string `json:"name"`
+			Image       string `json:"image"`
+			ContainerID string `json:"containerID"` // "containerd://<id>"
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+func (p podManifestSource) Container(id, podUID string) *ContainerInfo {
+	paths, _ := filepath.Glob(filepath.Join(p.dir, "*.json"))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var manifest struct {
+			podManifest
+			Items []podManifest `json:"items"`
+		}
+		if json.Unmarshal(data, &manifest) != nil {
+			continue
+		}
+		for _, pod := range append(manifest.Items, manifest.podManifest) {
+			info := &ContainerInfo{
+				ID:        id,
+				Pod:       pod.Metadata.Name,
+				Namespace: cmp.Or(pod.Metadata.Namespace, "default"),
+				Labels:    pod.Metadata.Labels,
+			}
+			for _, status := range pod.Status.ContainerStatuses {
+				if _, cid, _ := strings.Cut(status.ContainerID, "://"); cid == id {
+					info.Name, info.Image = status.Name, status.Image
+					return info
+				}
+			}
+			if podUID != "" && pod.Metadata.UID == podUID {
+				return info
+			}
+		}
+	}
+	return nil
+}
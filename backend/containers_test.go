@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseContainerCgroup(t *testing.T) {
+	id := strings.Repeat("0123abcd", 8)
+	uid := "0d2c3f4e-5a6b-4c7d-8e9f-a0b1c2d3e4f5"
+	tests := []struct {
+		path                string
+		id, runtime, podUID string
+	}{
+		{"/system.slice/docker-" + id + ".scope", id, "docker", ""},
+		{"/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" + strings.ReplaceAll(uid, "-", "_") +
+			".slice/cri-containerd-" + id + ".scope", id, "containerd", uid},
+		{"/kubepods/burstable/pod" + uid + "/" + id, id, "", uid},
+		{"/docker/" + id, id, "docker", ""},
+		{"/machine.slice/libpod-" + id + ".scope", id, "podman", ""},
+		{"/user.slice/user-1000.slice/session-2.scope", "", "", ""},
+		{"/system.slice/docker-" + id[:12] + ".scope", "", "", ""},
+	}
+	for _, tt := range tests {
+		id, runtime, podUID := parseContainerCgroup(tt.path)
+		if id != tt.id || runtime != tt.runtime || podUID != tt.podUID {
+			t.Errorf("parseContainerCgroup(%s) = %q, %q, %q", tt.path, id, runtime, podUID)
+		}
+	}
+}
+
+func TestPodManifestSource(t *testing.T) {
+	pods := podManifestSource{dir: filepath.Join("testdata", "pods")}
+	id := func(digit string) string { return strings.Repeat(digit, 64) }
+
+	tests := []struct {
+		name       string
+		id, podUID string
+		want       *ContainerInfo
+	}{
+		{"static pod", id("1"), "", &ContainerInfo{
+			ID: id("1"), Name: "kube-proxy", Image: "registry.k8s.io/kube-proxy:v1.34.1",
+			Pod: "kube-proxy-node1", Namespace: "kube-system",
+			Labels: map[string]string{"k8s-app": "kube-proxy", "tier": "node"},
+		}},
+		{"pod list", id("3"), "", &ContainerInfo{
+			ID: id("3"), Name: "exporter", Image: "nginx/nginx-prometheus-exporter:1.4",
+			Pod: "web-5d8f7c", Namespace: "shop", Labels: map[string]string{"app": "web"},
+		}},
+		// Matched by the cgroup's pod UID when the status doesn't list the
+		// container; the namespace defaults
+		{"by pod UID", id("4"), "9e8d7c6b-5a4f-4e3d-2c1b-0a9f8e7d6c5b", &ContainerInfo{
+			ID: id("4"), Pod: "batch-job", Namespace: "default",
+		}},
+		{"unknown", id("5"), "", nil},
+		{"unknown pod", id("5"), "11111111-2222-3333-4444-555555555555", nil},
+	}
+	for _, tt := range tests {
+		if got := pods.Container(tt.id, tt.podUID); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWorkloadSourcesMerge(t *testing.T) {
+	fake := newFakeCRI()
+	// The runtime knows the container but has lost its sandbox
+	fake.sandboxes = nil
+	fake.containers = [][]byte{criContainer(strings.Repeat("2", 64), "sb-web", "nginx", "docker.io/library/nginx:1.29")}
+	source := NewWorkloadSource(startFakeCRI(t, fake), filepath.Join("testdata", "pods"), t.TempDir())
+
+	// The CRI's name and image win; the manifest fills in the pod
+	want := &ContainerInfo{
+		ID: strings.Repeat("2", 64), Name: "nginx", Image: "docker.io/library/nginx:1.29",
+		Pod: "web-5d8f7c", Namespace: "shop", Labels: map[string]string{"app": "web"},
+	}
+	if got := source.Container(strings.Repeat("2", 64), ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("merged = %+v, want %+v", got, want)
+	}
+	if got := source.Container(strings.Repeat("e", 64), ""); got != nil {
+		t.Errorf("unknown container = %+v", got)
+	}
+}
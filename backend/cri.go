@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"iter"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// criRefreshInterval bounds how often an unknown container makes the CRI
+// client list everything again
+const criRefreshInterval = 10 * time.Second
+
+// CRIClient asks the kubelet's container runtime (containerd, CRI-O or
+// cri-dockerd) over its CRI socket which pod each container belongs to.
+// It speaks just enough gRPC for the two list calls it makes, so it needs
+// no generated code.
+type CRIClient struct {
+	socket string
+	client *http.Client
+
+	containers map[string]*ContainerInfo // by container ID
+	refreshed  time.Time
+	mu         sync.Mutex
+}
+
+// NewCRIClient creates a client for the CRI socket at path
+func NewCRIClient(path string) *CRIClient {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+		Protocols: new(http.Protocols),
+	}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return &CRIClient{
+		socket:     path,
+		client:     &http.Client{Transport: transport, Timeout: 5 * time.Second},
+		containers: make(map[string]*ContainerInfo),
+	}
+}
+
+// Container returns what the runtime knows about a container. A container
+// not seen before triggers a new listing, at most every few seconds.
+func (c *CRIClient) Container(id, podUID string) *ContainerInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if info, ok := c.containers[id]; ok {
+		return info
+	}
+	if time.Since(c.refreshed) < criRefreshInterval {
+		return nil
+	}
+	c.refreshed = time.Now()
+	containers, err := c.list()
+	if err != nil {
+		slog.Warn("Listing CRI containers failed", "component", "collector", "socket", c.socket, "error", err)
+		return nil
+	}
+	c.containers = containers
+	return c.containers[id]
+}
+
+// list fetches every container and pod sandbox and joins them
+func (c *CRIClient) list() (map[string]*ContainerInfo, error) {
+	sandboxes, err := c.call("ListPodSandbox")
+	if err != nil {
+		return nil, err
+	}
+	pods := make(map[string]criPod)
+	for _, msg := range protoRepeated(sandboxes, 1) {
+		pod := parseCRIPod(msg)
+		pods[pod.id] = pod
+	}
+
+	list, err := c.call("ListContainers")
+	if err != nil {
+		return nil, err
+	}
+	containers := make(map[string]*ContainerInfo)
+	for _, msg := range protoRepeated(list, 1) {
+		info, sandbox := parseCRIContainer(msg)
+		if pod, ok := pods[sandbox]; ok {
+			info.Pod, info.Namespace, info.Labels = pod.name, pod.namespace, pod.labels
+		}
+		containers[info.ID] = info
+	}
+	return containers, nil
+}
+
+// call makes a RuntimeService call with an empty (unfiltered) request and
+// returns the response message
+func (c *CRIClient) call(method string) ([]byte, error) {
+	// A gRPC message is framed by a compression flag and a length; the
+	// request message is empty
+	req, err := http.NewRequest("POST", "http://cri/runtime.v1.RuntimeService/"+method, strings.NewReader("\x00\x00\x00\x00\x00"))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: HTTP %d", method, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		return nil, err
+	}
+	// The status is in the trailers, or in the headers of an error
+	// returned before any message
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		return nil, fmt.Errorf("%s: grpc status %s %s", method, status, message)
+	}
+	if len(body) < 5 {
+		return nil, fmt.Errorf("%s: short response", method)
+	}
+	if body[0] != 0 {
+		return nil, fmt.Errorf("%s: compressed response", method)
+	}
+	size := binary.BigEndian.Uint32(body[1:5])
+	if int(size) > len(body)-5 {
+		return nil, fmt.Errorf("%s: truncated response", method)
+	}
+	return body[5 : 5+size], nil
+}
+
+// criPod is the part of a PodSandbox message kept
+type criPod struct {
+	id, name, namespace string
+	labels              map[string]string
+}
+
+// parseCRIPod decodes a PodSandbox: id = 1, metadata = 2 {name = 1,
+// uid = 2, namespace = 3}, labels = 5
+func parseCRIPod(msg []byte) criPod {
+	pod := criPod{}
+	for num, value := range protoFields(msg) {
+		switch num {
+		case 1:
+			pod.id = string(value)
+		case 2:
+			for num, value := range protoFields(value) {
+				switch num {
+				case 1:
+					pod.name = string(value)
+				case 3:
+					pod.namespace = string(value)
+				}
+			}
+		case 5:
+			pod.labels = protoMapEntry(pod.labels, value)
+		}
+	}
+	pod.labels = withoutKubernetesLabels(pod.labels)
+	return pod
+}
+
+// parseCRIContainer decodes a Container: id = 1, pod_sandbox_id = 2,
+// metadata = 3 {name = 1}, image = 4 {image = 1}
+func parseCRIContainer(msg []byte) (*ContainerInfo, string) {
+	info := &ContainerInfo{}
+	sandbox := ""
+	for num, value := range protoFields(msg) {
+		switch num {
+		case 1:
+			info.ID = string(value)
+		case 2:
+			sandbox = string(value)
+		case 3:
+			for num, value := range protoFields(value) {
+				if num == 1 {
+					info.Name = string(value)
+				}
+			}
+		case 4:
+			for num, value := range protoFields(value) {
+				if num == 1 {
+					info.Image = string(value)
+				}
+			}
+		}
+	}
+	return info, sandbox
+}
+
+// withoutKubernetesLabels drops the io.kubernetes.* bookkeeping labels
+// runtimes add, leaving the ones from the pod spec
+func withoutKubernetesLabels(labels map[string]string) map[string]string {
+	for key := range labels {
+		if strings.HasPrefix(key, "io.kubernetes.") {
+			delete(labels, key)
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// protoFields iterates over the length-delimited fields of a protobuf
+// message, which are all CRI strings and sub-messages need. Other wire
+// types are skipped, and iteration stops at malformed input.
+func protoFields(msg []byte) iter.Seq2[int, []byte] {
+	return func(yield func(int, []byte) bool) {
+		for len(msg) > 0 {
+			tag, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return
+			}
+			msg = msg[n:]
+			var value []byte
+			switch tag & 7 {
+			case 0: // varint
+				_, n = binary.Uvarint(msg)
+				if n <= 0 {
+					return
+				}
+				msg = msg[n:]
+				continue
+			case 1: // 64-bit
+				if len(msg) < 8 {
+					return
+				}
+				msg = msg[8:]
+				continue
+			case 5: // 32-bit
+				if len(msg) < 4 {
+					return
+				}
+				msg = msg[4:]
+				continue
+			case 2:
+				size, n := binary.Uvarint(msg)
+				if n <= 0 || size > uint64(len(msg)-n) {
+					return
+				}
+				value, msg = msg[n:n+int(size)], msg[n+int(size):]
+			default:
+				return
+			}
+			if !yield(int(tag>>3), value) {
+				return
+			}
+		}
+	}
+}
+
+// protoRepeated returns every occurrence of a repeated field
+func protoRepeated(msg []byte, field int) [][]byte {
+	var values [][]byte
+	for num, value := range protoFields(msg) {
+		if num == field {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// protoMapEntry adds a map<string, string> entry (key = 1, value = 2) to m
+func protoMapEntry(m map[string]string, entry []byte) map[string]string {
+	var key, value string
+	for num, v := range protoFields(entry) {
+		switch num {
+		case 1:
+			key = string(v)
+		case 2:
+			value = string(v)
+		}
+	}
+	if m == nil {
+		m = make(map[string]string)
+	}
+	m[key] = value
+	return m
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// protoBytes encodes a length-delimited protobuf field
+func protoBytes(num int, value []byte) []byte {
+	b := binary.AppendUvarint(nil, uint64(num<<3|2))
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func protoString(num int, s string) []byte {
+	return protoBytes(num, []byte(s))
+}
+
+// protoVarint encodes a varint field, which the CRI client skips
+func protoVarint(num int, v uint64) []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, uint64(num<<3)), v)
+}
+
+func protoMap(num int, m map[string]string) []byte {
+	var b []byte
+	for k, v := range m {
+		b = append(b, protoBytes(num, append(protoString(1, k), protoString(2, v)...))...)
+	}
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func criSandbox(id, name, uid, namespace string, labels map[string]string) []byte {
+	return concat(
+		protoString(1, id),
+		protoBytes(2, concat(protoString(1, name), protoString(2, uid), protoString(3, namespace), protoVarint(4, 0))),
+		protoVarint(3, 0),                   // state
+		protoVarint(4, 1760832000000000000), // created_at
+		protoMap(5, labels),
+		protoMap(6, map[string]string{"kubernetes.io/config.source": "api"}), // annotations
+	)
+}
+
+func criContainer(id, sandbox, name, image string) []byte {
+	return concat(
+		protoString(1, id),
+		protoString(2, sandbox),
+		protoBytes(3, concat(protoString(1, name), protoVarint(2, 0))),
+		protoBytes(4, protoString(1, image)),
+		protoString(5, "sha256:0123"), // image_ref
+		protoVarint(6, 1),             // state
+	)
+}
+
+// fakeCRI serves ListPodSandbox and ListContainers over h2c on a unix
+// socket, as containerd does
+type fakeCRI struct {
+	sandboxes, containers [][]byte
+	status                string // grpc-status to answer with
+	calls                 atomic.Int32
+}
+
+func (f *fakeCRI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.calls.Add(1)
+	if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" {
+		http.Error(w, "want gRPC over HTTP/2", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	if f.status != "0" {
+		// A trailers-only response
+		w.Header().Set("Grpc-Status", f.status)
+		w.Header().Set("Grpc-Message", "runtime unavailable")
+		return
+	}
+	var items [][]byte
+	switch r.URL.Path {
+	case "/runtime.v1.RuntimeService/ListPodSandbox":
+		items = f.sandboxes
+	case "/runtime.v1.RuntimeService/ListContainers":
+		items = f.containers
+	default:
+		w.Header().Set("Grpc-Status", "12") // unimplemented
+		return
+	}
+	var msg []byte
+	for _, item := range items {
+		msg = append(msg, protoBytes(1, item)...)
+	}
+	w.Header().Set("Trailer", "Grpc-Status")
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+	w.Write(append(frame, msg...))
+	w.Header().Set("Grpc-Status", "0")
+}
+
+func startFakeCRI(t *testing.T, f *fakeCRI) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cri.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: f, Protocols: new(http.Protocols)}
+	server.Protocols.SetUnencryptedHTTP2(true)
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	return path
+}
+
+var (
+	criWebID    = strings.Repeat("a", 64)
+	criSidecar  = strings.Repeat("b", 64)
+	criOrphanID = strings.Repeat("c", 64)
+)
+
+func newFakeCRI() *fakeCRI {
+	return &fakeCRI{
+		status: "0",
+		sandboxes: [][]byte{
+			criSandbox("sb-web", "web-5d8f7c", "0d2c3f4e-5a6b-4c7d-8e9f-a0b1c2d3e4f5", "shop", map[string]string{
+				"app":                         "web",
+				"io.kubernetes.pod.name":      "web-5d8f7c",
+				"io.kubernetes.pod.uid":       "0d2c3f4e-5a6b-4c7d-8e9f-a0b1c2d3e4f5",
+				"pod-template-hash":           "5d8f7c",
+				"io.kubernetes.pod.namespace": "shop",
+			}),
+		},
+		containers: [][]byte{
+			criContainer(criWebID, "sb-web", "nginx", "docker.io/library/nginx:1.29"),
+			criContainer(criSidecar, "sb-web", "exporter", "nginx/nginx-prometheus-exporter:1.4"),
+			criContainer(criOrphanID, "sb-gone", "leftover", "busybox"),
+		},
+	}
+}
+
+func TestCRIClientContainer(t *testing.T) {
+	fake := newFakeCRI()
+	client := NewCRIClient(startFakeCRI(t, fake))
+
+	want := &ContainerInfo{
+		ID: criWebID, Name: "nginx", Image: "docker.io/library/nginx:1.29",
+		Pod: "web-5d8f7c", Namespace: "shop",
+		Labels: map[string]string{"app": "web", "pod-template-hash": "5d8f7c"},
+	}
+	if got := client.Container(criWebID, ""); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Container = %+v, want %+v", got, want)
+	}
+	if got := client.Container(criSidecar, ""); got == nil || got.Name != "exporter" || got.Pod != "web-5d8f7c" {
+		t.Errorf("sidecar = %+v", got)
+	}
+	// A container whose sandbox is gone has no pod
+	if got := client.Container(criOrphanID, ""); got == nil || got.Pod != "" || got.Image != "busybox" {
+		t.Errorf("orphan = %+v", got)
+	}
+	if calls := fake.calls.Load(); calls != 2 {
+		t.Errorf("%d calls for known containers, want one listing (2 calls)", calls)
+	}
+
+	// An unknown container lists again, but not more often than
+	// criRefreshInterval
+	if got := client.Container(strings.Repeat("d", 64), ""); got != nil {
+		t.Errorf("unknown container = %+v", got)
+	}
+	if calls := fake.calls.Load(); calls != 2 {
+		t.Errorf("%d calls after an unknown container, want no new listing", calls)
+	}
+	client.refreshed = client.refreshed.Add(-criRefreshInterval)
+	client.Container(strings.Repeat("d", 64), "")
+	if calls := fake.calls.Load(); calls != 4 {
+		t.Errorf("%d calls once the interval passed, want 4", calls)
+	}
+}
+
+func TestCRIClientErrors(t *testing.T) {
+	fake := newFakeCRI()
+	fake.status = "14"
+	client := NewCRIClient(startFakeCRI(t, fake))
+	if _, err := client.list(); err == nil || !strings.Contains(err.Error(), "grpc status 14 runtime unavailable") {
+		t.Errorf("list with an unavailable runtime: %v", err)
+	}
+	if got := client.Container(criWebID, ""); got != nil {
+		t.Errorf("Container after a failed listing = %+v", got)
+	}
+
+	missing := NewCRIClient(filepath.Join(t.TempDir(), "missing.sock"))
+	if _, err := missing.list(); err == nil {
+		t.Error("list on a missing socket succeeded")
+	}
+}
+
+func TestProtoFieldsMalformed(t *testing.T) {
+	msg := concat(protoString(1, "ok"), []byte{0x12, 0x7f, 'x'}) // field 2 claims 127 bytes
+	var got []string
+	for num, value := range protoFields(msg) {
+		got = append(got, string(rune('0'+num))+":"+string(value))
+	}
+	if !reflect.DeepEqual(got, []string{"1:ok"}) {
+		t.Errorf("fields = %q, want only the well-formed one", got)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	maxNamesPerIP     = 8     // forward names remembered per address
+	maxPassiveEntries = 50000 // addresses remembered by passive DNS
+	passiveNameTTL    = 24 * time.Hour
+)
+
+// observedName is a forward name seen resolving to an address
+type observedName struct {
+	name     string
+	lastSeen time.Time
+}
+
+type ptrResult struct {
+	names   []string
+	expires time.Time
+}
+
+// NameResolver attributes names to IPs from reverse (PTR) lookups and from
+// forward DNS answers observed on the wire or in resolver logs. Lookups run
+// asynchronously; OnName is called whenever an address learns a new name.
+type NameResolver struct {
+	resolver *net.Resolver
+	timeout  time.Duration
+	queue    chan string
+	OnName   func(ip string)
+
+	passive map[string][]observedName // ip -> forward names, most recent first
+	ptr     map[string]ptrResult      // ip -> reverse lookup result
+	pending map[string]bool
+	mu      sync.Mutex
+}
+
+// NewNameResolver creates a resolver. server is an optional "host:port" DNS
+// server used for PTR lookups; when empty the system resolver is used.
+// With no workers, reverse lookups are disabled and only observed names apply.
+func NewNameResolver(server string, workers int) *NameResolver {
+	r := &NameResolver{
+		resolver: net.DefaultResolver,
+		timeout:  3 * time.Second,
+		queue:    make(chan string, 1024),
+		passive:  make(map[string][]observedName),
+		ptr:      make(map[string]ptrResult),
+		pending:  make(map[string]bool),
+	}
+	if server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	if workers < 1 {
+		r.queue = nil
+	}
+	for i := 0; i < workers; i++ {
+		go r.worker()
+	}
+	return r
+}
+
+// Lookup queues a reverse lookup for ip. It never blocks; if the queue is
+// full the request is dropped and will be retried on the next discovery.
+func (r *NameResolver) Lookup(ip string) {
+	if r.queue == nil {
+		return
+	}
+	r.mu.Lock()
+	if _, done := r.ptr[ip]; done || r.pending[ip] {
+		r.mu.Unlock()
+		return
+	}
+	r.pending[ip] = true
+	r.mu.Unlock()
+
+	select {
+	case r.queue <- ip:
+	default:
+		r.mu.Lock()
+		delete(r.pending, ip)
+		r.mu.Unlock()
+	}
+}
+
+func (r *NameResolver) worker() {
+	for ip := range r.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		names, err := r.resolver.LookupAddr(ctx, ip)
+		cancel()
+
+		result := ptrResult{expires: time.Now().Add(time.Hour)}
+		if err != nil {
+			// Negative results are cached for less time
+			result.expires = time.Now().Add(10 * time.Minute)
+		}
+		for _, name := range names {
+			result.names = append(result.names, strings.TrimSuffix(name, "."))
+		}
+
+		r.mu.Lock()
+		r.ptr[ip] = result
+		delete(r.pending, ip)
+		r.mu.Unlock()
+
+		if len(result.names) > 0 && r.OnName != nil {
+			r.OnName(ip)
+		}
+	}
+}
+
+// Names returns the best-known names for ip: the reverse name and the
+// forward names observed resolving to it (most recent first)
+func (r *NameResolver) Names(ip string) (ptrName string, forward []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if result, ok := r.ptr[ip]; ok {
+		if len(result.names) > 0 {
+			ptrName = result.names[0]
+		}
+		if time.Now().After(result.expires) {
+			// Let the next Lookup refresh it
+			delete(r.ptr, ip)
+		}
+	}
+
+	cutoff := time.Now().Add(-passiveNameTTL)
+	for _, obs := range r.passive[ip] {
+		if obs.lastSeen.After(cutoff) {
+			forward = append(forward, obs.name)
+		}
+	}
+	return ptrName, forward
+}
+
+// Observe records that name resolved to ip
+func (r *NameResolver) Observe(name, ip string, seen time.Time) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" || ip == "" {
+		return
+	}
+
+	r.mu.Lock()
+	names := r.passive[ip]
+	isNew := true
+	for i, obs := range names {
+		if obs.name == name {
+			// Move to the front
+			copy(names[1:i+1], names[:i])
+			isNew = false
+			break
+		}
+	}
+	if isNew {
+		if len(r.passive) >= maxPassiveEntries && len(names) == 0 {
+			r.evictOldestLocked()
+		}
+		names = append([]observedName{{}}, names...)
+		if len(names) > maxNamesPerIP {
+			names = names[:maxNamesPerIP]
+		}
+	}
+	names[0] = observedName{name: name, lastSeen: seen}
+	r.passive[ip] = names
+	r.mu.Unlock()
+
+	if isNew && r.OnName != nil {
+		r.OnName(ip)
+	}
+}
+
+func (r *NameResolver) evictOldestLocked() {
+	var oldestIP string
+	var oldest time.Time
+	for ip, names := range r.passive {
+		if oldestIP == "" || names[0].lastSeen.Before(oldest) {
+			oldestIP, oldest = ip, names[0].lastSeen
+		}
+	}
+	delete(r.passive, oldestIP)
+}
+
+// HandlePacket learns forward names from DNS responses seen by a PacketTap
+func (r *NameResolver) HandlePacket(pkt *Packet) {
+	if pkt.Protocol != ProtoUDP || (pkt.SrcPort != 53 && pkt.SrcPort != 5353) {
+		return
+	}
+	r.observeDNSMessage(pkt.Payload, pkt.Timestamp)
+}
+
+// observeDNSMessage parses a DNS response and records its A/AAAA answers
+// under the name the client originally asked for, so CNAME chains such as
+// api.github.com -> lb-140-82-112-5-iad.github.com resolve to the former
+func (r *NameResolver) observeDNSMessage(msg []byte, seen time.Time) {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil || !header.Response || header.RCode != dnsmessage.RCodeSuccess {
+		return
+	}
+
+	question, err := p.Question()
+	if err != nil {
+		return
+	}
+	asked := question.Name.String()
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return
+	}
+	for _, answer := range answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			r.Observe(asked, netip.AddrFrom4(body.A).String(), seen)
+		case *dnsmessage.AAAAResource:
+			r.Observe(asked, netip.AddrFrom16(body.AAAA).Unmap().String(), seen)
+		}
+	}
+}
+
+// dnsmasqReplyRe matches dnsmasq log-queries lines such as
+// "dnsmasq[812]: reply api.github.com is 140.82.112.5"
+var dnsmasqReplyRe = regexp.MustCompile(`dnsmasq\[\d+\]: (?:reply|cached) (\S+) is (\S+)`)
+
+// FollowDNSLog tails a dnsmasq query log and learns names from its replies.
+// It starts at the end of the file and reopens it after rotation.
+func (r *NameResolver) FollowDNSLog(path string) {
+	var file *os.File
+	var reader *bufio.Reader
+	var offset int64
+	var partial string
+
+	open := func(seekEnd bool) bool {
+		f, err := os.Open(path)
+		if err != nil {
+			return false
+		}
+		whence := io.SeekStart
+		if seekEnd {
+			whence = io.SeekEnd
+		}
+		offset, _ = f.Seek(0, whence)
+		file, reader = f, bufio.NewReader(f)
+		return true
+	}
+
+	if !open(true) {
+		slog.Info("DNS log not available yet, waiting for it", "component", "dns", "path", path)
+	}
+
+	for {
+		if file == nil {
+			time.Sleep(5 * time.Second)
+			open(false)
+			continue
+		}
+
+		line, err := reader.ReadString('\n')
+		offset += int64(len(line))
+		if err == nil {
+			line, partial = partial+line, ""
+			r.observeDNSLogLine(line, time.Now())
+			continue
+		}
+
+		// At EOF: keep any partial line and wait for more data, reopening
+		// the file if it was rotated
+		partial += line
+		time.Sleep(time.Second)
+		info, statErr := os.Stat(path)
+		current, _ := file.Stat()
+		if statErr != nil || current == nil || !os.SameFile(info, current) || info.Size() < offset {
+			file.Close()
+			file, partial = nil, ""
+			open(false)
+		}
+	}
+}
+
+// observeDNSLogLine records the answer in a dnsmasq reply line. Other lines,
+// and replies that aren't addresses (CNAMEs, NXDOMAIN), are ignored.
+func (r *NameResolver) observeDNSLogLine(line string, seen time.Time) {
+	m := dnsmasqReplyRe.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+	if _, err := netip.ParseAddr(m[2]); err == nil {
+		r.Observe(m[1], m[2], seen)
+	}
+}
+
+// ApplyNames updates a node's name attribution from the resolver. Observed
+// forward names win over the reverse name, which wins over the GeoIP
+// fallback. It reports whether the node changed.
+func ApplyNames(node *NetworkNode, r *NameResolver) bool {
+	ptrName, forward := r.Names(node.IPAddress)
+
+	changed := false
+	if ptrName != "" && ptrName != node.Hostname {
+		node.Hostname = ptrName
+		changed = true
+	}
+	if len(forward) > 0 && strings.Join(forward, ",") != strings.Join(node.DNSNames, ",") {
+		node.DNSNames = forward
+		changed = true
+	}
+
+	name := node.Name
+	switch {
+	case len(node.DNSNames) > 0:
+		name = node.DNSNames[0]
+	case node.Hostname != "":
+		name = node.Hostname
+	}
+	if name != node.Name {
+		node.Name = name
+		changed = true
+	}
+	return changed
+}
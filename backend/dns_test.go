@@ -0,0 +1,310 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestObserveDNSLogLine(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "dns", "dnsmasq.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewNameResolver("", 0)
+	now := time.Now()
+	for line := range strings.Lines(string(data)) {
+		r.observeDNSLogLine(line, now)
+	}
+
+	// dnsmasq logs the end of a CNAME chain under its own name; queries,
+	// CNAME steps, NXDOMAIN and DHCP lines teach nothing
+	want := map[string][]string{
+		"140.82.112.5":       {"lb-140-82-112-5-iad.github.com"},
+		"2620:2d:4000:1::16": {"archive.ubuntu.com"},
+		"93.184.215.14":      {"www.example.com"},
+	}
+	if len(r.passive) != len(want) {
+		t.Errorf("learned %d addresses, want %d: %v", len(r.passive), len(want), r.passive)
+	}
+	for ip, names := range want {
+		if _, forward := r.Names(ip); !reflect.DeepEqual(forward, names) {
+			t.Errorf("%s: names %q, want %q", ip, forward, names)
+		}
+	}
+}
+
+// dnsResponse builds a response to an A query for asked
+func dnsResponse(t *testing.T, rcode dnsmessage.RCode, asked string, answers ...dnsmessage.Resource) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, Response: true, RCode: rcode})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(asked), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	b.StartAnswers()
+	for _, answer := range answers {
+		var err error
+		switch body := answer.Body.(type) {
+		case *dnsmessage.CNAMEResource:
+			err = b.CNAMEResource(answer.Header, *body)
+		case *dnsmessage.AResource:
+			err = b.AResource(answer.Header, *body)
+		case *dnsmessage.AAAAResource:
+			err = b.AAAAResource(answer.Header, *body)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestHandleDNSPacket(t *testing.T) {
+	header := func(name string, typ dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET, TTL: 60}
+	}
+	chain := dnsResponse(t, dnsmessage.RCodeSuccess, "API.github.com.",
+		dnsmessage.Resource{Header: header("api.github.com.", dnsmessage.TypeCNAME),
+			Body: &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("lb-140-82-112-5-iad.github.com.")}},
+		dnsmessage.Resource{Header: header("lb-140-82-112-5-iad.github.com.", dnsmessage.TypeA),
+			Body: &dnsmessage.AResource{A: [4]byte{140, 82, 112, 5}}},
+		dnsmessage.Resource{Header: header("lb-140-82-112-5-iad.github.com.", dnsmessage.TypeAAAA),
+			Body: &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 5}}},
+	)
+	nxdomain := dnsResponse(t, dnsmessage.RCodeNameError, "nosuch.example.")
+	answer := dnsResponse(t, dnsmessage.RCodeSuccess, "www.example.com.",
+		dnsmessage.Resource{Header: header("www.example.com.", dnsmessage.TypeA),
+			Body: &dnsmessage.AResource{A: [4]byte{93, 184, 215, 14}}})
+	query := append([]byte(nil), answer...)
+	query[2] &^= 0x80 // clear QR
+
+	tests := []struct {
+		name string
+		pkt  Packet
+		want map[string][]string // address -> names learned
+	}{
+		{"CNAME chain", Packet{Protocol: ProtoUDP, SrcPort: 53, Payload: chain},
+			map[string][]string{"140.82.112.5": {"api.github.com"}, "2001:db8::5": {"api.github.com"}}},
+		{"mDNS", Packet{Protocol: ProtoUDP, SrcPort: 5353, Payload: answer},
+			map[string][]string{"93.184.215.14": {"www.example.com"}}},
+		{"NXDOMAIN", Packet{Protocol: ProtoUDP, SrcPort: 53, Payload: nxdomain}, nil},
+		{"query", Packet{Protocol: ProtoUDP, SrcPort: 53, Payload: query}, nil},
+		{"truncated", Packet{Protocol: ProtoUDP, SrcPort: 53, Payload: chain[:len(chain)-3]}, nil},
+		{"not port 53", Packet{Protocol: ProtoUDP, SrcPort: 5300, Payload: answer}, nil},
+		{"TCP", Packet{Protocol: ProtoTCP, SrcPort: 53, Payload: answer}, nil},
+	}
+	for _, tt := range tests {
+		r := NewNameResolver("", 0)
+		tt.pkt.Timestamp = time.Now()
+		r.HandlePacket(&tt.pkt)
+		got := make(map[string][]string)
+		for ip := range r.passive {
+			_, got[ip] = r.Names(ip)
+		}
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: learned %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNameResolverObserve(t *testing.T) {
+	r := NewNameResolver("", 0)
+	var notified []string
+	r.OnName = func(ip string) { notified = append(notified, ip) }
+	now := time.Now()
+
+	for i := range maxNamesPerIP + 2 {
+		r.Observe("host-"+strconv.Itoa(i)+".example.", "192.0.2.1", now)
+	}
+	// Seen again: moves to the front without a new notification
+	r.Observe("HOST-5.example", "192.0.2.1", now)
+	_, forward := r.Names("192.0.2.1")
+	want := []string{"host-5.example", "host-9.example", "host-8.example", "host-7.example",
+		"host-6.example", "host-4.example", "host-3.example", "host-2.example"}
+	if !reflect.DeepEqual(forward, want) {
+		t.Errorf("names %q, want the %d most recent %q", forward, maxNamesPerIP, want)
+	}
+	if len(notified) != maxNamesPerIP+2 {
+		t.Errorf("%d notifications, want one per new name", len(notified))
+	}
+
+	// Names not seen for a day are no longer reported
+	r.Observe("old.example", "192.0.2.2", now.Add(-passiveNameTTL-time.Minute))
+	r.Observe("new.example", "192.0.2.2", now)
+	if _, forward := r.Names("192.0.2.2"); !reflect.DeepEqual(forward, []string{"new.example"}) {
+		t.Errorf("names %q, want only the recent one", forward)
+	}
+
+	r.Observe("", "192.0.2.3", now)
+	r.Observe("empty.example", "", now)
+	if len(r.passive) != 2 {
+		t.Errorf("empty names or addresses recorded: %v", r.passive)
+	}
+}
+
+func TestNameResolverEvictsOldest(t *testing.T) {
+	r := NewNameResolver("", 0)
+	start := time.Now().Add(-time.Hour)
+	r.Observe("oldest.example", "192.0.2.1", start)
+	for i := 1; i < maxPassiveEntries; i++ {
+		ip := "10." + strconv.Itoa(i>>16) + "." + strconv.Itoa(i>>8&0xff) + "." + strconv.Itoa(i&0xff)
+		r.Observe("host.example", ip, start.Add(time.Minute))
+	}
+	// Another name for a known address doesn't evict anything
+	r.Observe("other.example", "192.0.2.1", start)
+	if len(r.passive) != maxPassiveEntries {
+		t.Fatalf("%d addresses, want %d", len(r.passive), maxPassiveEntries)
+	}
+
+	r.Observe("new.example", "192.0.2.2", start.Add(time.Minute))
+	if len(r.passive) != maxPassiveEntries {
+		t.Errorf("%d addresses after a new one, want %d", len(r.passive), maxPassiveEntries)
+	}
+	if _, ok := r.passive["192.0.2.1"]; ok {
+		t.Error("the least recently seen address was kept")
+	}
+}
+
+// ptrServer answers PTR queries for 192.0.2.9, and NXDOMAIN to the rest
+func ptrServer(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			header, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			known := q.Type == dnsmessage.TypePTR && q.Name.String() == "9.2.0.192.in-addr.arpa."
+			reply := dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true}
+			if !known {
+				reply.RCode = dnsmessage.RCodeNameError
+			}
+			b := dnsmessage.NewBuilder(nil, reply)
+			b.StartQuestions()
+			b.Question(q)
+			b.StartAnswers()
+			if known {
+				b.PTRResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60},
+					dnsmessage.PTRResource{PTR: dnsmessage.MustNewName("host-9.example.net.")})
+			}
+			msg, err := b.Finish()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(msg, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestNameResolverLookup(t *testing.T) {
+	r := NewNameResolver(ptrServer(t), 1)
+	named := make(chan string, 4)
+	r.OnName = func(ip string) { named <- ip }
+
+	r.Lookup("192.0.2.9")
+	select {
+	case ip := <-named:
+		if ip != "192.0.2.9" {
+			t.Errorf("OnName(%s)", ip)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reverse lookup didn't finish")
+	}
+	if ptr, _ := r.Names("192.0.2.9"); ptr != "host-9.example.net" {
+		t.Errorf("reverse name %q", ptr)
+	}
+
+	// A failed lookup is cached too, for less time, and names nothing
+	r.Lookup("192.0.2.10")
+	waitFor(t, func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		_, done := r.ptr["192.0.2.10"]
+		return done
+	})
+	r.mu.Lock()
+	failed := r.ptr["192.0.2.10"]
+	r.mu.Unlock()
+	if len(failed.names) != 0 || time.Until(failed.expires) > 10*time.Minute {
+		t.Errorf("failed lookup cached as %+v", failed)
+	}
+
+	// A cached result isn't looked up again until Names finds it expired
+	r.Lookup("192.0.2.9")
+	if len(r.queue) != 0 || r.pending["192.0.2.9"] {
+		t.Error("a cached result was queued again")
+	}
+	r.mu.Lock()
+	r.ptr["192.0.2.9"] = ptrResult{names: []string{"host-9.example.net"}, expires: time.Now().Add(-time.Second)}
+	r.mu.Unlock()
+	if ptr, _ := r.Names("192.0.2.9"); ptr != "host-9.example.net" {
+		t.Errorf("expired reverse name %q, want it once more", ptr)
+	}
+	r.mu.Lock()
+	_, cached := r.ptr["192.0.2.9"]
+	r.mu.Unlock()
+	if cached {
+		t.Error("expired result kept")
+	}
+
+	// Without workers nothing is looked up
+	off := NewNameResolver("", 0)
+	off.Lookup("192.0.2.9")
+	if len(off.pending) != 0 {
+		t.Error("lookup queued without workers")
+	}
+}
+
+func TestApplyNames(t *testing.T) {
+	r := NewNameResolver("", 0)
+	r.ptr["192.0.2.9"] = ptrResult{names: []string{"host-9.example.net"}, expires: time.Now().Add(time.Hour)}
+
+	node := &NetworkNode{IPAddress: "192.0.2.9", Name: "Example Hosting"}
+	if !ApplyNames(node, r) || node.Hostname != "host-9.example.net" || node.Name != "host-9.example.net" {
+		t.Errorf("with a reverse name: %+v", node)
+	}
+	if ApplyNames(node, r) {
+		t.Error("changed without new names")
+	}
+
+	// Observed forward names win over the reverse name
+	r.Observe("www.example.com", "192.0.2.9", time.Now())
+	if !ApplyNames(node, r) || node.Name != "www.example.com" || !reflect.DeepEqual(node.DNSNames, []string{"www.example.com"}) {
+		t.Errorf("with a forward name: %+v", node)
+	}
+
+	// A node nothing is known about keeps its GeoIP name
+	other := &NetworkNode{IPAddress: "198.51.100.1", Name: "Example Hosting"}
+	if ApplyNames(other, r) || other.Name != "Example Hosting" {
+		t.Errorf("without names: %+v", other)
+	}
+}
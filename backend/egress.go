@@ -0,0 +1,755 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// egressPolicyVersion is the policy file format this backend reads
+const egressPolicyVersion = 1
+
+// Egress modes
+const (
+	egressEnforce = "enforce" // alert on flows the policy doesn't allow
+	egressLearn   = "learn"   // only record flows, to propose a policy from
+)
+
+// egressViolationTTL is how long a violation stays listed after its flow
+// was last seen
+const egressViolationTTL = time.Hour
+
+// egressPolicyFile is the versioned allowlist NETOPS_EGRESS_POLICY points
+// at, and what learn mode proposes:
+//
+//	{
+//	  "version": 1,
+//	  "description": "web tier",
+//	  "rules": [
+//	    {"process": "nginx", "cidrs": ["10.0.0.0/8"], "ports": [5432]},
+//	    {"process": "apt*", "domains": ["*.ubuntu.com"], "ports": [80, 443]},
+//	    {"origin": "container:*", "asns": ["AS15169"], "ports": ["8000-8080"]}
+//	  ]
+//	}
+type egressPolicyFile struct {
+	Version     int          `json:"version"`
+	Description string       `json:"description,omitempty"`
+	Rules       []egressRule `json:"rules"`
+}
+
+// egressRule allows flows from a process to destinations on ports. An
+// empty list matches anything, so a rule without domains, CIDRs or ASNs
+// allows any destination.
+type egressRule struct {
+	Process     string      `json:"process,omitempty"` // glob over the process or unit name, empty or "*" for any
+	Origin      string      `json:"origin,omitempty"`  // glob over the node the flow starts at: "local", "container:*", an agent
+	Domains     []string    `json:"domains,omitempty"` // "*.example.com" matches its subdomains
+	CIDRs       []string    `json:"cidrs,omitempty"`
+	ASNs        []string    `json:"asns,omitempty"`
+	Ports       []portRange `json:"ports,omitempty"` // 443 or "8000-8080"
+	Description string      `json:"description,omitempty"`
+}
+
+// portRange is a port or an inclusive range of them
+type portRange struct {
+	Low, High int
+}
+
+func (p *portRange) UnmarshalJSON(data []byte) error {
+	var port int
+	if err := json.Unmarshal(data, &port); err == nil {
+		*p = portRange{port, port}
+		return p.validate()
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("port %s is not a number or a range", data)
+	}
+	low, high, isRange := strings.Cut(s, "-")
+	var err error
+	if p.Low, err = strconv.Atoi(strings.TrimSpace(low)); err != nil {
+		return fmt.Errorf("port %q is not a number or a range", s)
+	}
+	p.High = p.Low
+	if isRange {
+		if p.High, err = strconv.Atoi(strings.TrimSpace(high)); err != nil {
+			return fmt.Errorf("port %q is not a number or a range", s)
+		}
+	}
+	return p.validate()
+}
+
+func (p portRange) MarshalJSON() ([]byte, error) {
+	if p.Low == p.High {
+		return json.Marshal(p.Low)
+	}
+	return json.Marshal(fmt.Sprintf("%d-%d", p.Low, p.High))
+}
+
+func (p *portRange) validate() error {
+	if p.Low < 1 || p.High > 65535 || p.Low > p.High {
+		return fmt.Errorf("port range %d-%d is not within 1-65535", p.Low, p.High)
+	}
+	return nil
+}
+
+// compiledEgressRule is an egressRule ready to match flows
+type compiledEgressRule struct {
+	process, origin string
+	domains         []string
+	prefixes        []netip.Prefix
+	asns            map[string]bool
+	ports           []portRange
+}
+
+// parseEgressPolicy compiles a policy file, rejecting unknown fields,
+// other versions, bad globs and bad CIDRs
+func parseEgressPolicy(data []byte) ([]compiledEgressRule, error) {
+	var file egressPolicyFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, err
+	}
+	if file.Version != egressPolicyVersion {
+		return nil, fmt.Errorf("version %d is not supported (expected %d)", file.Version, egressPolicyVersion)
+	}
+
+	rules := make([]compiledEgressRule, 0, len(file.Rules))
+	for i, r := range file.Rules {
+		rule := compiledEgressRule{
+			process: strings.TrimSpace(r.Process),
+			origin:  strings.TrimSpace(r.Origin),
+			asns:    make(map[string]bool),
+			ports:   r.Ports,
+		}
+		for _, glob := range []string{rule.process, rule.origin} {
+			if _, err := path.Match(glob, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: pattern %q: %w", i+1, glob, err)
+			}
+		}
+		for _, domain := range r.Domains {
+			rule.domains = append(rule.domains, normalizeDomain(domain))
+		}
+		for _, cidr := range r.CIDRs {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+			if err != nil {
+				// A bare address is a single-host prefix
+				addr, addrErr := netip.ParseAddr(strings.TrimSpace(cidr))
+				if addrErr != nil {
+					return nil, fmt.Errorf("rule %d: %w", i+1, err)
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			rule.prefixes = append(rule.prefixes, prefix.Masked())
+		}
+		for _, asn := range r.ASNs {
+			rule.asns[normalizeASN(asn)] = true
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// normalizeDomain lowercases a name and drops a trailing dot
+func normalizeDomain(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// allows reports whether the rule covers a flow
+func (r *compiledEgressRule) allows(flow *EgressFlow) bool {
+	if !globMatch(r.process, flow.Process) || !globMatch(r.origin, flow.Origin) {
+		return false
+	}
+	if len(r.ports) > 0 && !slices.ContainsFunc(r.ports, func(p portRange) bool {
+		return flow.Port >= p.Low && flow.Port <= p.High
+	}) {
+		return false
+	}
+	if len(r.domains) == 0 && len(r.prefixes) == 0 && len(r.asns) == 0 {
+		return true
+	}
+	if addr, err := netip.ParseAddr(flow.IP); err == nil {
+		addr = addr.Unmap()
+		for _, prefix := range r.prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+	if flow.ASN != "" && r.asns[normalizeASN(flow.ASN)] {
+		return true
+	}
+	for _, name := range flow.Names {
+		name = normalizeDomain(name)
+		for _, domain := range r.domains {
+			if suffix, ok := strings.CutPrefix(domain, "*."); ok {
+				if strings.HasSuffix(name, "."+suffix) {
+					return true
+				}
+			} else if name == domain {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// globMatch matches value against a path.Match pattern; an empty pattern
+// matches anything
+func globMatch(pattern, value string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
+
+// egressAllowed reports whether any rule allows a flow
+func egressAllowed(rules []compiledEgressRule, flow *EgressFlow) bool {
+	for i := range rules {
+		if rules[i].allows(flow) {
+			return true
+		}
+	}
+	return false
+}
+
+// EgressPolicy is the allowlist of expected egress, reloaded when its file
+// changes
+type EgressPolicy struct {
+	path string
+
+	rules     []compiledEgressRule
+	loaded    bool
+	signature string
+	mu        sync.RWMutex
+}
+
+// NewEgressPolicy creates a policy backed by the file at path; call Reload
+// to read it
+func NewEgressPolicy(path string) *EgressPolicy {
+	return &EgressPolicy{path: path}
+}
+
+// Reload re-reads the policy file if it changed since the last load and
+// reports whether it did. A file with errors leaves the previous policy in
+// place.
+func (p *EgressPolicy) Reload() (bool, error) {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return false, err
+	}
+	signature := fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())
+	p.mu.RLock()
+	unchanged := p.loaded && p.signature == signature
+	p.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return false, err
+	}
+	rules, err := parseEgressPolicy(data)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", p.path, err)
+	}
+	slog.Info("Egress policy loaded", "component", "egress", "rules", len(rules))
+
+	p.mu.Lock()
+	p.rules, p.loaded, p.signature = rules, true, signature
+	p.mu.Unlock()
+	return true, nil
+}
+
+// Rules returns the loaded rules, which callers must not modify, and
+// whether a file has loaded yet
+func (p *EgressPolicy) Rules() ([]compiledEgressRule, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.rules, p.loaded
+}
+
+// EgressFlow is a destination a process on a monitored host connected to
+type EgressFlow struct {
+	Hour    time.Time `json:"hour"`              // start of the hour it was seen in
+	Origin  string    `json:"origin"`            // node the flow starts at, "local" for this host
+	Process string    `json:"process,omitempty"` // process or unit name, "" when unknown
+	IP      string    `json:"ip"`
+	Port    int       `json:"port"`
+	ASN     string    `json:"asn,omitempty"`
+	Country string    `json:"country,omitempty"`
+	Names   []string  `json:"names,omitempty"` // SNI, HTTP host and forward DNS names of the destination
+
+	edge edgeKey // the edge drawn for it
+}
+
+// key identifies a flow regardless of when it was seen
+func (f *EgressFlow) key() string {
+	return f.Origin + "|" + f.Process + "|" + f.IP + "|" + strconv.Itoa(f.Port)
+}
+
+// source names the process, or its origin when it is unknown
+func (f *EgressFlow) source() string {
+	if f.Process != "" {
+		return f.Process
+	}
+	return f.Origin
+}
+
+// egressPort is the destination port of a connection this side opened,
+// or 0 for an inbound one. The side with the lower port is taken to be
+// the server, as when probing.
+func egressPort(conn Connection) int {
+	if conn.RemotePort == 0 || conn.State == "LISTEN" {
+		return 0
+	}
+	if conn.RemotePort < 1024 || conn.RemotePort < conn.LocalPort {
+		return conn.RemotePort
+	}
+	return 0
+}
+
+// newEgressFlow describes an outbound connection drawn from origin
+func newEgressFlow(conn Connection, origin string, port int) EgressFlow {
+	flow := EgressFlow{
+		Hour:    time.Now().UTC().Truncate(time.Hour),
+		Origin:  cmp.Or(conn.Origin, "local"),
+		Process: strings.TrimPrefix(processNodeID(conn), processIDPrefix),
+		IP:      conn.RemoteIP,
+		Port:    port,
+		edge:    edgeKey{from: origin, to: conn.RemoteIP},
+	}
+	if conn.Service != nil {
+		flow.Names = appendNames(flow.Names, conn.Service.ServerNames...)
+		flow.Names = appendNames(flow.Names, conn.Service.HTTPHosts...)
+	}
+	return flow
+}
+
+// annotateEgressFlows adds each destination's ASN, country and forward DNS
+// names from its node. The reverse name is left out: the destination's
+// owner controls its PTR record and could claim an allowed domain with it.
+// Callers hold store.mu.
+func annotateEgressFlows(store *NodeStore, flows []EgressFlow) {
+	for i := range flows {
+		node, ok := store.Nodes[flows[i].IP]
+		if !ok {
+			continue
+		}
+		flows[i].ASN = node.ASN
+		flows[i].Country = node.Country
+		flows[i].Names = appendNames(flows[i].Names, node.DNSNames...)
+	}
+}
+
+// appendNames adds the names not in list yet, keeping their order
+func appendNames(list []string, names ...string) []string {
+	for _, name := range names {
+		if name = normalizeDomain(name); name != "" && !slices.Contains(list, name) {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+// EgressViolation is a flow no rule allows
+type EgressViolation struct {
+	Origin    string    `json:"origin"`
+	Process   string    `json:"process,omitempty"`
+	IP        string    `json:"ip"`
+	Port      int       `json:"port"`
+	ASN       string    `json:"asn,omitempty"`
+	Names     []string  `json:"names,omitempty"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Hours     int       `json:"hours,omitempty"` // hours of history it was seen in, for dry runs
+}
+
+func newEgressViolation(flow *EgressFlow, seen time.Time) *EgressViolation {
+	return &EgressViolation{
+		Origin:    flow.Origin,
+		Process:   flow.Process,
+		IP:        flow.IP,
+		Port:      flow.Port,
+		ASN:       flow.ASN,
+		Names:     slices.Clone(flow.Names),
+		FirstSeen: seen,
+		LastSeen:  seen,
+	}
+}
+
+// sortViolations orders violations by when they were last seen, newest
+// first
+func sortViolations(list []*EgressViolation) {
+	slices.SortFunc(list, func(a, b *EgressViolation) int {
+		return cmp.Or(b.LastSeen.Compare(a.LastSeen), cmp.Compare(a.IP, b.IP), cmp.Compare(a.Port, b.Port))
+	})
+}
+
+// EgressMonitor checks every outbound flow against the egress policy and
+// records flows for learn mode and dry runs
+type EgressMonitor struct {
+	Policy  *EgressPolicy  // nil without NETOPS_EGRESS_POLICY
+	History *EgressHistory // nil without NETOPS_EGRESS_HISTORY
+	Learn   bool           // record flows without checking them
+
+	violations map[string]*EgressViolation // by flow key
+	mu         sync.Mutex
+}
+
+// NewEgressMonitor checks flows against policy, or in learn mode only
+// records them to history. Either may be nil.
+func NewEgressMonitor(policy *EgressPolicy, history *EgressHistory, learn bool) *EgressMonitor {
+	return &EgressMonitor{
+		Policy:     policy,
+		History:    history,
+		Learn:      learn,
+		violations: make(map[string]*EgressViolation),
+	}
+}
+
+// Check evaluates a scan's flows, raising an alert the first time one
+// breaks the policy, and returns the edges of the flows that do. Callers
+// hold store.mu.
+func (m *EgressMonitor) Check(out *Outbox, flows []EgressFlow) map[edgeKey]string {
+	violating := make(map[edgeKey]string)
+	if m.Learn || m.Policy == nil {
+		return violating
+	}
+	rules, loaded := m.Policy.Rules()
+	if !loaded {
+		return violating // nothing to check against until the file is valid
+	}
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range flows {
+		flow := &flows[i]
+		key := flow.key()
+		if egressAllowed(rules, flow) {
+			delete(m.violations, key) // allowed since the policy changed
+			continue
+		}
+		if _, ok := violating[flow.edge]; !ok {
+			violating[flow.edge] = fmt.Sprintf("egress %s → port %d", flow.source(), flow.Port)
+		}
+		if v, ok := m.violations[key]; ok {
+			v.LastSeen = now
+			v.ASN = cmp.Or(flow.ASN, v.ASN)
+			v.Names = appendNames(v.Names, flow.Names...)
+			continue
+		}
+		m.violations[key] = newEgressViolation(flow, now)
+		raiseEgressAlert(out, flow)
+	}
+	maps.DeleteFunc(m.violations, func(_ string, v *EgressViolation) bool {
+		return now.Sub(v.LastSeen) > egressViolationTTL
+	})
+	return violating
+}
+
+// Record appends a scan's flows to the history, if one is kept
+func (m *EgressMonitor) Record(flows []EgressFlow) {
+	if m.History == nil {
+		return
+	}
+	if err := m.History.Record(flows); err != nil {
+		slog.Error("Recording egress history failed", "component", "egress", "error", err)
+	}
+}
+
+// Violations lists the flows breaking the policy seen within the last
+// hour, newest first
+func (m *EgressMonitor) Violations() []*EgressViolation {
+	m.mu.Lock()
+	list := make([]*EgressViolation, 0, len(m.violations))
+	for _, v := range m.violations {
+		c := *v
+		c.Names = slices.Clone(v.Names)
+		list = append(list, &c)
+	}
+	m.mu.Unlock()
+	sortViolations(list)
+	return list
+}
+
+// raiseEgressAlert reports a flow the egress policy doesn't allow
+func raiseEgressAlert(out *Outbox, flow *EgressFlow) {
+	destination := flow.IP
+	if len(flow.Names) > 0 {
+		destination = flow.Names[0] + " (" + flow.IP + ")"
+	}
+	msg := fmt.Sprintf("Egress policy violation: %s on %s connected to %s port %d, which no rule allows",
+		cmp.Or(flow.Process, "an unknown process"), flow.Origin, destination, flow.Port)
+	slog.Warn("Egress policy violation", "component", "egress", "origin", flow.Origin, "process", flow.Process,
+		"ip", flow.IP, "port", flow.Port, "names", flow.Names)
+	out.BroadcastAlert(NewAlert("egress-policy", flow.IP, "medium", msg))
+}
+
+// EgressHistory is an append-only JSON-lines log of the flows seen, one
+// line per flow and hour
+type EgressHistory struct {
+	path string
+
+	written map[string]time.Time // flow key -> hour last written
+	mu      sync.Mutex
+}
+
+// NewEgressHistory keeps history in the file at path
+func NewEgressHistory(path string) *EgressHistory {
+	return &EgressHistory{path: path, written: make(map[string]time.Time)}
+}
+
+// Record appends the flows not written yet this hour
+func (h *EgressHistory) Record(flows []EgressFlow) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for i := range flows {
+		key := flows[i].key()
+		if h.written[key].Equal(flows[i].Hour) {
+			continue
+		}
+		if err := encoder.Encode(&flows[i]); err != nil {
+			return err
+		}
+		h.written[key] = flows[i].Hour
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	file, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Flows returns the flows recorded since a time, oldest first
+func (h *EgressHistory) Flows(since time.Time) ([]EgressFlow, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.read(since)
+}
+
+// read parses the log, skipping lines it can't. Callers hold h.mu.
+func (h *EgressHistory) read(since time.Time) ([]EgressFlow, error) {
+	file, err := os.Open(h.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var flows []EgressFlow
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var flow EgressFlow
+		if err := json.Unmarshal(scanner.Bytes(), &flow); err != nil || flow.IP == "" {
+			continue
+		}
+		if !flow.Hour.Before(since.Truncate(time.Hour)) {
+			flows = append(flows, flow)
+		}
+	}
+	return flows, scanner.Err()
+}
+
+// Compact rewrites the log without the flows older than retention. It also
+// remembers what was written this hour, so a restart doesn't repeat it.
+func (h *EgressHistory) Compact(retention time.Duration) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	flows, err := h.read(time.Now().Add(-retention))
+	if err != nil {
+		return err
+	}
+	hour := time.Now().UTC().Truncate(time.Hour)
+	h.written = make(map[string]time.Time)
+	for i := range flows {
+		if flows[i].Hour.Equal(hour) {
+			h.written[flows[i].key()] = hour
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(h.path), filepath.Base(h.path)+".*")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for i := range flows {
+		if err = encoder.Encode(&flows[i]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), h.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// proposeEgressPolicy builds a policy that allows every flow given. Each
+// process gets a rule per set of ports, listing its destinations by name
+// where one is known, else by ASN, else by address.
+func proposeEgressPolicy(flows []EgressFlow, since time.Time) *egressPolicyFile {
+	type source struct{ process, origin string }
+	destinations := make(map[source]map[string][]int) // destination -> ports
+	for i := range flows {
+		flow := &flows[i]
+		src := source{process: flow.Process}
+		if flow.Process == "" {
+			src.origin = flow.Origin
+		}
+		var destination string
+		switch {
+		case len(flow.Names) > 0:
+			destination = "domain " + flow.Names[0]
+		case flow.ASN != "":
+			destination = "asn AS" + normalizeASN(flow.ASN)
+		default:
+			addr, err := netip.ParseAddr(flow.IP)
+			if err != nil {
+				continue
+			}
+			destination = "cidr " + netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()).String()
+		}
+		if destinations[src] == nil {
+			destinations[src] = make(map[string][]int)
+		}
+		if ports := destinations[src][destination]; !slices.Contains(ports, flow.Port) {
+			destinations[src][destination] = append(ports, flow.Port)
+		}
+	}
+
+	policy := &egressPolicyFile{
+		Version:     egressPolicyVersion,
+		Description: fmt.Sprintf("Learned from %d flows seen since %s", len(flows), since.UTC().Format(time.RFC3339)),
+		Rules:       []egressRule{},
+	}
+	for src, dests := range destinations {
+		// Destinations reached on the same ports share a rule
+		byPorts := make(map[string]*egressRule)
+		for destination, ports := range dests {
+			slices.Sort(ports)
+			key := fmt.Sprint(ports)
+			rule, ok := byPorts[key]
+			if !ok {
+				rule = &egressRule{Process: src.process, Origin: src.origin}
+				for _, port := range ports {
+					rule.Ports = append(rule.Ports, portRange{port, port})
+				}
+				byPorts[key] = rule
+			}
+			kind, value, _ := strings.Cut(destination, " ")
+			switch kind {
+			case "domain":
+				rule.Domains = append(rule.Domains, value)
+			case "asn":
+				rule.ASNs = append(rule.ASNs, value)
+			case "cidr":
+				rule.CIDRs = append(rule.CIDRs, value)
+			}
+		}
+		for _, rule := range byPorts {
+			slices.Sort(rule.Domains)
+			slices.Sort(rule.ASNs)
+			slices.Sort(rule.CIDRs)
+			policy.Rules = append(policy.Rules, *rule)
+		}
+	}
+	slices.SortFunc(policy.Rules, func(a, b egressRule) int {
+		return cmp.Or(cmp.Compare(a.Process, b.Process), cmp.Compare(a.Origin, b.Origin),
+			cmp.Compare(a.Ports[0].Low, b.Ports[0].Low), cmp.Compare(len(a.Ports), len(b.Ports)))
+	})
+	return policy
+}
+
+// dryRunEgress lists the recorded flows the rules would not allow, one
+// entry per flow with the hours it was seen in
+func dryRunEgress(rules []compiledEgressRule, flows []EgressFlow) []*EgressViolation {
+	byKey := make(map[string]*EgressViolation)
+	for i := range flows {
+		flow := &flows[i]
+		if egressAllowed(rules, flow) {
+			continue
+		}
+		v, ok := byKey[flow.key()]
+		if !ok {
+			v = newEgressViolation(flow, flow.Hour)
+			byKey[flow.key()] = v
+		}
+		if flow.Hour.Before(v.FirstSeen) {
+			v.FirstSeen = flow.Hour
+		}
+		if flow.Hour.After(v.LastSeen) {
+			v.LastSeen = flow.Hour
+		}
+		v.ASN = cmp.Or(flow.ASN, v.ASN)
+		v.Names = appendNames(v.Names, flow.Names...)
+		v.Hours++
+	}
+	list := slices.Collect(maps.Values(byKey))
+	sortViolations(list)
+	return list
+}
+
+// refreshEgress re-reads the policy file every interval and drops history
+// older than retention once a day
+func refreshEgress(egress *EgressMonitor, interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	compacted := time.Now()
+	for range ticker.C {
+		if egress.Policy != nil {
+			if _, err := egress.Policy.Reload(); err != nil {
+				slog.Error("Egress policy reload failed", "component", "egress", "error", err)
+			}
+		}
+		if egress.History != nil && time.Since(compacted) >= 24*time.Hour {
+			compacted = time.Now()
+			if err := egress.History.Compact(retention); err != nil {
+				slog.Error("Egress history compaction failed", "component", "egress", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readEgressFixture(t *testing.T) []compiledEgressRule {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "egress", "policy.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := parseEgressPolicy(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestParseEgressPolicy(t *testing.T) {
+	rules := readEgressFixture(t)
+	if len(rules) != 4 {
+		t.Fatalf("%d rules, want 4", len(rules))
+	}
+	want := []compiledEgressRule{
+		{process: "nginx", asns: map[string]bool{}, ports: []portRange{{5432, 5432}},
+			prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.0.2.7/32")}},
+		{process: "apt*", asns: map[string]bool{}, ports: []portRange{{80, 80}, {443, 443}},
+			domains: []string{"*.ubuntu.com", "ubuntu.com"}},
+		{origin: "container:*", asns: map[string]bool{"15169": true}, ports: []portRange{{8000, 8080}}},
+		{process: "chronyd", asns: map[string]bool{}, ports: []portRange{{123, 123}}},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("rules:\n got %+v\nwant %+v", rules, want)
+	}
+
+	invalid := []struct {
+		file string
+		want string
+	}{
+		{`{"version": 2, "rules": []}`, "version 2"},
+		{`{"rules": []}`, "version 0"},
+		{`{"version": 1, "rules": [{"proces": "nginx"}]}`, "unknown field"},
+		{`{"version": 1, "rules": [{"process": "[nginx"}]}`, `rule 1: pattern "[nginx"`},
+		{`{"version": 1, "rules": [{}, {"origin": "agent-["}]}`, "rule 2"},
+		{`{"version": 1, "rules": [{"cidrs": ["10.0.0.0/33"]}]}`, "rule 1"},
+		{`{"version": 1, "rules": [{"ports": [0]}]}`, "not within 1-65535"},
+		{`{"version": 1, "rules": [{"ports": [70000]}]}`, "not within 1-65535"},
+		{`{"version": 1, "rules": [{"ports": ["8080-8000"]}]}`, "not within 1-65535"},
+		{`{"version": 1, "rules": [{"ports": ["http"]}]}`, "not a number or a range"},
+		{`{"version": 1, "rules": [{"ports": [true]}]}`, "not a number or a range"},
+	}
+	for _, tt := range invalid {
+		if _, err := parseEgressPolicy([]byte(tt.file)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.file, err, tt.want)
+		}
+	}
+}
+
+func TestPortRangeJSON(t *testing.T) {
+	var ports []portRange
+	if err := json.Unmarshal([]byte(`[443, "8000-8080", " 22 ", "53-53"]`), &ports); err != nil {
+		t.Fatal(err)
+	}
+	want := []portRange{{443, 443}, {8000, 8080}, {22, 22}, {53, 53}}
+	if !reflect.DeepEqual(ports, want) {
+		t.Errorf("parsed %v, want %v", ports, want)
+	}
+	data, err := json.Marshal(ports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `[443,"8000-8080",22,53]` {
+		t.Errorf("marshaled %s", data)
+	}
+}
+
+func TestEgressRuleAllows(t *testing.T) {
+	rules := readEgressFixture(t)
+	tests := []struct {
+		name string
+		flow EgressFlow
+		want bool
+	}{
+		{"prefix", EgressFlow{Origin: "local", Process: "nginx", IP: "10.1.2.3", Port: 5432}, true},
+		{"other port", EgressFlow{Origin: "local", Process: "nginx", IP: "10.1.2.3", Port: 5433}, false},
+		{"single host", EgressFlow{Origin: "local", Process: "nginx", IP: "::ffff:192.0.2.7", Port: 5432}, true},
+		{"outside the prefixes", EgressFlow{Origin: "local", Process: "nginx", IP: "192.0.2.8", Port: 5432}, false},
+		{"other process", EgressFlow{Origin: "local", Process: "postgres", IP: "10.1.2.3", Port: 5432}, false},
+		{"subdomain", EgressFlow{Origin: "local", Process: "apt-get", IP: "198.51.100.1", Port: 443, Names: []string{"Archive.Ubuntu.com."}}, true},
+		{"exact domain", EgressFlow{Origin: "local", Process: "apt", IP: "198.51.100.1", Port: 80, Names: []string{"ubuntu.com"}}, true},
+		{"any of the names", EgressFlow{Origin: "local", Process: "apt", IP: "198.51.100.1", Port: 80, Names: []string{"cdn.example", "security.ubuntu.com"}}, true},
+		{"suffix without a dot", EgressFlow{Origin: "local", Process: "apt", IP: "198.51.100.1", Port: 443, Names: []string{"notubuntu.com"}}, false},
+		{"domain as a prefix", EgressFlow{Origin: "local", Process: "apt", IP: "198.51.100.1", Port: 443, Names: []string{"ubuntu.com.evil.example"}}, false},
+		{"no names", EgressFlow{Origin: "local", Process: "apt", IP: "198.51.100.1", Port: 443}, false},
+		{"ASN", EgressFlow{Origin: "container:web", IP: "142.250.1.1", Port: 8080, ASN: "15169"}, true},
+		{"ASN outside the range", EgressFlow{Origin: "container:web", IP: "142.250.1.1", Port: 8081, ASN: "AS15169"}, false},
+		{"ASN from another origin", EgressFlow{Origin: "local", IP: "142.250.1.1", Port: 8080, ASN: "AS15169"}, false},
+		{"any destination", EgressFlow{Origin: "agent-1", Process: "chronyd", IP: "203.0.113.123", Port: 123}, true},
+		{"unknown process", EgressFlow{Origin: "local", IP: "203.0.113.123", Port: 123}, false},
+	}
+	for _, tt := range tests {
+		if got := egressAllowed(rules, &tt.flow); got != tt.want {
+			t.Errorf("%s: allowed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if egressAllowed(nil, &tests[0].flow) {
+		t.Error("an empty policy allowed a flow")
+	}
+}
+
+func TestAnnotateEgressFlowsIgnoresReverseNames(t *testing.T) {
+	rules := readEgressFixture(t)
+	store := NewNodeStore()
+	// The destination's owner set its PTR record to an allowed domain
+	store.Nodes["203.0.113.66"] = &NetworkNode{ID: "203.0.113.66", IPAddress: "203.0.113.66",
+		Hostname: "mirror.ubuntu.com", ASN: "AS64511", Country: "NL"}
+	store.Nodes["198.51.100.1"] = &NetworkNode{ID: "198.51.100.1", IPAddress: "198.51.100.1",
+		Hostname: "host-1.provider.example", DNSNames: []string{"Archive.ubuntu.com"}}
+
+	flows := []EgressFlow{
+		{Origin: "local", Process: "apt", IP: "203.0.113.66", Port: 443},
+		{Origin: "local", Process: "apt", IP: "198.51.100.1", Port: 443, Names: []string{"archive.ubuntu.com"}},
+	}
+	annotateEgressFlows(store, flows)
+
+	if flows[0].ASN != "AS64511" || flows[0].Country != "NL" || len(flows[0].Names) != 0 {
+		t.Errorf("flow to a PTR-only node = %+v", flows[0])
+	}
+	if egressAllowed(rules, &flows[0]) {
+		t.Error("a reverse name matched a domain rule")
+	}
+	if !reflect.DeepEqual(flows[1].Names, []string{"archive.ubuntu.com"}) {
+		t.Errorf("names = %q, want the SNI and forward name once", flows[1].Names)
+	}
+	if !egressAllowed(rules, &flows[1]) {
+		t.Error("a forward name didn't match a domain rule")
+	}
+
+	// Nor is the PTR name learned
+	proposal := proposeEgressPolicy(flows[:1], time.Now())
+	if len(proposal.Rules) != 1 || len(proposal.Rules[0].Domains) != 0 ||
+		!reflect.DeepEqual(proposal.Rules[0].ASNs, []string{"AS64511"}) {
+		t.Errorf("proposed %+v, want the ASN and no domain", proposal.Rules)
+	}
+}
+
+func TestEgressMonitorWaitsForPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	policy := NewEgressPolicy(path)
+	if _, err := policy.Reload(); err == nil {
+		t.Fatal("Reload of a missing file succeeded")
+	}
+	monitor := NewEgressMonitor(policy, nil, false)
+	out := NewWSHub(16).NewOutbox()
+	flows := []EgressFlow{
+		{Origin: "local", Process: "curl", IP: "203.0.113.9", Port: 443, edge: edgeKey{"local", "203.0.113.9"}},
+		{Origin: "local", Process: "chronyd", IP: "203.0.113.123", Port: 123, edge: edgeKey{"local", "203.0.113.123"}},
+	}
+
+	// Nothing is checked until a valid file loads
+	if got := monitor.Check(out, flows); len(got) != 0 || len(out.messages) != 0 {
+		t.Errorf("without a policy: violations %v, %d alerts", got, len(out.messages))
+	}
+
+	data, err := os.ReadFile(filepath.Join("testdata", "egress", "policy.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path, data, 0o644)
+	if changed, err := policy.Reload(); err != nil || !changed {
+		t.Fatalf("Reload once the file exists = %v, %v", changed, err)
+	}
+	want := map[edgeKey]string{{"local", "203.0.113.9"}: "egress curl → port 443"}
+	if got := monitor.Check(out, flows); !reflect.DeepEqual(got, want) {
+		t.Errorf("violations = %v, want %v", got, want)
+	}
+	monitor.Check(out, flows)
+	if len(out.messages) != 1 || out.messages[0].Alert.Type != "egress-policy" {
+		t.Errorf("alerts = %+v, want one egress-policy alert", out.messages)
+	}
+	if v := monitor.Violations(); len(v) != 1 || v[0].Process != "curl" {
+		t.Errorf("Violations = %+v", v)
+	}
+
+	learning := NewEgressMonitor(policy, nil, true)
+	if got := learning.Check(out, flows); len(got) != 0 {
+		t.Errorf("learn mode flagged %v", got)
+	}
+}
+
+func TestDryRunEgress(t *testing.T) {
+	rules := readEgressFixture(t)
+	h0 := time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC)
+	h1, h2 := h0.Add(time.Hour), h0.Add(2*time.Hour)
+	flows := []EgressFlow{
+		{Hour: h1, Origin: "local", Process: "curl", IP: "203.0.113.9", Port: 443, Names: []string{"a.example"}},
+		{Hour: h0, Origin: "local", Process: "curl", IP: "203.0.113.9", Port: 443},
+		{Hour: h1, Origin: "local", Process: "nginx", IP: "10.1.2.3", Port: 5432},
+		{Hour: h1, Origin: "local", Process: "wget", IP: "203.0.113.10", Port: 80},
+		{Hour: h2, Origin: "local", Process: "curl", IP: "203.0.113.9", Port: 443, ASN: "AS64500", Names: []string{"b.example", "a.example"}},
+	}
+	want := []*EgressViolation{
+		{Origin: "local", Process: "curl", IP: "203.0.113.9", Port: 443, ASN: "AS64500",
+			Names: []string{"a.example", "b.example"}, FirstSeen: h0, LastSeen: h2, Hours: 3},
+		{Origin: "local", Process: "wget", IP: "203.0.113.10", Port: 80, FirstSeen: h1, LastSeen: h1, Hours: 1},
+	}
+	if got := dryRunEgress(rules, flows); !reflect.DeepEqual(got, want) {
+		t.Errorf("dry run:\n got %+v\nwant %+v", got, want)
+	}
+	if got := dryRunEgress(rules, nil); len(got) != 0 {
+		t.Errorf("dry run without history = %+v", got)
+	}
+}
+
+func TestProposeEgressPolicy(t *testing.T) {
+	since := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	flows := []EgressFlow{
+		{Origin: "local", Process: "nginx", IP: "10.1.2.4", Port: 5432},
+		{Origin: "local", Process: "apt", IP: "198.51.100.1", Port: 443, ASN: "AS41231", Names: []string{"archive.ubuntu.com"}},
+		{Origin: "container:web", IP: "142.250.1.1", Port: 8080, ASN: "15169"},
+		{Origin: "local", Process: "nginx", IP: "10.1.2.3", Port: 5432},
+		{Origin: "local", Process: "apt", IP: "198.51.100.1", Port: 80, Names: []string{"archive.ubuntu.com"}},
+		{Origin: "local", Process: "nginx", IP: "::ffff:10.1.2.3", Port: 5432},
+		{Origin: "local", Process: "nginx", IP: "2001:db8::5", Port: 5432},
+		{Origin: "local", Process: "nginx", IP: "not an address", Port: 5432},
+	}
+	got := proposeEgressPolicy(flows, since)
+	want := &egressPolicyFile{
+		Version:     egressPolicyVersion,
+		Description: "Learned from 8 flows seen since 2026-10-01T00:00:00Z",
+		Rules: []egressRule{
+			{Origin: "container:web", ASNs: []string{"AS15169"}, Ports: []portRange{{8080, 8080}}},
+			{Process: "apt", Domains: []string{"archive.ubuntu.com"}, Ports: []portRange{{80, 80}, {443, 443}}},
+			{Process: "nginx", CIDRs: []string{"10.1.2.3/32", "10.1.2.4/32", "2001:db8::5/128"}, Ports: []portRange{{5432, 5432}}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("proposal:\n got %+v\nwant %+v", got, want)
+	}
+
+	// The proposal, saved as a policy, allows every flow it came from
+	data, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := parseEgressPolicy(data)
+	if err != nil {
+		t.Fatalf("proposal doesn't parse: %v\n%s", err, data)
+	}
+	for _, flow := range flows[:len(flows)-1] {
+		if !egressAllowed(rules, &flow) {
+			t.Errorf("proposal denies %+v", flow)
+		}
+	}
+	if got := proposeEgressPolicy(nil, since); got.Rules == nil || len(got.Rules) != 0 {
+		t.Errorf("proposal from no flows = %+v, want an empty rule list", got.Rules)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+// Enrichers holds the optional sources that annotate newly discovered nodes.
+// Any field may be nil when the feature is not configured.
+type Enrichers struct {
+	Intel   *ThreatIntel
+	ASN     *ASNIndex
+	Cloud   *CloudRanges
+	Zones   *ZonePolicy
+	Names   *NameResolver
+	Sniffer *ServiceSniffer
+	Traffic *TrafficMeter
+	Prober  *Prober
+	Tracer  *Tracer
+}
+
+// Enrich annotates a new node before it is added to the store
+func (e *Enrichers) Enrich(node *NetworkNode) {
+	if e.Intel != nil {
+		ApplyThreatMatch(node, e.Intel.Match(node.IPAddress))
+	}
+	if e.ASN != nil {
+		ApplyRouting(node, e.ASN.Lookup(node.IPAddress))
+	}
+	if e.Cloud != nil {
+		ApplyCloud(node, e.Cloud.Lookup(node.IPAddress))
+	}
+	if e.Zones != nil {
+		ApplyZone(node, e.Zones.Assign(node))
+	}
+	if e.Names != nil {
+		// Names seen in DNS answers before the connection opened apply immediately
+		ApplyNames(node, e.Names)
+	}
+}
+
+// Discovered starts background work for a node once it is in the store;
+// results are applied to the stored node as they arrive
+func (e *Enrichers) Discovered(node *NetworkNode) {
+	if e.Names != nil {
+		e.Names.Lookup(node.IPAddress)
+	}
+}
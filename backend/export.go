@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TopologySnapshot is the map at one moment, in a stable order so exports
+// of the same state are identical
+type TopologySnapshot struct {
+	Time  time.Time
+	Nodes []*NetworkNode // sorted by ID
+	Edges []WSConnection // sorted by from, then to
+	index map[string]*NetworkNode
+}
+
+// NewTopologySnapshot sorts the nodes and a copy of the edges
+func NewTopologySnapshot(nodes []*NetworkNode, edges []WSConnection, at time.Time) *TopologySnapshot {
+	s := &TopologySnapshot{Time: at, Nodes: nodes, Edges: append([]WSConnection(nil), edges...)}
+	sort.Slice(s.Nodes, func(i, j int) bool { return s.Nodes[i].ID < s.Nodes[j].ID })
+	sort.Slice(s.Edges, func(i, j int) bool {
+		if s.Edges[i].From != s.Edges[j].From {
+			return s.Edges[i].From < s.Edges[j].From
+		}
+		return s.Edges[i].To < s.Edges[j].To
+	})
+	s.index = make(map[string]*NetworkNode, len(nodes))
+	for _, node := range s.Nodes {
+		s.index[node.ID] = node
+	}
+	return s
+}
+
+// exportAttr is an attribute written by every export format. value returns
+// nil when the attribute is absent.
+type exportAttr[T any] struct {
+	name  string
+	kind  string // GraphML attr.type: string, int, long, double or boolean
+	value func(T) any
+}
+
+var nodeExportAttrs = []exportAttr[*NetworkNode]{
+	{"name", "string", func(n *NetworkNode) any { return optional(n.Name) }},
+	{"ip", "string", func(n *NetworkNode) any { return optional(n.IPAddress) }},
+	{"type", "string", func(n *NetworkNode) any { return optional(n.Type) }},
+	{"status", "string", func(n *NetworkNode) any { return optional(n.Status) }},
+	{"asn", "string", func(n *NetworkNode) any { return optional(n.ASN) }},
+	{"owner", "string", func(n *NetworkNode) any { return optional(n.Owner) }},
+	{"prefix", "string", func(n *NetworkNode) any {
+		if n.Routing == nil {
+			return nil
+		}
+		return n.Routing.Prefix
+	}},
+	{"cloud_provider", "string", func(n *NetworkNode) any {
+		if n.Cloud == nil {
+			return nil
+		}
+		return n.Cloud.Provider
+	}},
+	{"cloud_service", "string", func(n *NetworkNode) any {
+		if n.Cloud == nil {
+			return nil
+		}
+		return optional(n.Cloud.Service)
+	}},
+	{"cloud_region", "string", func(n *NetworkNode) any {
+		if n.Cloud == nil {
+			return nil
+		}
+		return optional(n.Cloud.Region)
+	}},
+	{"security_zone", "string", func(n *NetworkNode) any { return optional(n.SecurityZone) }},
+	{"country", "string", func(n *NetworkNode) any { return optional(n.Country) }},
+	{"city", "string", func(n *NetworkNode) any { return optional(n.City) }},
+	{"hostname", "string", func(n *NetworkNode) any { return optional(n.Hostname) }},
+	{"latitude", "double", func(n *NetworkNode) any { return located(n, n.Location.Lat) }},
+	{"longitude", "double", func(n *NetworkNode) any { return located(n, n.Location.Lng) }},
+	{"connections", "int", func(n *NetworkNode) any { return n.Connections }},
+	{"internal", "boolean", func(n *NetworkNode) any { return n.Internal }},
+	{"agent", "string", func(n *NetworkNode) any { return optional(n.Agent) }},
+	{"process", "string", func(n *NetworkNode) any { return optional(n.Process) }},
+	{"processes", "string", func(n *NetworkNode) any { return optional(strings.Join(n.Processes, ";")) }},
+	{"container_image", "string", func(n *NetworkNode) any {
+		if n.Container == nil {
+			return nil
+		}
+		return optional(n.Container.Image)
+	}},
+	{"pod", "string", func(n *NetworkNode) any {
+		if n.Container == nil {
+			return nil
+		}
+		return optional(n.Container.Pod)
+	}},
+	{"pod_namespace", "string", func(n *NetworkNode) any {
+		if n.Container == nil {
+			return nil
+		}
+		return optional(n.Container.Namespace)
+	}},
+	{"reputation", "int", func(n *NetworkNode) any { return n.Reputation }},
+	{"threat_feeds", "string", func(n *NetworkNode) any { return optional(strings.Join(n.ThreatFeeds, ";")) }},
+	{"bytes_in", "long", func(n *NetworkNode) any {
+		return trafficValue(n.Traffic, func(t *TrafficStats) any { return t.BytesIn })
+	}},
+	{"bytes_out", "long", func(n *NetworkNode) any {
+		return trafficValue(n.Traffic, func(t *TrafficStats) any { return t.BytesOut })
+	}},
+	{"first_seen", "string", func(n *NetworkNode) any { return timeValue(n.FirstSeen) }},
+	{"last_seen", "string", func(n *NetworkNode) any { return timeValue(n.LastSeen) }},
+}
+
+var edgeExportAttrs = []exportAttr[WSConnection]{
+	{"server_names", "string", func(e WSConnection) any {
+		return serviceValue(e.Service, func(s *ServiceInfo) []string { return s.ServerNames })
+	}},
+	{"http_hosts", "string", func(e WSConnection) any {
+		return serviceValue(e.Service, func(s *ServiceInfo) []string { return s.HTTPHosts })
+	}},
+	{"alpn", "string", func(e WSConnection) any {
+		return serviceValue(e.Service, func(s *ServiceInfo) []string { return s.ALPN })
+	}},
+	{"bytes_in", "long", func(e WSConnection) any {
+		return trafficValue(e.Traffic, func(t *TrafficStats) any { return t.BytesIn })
+	}},
+	{"bytes_out", "long", func(e WSConnection) any {
+		return trafficValue(e.Traffic, func(t *TrafficStats) any { return t.BytesOut })
+	}},
+	{"rate_in", "double", func(e WSConnection) any {
+		return trafficValue(e.Traffic, func(t *TrafficStats) any { return t.RateIn })
+	}},
+	{"rate_out", "double", func(e WSConnection) any {
+		return trafficValue(e.Traffic, func(t *TrafficStats) any { return t.RateOut })
+	}},
+	{"latency_ms", "double", func(e WSConnection) any {
+		if e.Latency == 0 {
+			return nil
+		}
+		return e.Latency
+	}},
+	{"violation", "string", func(e WSConnection) any { return optional(e.Violation) }},
+}
+
+func optional(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// hasLocation reports whether a node was placed on the map; GeoIP misses
+// leave it at 0,0
+func hasLocation(n *NetworkNode) bool {
+	return n.Location != (Location{})
+}
+
+func located(n *NetworkNode, v float64) any {
+	if !hasLocation(n) {
+		return nil
+	}
+	return v
+}
+
+func timeValue(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func trafficValue(t *TrafficStats, field func(*TrafficStats) any) any {
+	if t == nil {
+		return nil
+	}
+	return field(t)
+}
+
+func serviceValue(s *ServiceInfo, field func(*ServiceInfo) []string) any {
+	if s == nil {
+		return nil
+	}
+	return optional(strings.Join(field(s), ";"))
+}
+
+// formatAttr writes a value the same way in every text format
+func formatAttr(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// exportFormat is one output format of /api/export and the export command
+type exportFormat struct {
+	contentType string
+	extension   string
+	write       func(io.Writer, *TopologySnapshot) error
+}
+
+var exportFormats = map[string]exportFormat{
+	"graphml":   {"application/graphml+xml", "graphml", WriteGraphML},
+	"gexf":      {"application/gexf+xml", "gexf", WriteGEXF},
+	"dot":       {"text/vnd.graphviz", "dot", WriteDOT},
+	"geojson":   {"application/geo+json", "geojson", WriteGeoJSON},
+	"csv":       {"text/csv", "csv", WriteNodesCSV},
+	"csv-edges": {"text/csv", "edges.csv", WriteEdgesCSV},
+}
+
+// exportFormatNames lists the formats for usage and error messages
+func exportFormatNames() string {
+	names := make([]string, 0, len(exportFormats))
+	for name := range exportFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// xmlEscape escapes text for XML attribute values and character data
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// WriteGraphML writes the snapshot as GraphML (yEd, Gephi, NetworkX)
+func WriteGraphML(w io.Writer, s *TopologySnapshot) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(xml.Header)
+	bw.WriteString(`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">` + "\n")
+	for _, a := range nodeExportAttrs {
+		fmt.Fprintf(bw, "  <key id=\"n_%s\" for=\"node\" attr.name=\"%s\" attr.type=\"%s\"/>\n", a.name, a.name, a.kind)
+	}
+	for _, a := range edgeExportAttrs {
+		fmt.Fprintf(bw, "  <key id=\"e_%s\" for=\"edge\" attr.name=\"%s\" attr.type=\"%s\"/>\n", a.name, a.name, a.kind)
+	}
+	bw.WriteString("  <graph id=\"netops\" edgedefault=\"directed\">\n")
+	for _, node := range s.Nodes {
+		fmt.Fprintf(bw, "    <node id=\"%s\">\n", xmlEscape(node.ID))
+		for _, a := range nodeExportAttrs {
+			if v := a.value(node); v != nil {
+				fmt.Fprintf(bw, "      <data key=\"n_%s\">%s</data>\n", a.name, xmlEscape(formatAttr(v)))
+			}
+		}
+		bw.WriteString("    </node>\n")
+	}
+	for i, edge := range s.Edges {
+		fmt.Fprintf(bw, "    <edge id=\"e%d\" source=\"%s\" target=\"%s\">\n", i, xmlEscape(edge.From), xmlEscape(edge.To))
+		for _, a := range edgeExportAttrs {
+			if v := a.value(edge); v != nil {
+				fmt.Fprintf(bw, "      <data key=\"e_%s\">%s</data>\n", a.name, xmlEscape(formatAttr(v)))
+			}
+		}
+		bw.WriteString("    </edge>\n")
+	}
+	bw.WriteString("  </graph>\n</graphml>\n")
+	return bw.Flush()
+}
+
+// gexfType maps GraphML attribute types to GEXF ones
+func gexfType(kind string) string {
+	if kind == "int" {
+		return "integer"
+	}
+	return kind
+}
+
+// WriteGEXF writes the snapshot as GEXF 1.3 (Gephi). Nodes are positioned
+// at their map coordinates, longitude as x and latitude as y.
+func WriteGEXF(w io.Writer, s *TopologySnapshot) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(xml.Header)
+	bw.WriteString(`<gexf xmlns="http://gexf.net/1.3" xmlns:viz="http://gexf.net/1.3/viz" version="1.3">` + "\n")
+	fmt.Fprintf(bw, "  <meta lastmodifieddate=\"%s\">\n    <creator>NetOps</creator>\n  </meta>\n", s.Time.UTC().Format(time.DateOnly))
+	bw.WriteString("  <graph mode=\"static\" defaultedgetype=\"directed\">\n")
+	bw.WriteString("    <attributes class=\"node\">\n")
+	for i, a := range nodeExportAttrs {
+		fmt.Fprintf(bw, "      <attribute id=\"%d\" title=\"%s\" type=\"%s\"/>\n", i, a.name, gexfType(a.kind))
+	}
+	bw.WriteString("    </attributes>\n    <attributes class=\"edge\">\n")
+	for i, a := range edgeExportAttrs {
+		fmt.Fprintf(bw, "      <attribute id=\"%d\" title=\"%s\" type=\"%s\"/>\n", i, a.name, gexfType(a.kind))
+	}
+	bw.WriteString("    </attributes>\n    <nodes>\n")
+	for _, node := range s.Nodes {
+		fmt.Fprintf(bw, "      <node id=\"%s\" label=\"%s\">\n        <attvalues>\n", xmlEscape(node.ID), xmlEscape(node.Name))
+		for i, a := range nodeExportAttrs {
+			if v := a.value(node); v != nil {
+				fmt.Fprintf(bw, "          <attvalue for=\"%d\" value=\"%s\"/>\n", i, xmlEscape(formatAttr(v)))
+			}
+		}
+		bw.WriteString("        </attvalues>\n")
+		if hasLocation(node) {
+			fmt.Fprintf(bw, "        <viz:position x=\"%s\" y=\"%s\"/>\n", formatAttr(node.Location.Lng), formatAttr(node.Location.Lat))
+		}
+		bw.WriteString("      </node>\n")
+	}
+	bw.WriteString("    </nodes>\n    <edges>\n")
+	for i, edge := range s.Edges {
+		fmt.Fprintf(bw, "      <edge id=\"%d\" source=\"%s\" target=\"%s\">\n        <attvalues>\n", i, xmlEscape(edge.From), xmlEscape(edge.To))
+		for j, a := range edgeExportAttrs {
+			if v := a.value(edge); v != nil {
+				fmt.Fprintf(bw, "          <attvalue for=\"%d\" value=\"%s\"/>\n", j, xmlEscape(formatAttr(v)))
+			}
+		}
+		bw.WriteString("        </attvalues>\n      </edge>\n")
+	}
+	bw.WriteString("    </edges>\n  </graph>\n</gexf>\n")
+	return bw.Flush()
+}
+
+// dotQuote quotes a string as a DOT ID
+func dotQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// WriteDOT writes the snapshot as a Graphviz digraph
+func WriteDOT(w io.Writer, s *TopologySnapshot) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("digraph netops {\n")
+	for _, node := range s.Nodes {
+		attrs := []string{"label=" + dotQuote(node.Name)}
+		for _, a := range nodeExportAttrs {
+			if v := a.value(node); v != nil && a.name != "name" {
+				attrs = append(attrs, a.name+"="+dotQuote(formatAttr(v)))
+			}
+		}
+		fmt.Fprintf(bw, "  %s [%s];\n", dotQuote(node.ID), strings.Join(attrs, ", "))
+	}
+	for _, edge := range s.Edges {
+		var attrs []string
+		for _, a := range edgeExportAttrs {
+			if v := a.value(edge); v != nil {
+				attrs = append(attrs, a.name+"="+dotQuote(formatAttr(v)))
+			}
+		}
+		fmt.Fprintf(bw, "  %s -> %s", dotQuote(edge.From), dotQuote(edge.To))
+		if len(attrs) > 0 {
+			fmt.Fprintf(bw, " [%s]", strings.Join(attrs, ", "))
+		}
+		bw.WriteString(";\n")
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// geoJSONFeature is a GeoJSON Feature; Geometry is nil for nodes without a
+// location
+type geoJSONFeature struct {
+	Type       string         `json:"type"`
+	ID         string         `json:"id"`
+	Geometry   any            `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+// WriteGeoJSON writes nodes as Points and edges as great-circle
+// LineStrings (MultiLineStrings when they cross the antimeridian). The
+// "kind" property tells them apart.
+func WriteGeoJSON(w io.Writer, s *TopologySnapshot) error {
+	features := make([]geoJSONFeature, 0, len(s.Nodes)+len(s.Edges))
+	for _, node := range s.Nodes {
+		props := map[string]any{"kind": "node", "id": node.ID}
+		for _, a := range nodeExportAttrs {
+			if v := a.value(node); v != nil {
+				props[a.name] = v
+			}
+		}
+		f := geoJSONFeature{Type: "Feature", ID: node.ID, Properties: props}
+		if hasLocation(node) {
+			f.Geometry = geoJSONGeometry{Type: "Point", Coordinates: []float64{node.Location.Lng, node.Location.Lat}}
+		}
+		features = append(features, f)
+	}
+	for _, edge := range s.Edges {
+		props := map[string]any{"kind": "edge", "from": edge.From, "to": edge.To}
+		for _, a := range edgeExportAttrs {
+			if v := a.value(edge); v != nil {
+				props[a.name] = v
+			}
+		}
+		f := geoJSONFeature{Type: "Feature", ID: edge.From + ">" + edge.To, Properties: props}
+		from, to := s.index[edge.From], s.index[edge.To]
+		if from != nil && to != nil && hasLocation(from) && hasLocation(to) {
+			parts := splitAntimeridian(greatCircle(from.Location, to.Location))
+			if len(parts) == 1 {
+				f.Geometry = geoJSONGeometry{Type: "LineString", Coordinates: parts[0]}
+			} else {
+				f.Geometry = geoJSONGeometry{Type: "MultiLineString", Coordinates: parts}
+			}
+		}
+		features = append(features, f)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]any{"type": "FeatureCollection", "features": features})
+}
+
+// greatCircle interpolates the shortest path between two points, with a
+// vertex about every 100km (at least the two ends)
+func greatCircle(a, b Location) [][]float64 {
+	rad := math.Pi / 180
+	lat1, lng1 := a.Lat*rad, a.Lng*rad
+	lat2, lng2 := b.Lat*rad, b.Lng*rad
+
+	// Central angle by the haversine formula
+	d := 2 * math.Asin(math.Sqrt(math.Pow(math.Sin((lat2-lat1)/2), 2)+
+		math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin((lng2-lng1)/2), 2)))
+	// The same or antipodal points have no single shortest path, and the
+	// interpolation below would divide by zero
+	sinD := math.Sin(d)
+	if sinD < 1e-9 {
+		return [][]float64{{a.Lng, a.Lat}, {b.Lng, b.Lat}}
+	}
+	steps := max(1, int(math.Ceil(d*6371/100)))
+
+	points := make([][]float64, 0, steps+1)
+	for i := 0; i <= steps; i++ {
+		f := float64(i) / float64(steps)
+		p := math.Sin((1-f)*d) / sinD
+		q := math.Sin(f*d) / sinD
+		x := p*math.Cos(lat1)*math.Cos(lng1) + q*math.Cos(lat2)*math.Cos(lng2)
+		y := p*math.Cos(lat1)*math.Sin(lng1) + q*math.Cos(lat2)*math.Sin(lng2)
+		z := p*math.Sin(lat1) + q*math.Sin(lat2)
+		lat := math.Atan2(z, math.Hypot(x, y)) / rad
+		lng := math.Atan2(y, x) / rad
+		points = append(points, []float64{roundCoord(lng), roundCoord(lat)})
+	}
+	// Keep the ends exact
+	points[0] = []float64{a.Lng, a.Lat}
+	points[steps] = []float64{b.Lng, b.Lat}
+	return points
+}
+
+// roundCoord keeps six decimals, about 10cm
+func roundCoord(v float64) float64 {
+	return math.Round(v*1e6) / 1e6
+}
+
+// splitAntimeridian breaks a line where it jumps across longitude ±180,
+// ending one part and starting the next on the meridian
+func splitAntimeridian(points [][]float64) [][][]float64 {
+	parts := [][][]float64{{points[0]}}
+	for i := 1; i < len(points); i++ {
+		prev, cur := points[i-1], points[i]
+		if math.Abs(cur[0]-prev[0]) > 180 {
+			edge := 180.0
+			if prev[0] < 0 {
+				edge = -180
+			}
+			// Latitude where the segment meets the meridian, measuring
+			// the current point's longitude on the far side
+			curLng := cur[0] + 2*edge
+			f := (edge - prev[0]) / (curLng - prev[0])
+			lat := roundCoord(prev[1] + f*(cur[1]-prev[1]))
+			last := len(parts) - 1
+			parts[last] = append(parts[last], []float64{edge, lat})
+			parts = append(parts, [][]float64{{-edge, lat}})
+		}
+		last := len(parts) - 1
+		parts[last] = append(parts[last], cur)
+	}
+	return parts
+}
+
+// WriteNodesCSV writes one row per node
+func WriteNodesCSV(w io.Writer, s *TopologySnapshot) error {
+	cw := csv.NewWriter(w)
+	header := []string{"id"}
+	for _, a := range nodeExportAttrs {
+		header = append(header, a.name)
+	}
+	cw.Write(header)
+	for _, node := range s.Nodes {
+		row := []string{node.ID}
+		for _, a := range nodeExportAttrs {
+			row = append(row, formatAttr(a.value(node)))
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteEdgesCSV writes one row per edge
+func WriteEdgesCSV(w io.Writer, s *TopologySnapshot) error {
+	cw := csv.NewWriter(w)
+	header := []string{"from", "to"}
+	for _, a := range edgeExportAttrs {
+		header = append(header, a.name)
+	}
+	cw.Write(header)
+	for _, edge := range s.Edges {
+		row := []string{edge.From, edge.To}
+		for _, a := range edgeExportAttrs {
+			row = append(row, formatAttr(a.value(edge)))
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// HandleExport downloads the current topology.
+// GET /api/export?format=graphml|gexf|dot|geojson|csv|csv-edges
+func HandleExport(hub *WSHub, store *NodeStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("format")
+		format, ok := exportFormats[name]
+		if !ok {
+			http.Error(w, "format must be one of "+exportFormatNames(), http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		snapshot := NewTopologySnapshot(store.Snapshot(), hub.Edges(), now)
+
+		w.Header().Set("Content-Type", format.contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"netops-%s.%s\"",
+			now.UTC().Format("20060102-150405"), format.extension))
+		if err := format.write(w, snapshot); err != nil {
+			slog.Warn("Export failed", "component", "api", "format", name, "error", err)
+		}
+	}
+}
+
+// runExport implements "netops-backend export [flags] <format>": it
+// downloads an export from a running server
+func runExport(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	server := flags.String("server", envString("NETOPS_SERVER", "http://localhost:8081"), "backend URL")
+	token := flags.String("token", os.Getenv("NETOPS_TOKEN"), "API token, if the backend requires one")
+	output := flags.String("o", "", "output file (default stdout)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: netops-backend export [flags] <format>\n\nFormats: %s\n\nFlags:\n", exportFormatNames())
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := downloadExport(*server, *token, flags.Arg(0), *output); err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func downloadExport(server, token, format, output string) error {
+	if _, ok := exportFormats[format]; !ok {
+		return fmt.Errorf("unknown format %q (expected one of %s)", format, exportFormatNames())
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(server, "/")+"/api/export?format="+format, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var out io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
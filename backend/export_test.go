@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// exportSnapshot covers every attribute, characters each format escapes,
+// an edge across the antimeridian and one between antipodal points
+func exportSnapshot() *TopologySnapshot {
+	seen := time.Date(2026, 10, 19, 8, 30, 0, 0, time.UTC)
+	nodes := []*NetworkNode{
+		{
+			ID: "local", Name: `ops "laptop"`, IPAddress: "192.168.1.10", Type: "local",
+			Status: "online", Internal: true, Location: Location{Lat: 52.37, Lng: 4.89},
+			Country: "NL", City: "Amsterdam", Connections: 4, SecurityZone: "office",
+			Process: "firefox", Processes: []string{"firefox", "curl"},
+			Traffic:   &TrafficStats{BytesIn: 1 << 33, BytesOut: 4096},
+			FirstSeen: seen.Add(-time.Hour), LastSeen: seen,
+		},
+		{
+			ID: "203.0.113.9", Name: "cdn <edge> & co, ltd", IPAddress: "203.0.113.9", Type: "cloud",
+			Status: "online", ASN: "AS64500", Owner: "Example CDN", Hostname: "edge9.example.net",
+			Location: Location{Lat: 51.51, Lng: -0.13}, Country: "GB", City: "London",
+			Routing:     &RoutingInfo{Prefix: "203.0.113.0/24", Origin: []uint32{64500}},
+			Cloud:       &CloudInfo{Provider: "aws", Service: "CLOUDFRONT", Region: "eu-west-2", Prefix: "203.0.113.0/24"},
+			Reputation:  -2,
+			ThreatFeeds: []string{"feodo", "drop"},
+			LastSeen:    seen,
+		},
+		{ID: "suva", Name: "suva", Location: Location{Lat: -18.14, Lng: 178.44}},
+		{ID: "apia", Name: "apia", Location: Location{Lat: -13.83, Lng: -171.76}},
+		{ID: "north", Name: "north", Location: Location{Lat: 10, Lng: 20}},
+		{ID: "south", Name: "south", Location: Location{Lat: -10, Lng: -160}},
+		{
+			ID: "10.42.0.7", Name: "api-7d9f", IPAddress: "10.42.0.7", Type: "container", Internal: true,
+			Agent:     "web-1",
+			Container: &ContainerInfo{ID: "abc123", Image: "ghcr.io/example/api:1.4", Pod: "api-7d9f", Namespace: "prod"},
+		},
+	}
+	edges := []WSConnection{
+		{From: "suva", To: "apia"},
+		{From: "local", To: "203.0.113.9", Latency: 11.25,
+			Service: &ServiceInfo{ServerNames: []string{"example.net", "www.example.net"}, ALPN: []string{"h2"}, HTTPHosts: []string{"example.net"}},
+			Traffic: &TrafficStats{BytesIn: 52000, BytesOut: 1200, RateIn: 512.5, RateOut: 12},
+		},
+		{From: "north", To: "south"},
+		{From: "local", To: "10.42.0.7", Violation: "office → prod"},
+	}
+	return NewTopologySnapshot(nodes, edges, seen)
+}
+
+func TestExportGolden(t *testing.T) {
+	for name, format := range exportFormats {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := format.write(&buf, exportSnapshot()); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join("testdata", "export", "topology."+format.extension)
+			if *updateGolden {
+				if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("%s export differs from %s (rerun with -update to accept)\n%s", name, path, buf.String())
+			}
+		})
+	}
+}
+
+func TestGeoJSONGeometry(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteGeoJSON(&buf, exportSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Features []struct {
+			ID       string `json:"id"`
+			Geometry struct {
+				Type string `json:"type"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	types := make(map[string]string)
+	for _, f := range doc.Features {
+		types[f.ID] = f.Geometry.Type
+	}
+	for id, want := range map[string]string{
+		"suva>apia":       "MultiLineString",
+		"north>south":     "LineString",
+		"local>10.42.0.7": "", // no location for the container
+	} {
+		if types[id] != want {
+			t.Errorf("%s geometry = %q, want %q", id, types[id], want)
+		}
+	}
+}
+
+func TestGreatCircle(t *testing.T) {
+	tests := []struct {
+		name   string
+		a, b   Location
+		points int
+	}{
+		{"same point", Location{Lat: 1, Lng: 2}, Location{Lat: 1, Lng: 2}, 2},
+		{"antipodal", Location{Lat: 10, Lng: 20}, Location{Lat: -10, Lng: -160}, 2},
+		{"nearly antipodal", Location{Lat: 0, Lng: 0.5}, Location{Lat: 0, Lng: -179.5}, 2},
+		{"short", Location{Lat: 52.37, Lng: 4.89}, Location{Lat: 52.52, Lng: 13.40}, 7},
+	}
+	for _, tt := range tests {
+		points := greatCircle(tt.a, tt.b)
+		if len(points) != tt.points {
+			t.Errorf("%s: %d points, want %d", tt.name, len(points), tt.points)
+		}
+		for _, p := range points {
+			if math.IsNaN(p[0]) || math.IsNaN(p[1]) {
+				t.Fatalf("%s: NaN in %v", tt.name, points)
+			}
+		}
+		if first, last := points[0], points[len(points)-1]; first[0] != tt.a.Lng || first[1] != tt.a.Lat ||
+			last[0] != tt.b.Lng || last[1] != tt.b.Lat {
+			t.Errorf("%s: ends %v, %v", tt.name, first, last)
+		}
+	}
+}
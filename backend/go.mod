@@ -2,4 +2,13 @@ module netops-backend
 
 go 1.25.5
 
-require github.com/gorilla/websocket v1.5.3 // indirect
+require github.com/gorilla/websocket v1.5.3
+
+require golang.org/x/net v0.51.0
+
+require (
+	golang.org/x/crypto v0.49.0
+	golang.org/x/term v0.41.0
+)
+
+require golang.org/x/sys v0.42.0
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Grouping modes a /ws client may ask for. A group node stands in for
+// every node that shares the attribute; nodes without it, this host and
+// internal hosts are always shown individually.
+const (
+	groupByASN     = "asn"
+	groupByPrefix  = "prefix" // the /24 or /48 around the address
+	groupByOwner   = "owner"
+	groupByCountry = "country"
+	groupByCity    = "city"
+)
+
+// groupIDPrefix starts the ID of every group node
+const groupIDPrefix = "group:"
+
+// GroupInfo describes a group node
+type GroupInfo struct {
+	By      string `json:"by"`  // grouping mode
+	Key     string `json:"key"` // the value the members share
+	Members int    `json:"members"`
+}
+
+// validGroupBy reports whether by names a grouping mode
+func validGroupBy(by string) bool {
+	switch by {
+	case groupByASN, groupByPrefix, groupByOwner, groupByCountry, groupByCity:
+		return true
+	}
+	return false
+}
+
+// groupKey returns the key a node is grouped under and a display name for
+// the group, or an empty key when the node stays on its own
+func groupKey(node *NetworkNode, by string) (key, label string) {
+	if node.ID == "local" || node.Internal {
+		return "", ""
+	}
+	switch by {
+	case groupByASN:
+		asn := normalizeASN(node.ASN)
+		if asn == "" {
+			return "", ""
+		}
+		label = "AS" + asn
+		if node.Routing != nil && node.Routing.Name != "" {
+			label += " " + node.Routing.Name
+		} else if node.Owner != "" {
+			label += " " + node.Owner
+		}
+		return asn, label
+	case groupByPrefix:
+		addr, err := netip.ParseAddr(node.IPAddress)
+		if err != nil {
+			return "", ""
+		}
+		addr = addr.Unmap()
+		bits := 24
+		if addr.Is6() {
+			bits = 48
+		}
+		prefix := netip.PrefixFrom(addr, bits).Masked().String()
+		return prefix, prefix
+	case groupByOwner:
+		owner := strings.TrimSpace(node.Owner)
+		return strings.ToLower(owner), owner
+	case groupByCountry:
+		country := strings.ToUpper(node.Country)
+		return country, country
+	case groupByCity:
+		if node.City == "" {
+			return "", ""
+		}
+		country := strings.ToUpper(node.Country)
+		return strings.ToLower(node.City) + "," + country, node.City + ", " + country
+	}
+	return "", ""
+}
+
+// groupID is the node ID of a group
+func groupID(by, key string) string {
+	return groupIDPrefix + by + ":" + key
+}
+
+// newGroupNode rolls members up into one node: connections and traffic
+// are summed, the location is the centroid of the members that have one,
+// and attributes are kept where every member agrees
+func newGroupNode(by, key, label string, members []*NetworkNode) *NetworkNode {
+	members = slices.SortedFunc(slices.Values(members), func(a, b *NetworkNode) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	g := &NetworkNode{
+		ID:     groupID(by, key),
+		Name:   fmt.Sprintf("%s (%d)", label, len(members)),
+		Status: "offline",
+		Group:  &GroupInfo{By: by, Key: key, Members: len(members)},
+	}
+	if by == groupByPrefix {
+		g.IPAddress = key
+	}
+
+	types := make(map[string]int)
+	feeds := make(map[string]bool)
+	located := 0
+	for i, m := range members {
+		if i == 0 {
+			g.Country, g.City, g.ASN, g.Owner = m.Country, m.City, m.ASN, m.Owner
+			g.SecurityZone = m.SecurityZone
+			g.FirstSeen, g.LastSeen = m.FirstSeen, m.LastSeen
+		}
+		if g.Country != m.Country {
+			g.Country = ""
+		}
+		if g.City != m.City {
+			g.City = ""
+		}
+		if g.ASN != m.ASN {
+			g.ASN = ""
+		}
+		if g.Owner != m.Owner {
+			g.Owner = ""
+		}
+		if g.SecurityZone != m.SecurityZone {
+			g.SecurityZone = ""
+		}
+		if m.FirstSeen.Before(g.FirstSeen) {
+			g.FirstSeen = m.FirstSeen
+		}
+		if m.LastSeen.After(g.LastSeen) {
+			g.LastSeen = m.LastSeen
+		}
+		if m.Status == "online" {
+			g.Status = "online"
+		}
+		if m.Location != (Location{}) {
+			g.Location.Lat += m.Location.Lat
+			g.Location.Lng += m.Location.Lng
+			located++
+		}
+		g.Connections += m.Connections
+		g.Traffic = addTraffic(g.Traffic, m.Traffic)
+		g.Reputation = max(g.Reputation, m.Reputation)
+		for _, feed := range m.ThreatFeeds {
+			feeds[feed] = true
+		}
+		types[m.Type]++
+	}
+	if located > 0 {
+		g.Location.Lat /= float64(located)
+		g.Location.Lng /= float64(located)
+	}
+	for t, n := range types {
+		if n > types[g.Type] || (n == types[g.Type] && t < g.Type) {
+			g.Type = t
+		}
+	}
+	if len(feeds) > 0 {
+		g.ThreatFeeds = slices.Sorted(maps.Keys(feeds))
+	}
+	return g
+}
+
+// addTraffic sums two sets of counters; either may be nil
+func addTraffic(a, b *TrafficStats) *TrafficStats {
+	if b == nil {
+		return a
+	}
+	sum := TrafficStats{}
+	if a != nil {
+		sum = *a
+	}
+	sum.BytesIn += b.BytesIn
+	sum.BytesOut += b.BytesOut
+	sum.PacketsIn += b.PacketsIn
+	sum.PacketsOut += b.PacketsOut
+	sum.RateIn += b.RateIn
+	sum.RateOut += b.RateOut
+	sum.RateIn1m += b.RateIn1m
+	sum.RateOut1m += b.RateOut1m
+	sum.PacketRate += b.PacketRate
+	return &sum
+}
+
+// Grouping is one client's roll-up of the nodes it is sent. It keeps the
+// latest copy of every node it was given so a change to one member can
+// update its group without going back to the store.
+type Grouping struct {
+	By       string
+	expanded map[string]bool            // group IDs shown as their members
+	nodes    map[string]*NetworkNode    // every node given, by ID
+	members  map[string]map[string]bool // group ID -> member IDs
+	labels   map[string]string          // group ID -> display name
+}
+
+// NewGrouping creates an empty roll-up in mode by
+func NewGrouping(by string) *Grouping {
+	return &Grouping{
+		By:       by,
+		expanded: make(map[string]bool),
+		nodes:    make(map[string]*NetworkNode),
+		members:  make(map[string]map[string]bool),
+		labels:   make(map[string]string),
+	}
+}
+
+// shownAs returns the ID a node is displayed under: its group's, or its
+// own when it isn't grouped or its group is expanded
+func (g *Grouping) shownAs(node *NetworkNode) (id, label string) {
+	key, label := groupKey(node, g.By)
+	if key == "" {
+		return node.ID, ""
+	}
+	id = groupID(g.By, key)
+	if g.expanded[id] {
+		return node.ID, ""
+	}
+	return id, label
+}
+
+// Set records the latest copy of a node, or its removal when node is nil,
+// and returns the IDs it was and now is shown under
+func (g *Grouping) Set(id string, node *NetworkNode) (before, after string) {
+	if old, ok := g.nodes[id]; ok {
+		before, _ = g.shownAs(old)
+		if before != id {
+			delete(g.members[before], id)
+		}
+		delete(g.nodes, id)
+	}
+	if node == nil {
+		return before, ""
+	}
+	g.nodes[id] = node
+	after, label := g.shownAs(node)
+	if after != id {
+		if g.members[after] == nil {
+			g.members[after] = make(map[string]bool)
+		}
+		g.members[after][id] = true
+		g.labels[after] = label
+	}
+	return before, after
+}
+
+// Group returns the current group node for a group ID, or nil once it has
+// no members left
+func (g *Grouping) Group(id string) *NetworkNode {
+	ids := g.members[id]
+	if len(ids) == 0 {
+		delete(g.members, id)
+		delete(g.labels, id)
+		return nil
+	}
+	members := make([]*NetworkNode, 0, len(ids))
+	for member := range ids {
+		members = append(members, g.nodes[member])
+	}
+	key := strings.TrimPrefix(id, groupIDPrefix+g.By+":")
+	return newGroupNode(g.By, key, g.labels[id], members)
+}
+
+// Detail returns a group node and copies of its members, sorted by ID,
+// or nil when no node is in the group. It works for expanded groups too.
+func (g *Grouping) Detail(id string) (*NetworkNode, []*NetworkNode) {
+	var key, label string
+	var members []*NetworkNode
+	for _, node := range g.nodes {
+		if k, l := groupKey(node, g.By); k != "" && groupID(g.By, k) == id {
+			key, label = k, l
+			members = append(members, copyNode(node))
+		}
+	}
+	if len(members) == 0 {
+		return nil, nil
+	}
+	slices.SortFunc(members, func(a, b *NetworkNode) int { return cmp.Compare(a.ID, b.ID) })
+	return newGroupNode(g.By, key, label, members), members
+}
+
+// ShownAs returns the ID a node is displayed under, or "" for a node the
+// grouping wasn't given
+func (g *Grouping) ShownAs(id string) string {
+	node, ok := g.nodes[id]
+	if !ok {
+		return ""
+	}
+	shown, _ := g.shownAs(node)
+	return shown
+}
+
+// Expand shows a group as its members, or collapses it again
+func (g *Grouping) Expand(id string, expand bool) {
+	if expand {
+		g.expanded[id] = true
+	} else {
+		delete(g.expanded, id)
+	}
+}
+
+// Reset replaces every node and returns what is to be displayed: group
+// nodes and the nodes shown individually
+func (g *Grouping) Reset(nodes []*NetworkNode) []*NetworkNode {
+	g.nodes = make(map[string]*NetworkNode, len(nodes))
+	g.members = make(map[string]map[string]bool)
+	g.labels = make(map[string]string)
+	var shown []*NetworkNode
+	for _, node := range nodes {
+		if _, after := g.Set(node.ID, node); after == node.ID {
+			shown = append(shown, node)
+		}
+	}
+	for id := range g.members {
+		shown = append(shown, g.Group(id))
+	}
+	return shown
+}
+
+// RollUpEdges moves each edge's ends to the nodes they are shown under and
+// merges edges that end up joining the same pair. Edges inside a group and
+// edges to nodes the grouping wasn't given are dropped.
+func (g *Grouping) RollUpEdges(edges []WSConnection) []WSConnection {
+	var out []WSConnection
+	index := make(map[edgeKey]int)
+	for _, edge := range edges {
+		from, ok := g.nodes[edge.From]
+		if !ok {
+			continue
+		}
+		to, ok := g.nodes[edge.To]
+		if !ok {
+			continue
+		}
+		edge.From, _ = g.shownAs(from)
+		edge.To, _ = g.shownAs(to)
+		if edge.From == edge.To {
+			continue
+		}
+		key := edgeKey{edge.From, edge.To}
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(out)
+			out = append(out, edge)
+			continue
+		}
+		// Merged edges keep the slowest path, no single service, and a
+		// violation if any member edge had one
+		merged := &out[i]
+		merged.Traffic = addTraffic(merged.Traffic, edge.Traffic)
+		merged.Latency = max(merged.Latency, edge.Latency)
+		merged.Service = nil
+		merged.Violation = cmp.Or(merged.Violation, edge.Violation)
+	}
+	return out
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestGroupKey(t *testing.T) {
+	tests := []struct {
+		by         string
+		node       NetworkNode
+		key, label string
+	}{
+		{groupByASN, NetworkNode{ASN: "AS64500", Owner: "Example Hosting"}, "64500", "AS64500 Example Hosting"},
+		// The routing name wins over GeoIP's owner
+		{groupByASN, NetworkNode{ASN: "as64500", Owner: "Example Hosting", Routing: &RoutingInfo{Name: "EXAMPLE-NET"}}, "64500", "AS64500 EXAMPLE-NET"},
+		{groupByASN, NetworkNode{ASN: "64500"}, "64500", "AS64500"},
+		{groupByASN, NetworkNode{Owner: "Example Hosting"}, "", ""},
+		{groupByPrefix, NetworkNode{IPAddress: "203.0.113.77"}, "203.0.113.0/24", "203.0.113.0/24"},
+		{groupByPrefix, NetworkNode{IPAddress: "::ffff:203.0.113.77"}, "203.0.113.0/24", "203.0.113.0/24"},
+		{groupByPrefix, NetworkNode{IPAddress: "2001:db8:1:2::5"}, "2001:db8:1::/48", "2001:db8:1::/48"},
+		{groupByPrefix, NetworkNode{ID: "hop-3"}, "", ""},
+		{groupByOwner, NetworkNode{Owner: " Example Hosting "}, "example hosting", "Example Hosting"},
+		{groupByOwner, NetworkNode{ASN: "AS64500"}, "", ""},
+		{groupByCountry, NetworkNode{Country: "de"}, "DE", "DE"},
+		{groupByCountry, NetworkNode{}, "", ""},
+		{groupByCity, NetworkNode{City: "Berlin", Country: "de"}, "berlin,DE", "Berlin, DE"},
+		{groupByCity, NetworkNode{Country: "DE"}, "", ""},
+		// This host and internal hosts always stay on their own
+		{groupByCountry, NetworkNode{ID: "local", Country: "DE"}, "", ""},
+		{groupByCountry, NetworkNode{Internal: true, Country: "DE"}, "", ""},
+		{"region", NetworkNode{Country: "DE"}, "", ""},
+	}
+	for _, tt := range tests {
+		key, label := groupKey(&tt.node, tt.by)
+		if key != tt.key || label != tt.label {
+			t.Errorf("groupKey(%+v, %s) = %q, %q; want %q, %q", tt.node, tt.by, key, label, tt.key, tt.label)
+		}
+	}
+}
+
+func TestNewGroupNode(t *testing.T) {
+	members := []*NetworkNode{
+		{ID: "b", Type: "server", Country: "DE", ASN: "AS64500", Status: "offline", Connections: 2,
+			Location: Location{Lat: 50, Lng: 10}, Traffic: &TrafficStats{BytesIn: 100, RateIn: 1}, ThreatFeeds: []string{"spamhaus"}},
+		{ID: "a", Type: "cdn", Country: "DE", ASN: "AS64501", Status: "online", Connections: 3,
+			Location: Location{Lat: 52, Lng: 14}, Reputation: 40, ThreatFeeds: []string{"abuse.ch", "spamhaus"}},
+		// No location: left out of the centroid rather than counted as (0, 0)
+		{ID: "c", Type: "server", Country: "DE", ASN: "AS64500", Status: "offline", Connections: 1,
+			Traffic: &TrafficStats{BytesIn: 50, RateIn: 2}},
+	}
+	g := newGroupNode(groupByCountry, "DE", "DE", members)
+
+	want := &NetworkNode{
+		ID:          "group:country:DE",
+		Name:        "DE (3)",
+		Type:        "server",
+		Country:     "DE",
+		Status:      "online",
+		Location:    Location{Lat: 51, Lng: 12},
+		Connections: 6,
+		Traffic:     &TrafficStats{BytesIn: 150, RateIn: 3},
+		Reputation:  40,
+		ThreatFeeds: []string{"abuse.ch", "spamhaus"},
+		Group:       &GroupInfo{By: groupByCountry, Key: "DE", Members: 3},
+	}
+	if !reflect.DeepEqual(g, want) {
+		t.Errorf("group node:\n got %+v\nwant %+v", g, want)
+	}
+
+	if g := newGroupNode(groupByASN, "64500", "AS64500", members[2:]); g.Location != (Location{}) {
+		t.Errorf("location %+v with no located member", g.Location)
+	}
+}
+
+func TestGroupingSet(t *testing.T) {
+	g := NewGrouping(groupByCountry)
+	de1 := &NetworkNode{ID: "203.0.113.1", Country: "DE"}
+	de2 := &NetworkNode{ID: "203.0.113.2", Country: "DE"}
+	fr := &NetworkNode{ID: "203.0.113.2", Country: "FR"}
+	local := &NetworkNode{ID: "local", Country: "DE"}
+
+	steps := []struct {
+		name          string
+		id            string
+		node          *NetworkNode
+		before, after string
+	}{
+		{"first member", de1.ID, de1, "", "group:country:DE"},
+		{"second member", de2.ID, de2, "", "group:country:DE"},
+		{"local stays on its own", "local", local, "", "local"},
+		{"moves to another group", fr.ID, fr, "group:country:DE", "group:country:FR"},
+		{"removed", de1.ID, nil, "group:country:DE", ""},
+		{"removed again", de1.ID, nil, "", ""},
+	}
+	for _, step := range steps {
+		before, after := g.Set(step.id, step.node)
+		if before != step.before || after != step.after {
+			t.Errorf("%s: Set = %q, %q; want %q, %q", step.name, before, after, step.before, step.after)
+		}
+	}
+
+	if group := g.Group("group:country:FR"); group == nil || group.Group.Members != 1 || group.Name != "FR (1)" {
+		t.Errorf("FR group = %+v", group)
+	}
+	// The DE group emptied and is dropped
+	if group := g.Group("group:country:DE"); group != nil {
+		t.Errorf("empty group = %+v", group)
+	}
+	if _, ok := g.members["group:country:DE"]; ok {
+		t.Error("empty group's members kept")
+	}
+	if got := g.ShownAs(fr.ID); got != "group:country:FR" {
+		t.Errorf("ShownAs = %q", got)
+	}
+	if got := g.ShownAs(de1.ID); got != "" {
+		t.Errorf("ShownAs of a removed node = %q", got)
+	}
+}
+
+func TestGroupingReset(t *testing.T) {
+	nodes := []*NetworkNode{
+		{ID: "local", Country: "DE"},
+		{ID: "203.0.113.1", Country: "DE", Location: Location{Lat: 52, Lng: 13}},
+		{ID: "203.0.113.2", Country: "DE", Location: Location{Lat: 48, Lng: 11}},
+		{ID: "198.51.100.1", Country: "FR"},
+		{ID: "hop-1"},
+	}
+	shownIDs := func(shown []*NetworkNode) []string {
+		var ids []string
+		for _, node := range shown {
+			ids = append(ids, node.ID)
+		}
+		slices.Sort(ids)
+		return ids
+	}
+
+	g := NewGrouping(groupByCountry)
+	shown := g.Reset(nodes)
+	want := []string{"group:country:DE", "group:country:FR", "hop-1", "local"}
+	if got := shownIDs(shown); !reflect.DeepEqual(got, want) {
+		t.Errorf("shown %q, want %q", got, want)
+	}
+	for _, node := range shown {
+		if node.ID == "group:country:DE" && node.Location != (Location{Lat: 50, Lng: 12}) {
+			t.Errorf("DE centroid = %+v", node.Location)
+		}
+	}
+
+	// An expanded group sends its members instead
+	g.Expand("group:country:DE", true)
+	want = []string{"203.0.113.1", "203.0.113.2", "group:country:FR", "hop-1", "local"}
+	if got := shownIDs(g.Reset(nodes)); !reflect.DeepEqual(got, want) {
+		t.Errorf("expanded: shown %q, want %q", got, want)
+	}
+	if got := g.ShownAs("203.0.113.1"); got != "203.0.113.1" {
+		t.Errorf("member of an expanded group shown as %q", got)
+	}
+	// Detail still finds the members of an expanded group
+	if group, members := g.Detail("group:country:DE"); group == nil || len(members) != 2 {
+		t.Errorf("Detail = %+v, %d members", group, len(members))
+	}
+
+	g.Expand("group:country:DE", false)
+	want = []string{"group:country:DE", "group:country:FR", "hop-1", "local"}
+	if got := shownIDs(g.Reset(nodes)); !reflect.DeepEqual(got, want) {
+		t.Errorf("collapsed: shown %q, want %q", got, want)
+	}
+}
+
+func TestGroupingRollUpEdges(t *testing.T) {
+	g := NewGrouping(groupByCountry)
+	g.Reset([]*NetworkNode{
+		{ID: "local"},
+		{ID: "203.0.113.1", Country: "DE"},
+		{ID: "203.0.113.2", Country: "DE"},
+	})
+	edges := []WSConnection{
+		{From: "local", To: "203.0.113.1", Latency: 20, Traffic: &TrafficStats{BytesOut: 10}, Service: &ServiceInfo{ServerNames: []string{"example.com"}}},
+		{From: "local", To: "203.0.113.2", Latency: 35, Traffic: &TrafficStats{BytesOut: 5}, Violation: "dmz → outside"},
+		// Inside the group
+		{From: "203.0.113.1", To: "203.0.113.2"},
+		// To a node the grouping wasn't given
+		{From: "local", To: "198.51.100.1"},
+	}
+	got := g.RollUpEdges(edges)
+	want := []WSConnection{
+		{From: "local", To: "group:country:DE", Latency: 35, Traffic: &TrafficStats{BytesOut: 15}, Violation: "dmz → outside"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("edges:\n got %+v\nwant %+v", got, want)
+	}
+}
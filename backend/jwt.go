@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwtLeeway tolerates clock skew between us and the identity provider
+const jwtLeeway = time.Minute
+
+// JWTClaims are the registered claims we check plus audience and roles
+type JWTClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+
+	audience []string
+	roles    []string
+}
+
+// HasRole reports whether the token's roles claim lists role
+func (c *JWTClaims) HasRole(role string) bool {
+	return slices.Contains(c.roles, role)
+}
+
+// JWTVerifier validates tokens from an OIDC provider against the keys in a
+// local JWKS file. The file is re-read when a token names an unknown key,
+// so rotated keys are picked up once the file is updated.
+type JWTVerifier struct {
+	Issuer     string // required "iss", empty to skip the check
+	Audience   string // required "aud", empty to skip the check
+	RolesClaim string // claim listing the subject's roles
+
+	path  string
+	keys  map[string]crypto.PublicKey // kid -> key
+	mtime time.Time
+	mu    sync.Mutex
+}
+
+// NewJWTVerifier loads the JWKS file at path
+func NewJWTVerifier(path, issuer, audience string) (*JWTVerifier, error) {
+	v := &JWTVerifier{Issuer: issuer, Audience: audience, RolesClaim: "roles", path: path}
+	if err := v.reload(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// reload re-reads the key file if it changed; callers hold v.mu or own v
+func (v *JWTVerifier) reload() error {
+	info, err := os.Stat(v.path)
+	if err != nil {
+		return fmt.Errorf("read JWKS file: %w", err)
+	}
+	if v.keys != nil && info.ModTime().Equal(v.mtime) {
+		return nil
+	}
+	data, err := os.ReadFile(v.path)
+	if err != nil {
+		return fmt.Errorf("read JWKS file: %w", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", v.path, err)
+	}
+	v.keys = keys
+	v.mtime = info.ModTime()
+	return nil
+}
+
+func (v *JWTVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if err := v.reload(); err != nil {
+		return nil, err
+	}
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	// A single key without a kid signs everything
+	if key, ok := v.keys[""]; ok && len(v.keys) == 1 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// Verify checks a compact JWS token's signature and claims
+func (v *JWTVerifier) Verify(token string) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("token header: %w", err)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	if err := verifyJWS(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := decodeJWTPart(parts[1], &raw); err != nil {
+		return nil, fmt.Errorf("token claims: %w", err)
+	}
+	claims := &JWTClaims{}
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return nil, fmt.Errorf("token claims: %w", err)
+	}
+	claims.audience = stringOrList(raw["aud"])
+	claims.roles = stringOrList(raw[v.RolesClaim])
+
+	now := time.Now()
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(jwtLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0).Add(-jwtLeeway)) {
+		return nil, errors.New("token not yet valid")
+	}
+	if v.Issuer != "" && claims.Issuer != v.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if v.Audience != "" && !slices.Contains(claims.audience, v.Audience) {
+		return nil, errors.New("token not issued for this audience")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// stringOrList decodes a claim that may be a string or an array of strings
+func stringOrList(raw json.RawMessage) []string {
+	if raw == nil {
+		return nil
+	}
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return []string{one}
+	}
+	var list []string
+	json.Unmarshal(raw, &list)
+	return list
+}
+
+// ecdsaCurves maps the ES algorithms to the curve each one requires
+var ecdsaCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+// verifyJWS checks a signature for the asymmetric algorithms OIDC providers
+// use. "none" and the HMAC algorithms are refused.
+func verifyJWS(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		if k, ok := key.(ed25519.PublicKey); ok && ed25519.Verify(k, signed, sig) {
+			return nil
+		}
+		return errors.New("invalid signature")
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[0] {
+		case 'R':
+			err = rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		case 'P':
+			err = rsa.VerifyPSS(k, hash, digest, sig, nil)
+		default:
+			err = errors.New("key type does not match algorithm")
+		}
+		if err != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		// Each ES algorithm is tied to one curve (RFC 7518 section 3.4)
+		if ecdsaCurves[alg] != k.Curve.Params().Name {
+			return errors.New("key type does not match algorithm")
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return errors.New("key type does not match algorithm")
+}
+
+// jwk is one key of a JSON Web Key Set
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS decodes the RSA, EC and Ed25519 signing keys of a key set
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err1 := b64.DecodeString(k.N)
+		e, err2 := b64.DecodeString(k.E)
+		if err := errors.Join(err1, err2); err != nil {
+			return nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31 {
+			return nil, errors.New("bad RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err1 := b64.DecodeString(k.X)
+		y, err2 := b64.DecodeString(k.Y)
+		if err := errors.Join(err1, err2); err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point not on curve")
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("bad Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKeys are signing keys generated once per test run
+type testKeys struct {
+	rsa   *rsa.PrivateKey
+	p256  *ecdsa.PrivateKey
+	p384  *ecdsa.PrivateKey
+	ed    ed25519.PrivateKey
+	jwks  string // path of a JWKS file with all public keys
+	other *rsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+	k := &testKeys{}
+	var err error
+	if k.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if k.other, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if k.p256, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if k.p384, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if _, k.ed, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+
+	b64 := base64.RawURLEncoding
+	ecJWK := func(kid string, key *ecdsa.PrivateKey) map[string]string {
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return map[string]string{
+			"kty": "EC", "kid": kid, "use": "sig", "crv": key.Curve.Params().Name,
+			"x": b64.EncodeToString(key.X.FillBytes(make([]byte, size))),
+			"y": b64.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+		}
+	}
+	set := map[string]any{"keys": []map[string]string{
+		{
+			"kty": "RSA", "kid": "rsa", "use": "sig",
+			"n": b64.EncodeToString(k.rsa.N.Bytes()),
+			"e": b64.EncodeToString(big.NewInt(int64(k.rsa.E)).Bytes()),
+		},
+		ecJWK("p256", k.p256),
+		ecJWK("p384", k.p384),
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64.EncodeToString(k.ed.Public().(ed25519.PublicKey))},
+		// Encryption keys are skipped
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	}}
+	data, _ := json.Marshal(set)
+	k.jwks = filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(k.jwks, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// signJWT builds a compact JWS with the given header alg/kid. A nil key
+// leaves the signature empty.
+func signJWT(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	b64 := base64.RawURLEncoding
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+
+	hash := crypto.SHA256
+	if strings.HasSuffix(alg, "384") {
+		hash = crypto.SHA384
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case nil:
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest)
+		if err == nil {
+			size := (k.Curve.Params().BitSize + 7) / 8
+			sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	default:
+		t.Fatalf("unsupported test key %T", key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+func validClaims() map[string]any {
+	return map[string]any{
+		"iss":   "https://idp.example.com",
+		"sub":   "alice",
+		"aud":   []string{"netops", "other"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"roles": "admin",
+	}
+}
+
+func TestJWTVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	verifier, err := NewJWTVerifier(keys.jwks, "https://idp.example.com", "netops")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		alg, kid string
+		key      any
+	}{
+		{"RS256", "rsa", keys.rsa},
+		{"ES256", "p256", keys.p256},
+		{"ES384", "p384", keys.p384},
+		{"EdDSA", "ed", keys.ed},
+	}
+	for _, tt := range tests {
+		claims, err := verifier.Verify(signJWT(t, tt.alg, tt.kid, tt.key, validClaims()))
+		if err != nil {
+			t.Errorf("%s: %v", tt.alg, err)
+			continue
+		}
+		if claims.Subject != "alice" || !claims.HasRole("admin") {
+			t.Errorf("%s: claims = %+v", tt.alg, claims)
+		}
+	}
+}
+
+func TestJWTVerifyRejects(t *testing.T) {
+	keys := newTestKeys(t)
+	verifier, err := NewJWTVerifier(keys.jwks, "https://idp.example.com", "netops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	with := func(key string, value any) map[string]any {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+	rsaDER, _ := x509.MarshalPKIXPublicKey(&keys.rsa.PublicKey)
+
+	tests := map[string]string{
+		"expired":        signJWT(t, "RS256", "rsa", keys.rsa, with("exp", time.Now().Add(-time.Hour).Unix())),
+		"no expiry":      signJWT(t, "RS256", "rsa", keys.rsa, with("exp", nil)),
+		"not yet valid":  signJWT(t, "RS256", "rsa", keys.rsa, with("nbf", time.Now().Add(time.Hour).Unix())),
+		"wrong audience": signJWT(t, "RS256", "rsa", keys.rsa, with("aud", "someone-else")),
+		"wrong issuer":   signJWT(t, "RS256", "rsa", keys.rsa, with("iss", "https://evil.example.com")),
+		"alg none":       signJWT(t, "none", "rsa", nil, validClaims()),
+		// The RSA public key used as an HMAC secret
+		"HS256 with RSA key": signJWT(t, "HS256", "rsa", rsaDER, validClaims()),
+		"unknown kid":        signJWT(t, "RS256", "missing", keys.rsa, validClaims()),
+		"wrong RSA key":      signJWT(t, "RS256", "rsa", keys.other, validClaims()),
+		"RS256 on EC key":    signJWT(t, "RS256", "p256", keys.rsa, validClaims()),
+		"EdDSA on RSA key":   signJWT(t, "EdDSA", "rsa", keys.ed, validClaims()),
+		// ES256 must be P-256 and ES384 must be P-384
+		"ES256 on P-384 key": signJWT(t, "ES256", "p384", keys.p384, validClaims()),
+		"ES384 on P-256 key": signJWT(t, "ES384", "p256", keys.p256, validClaims()),
+		"malformed":          "not.a-token",
+	}
+	for name, token := range tests {
+		if claims, err := verifier.Verify(token); err == nil {
+			t.Errorf("%s: accepted with claims %+v", name, claims)
+		}
+	}
+
+	// Tampering with the claims breaks the signature
+	token := signJWT(t, "ES256", "p256", keys.p256, validClaims())
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(with("sub", "mallory"))
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+	if _, err := verifier.Verify(strings.Join(parts, ".")); err == nil {
+		t.Error("tampered claims accepted")
+	}
+}
+
+func TestJWTVerifierPicksUpRotatedKeys(t *testing.T) {
+	keys := newTestKeys(t)
+	verifier, err := NewJWTVerifier(keys.jwks, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := map[string]any{"keys": []map[string]string{{
+		"kty": "RSA", "kid": "rsa-2",
+		"n": base64.RawURLEncoding.EncodeToString(keys.other.N.Bytes()),
+		"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(keys.other.E)).Bytes()),
+	}}}
+	data, _ := json.Marshal(rotated)
+	if err := os.WriteFile(keys.jwks, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the modification time moves even on coarse filesystems
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(keys.jwks, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := verifier.Verify(signJWT(t, "RS256", "rsa-2", keys.other, validClaims())); err != nil {
+		t.Errorf("token signed with the rotated key: %v", err)
+	}
+}
+
+func TestParseJWKSRejects(t *testing.T) {
+	tests := map[string]string{
+		"no keys":       `{"keys": []}`,
+		"only enc keys": `{"keys": [{"kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"}]}`,
+		"bad curve":     `{"keys": [{"kty": "EC", "crv": "secp256k1", "x": "AA", "y": "AA"}]}`,
+		"off curve":     `{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`,
+		"short ed25519": `{"keys": [{"kty": "OKP", "crv": "Ed25519", "x": "AQID"}]}`,
+		"symmetric":     `{"keys": [{"kty": "oct", "k": "c2VjcmV0"}]}`,
+		"not json":      `keys`,
+	}
+	for name, data := range tests {
+		if _, err := parseJWKS([]byte(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
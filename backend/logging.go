@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogSink is the handler behind the default slog logger and the log
+// package: every record goes to the console (stdout, or stderr for CLI
+// commands) and to the LogHub, which streams it to /logs clients and keeps
+// it for late ones
+type LogSink struct {
+	level   slog.Leveler
+	console slog.Handler
+	hub     *LogHub     // nil in agent mode
+	attrs   []slog.Attr // from WithAttrs, keys already prefixed by their groups
+	group   string      // prefix for keys added later, "" or "a.b."
+}
+
+// setupLogging installs a LogSink writing to out as the default logger.
+// hub may be nil.
+func setupLogging(cfg *Config, hub *LogHub, out io.Writer) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return fmt.Errorf("NETOPS_LOG_LEVEL: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var console slog.Handler
+	switch cfg.LogFormat {
+	case "text", "":
+		console = slog.NewTextHandler(out, opts)
+	case "json":
+		console = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("NETOPS_LOG_FORMAT: unknown format %q (expected \"text\" or \"json\")", cfg.LogFormat)
+	}
+	slog.SetDefault(slog.New(&LogSink{level: level, console: console, hub: hub}))
+	return nil
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+func (s *LogSink) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= s.level.Level()
+}
+
+func (s *LogSink) Handle(ctx context.Context, r slog.Record) error {
+	err := s.console.Handle(ctx, r)
+	if s.hub == nil {
+		return err
+	}
+
+	msg := LogMessage{
+		Time:    r.Time,
+		Level:   levelName(r.Level),
+		Message: r.Message,
+		level:   r.Level,
+	}
+	add := func(key string, v slog.Value) {
+		if key == "component" {
+			msg.Component = v.String()
+			return
+		}
+		if msg.Fields == nil {
+			msg.Fields = make(map[string]any)
+		}
+		msg.Fields[key] = fieldValue(v)
+	}
+	for _, a := range s.attrs {
+		add(a.Key, a.Value)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		flattenAttr(s.group, a, add)
+		return true
+	})
+	s.hub.Publish(msg)
+	return err
+}
+
+func (s *LogSink) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := *s
+	next.console = s.console.WithAttrs(attrs)
+	next.attrs = slices.Clip(s.attrs)
+	for _, a := range attrs {
+		flattenAttr(s.group, a, func(key string, v slog.Value) {
+			next.attrs = append(next.attrs, slog.Attr{Key: key, Value: v})
+		})
+	}
+	return &next
+}
+
+func (s *LogSink) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return s
+	}
+	next := *s
+	next.console = s.console.WithGroup(name)
+	next.group = s.group + name + "."
+	return &next
+}
+
+// flattenAttr calls add for a and the members of groups within it, with
+// keys joined by dots
+func flattenAttr(prefix string, a slog.Attr, add func(string, slog.Value)) {
+	v := a.Value.Resolve()
+	if v.Kind() != slog.KindGroup {
+		if a.Key != "" {
+			add(prefix+a.Key, v)
+		}
+		return
+	}
+	if a.Key != "" {
+		prefix += a.Key + "."
+	}
+	for _, member := range v.Group() {
+		flattenAttr(prefix, member, add)
+	}
+}
+
+// fieldValue converts an attribute value to something that encodes
+// readably as JSON: durations and errors become strings
+func fieldValue(v slog.Value) any {
+	switch v.Kind() {
+	case slog.KindDuration:
+		return v.Duration().String()
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return err.Error()
+		}
+		if s, ok := v.Any().(fmt.Stringer); ok {
+			return s.String()
+		}
+	}
+	return v.Any()
+}
+
+// levelName is the lower-case name used in log messages: debug, info, warn
+// or error
+func levelName(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
+
+// LogFilter selects log messages; empty fields match everything
+type LogFilter struct {
+	Level      slog.Level // minimum level
+	Components []string   // empty for every component
+	Text       string     // case-insensitive substring of the message
+	After      uint64     // only messages with a greater seq
+	Since      time.Time  // only messages logged at or after this time
+}
+
+// Matches reports whether a message passes the filter
+func (f *LogFilter) Matches(msg *LogMessage) bool {
+	if msg.level < f.Level || msg.Seq <= f.After {
+		return false
+	}
+	if !f.Since.IsZero() && msg.Time.Before(f.Since) {
+		return false
+	}
+	if len(f.Components) > 0 && !slices.Contains(f.Components, msg.Component) {
+		return false
+	}
+	return f.Text == "" || strings.Contains(strings.ToLower(msg.Message), strings.ToLower(f.Text))
+}
+
+// parseLogFilter reads a filter from the query parameters level,
+// component (repeated or comma-separated), q, after and since
+func parseLogFilter(query url.Values) (LogFilter, error) {
+	f := LogFilter{Level: slog.LevelDebug, Text: query.Get("q")}
+	if v := query.Get("level"); v != "" {
+		if err := f.Level.UnmarshalText([]byte(v)); err != nil {
+			return f, fmt.Errorf("invalid level %q", v)
+		}
+	}
+	for _, v := range query["component"] {
+		for _, c := range strings.Split(v, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				f.Components = append(f.Components, c)
+			}
+		}
+	}
+	if v := query.Get("after"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return f, errors.New("after must be a sequence number")
+		}
+		f.After = n
+	}
+	if v := query.Get("since"); v != "" {
+		t, err := parseSince(v)
+		if err != nil {
+			return f, errors.New("since must be a duration or an RFC 3339 time")
+		}
+		f.Since = t
+	}
+	return f, nil
+}
+
+// parseSince accepts a duration ago ("15m") or an RFC 3339 time
+func parseSince(v string) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
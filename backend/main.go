@@ -2,180 +2,752 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"slices"
+	"strings"
 	"time"
 )
 
 func main() {
-	// Initialize WebSocket hub, log hub, and node store
-	hub := NewWSHub()
-	logHub := NewLogHub()
+	cfg := LoadConfig()
+
+	command := "server"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	// Only the server keeps logs for /logs clients; CLI commands log to
+	// stderr so their output can be piped
+	var logHub *LogHub
+	logOutput := io.Writer(os.Stdout)
+	switch command {
+	case "server":
+		logHub = NewLogHub(cfg.LogBuffer)
+	case "export", "scan", "watch", "tail":
+		logOutput = os.Stderr
+	}
+	if err := setupLogging(cfg, logHub, logOutput); err != nil {
+		log.Fatalf("Invalid logging settings: %v", err)
+	}
+
+	switch command {
+	case "agent":
+		runAgent(cfg)
+		return
+	case "export":
+		runExport(os.Args[2:])
+		return
+	case "scan":
+		runScan(cfg, os.Args[2:])
+		return
+	case "watch":
+		runWatch(cfg, os.Args[2:])
+		return
+	case "tail":
+		runTail(cfg, os.Args[2:])
+		return
+	case "agent-cert":
+		if len(os.Args) != 3 {
+			fatal("Usage: netops-backend agent-cert <agent-id>")
+		}
+		issueAgentCert(cfg, os.Args[2])
+		return
+	case "server":
+	default:
+		fatal(fmt.Sprintf("Unknown command %q (expected server, agent, agent-cert, export, scan, watch or tail)", command))
+	}
+
+	auth, err := NewAuth(cfg)
+	if err != nil {
+		fatal("Invalid authentication settings", "component", "auth", "error", err)
+	}
+	if !auth.Enabled() {
+		slog.Warn("Authentication is disabled, anyone who can reach this port has admin access", "component", "auth")
+	}
+	upgrader.CheckOrigin = auth.CheckOrigin
+	upgrader.EnableCompression = cfg.WSCompression
+
+	certs, err := SetupTLS(cfg)
+	if err != nil {
+		fatal("Invalid TLS settings", "component", "tls", "error", err)
+	}
+
+	// Initialize WebSocket hub and node store
+	hub := NewWSHub(cfg.WSBacklog)
 	store := NewNodeStore()
 
 	// Create local node (your machine in Orlando)
 	localNode := &NetworkNode{
-		ID:       "local",
-		Name:     "Local Machine (Orlando)",
-		IPAddress: "192.168.1.192", // Your local IP
-		Type:     "endpoint",
-		Location: Location{Lat: 28.5383, Lng: -81.3792}, // Orlando coordinates
-		Status:   "online",
+		ID:          "local",
+		Name:        "Local Machine (Orlando)",
+		IPAddress:   "192.168.1.192", // Your local IP
+		Type:        "endpoint",
+		Location:    Location{Lat: 28.5383, Lng: -81.3792}, // Orlando coordinates
+		Status:      "online",
 		Connections: 0,
-		FirstSeen: time.Now(),
-		LastSeen:  time.Now(),
+		FirstSeen:   time.Now(),
+		LastSeen:    time.Now(),
 	}
 	store.Nodes["local"] = localNode
 
-	// Start WebSocket hubs in background
+	// Start WebSocket hub in background
 	go hub.Run()
-	go logHub.Run()
+
+	enrich := &Enrichers{}
+
+	// Load threat intel feeds if configured
+	if cfg.ThreatIntelDir != "" {
+		intel := NewThreatIntel(cfg.ThreatIntelDir)
+		if _, err := intel.Reload(); err != nil {
+			slog.Warn("Threat intel disabled", "component", "threatintel", "error", err)
+		} else {
+			feeds, entries := intel.Stats()
+			slog.Info("Threat intel loaded", "component", "threatintel", "feeds", feeds, "entries", entries, "dir", cfg.ThreatIntelDir)
+			enrich.Intel = intel
+			go refreshThreatIntel(intel, cfg.ThreatIntelRefresh, hub, store)
+		}
+	}
+
+	// Announced prefixes and origin ASes from offline routing data
+	if cfg.ASNDir != "" {
+		index := NewASNIndex(cfg.ASNDir)
+		if _, err := index.Reload(); err != nil {
+			slog.Warn("ASN index disabled", "component", "asn", "error", err)
+		} else {
+			enrich.ASN = index
+			go refreshASNIndex(index, cfg.ASNRefresh, hub, store)
+		}
+	}
+
+	// Provider, service and region from published cloud ranges
+	if cfg.CloudDir != "" {
+		ranges := NewCloudRanges(cfg.CloudDir)
+		if _, err := ranges.Reload(); err != nil {
+			slog.Warn("Cloud ranges disabled", "component", "cloud", "error", err)
+		} else {
+			enrich.Cloud = ranges
+			go refreshCloudRanges(ranges, cfg.CloudRefresh, hub, store)
+		}
+	}
+
+	// Security zones and the policy between them
+	if cfg.ZonesFile != "" {
+		zones := NewZonePolicy(cfg.ZonesFile)
+		if _, err := zones.Reload(); err != nil {
+			slog.Warn("Security zones disabled", "component", "zones", "error", err)
+		} else {
+			enrich.Zones = zones
+			go refreshZones(zones, cfg.ZonesRefresh)
+		}
+	}
+
+	// Allowlist of expected egress, and the history learning and dry runs read
+	var egress *EgressMonitor
+	if cfg.EgressPolicy != "" || cfg.EgressHistory != "" {
+		if cfg.EgressMode != egressEnforce && cfg.EgressMode != egressLearn {
+			fatal("Invalid NETOPS_EGRESS_MODE (expected enforce or learn)", "component", "egress", "mode", cfg.EgressMode)
+		}
+		// A policy that fails to load is kept, and checks begin once the
+		// refresh finds a valid file
+		var policy *EgressPolicy
+		if cfg.EgressPolicy != "" {
+			policy = NewEgressPolicy(cfg.EgressPolicy)
+			if _, err := policy.Reload(); err != nil {
+				slog.Warn("Egress policy not loaded, retrying every refresh", "component", "egress", "error", err)
+			}
+		}
+		var history *EgressHistory
+		if cfg.EgressHistory != "" {
+			history = NewEgressHistory(cfg.EgressHistory)
+			if err := history.Compact(cfg.EgressRetention); err != nil {
+				slog.Warn("Egress history disabled", "component", "egress", "error", err)
+				history = nil
+			}
+		}
+		if policy != nil || history != nil {
+			egress = NewEgressMonitor(policy, history, cfg.EgressMode == egressLearn)
+			go refreshEgress(egress, cfg.EgressRefresh, cfg.EgressRetention)
+			slog.Info("Egress monitoring enabled", "component", "egress", "mode", cfg.EgressMode, "history", cfg.EgressHistory)
+		}
+	}
+
+	// Usual egress of each host and process, to score scans against
+	var baseline *Baseline
+	if cfg.Baseline {
+		baseline = NewBaseline(cfg.BaselineState, cfg.BaselineWindow, cfg.BaselineWarmup, cfg.BaselineThreshold, scanInterval)
+		if err := baseline.Load(); err != nil {
+			slog.Warn("Saved baseline ignored, starting over", "component", "baseline", "error", err)
+		}
+		if cfg.BaselineState != "" {
+			go saveBaseline(baseline, baselineSaveInterval)
+		}
+		slog.Info("Baseline learning enabled", "component", "baseline", "window", cfg.BaselineWindow, "warmup", cfg.BaselineWarmup)
+	}
+
+	// Name attribution from reverse and passive DNS
+	if cfg.ReverseDNS || cfg.DNSLog != "" || cfg.CaptureInterface != "" || cfg.CapturePcap != "" {
+		workers := cfg.DNSWorkers
+		if !cfg.ReverseDNS {
+			workers = 0
+		}
+		names := NewNameResolver(cfg.DNSServer, workers)
+		names.OnName = func(ip string) {
+			out := hub.NewOutbox()
+			store.mu.Lock()
+			if node, ok := store.Nodes[ip]; ok && ApplyNames(node, names) {
+				out.BroadcastNodeUpdate(node)
+			}
+			store.mu.Unlock()
+			out.Flush()
+		}
+		enrich.Names = names
+		if cfg.DNSLog != "" {
+			go names.FollowDNSLog(cfg.DNSLog)
+		}
+	}
+
+	// Bandwidth accounting from conntrack counters
+	if cfg.TrafficSource == "conntrack" {
+		enrich.Traffic = NewTrafficMeter()
+		go enrich.Traffic.PollConntrack(cfg.ConntrackPath, 5*time.Second)
+	}
+
+	// Passive packet capture feeds the enrichers that watch traffic
+	if cfg.CaptureInterface != "" || cfg.CapturePcap != "" {
+		source, err := OpenPacketSource(cfg.CaptureInterface, cfg.CapturePcap)
+		if err != nil {
+			slog.Warn("Packet capture disabled", "component", "capture", "error", err)
+		} else {
+			tap := NewPacketTap(source)
+			enrich.Sniffer = NewServiceSniffer()
+			tap.Handle(enrich.Sniffer.HandlePacket)
+			if enrich.Names != nil {
+				tap.Handle(enrich.Names.HandlePacket)
+			}
+			if cfg.TrafficSource == "" || cfg.TrafficSource == "capture" {
+				enrich.Traffic = NewTrafficMeter()
+				enrich.Traffic.Replay = cfg.CapturePcap != ""
+				tap.Handle(enrich.Traffic.HandlePacket)
+			}
+			startPacketTap(tap)
+		}
+	}
+
+	// Active latency and loss probing of remote peers
+	if cfg.Probe {
+		enrich.Prober = NewProber(cfg.ProbeInterval, cfg.ProbeTimeout, cfg.ProbeCount, cfg.ProbeRate, cfg.ProbeICMP)
+		enrich.Prober.OnResult = func(ip string, health *NodeHealth) {
+			out := hub.NewOutbox()
+			store.mu.Lock()
+			if node, ok := store.Nodes[ip]; ok {
+				node.Health = health
+				out.BroadcastNodeUpdate(node)
+			}
+			store.mu.Unlock()
+			out.Flush()
+		}
+		go enrich.Prober.Run()
+		slog.Info("Connection probing enabled", "component", "prober", "interval", cfg.ProbeInterval, "rate", cfg.ProbeRate)
+	}
+
+	// Traceroute replaces direct edges with the routers along the path
+	if cfg.Trace {
+		tracer, err := NewTracer(cfg.TraceProtocol, cfg.TraceInterval, cfg.TraceTimeout, cfg.TraceMaxHops, cfg.TraceQueries)
+		if err != nil {
+			fatal("Invalid NETOPS_TRACE_PROTOCOL", "component", "traceroute", "error", err)
+		}
+		tracer.OnPath = func(path *TracePath) {
+			addHopNodes(hub, store, enrich, path)
+		}
+		enrich.Tracer = tracer
+		go tracer.Run()
+		slog.Info("Traceroute enabled", "component", "traceroute", "protocol", cfg.TraceProtocol, "interval", cfg.TraceInterval)
+	}
+
+	localCollector, err := NewCollector(cfg, false)
+	if err != nil {
+		fatal("Invalid NETOPS_COLLECTOR", "component", "collector", "error", err)
+	}
+	collector := multiCollector{localCollector}
+
+	// Accept connection batches from agents on other hosts
+	var agents *AgentCollector
+	if len(cfg.AgentTokens) > 0 || certs.VerifiesClients() {
+		agents = NewAgentCollector(cfg.AgentTokens, 3*cfg.AgentInterval)
+		collector = append(collector, agents)
+		http.HandleFunc("/agent", agents.HandleAgent())
+	}
 
 	// Start monitoring loop in background
-	go monitorConnections(hub, logHub, store)
+	go monitorConnections(hub, store, collector, enrich, egress, baseline, cfg.Processes)
 
 	// Set up HTTP routes
-	http.HandleFunc("/ws", HandleWebSocket(hub, store))
-	http.HandleFunc("/logs", HandleLogStream(logHub))
+	http.HandleFunc("/ws", auth.Require(RoleViewer, HandleWebSocket(hub, store)))
+	http.HandleFunc("/logs", auth.Require(RoleViewer, HandleLogStream(logHub)))
+	http.HandleFunc("/api/logs", auth.Require(RoleViewer, HandleLogQuery(logHub)))
+	http.HandleFunc("/api/export", auth.Require(RoleViewer, HandleExport(hub, store)))
+	http.HandleFunc("/api/traffic/top", auth.Require(RoleViewer, HandleTopTalkers(enrich.Traffic)))
+	http.HandleFunc("/api/threatintel/reload", auth.Require(RoleAdmin, HandleThreatIntelReload(enrich.Intel, hub, store)))
+	http.HandleFunc("/api/trace", auth.Require(RoleAdmin, HandleTrace(enrich.Tracer)))
+	http.HandleFunc("/api/egress/violations", auth.Require(RoleViewer, HandleEgressViolations(egress)))
+	http.HandleFunc("/api/egress/learn", auth.Require(RoleViewer, HandleEgressLearn(egress)))
+	http.HandleFunc("/api/egress/dryrun", auth.Require(RoleViewer, HandleEgressDryRun(egress)))
+	http.HandleFunc("/api/baseline", auth.Require(RoleViewer, HandleBaseline(baseline)))
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
 
 	// Start HTTP server
-	log.Println("NetOps backend starting on :8081")
-	log.Println("WebSocket endpoint: ws://localhost:8081/ws")
-	log.Println("Log stream endpoint: ws://localhost:8081/logs")
-	logHub.BroadcastLog("info", "NetOps backend started on :8081")
-	if err := http.ListenAndServe(":8081", nil); err != nil {
-		log.Fatal("Server failed to start:", err)
+	addr := ":" + cfg.Port
+	scheme := "ws"
+	if certs != nil {
+		scheme = "wss"
+	}
+	slog.Info("NetOps backend starting", "component", "server", "addr", addr,
+		"ws", fmt.Sprintf("%s://localhost%s/ws", scheme, addr),
+		"logs", fmt.Sprintf("%s://localhost%s/logs", scheme, addr))
+
+	server := &http.Server{Addr: addr}
+	if certs != nil {
+		server.TLSConfig = certs.ServerConfig()
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		fatal("Server failed to start", "component", "server", "error", err)
+	}
+}
+
+// Nodes not seen in a scan are marked offline after nodeOfflineAfter and
+// removed after nodeRemoveAfter
+const (
+	nodeOfflineAfter = 30 * time.Second
+	nodeRemoveAfter  = 5 * time.Minute
+)
+
+// newRemoteNode builds the node for a connection's remote peer from its
+// GeoIP record
+func newRemoteNode(conn Connection, geoInfo *GeoIPInfo) *NetworkNode {
+	return &NetworkNode{
+		ID:          conn.RemoteIP,
+		Name:        GetNodeName(geoInfo),
+		IPAddress:   conn.RemoteIP,
+		Type:        ClassifyNode(conn.RemotePort, geoInfo.ASN, geoInfo.Owner, geoInfo.Hostname),
+		Location:    geoInfo.Location,
+		Country:     geoInfo.Country,
+		City:        geoInfo.City,
+		Owner:       geoInfo.Owner,
+		ASN:         geoInfo.ASN,
+		Status:      "online",
+		Connections: 1,
+		Process:     conn.Process,
+		FirstSeen:   time.Now(),
+		LastSeen:    time.Now(),
 	}
 }
 
-// monitorConnections periodically scans network connections
-func monitorConnections(hub *WSHub, logHub *LogHub, store *NodeStore) {
-	ticker := time.NewTicker(5 * time.Second)
+// scanInterval is the time between connection scans
+const scanInterval = 5 * time.Second
+
+// monitorConnections periodically scans network connections. With
+// processNodes, this host's connections run through a node per local
+// application.
+func monitorConnections(hub *WSHub, store *NodeStore, collector Collector, enrich *Enrichers, egress *EgressMonitor, baseline *Baseline, processNodes bool) {
+	ticker := time.NewTicker(scanInterval)
 	defer ticker.Stop()
 
-	log.Println("Network monitoring started (scanning every 5 seconds)")
-	logHub.BroadcastLog("info", "Network monitoring started (scanning every 5 seconds)")
+	logger := slog.With("component", "monitor")
+	logger.Info("Network monitoring started", "collector", collector.Name(), "interval", scanInterval)
+
+	violations := make(map[edgeKey]string) // edges breaking zone policy, alerted once
 
 	for range ticker.C {
-		connections, err := CaptureConnections()
+		started := time.Now()
+		connections, err := collector.Collect()
 		if err != nil {
-			errMsg := fmt.Sprintf("Failed to capture connections: %v", err)
-			log.Printf(errMsg)
-			logHub.BroadcastLog("error", errMsg)
+			logger.Error("Failed to capture connections", "error", err)
 			continue
 		}
-
-		statusMsg := fmt.Sprintf("Found %d active connections", len(connections))
-		log.Printf(statusMsg)
-		logHub.BroadcastLog("info", statusMsg)
+		logger.Info("Found active connections", "connections", len(connections), "duration", time.Since(started))
 
 		// Track which IPs we've seen this scan and count connections per IP
 		seenIPs := make(map[string]int) // IP -> connection count
+		seenEdges := make(map[edgeKey]bool)
+		edgeLatency := make(map[edgeKey]float64)
+		peerApps := make(map[string][]string) // remote IP -> applications talking to it
+		processPIDs := make(map[string][]int) // process node -> PIDs seen
+		var flows []EgressFlow                // outbound flows, for the egress policy and baseline
 
 		// Process each connection
 		for _, conn := range connections {
+			if enrich.Sniffer != nil {
+				enrich.Sniffer.Annotate(&conn)
+			}
 			ip := conn.RemoteIP
+
+			// Connections from other hosts (agents, or forwarded traffic on
+			// a gateway) start at an internal node instead of the local machine
+			origin := "local"
+			if conn.Origin != "" {
+				origin = conn.Origin
+				seenIPs[origin]++
+				ensureOriginNode(hub, store, enrich, collector, origin, conn.LocalIP)
+				if strings.HasPrefix(origin, containerIDPrefix) || strings.HasPrefix(origin, netnsIDPrefix) {
+					// Containers and namespaces are on this host
+					seenEdges[edgeKey{from: "local", to: origin}] = true
+				}
+			} else if id := processNodeID(conn); id != "" {
+				if app := strings.TrimPrefix(id, processIDPrefix); !slices.Contains(peerApps[ip], app) {
+					peerApps[ip] = append(peerApps[ip], app)
+				}
+				if processNodes {
+					origin = id
+					seenIPs[id]++
+					seenEdges[edgeKey{from: "local", to: id}] = true
+					if conn.PID != 0 {
+						processPIDs[id] = append(processPIDs[id], conn.PID)
+					}
+					ensureProcessNode(hub, store, id, conn)
+				}
+			}
+
+			// Traffic between two internal hosts ends at the other's node
+			if conn.Target != "" {
+				seenIPs[conn.Target]++
+				ensureOriginNode(hub, store, enrich, collector, conn.Target, conn.RemoteIP)
+				seenEdges[edgeKey{from: origin, to: conn.Target}] = true
+				continue
+			}
 			seenIPs[ip]++
+			if egress != nil || baseline != nil {
+				if port := egressPort(conn); port != 0 {
+					flows = append(flows, newEgressFlow(conn, origin, port))
+				}
+			}
+
+			// Only paths from this host can be measured from here
+			var path *TracePath
+			if conn.Origin == "" {
+				if enrich.Prober != nil {
+					enrich.Prober.Track(ip, probePort(conn))
+				}
+				if enrich.Tracer != nil {
+					enrich.Tracer.Track(ip, probePort(conn))
+					path = enrich.Tracer.Path(ip)
+				}
+			}
 
 			// Check if we already have this node
-			if node, exists := store.Nodes[ip]; exists {
+			store.mu.Lock()
+			if path != nil {
+				addRouteEdges(store, path, origin, seenIPs, seenEdges, edgeLatency)
+			} else {
+				seenEdges[edgeKey{from: origin, to: ip}] = true
+			}
+			node, exists := store.Nodes[ip]
+			if exists {
 				// Update existing node
 				node.LastSeen = time.Now()
 				node.Status = "online"
 				if conn.Process != "" && node.Process == "" {
 					node.Process = conn.Process
 				}
-			} else {
+			}
+			store.mu.Unlock()
+
+			if !exists {
 				// New node - perform GeoIP lookup
-				discoveryMsg := fmt.Sprintf("Discovering new node: %s", ip)
-				log.Printf(discoveryMsg)
-				logHub.BroadcastLog("info", discoveryMsg)
+				logger.Info("Discovering new node", "ip", ip)
 
+				lookupStarted := time.Now()
 				geoInfo, err := LookupGeoIP(ip)
 				if err != nil {
-					errMsg := fmt.Sprintf("GeoIP lookup failed for %s: %v", ip, err)
-					log.Printf(errMsg)
-					logHub.BroadcastLog("warn", errMsg)
+					logger.Warn("GeoIP lookup failed", "ip", ip, "error", err, "duration", time.Since(lookupStarted))
 					continue
 				}
 
-				// Classify node type
-				nodeType := ClassifyNode(conn.RemotePort, geoInfo.ASN, geoInfo.Owner, geoInfo.Hostname)
-
-				// Create new node
-				node := &NetworkNode{
-					ID:          ip,
-					Name:        GetNodeName(geoInfo),
-					IPAddress:   ip,
-					Type:        nodeType,
-					Location:    geoInfo.Location,
-					Owner:       geoInfo.Owner,
-					ASN:         geoInfo.ASN,
-					Status:      "online",
-					Connections: 1,
-					Process:     conn.Process,
-					FirstSeen:   time.Now(),
-					LastSeen:    time.Now(),
-				}
+				// Create and classify the new node
+				node := newRemoteNode(conn, geoInfo)
+				node.Processes = slices.Clone(peerApps[ip])
+
+				// Threat intel, DNS names and other annotations
+				enrich.Enrich(node)
 
 				// Add to store
+				store.mu.Lock()
 				store.Nodes[ip] = node
+				store.mu.Unlock()
 
 				// Broadcast to clients
-				nodeMsg := fmt.Sprintf("New node added: %s (%s) - %s", node.Name, node.IPAddress, node.Type)
-				log.Printf(nodeMsg)
-				logHub.BroadcastLog("info", nodeMsg)
+				logger.Info("New node added", "node_id", node.ID, "name", node.Name, "ip", node.IPAddress, "type", node.Type)
 				hub.BroadcastNodeAdd(node)
+				enrich.Discovered(node)
+				if len(node.ThreatFeeds) > 0 {
+					raiseThreatAlert(hub, node)
+				}
 			}
 		}
 
 		// Update connection counts and build connection list
-		wsConnections := []WSConnection{}
+		out := hub.NewOutbox()
+		store.mu.Lock()
 		for ip, count := range seenIPs {
 			if node, exists := store.Nodes[ip]; exists {
 				node.Connections = count
-				// Create connection from local to this node
-				wsConnections = append(wsConnections, WSConnection{
-					From: "local",
-					To:   ip,
-				})
+				if enrich.Traffic != nil && !node.Internal && node.Type != "process" {
+					node.Traffic = enrich.Traffic.Remote(ip)
+				}
 			}
 		}
+		for ip, apps := range peerApps {
+			if node, exists := store.Nodes[ip]; exists {
+				slices.Sort(apps)
+				node.Processes = apps
+			}
+		}
+		if processNodes {
+			updateProcessNodes(out, store, processPIDs)
+		}
+		if enrich.Zones != nil {
+			assignZones(out, store, enrich.Zones)
+		}
+		annotateEgressFlows(store, flows)
+		var egressViolations map[edgeKey]string
+		if egress != nil {
+			egressViolations = egress.Check(out, flows)
+		}
+		wsConnections := []WSConnection{}
+		violating := make(map[edgeKey]string)
+		for key := range seenEdges {
+			_, fromExists := store.Nodes[key.from]
+			_, toExists := store.Nodes[key.to]
+			if !fromExists || !toExists {
+				continue
+			}
+			edge := WSConnection{
+				From: key.from,
+				To:   key.to,
+			}
+			if enrich.Sniffer != nil {
+				edge.Service = enrich.Sniffer.Remote(key.to)
+			}
+			if enrich.Traffic != nil {
+				edge.Traffic = enrich.Traffic.Edge(key.from, key.to)
+			}
+			edge.Latency = edgeLatency[key]
+			if enrich.Zones != nil {
+				edge.Violation = enrich.Zones.Check(store.Nodes[key.from].SecurityZone, store.Nodes[key.to].SecurityZone)
+				if edge.Violation != "" {
+					violating[key] = edge.Violation
+					if violations[key] != edge.Violation {
+						raiseZoneAlert(out, store.Nodes[key.from], store.Nodes[key.to], edge.Violation)
+					}
+				}
+			}
+			if edge.Violation == "" {
+				edge.Violation = egressViolations[key]
+			}
+			wsConnections = append(wsConnections, edge)
+		}
+		violations = violating
+
+		store.mu.Unlock()
+		out.Flush()
+		if egress != nil {
+			egress.Record(flows)
+		}
+		if baseline != nil {
+			for _, anomaly := range baseline.Observe(flows, time.Now()) {
+				logger.Warn("Baseline anomaly", "node_id", anomaly.NodeID, "kind", anomaly.Kind, "value", anomaly.Value, "score", anomaly.Score)
+				hub.BroadcastAnomaly(anomaly)
+			}
+		}
+		if enrich.Traffic != nil && !enrich.Traffic.Replay {
+			enrich.Traffic.Expire()
+		}
 
 		// Broadcast updated state with connections
 		hub.BroadcastConnectionUpdate(wsConnections)
 
 		// Mark nodes as offline if not seen
+		out = hub.NewOutbox()
+		store.mu.Lock()
 		now := time.Now()
 		for ip, node := range store.Nodes {
 			if ip == "local" {
 				continue // Skip local node
 			}
 			if _, seen := seenIPs[ip]; !seen {
-				// If not seen for 30 seconds, mark as offline
-				if now.Sub(node.LastSeen) > 30*time.Second {
+				// If not seen for a while, mark as offline
+				if now.Sub(node.LastSeen) > nodeOfflineAfter {
 					if node.Status != "offline" {
 						node.Status = "offline"
-						hub.BroadcastNodeUpdate(node)
-						offlineMsg := fmt.Sprintf("Node marked offline: %s (%s)", node.Name, node.IPAddress)
-						log.Printf(offlineMsg)
-						logHub.BroadcastLog("warn", offlineMsg)
+						out.BroadcastNodeUpdate(node)
+						logger.Warn("Node marked offline", "node_id", node.ID, "name", node.Name, "ip", node.IPAddress)
 					}
 
-					// If offline for 5 minutes, remove it
-					if now.Sub(node.LastSeen) > 5*time.Minute {
+					// If offline for longer, remove it
+					if now.Sub(node.LastSeen) > nodeRemoveAfter {
 						delete(store.Nodes, ip)
-						hub.BroadcastNodeRemove(ip)
-						removeMsg := fmt.Sprintf("Node removed: %s (%s)", node.Name, node.IPAddress)
-						log.Printf(removeMsg)
-						logHub.BroadcastLog("warn", removeMsg)
+						out.BroadcastNodeRemove(ip)
+						logger.Warn("Node removed", "node_id", node.ID, "name", node.Name, "ip", node.IPAddress)
 					}
 				}
 			}
 		}
+		store.mu.Unlock()
+		out.Flush()
+	}
+}
+
+// addRouteEdges draws the traced route to a peer as a chain of edges
+// through the hops that answered, each carrying the round trip to its far
+// end so it shows where latency builds up. Hops are kept alive while a
+// peer routed through them is. Callers must hold store.mu.
+func addRouteEdges(store *NodeStore, path *TracePath, from string, seenIPs map[string]int, seenEdges map[edgeKey]bool, latency map[edgeKey]float64) {
+	for _, hop := range path.Hops {
+		if hop.IP == "" || hop.IP == path.Target {
+			continue
+		}
+		node, ok := store.Nodes[hop.IP]
+		if !ok {
+			continue // still being added
+		}
+		node.LastSeen = time.Now()
+		node.Status = "online"
+		seenIPs[hop.IP]++
+		key := edgeKey{from: from, to: hop.IP}
+		seenEdges[key] = true
+		latency[key] = hop.RTT
+		from = hop.IP
+	}
+	key := edgeKey{from: from, to: path.Target}
+	seenEdges[key] = true
+	if path.Reached {
+		latency[key] = path.Hops[len(path.Hops)-1].RTT
+	}
+}
+
+// addHopNodes adds a router node for each hop of a traced path that isn't
+// on the map yet. Hops without a location of their own (private addresses,
+// failed lookups) are drawn where the previous hop is.
+func addHopNodes(hub *WSHub, store *NodeStore, enrich *Enrichers, path *TracePath) {
+	var location Location
+	store.mu.RLock()
+	if local, ok := store.Nodes["local"]; ok {
+		location = local.Location
+	}
+	store.mu.RUnlock()
+
+	for _, hop := range path.Hops {
+		if hop.IP == "" || hop.IP == path.Target {
+			continue
+		}
+		store.mu.RLock()
+		existing, exists := store.Nodes[hop.IP]
+		if exists {
+			location = existing.Location
+		}
+		store.mu.RUnlock()
+		if exists {
+			continue
+		}
+
+		node := &NetworkNode{
+			ID:        hop.IP,
+			Name:      hop.IP,
+			IPAddress: hop.IP,
+			Type:      "router",
+			Hop:       true,
+			Location:  location,
+			Status:    "online",
+			FirstSeen: time.Now(),
+			LastSeen:  time.Now(),
+		}
+		if !isPrivateIP(net.ParseIP(hop.IP)) {
+			if geoInfo, err := LookupGeoIP(hop.IP); err != nil {
+				slog.Debug("GeoIP lookup failed", "component", "traceroute", "ip", hop.IP, "error", err)
+			} else {
+				node.Name = GetNodeName(geoInfo)
+				node.Country = geoInfo.Country
+				node.City = geoInfo.City
+				node.Owner = geoInfo.Owner
+				node.ASN = geoInfo.ASN
+				if geoInfo.Location != (Location{}) {
+					node.Location = geoInfo.Location
+				}
+			}
+		}
+		location = node.Location
+		enrich.Enrich(node)
+
+		store.mu.Lock()
+		if _, exists := store.Nodes[hop.IP]; exists {
+			store.mu.Unlock()
+			continue
+		}
+		store.Nodes[hop.IP] = node
+		store.mu.Unlock()
+
+		slog.Info("New router hop added", "component", "traceroute", "node_id", node.ID, "name", node.Name, "ttl", hop.TTL, "target", path.Target)
+		hub.BroadcastNodeAdd(node)
+		enrich.Discovered(node)
+	}
+}
+
+// ensureOriginNode adds a node for an internal host: an agent's machine, or
+// a LAN client seen as the source of forwarded connections. Hosts without
+// a location of their own are drawn at the local machine's location.
+func ensureOriginNode(hub *WSHub, store *NodeStore, enrich *Enrichers, collector Collector, id, ip string) {
+	store.mu.Lock()
+	if node, exists := store.Nodes[id]; exists {
+		node.LastSeen = time.Now()
+		node.Status = "online"
+		store.mu.Unlock()
+		return
+	}
+	store.mu.Unlock()
+
+	// Describers take their own locks, never while holding store.mu
+	var node *NetworkNode
+	if d, ok := collector.(OriginDescriber); ok {
+		node = d.DescribeOrigin(id)
+	}
+	if node == nil {
+		node = &NetworkNode{
+			ID:        id,
+			Name:      ip,
+			IPAddress: ip,
+			Type:      "endpoint",
+			Status:    "online",
+			Internal:  true,
+		}
 	}
+
+	store.mu.Lock()
+	if _, exists := store.Nodes[id]; exists {
+		store.mu.Unlock()
+		return
+	}
+	if local, ok := store.Nodes["local"]; ok && node.Location == (Location{}) {
+		node.Location = local.Location
+	}
+	node.FirstSeen = time.Now()
+	node.LastSeen = time.Now()
+	if enrich.Names != nil && node.Agent == "" {
+		ApplyNames(node, enrich.Names)
+	}
+	store.Nodes[id] = node
+	store.mu.Unlock()
+
+	slog.Info("New internal host added", "component", "monitor", "node_id", node.ID, "name", node.Name, "ip", node.IPAddress)
+	hub.BroadcastNodeAdd(node)
+	enrich.Discovered(node)
 }
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+)
+
+// MRT record types and TABLE_DUMP_V2 subtypes (RFC 6396, RFC 8050)
+const (
+	mrtTableDumpV2 = 13
+
+	mrtPeerIndexTable        = 1
+	mrtRIBIPv4Unicast        = 2
+	mrtRIBIPv6Unicast        = 4
+	mrtRIBIPv4UnicastAddPath = 8
+	mrtRIBIPv6UnicastAddPath = 10
+
+	// Records claiming more are corrupt; a RIB entry with every peer of a
+	// large collector is tens of KiB
+	mrtMaxRecord = 1 << 20
+
+	bgpAttrASPath = 2
+	bgpASSet      = 1
+	bgpASSequence = 2
+)
+
+// mrtRoute is one RIB entry: a prefix and the AS path one peer saw for it
+type mrtRoute struct {
+	prefix netip.Prefix
+	path   []uint32 // AS_SEQUENCE hops, peer first, prepending removed
+	set    []uint32 // a trailing AS_SET, the aggregated origins
+}
+
+// origins returns the ASes that originate the route
+func (r mrtRoute) origins() []uint32 {
+	if len(r.set) > 0 {
+		return r.set
+	}
+	if len(r.path) == 0 {
+		return nil
+	}
+	return r.path[len(r.path)-1:]
+}
+
+// upstream returns the AS the origin learned the route from, or 0
+func (r mrtRoute) upstream() uint32 {
+	if len(r.set) > 0 || len(r.path) < 2 {
+		return 0
+	}
+	return r.path[len(r.path)-2]
+}
+
+// readMRT calls fn for every unicast RIB entry in a TABLE_DUMP_V2 file.
+// Other record types are skipped.
+func readMRT(r io.Reader, fn func(mrtRoute)) error {
+	br := bufio.NewReaderSize(r, 1<<16)
+	header := make([]byte, 12)
+	var body []byte
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("mrt header: %w", err)
+		}
+		typ := binary.BigEndian.Uint16(header[4:6])
+		subtype := binary.BigEndian.Uint16(header[6:8])
+		length := int(binary.BigEndian.Uint32(header[8:12]))
+		if length > mrtMaxRecord {
+			return fmt.Errorf("mrt record: length %d exceeds %d", length, mrtMaxRecord)
+		}
+		if cap(body) < length {
+			body = make([]byte, length)
+		}
+		body = body[:length]
+		if _, err := io.ReadFull(br, body); err != nil {
+			return fmt.Errorf("mrt record: %w", err)
+		}
+		if typ != mrtTableDumpV2 {
+			continue
+		}
+
+		var v6, addPath bool
+		switch subtype {
+		case mrtRIBIPv4Unicast:
+		case mrtRIBIPv6Unicast:
+			v6 = true
+		case mrtRIBIPv4UnicastAddPath:
+			addPath = true
+		case mrtRIBIPv6UnicastAddPath:
+			v6, addPath = true, true
+		default:
+			continue // the peer index and multicast/generic RIBs
+		}
+		if err := parseMRTRIB(body, v6, addPath, fn); err != nil {
+			return err
+		}
+	}
+}
+
+var errMRTShort = errors.New("mrt: truncated RIB entry")
+
+// parseMRTRIB decodes a RIB_IPV4_UNICAST or RIB_IPV6_UNICAST record
+func parseMRTRIB(b []byte, v6, addPath bool, fn func(mrtRoute)) error {
+	if len(b) < 5 {
+		return errMRTShort
+	}
+	bitLen := int(b[4])
+	n := (bitLen + 7) / 8
+	b = b[5:]
+	if len(b) < n+2 || (!v6 && bitLen > 32) || bitLen > 128 {
+		return errMRTShort
+	}
+	var addr netip.Addr
+	if v6 {
+		var a [16]byte
+		copy(a[:], b[:n])
+		addr = netip.AddrFrom16(a)
+	} else {
+		var a [4]byte
+		copy(a[:], b[:n])
+		addr = netip.AddrFrom4(a)
+	}
+	prefix := netip.PrefixFrom(addr, bitLen).Masked()
+	count := int(binary.BigEndian.Uint16(b[n:]))
+	b = b[n+2:]
+
+	for range count {
+		// peer index, originated time, and with ADD-PATH a path identifier
+		skip := 6
+		if addPath {
+			skip += 4
+		}
+		if len(b) < skip+2 {
+			return errMRTShort
+		}
+		attrLen := int(binary.BigEndian.Uint16(b[skip:]))
+		b = b[skip+2:]
+		if len(b) < attrLen {
+			return errMRTShort
+		}
+		route := mrtRoute{prefix: prefix}
+		if err := parseASPathAttr(b[:attrLen], &route); err != nil {
+			return err
+		}
+		b = b[attrLen:]
+		fn(route)
+	}
+	return nil
+}
+
+// parseASPathAttr finds AS_PATH among BGP path attributes. TABLE_DUMP_V2
+// always encodes AS numbers in four bytes.
+func parseASPathAttr(b []byte, route *mrtRoute) error {
+	for len(b) >= 3 {
+		flags, typ := b[0], b[1]
+		var length int
+		if flags&0x10 != 0 { // extended length
+			if len(b) < 4 {
+				return errMRTShort
+			}
+			length = int(binary.BigEndian.Uint16(b[2:4]))
+			b = b[4:]
+		} else {
+			length = int(b[2])
+			b = b[3:]
+		}
+		if len(b) < length {
+			return errMRTShort
+		}
+		if typ == bgpAttrASPath {
+			return parseASPath(b[:length], route)
+		}
+		b = b[length:]
+	}
+	return nil
+}
+
+func parseASPath(b []byte, route *mrtRoute) error {
+	for len(b) >= 2 {
+		segType, count := b[0], int(b[1])
+		b = b[2:]
+		if len(b) < 4*count {
+			return errMRTShort
+		}
+		switch segType {
+		case bgpASSequence:
+			for i := range count {
+				asn := binary.BigEndian.Uint32(b[4*i:])
+				if n := len(route.path); n == 0 || route.path[n-1] != asn {
+					route.path = append(route.path, asn)
+				}
+			}
+			route.set = nil
+		case bgpASSet:
+			route.set = route.set[:0]
+			for i := range count {
+				route.set = append(route.set, binary.BigEndian.Uint32(b[4*i:]))
+			}
+		}
+		b = b[4*count:]
+	}
+	return nil
+}
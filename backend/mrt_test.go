@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/netip"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func readRIBFixture(t *testing.T) []byte {
+	t.Helper()
+	f, err := os.Open("testdata/asn/rib.mrt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestReadMRT(t *testing.T) {
+	var routes []mrtRoute
+	if err := readMRT(bytes.NewReader(readRIBFixture(t)), func(r mrtRoute) { routes = append(routes, r) }); err != nil {
+		t.Fatal(err)
+	}
+	want := []mrtRoute{
+		// Prepending is removed
+		{prefix: netip.MustParsePrefix("203.0.113.0/24"), path: []uint32{64600, 64601, 64510}},
+		// An extended-length AS_PATH attribute
+		{prefix: netip.MustParsePrefix("203.0.113.0/24"), path: []uint32{64602, 64511}},
+		{prefix: netip.MustParsePrefix("192.0.2.0/24"), path: []uint32{64600, 64520}},
+		{prefix: netip.MustParsePrefix("198.18.0.0/15"), path: []uint32{64600}, set: []uint32{64530, 64531}},
+		// ADD-PATH entries carry a path identifier
+		{prefix: netip.MustParsePrefix("2001:db8:1::/48"), path: []uint32{64600, 64540}},
+		{prefix: netip.MustParsePrefix("2001:db8:1::/48"), path: []uint32{64602, 64540}},
+	}
+	if !reflect.DeepEqual(routes, want) {
+		t.Fatalf("routes:\n got %+v\nwant %+v", routes, want)
+	}
+
+	if got := routes[0].origins(); !reflect.DeepEqual(got, []uint32{64510}) {
+		t.Errorf("origins = %v", got)
+	}
+	if got := routes[0].upstream(); got != 64601 {
+		t.Errorf("upstream = %d, want 64601", got)
+	}
+	if got := routes[3].origins(); !reflect.DeepEqual(got, []uint32{64530, 64531}) {
+		t.Errorf("AS_SET origins = %v", got)
+	}
+	if got := routes[3].upstream(); got != 0 {
+		t.Errorf("AS_SET upstream = %d, want 0", got)
+	}
+}
+
+func TestReadMRTTruncated(t *testing.T) {
+	data := readRIBFixture(t)
+	for _, n := range []int{5, 20, len(data) - 1} {
+		err := readMRT(bytes.NewReader(data[:n]), func(mrtRoute) {})
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("cut at %d: err = %v, want unexpected EOF", n, err)
+		}
+	}
+
+	// A record whose entries run past its length
+	rib := []byte{0, 0, 0, 0, 24, 192, 0, 2, 0, 1, 0, 0}
+	header := []byte{0, 0, 0, 0, 0, mrtTableDumpV2, 0, mrtRIBIPv4Unicast, 0, 0, 0, byte(len(rib))}
+	if err := readMRT(bytes.NewReader(append(header, rib...)), func(mrtRoute) {}); !errors.Is(err, errMRTShort) {
+		t.Errorf("short RIB entry: err = %v", err)
+	}
+
+	// A length no real record has fails before anything is allocated
+	header = []byte{0, 0, 0, 0, 0, mrtTableDumpV2, 0, mrtRIBIPv4Unicast, 0xff, 0xff, 0xff, 0xff}
+	if err := readMRT(bytes.NewReader(header), func(mrtRoute) {}); err == nil || errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("oversized record: err = %v", err)
+	}
+}
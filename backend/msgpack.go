@@ -0,0 +1,724 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MessagePack encoding of the /ws messages. Values are encoded with the same
+// field names, embedding and omitempty rules as their JSON form, and types
+// with their own JSON or text encoding are encoded as that value, so a
+// MessagePack client decodes exactly the objects a JSON client parses;
+// times use the MessagePack timestamp extension instead of RFC 3339 strings.
+
+// MarshalMsgpack encodes v as MessagePack
+func MarshalMsgpack(v any) ([]byte, error) {
+	e := &msgpackEncoder{buf: make([]byte, 0, 256)}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, 0xc0)
+		return nil
+	}
+	if v.Type() == timeType {
+		e.encodeTime(v.Interface().(time.Time))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	}
+	if m := marshalerOf(v); m != nil {
+		return e.encodeMarshaler(m)
+	}
+	return e.encodeKind(v)
+}
+
+// encodeKind encodes v by its kind, for values that are not pointers,
+// interfaces or marshalers
+func (e *msgpackEncoder) encodeKind(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.buf = append(e.buf, 0xca)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.buf = append(e.buf, 0xcb)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.encodeBytes(v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		e.encodeLength(v.Len(), 0x90, 0xdc, 0xdd)
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("msgpack: unsupported map key type %s", v.Type().Key())
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		e.encodeLength(len(keys), 0x80, 0xde, 0xdf)
+		for _, key := range keys {
+			e.encodeString(key.String())
+			if err := e.encode(v.MapIndex(key)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// marshalerKind says how values of a type encode themselves, if they do
+type marshalerKind int
+
+const (
+	marshalerNone marshalerKind = iota
+	marshalerValue
+	marshalerPointer // only through the pointer method set
+)
+
+var msgpackMarshalerCache sync.Map // reflect.Type -> marshalerKind
+
+// marshalerOf returns v as a json.Marshaler or encoding.TextMarshaler, the
+// former preferred, using the pointer method set when v is addressable as
+// encoding/json does. It returns nil for types without either.
+func marshalerOf(v reflect.Value) any {
+	switch marshalerKindOf(v.Type()) {
+	case marshalerValue:
+		if v.CanInterface() {
+			return v.Interface()
+		}
+	case marshalerPointer:
+		if v.CanAddr() && v.Addr().CanInterface() {
+			return v.Addr().Interface()
+		}
+	}
+	return nil
+}
+
+func marshalerKindOf(t reflect.Type) marshalerKind {
+	if t.PkgPath() == "" && t.Kind() != reflect.Struct {
+		return marshalerNone // predeclared or unnamed, so no methods
+	}
+	if kind, ok := msgpackMarshalerCache.Load(t); ok {
+		return kind.(marshalerKind)
+	}
+	var kind marshalerKind
+	switch {
+	case t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType):
+		kind = marshalerValue
+	case reflect.PointerTo(t).Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType):
+		kind = marshalerPointer
+	}
+	msgpackMarshalerCache.Store(t, kind)
+	return kind
+}
+
+// encodeMarshaler encodes the value a type's MarshalJSON produces, e.g. a
+// port range as 443 or "8000-8080", or its MarshalText as a string
+func (e *msgpackEncoder) encodeMarshaler(m any) error {
+	if tm, ok := m.(encoding.TextMarshaler); ok {
+		if _, isJSON := m.(json.Marshaler); !isJSON {
+			text, err := tm.MarshalText()
+			if err != nil {
+				return err
+			}
+			e.encodeString(string(text))
+			return nil
+		}
+	}
+	data, err := m.(json.Marshaler).MarshalJSON()
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return fmt.Errorf("msgpack: decode MarshalJSON output: %w", err)
+	}
+	return e.encodeJSONValue(value)
+}
+
+// encodeJSONValue encodes a value decoded from JSON with UseNumber
+func (e *msgpackEncoder) encodeJSONValue(value any) error {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			e.encodeInt(n)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		e.buf = append(e.buf, 0xcb)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(f))
+		return nil
+	case []any:
+		e.encodeLength(len(v), 0x90, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := e.encodeJSONValue(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]any:
+		keys := slices.Sorted(maps.Keys(v))
+		e.encodeLength(len(keys), 0x80, 0xde, 0xdf)
+		for _, key := range keys {
+			e.encodeString(key)
+			if err := e.encodeJSONValue(v[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// nil, bool and string
+	return e.encode(reflect.ValueOf(value))
+}
+
+func (e *msgpackEncoder) encodeStruct(v reflect.Value) error {
+	fields := cachedFields(v.Type())
+	count := 0
+	for _, f := range fields {
+		if _, ok := structField(v, f); ok {
+			count++
+		}
+	}
+	e.encodeLength(count, 0x80, 0xde, 0xdf)
+	for _, f := range fields {
+		field, ok := structField(v, f)
+		if !ok {
+			continue
+		}
+		e.encodeString(f.name)
+		encode := e.encode
+		if f.plain {
+			encode = e.encodeKind
+		}
+		if err := encode(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// structField returns the value of f in v, or false when the field is
+// omitted
+func structField(v reflect.Value, f msgpackField) (reflect.Value, bool) {
+	field, ok := fieldByIndex(v, f.index)
+	if !ok || (f.omitEmpty && isEmptyValue(field)) {
+		return reflect.Value{}, false
+	}
+	return field, true
+}
+
+// fieldByIndex follows a promoted field's index path, reporting false when
+// it passes through a nil embedded pointer
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	if len(index) == 1 {
+		return v.Field(index[0]), true
+	}
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func (e *msgpackEncoder) encodeInt(n int64) {
+	switch {
+	case n >= 0:
+		e.encodeUint(uint64(n))
+	case n >= -32:
+		e.buf = append(e.buf, byte(n))
+	case n >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		e.buf = append(e.buf, 0xd1)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	case n >= math.MinInt32:
+		e.buf = append(e.buf, 0xd2)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	default:
+		e.buf = append(e.buf, 0xd3)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(n))
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(n uint64) {
+	switch {
+	case n < 128:
+		e.buf = append(e.buf, byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xcd)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	case n <= math.MaxUint32:
+		e.buf = append(e.buf, 0xce)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	default:
+		e.buf = append(e.buf, 0xcf)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, n)
+	}
+}
+
+func (e *msgpackEncoder) encodeString(s string) {
+	switch n := len(s); {
+	case n < 32:
+		e.buf = append(e.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xda)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, 0xdb)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) encodeBytes(b []byte) {
+	switch {
+	case len(b) <= math.MaxUint8:
+		e.buf = append(e.buf, 0xc4, byte(len(b)))
+	case len(b) <= math.MaxUint16:
+		e.buf = append(e.buf, 0xc5)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(len(b)))
+	default:
+		e.buf = append(e.buf, 0xc6)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(len(b)))
+	}
+	e.buf = append(e.buf, b...)
+}
+
+// encodeLength writes an array or map header: the fix form for small
+// lengths, otherwise the 16- or 32-bit form
+func (e *msgpackEncoder) encodeLength(n int, fix, code16, code32 byte) {
+	switch {
+	case n < 16:
+		e.buf = append(e.buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, code16)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, code32)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+}
+
+// encodeTime writes the timestamp extension (type -1) in its 96-bit form,
+// which holds any time.Time
+func (e *msgpackEncoder) encodeTime(t time.Time) {
+	e.buf = append(e.buf, 0xc7, 12, 0xff)
+	e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(t.Nanosecond()))
+	e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(t.Unix()))
+}
+
+type msgpackField struct {
+	name      string
+	index     []int // path through embedded structs
+	omitEmpty bool
+	tagged    bool // named by a json tag
+	plain     bool // encoded by kind alone, see encodeKind
+}
+
+var msgpackFieldCache sync.Map // reflect.Type -> []msgpackField
+
+// cachedFields lists a struct's fields under their JSON names, with the
+// fields of embedded structs promoted as encoding/json promotes them
+func cachedFields(t reflect.Type) []msgpackField {
+	if fields, ok := msgpackFieldCache.Load(t); ok {
+		return fields.([]msgpackField)
+	}
+	fields := typeFields(t)
+	msgpackFieldCache.Store(t, fields)
+	return fields
+}
+
+// isPlainType reports whether values of t skip the checks in encode
+func isPlainType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return false
+	}
+	return t != timeType && marshalerKindOf(t) == marshalerNone
+}
+
+// typeFields walks t breadth first. A shallower field hides deeper ones of
+// the same name; among fields at the same depth a single tagged one wins,
+// and otherwise the name is dropped.
+func typeFields(t reflect.Type) []msgpackField {
+	type embedded struct {
+		typ   reflect.Type
+		index []int
+	}
+	var fields []msgpackField
+	taken := make(map[string]bool)
+	visited := make(map[reflect.Type]bool)
+
+	for next := []embedded{{typ: t}}; len(next) > 0; {
+		current := next
+		next = nil
+		var level []msgpackField
+		for _, s := range current {
+			if visited[s.typ] {
+				continue
+			}
+			visited[s.typ] = true
+			for i := 0; i < s.typ.NumField(); i++ {
+				sf := s.typ.Field(i)
+				name, opts, _ := strings.Cut(sf.Tag.Get("json"), ",")
+				if name == "-" && opts == "" {
+					continue
+				}
+				index := append(slices.Clone(s.index), i)
+				if sf.Anonymous {
+					ft := sf.Type
+					if ft.Kind() == reflect.Pointer {
+						ft = ft.Elem()
+					}
+					if name == "" && ft.Kind() == reflect.Struct {
+						next = append(next, embedded{typ: ft, index: index})
+						continue
+					}
+					if !sf.IsExported() {
+						continue
+					}
+				} else if !sf.IsExported() {
+					continue
+				}
+				field := msgpackField{
+					name:      name,
+					index:     index,
+					omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+					tagged:    name != "",
+					plain:     isPlainType(sf.Type),
+				}
+				if field.name == "" {
+					field.name = sf.Name
+				}
+				level = append(level, field)
+			}
+		}
+
+		byName := make(map[string][]msgpackField)
+		for _, f := range level {
+			if !taken[f.name] {
+				byName[f.name] = append(byName[f.name], f)
+			}
+		}
+		for name, candidates := range byName {
+			taken[name] = true
+			var tagged []msgpackField
+			for _, f := range candidates {
+				if f.tagged {
+					tagged = append(tagged, f)
+				}
+			}
+			switch {
+			case len(candidates) == 1:
+				fields = append(fields, candidates[0])
+			case len(tagged) == 1:
+				fields = append(fields, tagged[0])
+			}
+		}
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		return slices.Compare(fields[i].index, fields[j].index) < 0
+	})
+	return fields
+}
+
+// isEmptyValue follows encoding/json's omitempty rules
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+// UnmarshalMsgpack decodes a MessagePack client request into v by way of
+// its JSON form. Requests are small and rare, so the detour is cheap.
+func UnmarshalMsgpack(data []byte, v any) error {
+	d := &msgpackDecoder{buf: data}
+	value, err := d.decode(0)
+	if err != nil {
+		return err
+	}
+	if d.pos != len(data) {
+		return errors.New("msgpack: trailing data")
+	}
+	j, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, v)
+}
+
+// msgpackMaxDepth bounds nesting so hostile input cannot exhaust the stack
+const msgpackMaxDepth = 32
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+type msgpackDecoder struct {
+	buf []byte
+	pos int
+}
+
+func (d *msgpackDecoder) take(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.buf) {
+		return nil, errMsgpackShort
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.take(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *msgpackDecoder) decode(depth int) (any, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errors.New("msgpack: nesting too deep")
+	}
+	b, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.decodeMap(int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return d.decodeArray(int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		s, err := d.take(int(c & 0x1f))
+		return string(s), err
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6: // bin 8/16/32
+		return d.decodeString(1 << (c - 0xc4))
+	case 0xd9, 0xda, 0xdb: // str 8/16/32
+		return d.decodeString(1 << (c - 0xd9))
+	case 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.uint(1 << (c - 0xcc))
+	case 0xd0:
+		n, err := d.uint(1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := d.uint(2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := d.uint(4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := d.uint(8)
+		return int64(n), err
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n), depth)
+	case 0xd6: // fixext 4
+		return d.decodeExt(4)
+	case 0xd7: // fixext 8
+		return d.decodeExt(8)
+	case 0xc7: // ext 8
+		n, err := d.uint(1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeExt(int(n))
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type byte 0x%02x", c)
+}
+
+// decodeExt reads an extension value of n bytes. Only the timestamp
+// extension (type -1) is understood, in its 32-, 64- and 96-bit forms.
+func (d *msgpackDecoder) decodeExt(n int) (any, error) {
+	typ, err := d.uint(1)
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.take(n)
+	if err != nil {
+		return nil, err
+	}
+	if int8(typ) != -1 {
+		return nil, fmt.Errorf("msgpack: unsupported extension type %d", int8(typ))
+	}
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0).UTC(), nil
+	case 8:
+		v := binary.BigEndian.Uint64(data)
+		return time.Unix(int64(v&(1<<34-1)), int64(v>>34)).UTC(), nil
+	case 12:
+		nsec := binary.BigEndian.Uint32(data[:4])
+		sec := int64(binary.BigEndian.Uint64(data[4:]))
+		return time.Unix(sec, int64(nsec)).UTC(), nil
+	}
+	return nil, fmt.Errorf("msgpack: bad timestamp length %d", n)
+}
+
+// decodeString reads a string or binary value whose length takes size bytes
+func (d *msgpackDecoder) decodeString(size int) (any, error) {
+	n, err := d.uint(size)
+	if err != nil {
+		return nil, err
+	}
+	s, err := d.take(int(n))
+	return string(s), err
+}
+
+func (d *msgpackDecoder) decodeArray(n, depth int) (any, error) {
+	if n > len(d.buf)-d.pos {
+		return nil, errMsgpackShort
+	}
+	out := make([]any, n)
+	for i := range out {
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n, depth int) (any, error) {
+	if n > len(d.buf)-d.pos {
+		return nil, errMsgpackShort
+	}
+	out := make(map[string]any, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, errors.New("msgpack: map key is not a string")
+		}
+		if out[key], err = d.decode(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// jsonForm is v as a JSON client sees it
+func jsonForm(t testing.TB, v any) any {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out any
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// msgpackForm is v encoded as MessagePack and decoded again, in the same
+// generic form as jsonForm
+func msgpackForm(t testing.TB, v any) any {
+	t.Helper()
+	data, err := MarshalMsgpack(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out any
+	if err := UnmarshalMsgpack(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func sampleNode(i int) *NetworkNode {
+	seen := time.Date(2026, 10, 19, 12, 0, 0, 123456789, time.UTC)
+	return &NetworkNode{
+		ID:          fmt.Sprintf("203.0.113.%d", i%250),
+		Name:        fmt.Sprintf("edge-%d.example.net", i),
+		IPAddress:   fmt.Sprintf("203.0.113.%d", i%250),
+		Type:        "server",
+		Location:    Location{Lat: 52.37, Lng: 4.89},
+		Country:     "NL",
+		ASN:         "AS64500",
+		Status:      "online",
+		Connections: i,
+		DNSNames:    []string{"www.example.net", "cdn.example.net"},
+		Reputation:  -1 + i%3, // exercises negative fixints
+		PIDs:        []int{1, 300, 70000, 5_000_000_000},
+		FirstSeen:   seen.Add(-time.Hour),
+		LastSeen:    seen,
+	}
+}
+
+func sampleEdges(n int) []WSConnection {
+	edges := make([]WSConnection, n)
+	for i := range edges {
+		edges[i] = WSConnection{
+			From:    "local",
+			To:      fmt.Sprintf("203.0.113.%d", i%250),
+			Latency: 12.5 + float64(i),
+			Service: &ServiceInfo{
+				ServerNames: []string{"example.net"},
+				ALPN:        []string{"h2"},
+				JA4:         []string{"t13d1516h2_8daaf6152771_02713d6af862"},
+			},
+		}
+	}
+	return edges
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	tests := map[string]any{
+		"node_update": WSMessage{Type: "node_update", Seq: 1 << 40, Node: sampleNode(7)},
+		"connections": WSMessage{Type: "connections_update", Seq: 42, Connections: sampleEdges(40)},
+		"alert": WSMessage{Type: "alert", Alert: &Alert{
+			ID: "threat-intel-1", Type: "threat-intel", NodeID: "203.0.113.7", Severity: "high",
+			Message: "listed", Timestamp: time.Date(2026, 10, 19, 1, 2, 3, 4, time.UTC),
+		}},
+		"error": WSMessage{Type: "error", RequestID: "r1", Error: "unknown node"},
+		// Long strings and large collections use the 16- and 32-bit forms
+		"large": map[string]any{
+			"text":  string(make([]byte, 70000)),
+			"nodes": []*NetworkNode{sampleNode(1), nil, sampleNode(2)},
+			"edges": sampleEdges(70),
+		},
+	}
+	for name, v := range tests {
+		if got, want := msgpackForm(t, v), jsonForm(t, v); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: MessagePack form differs from JSON\n got: %v\nwant: %v", name, got, want)
+		}
+	}
+}
+
+// Embedded structs and custom encodings, as encoding/json handles them
+type msgpackBase struct {
+	ID      string `json:"id"`
+	Shadow  string `json:"shadow"`
+	Created time.Time
+}
+
+type msgpackExtra struct {
+	Note   string `json:"note,omitempty"`
+	Shadow string `json:"shadow"`
+}
+
+type msgpackNamed struct {
+	Value int `json:"value"`
+}
+
+type msgpackEmbedding struct {
+	msgpackBase
+	*msgpackExtra
+	Named  msgpackNamed `json:"named"`
+	Shadow string       `json:"shadow"` // hides both embedded fields
+	Ports  []portRange  `json:"ports"`
+	Addr   netip.Addr   `json:"addr"`
+	Prefix *netip.Prefix
+	Range  *portRange `json:"range,omitempty"`
+}
+
+func TestMsgpackEmbeddedAndMarshalers(t *testing.T) {
+	prefix := netip.MustParsePrefix("198.51.100.0/24")
+	tests := map[string]any{
+		"embedded": msgpackEmbedding{
+			msgpackBase:  msgpackBase{ID: "a", Shadow: "base", Created: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)},
+			msgpackExtra: &msgpackExtra{Note: "extra", Shadow: "extra"},
+			Named:        msgpackNamed{Value: 3},
+			Shadow:       "outer",
+			Ports:        []portRange{{Low: 443, High: 443}, {Low: 8000, High: 8080}},
+			Addr:         netip.MustParseAddr("2001:db8::1"),
+			Prefix:       &prefix,
+			Range:        &portRange{Low: 1, High: 1023},
+		},
+		// A nil embedded pointer contributes no fields
+		"nil embedded": &msgpackEmbedding{msgpackBase: msgpackBase{ID: "b"}},
+		"policy": egressPolicyFile{Version: 1, Rules: []egressRule{
+			{Process: "curl", Domains: []string{"*.example.com"}, Ports: []portRange{{Low: 443, High: 443}}},
+			{CIDRs: []string{"10.0.0.0/8"}, Ports: []portRange{{Low: 8000, High: 8080}}},
+		}},
+	}
+	for name, v := range tests {
+		if got, want := msgpackForm(t, v), jsonForm(t, v); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: MessagePack form differs from JSON\n got: %v\nwant: %v", name, got, want)
+		}
+	}
+
+	got := msgpackForm(t, egressRule{Ports: []portRange{{Low: 443, High: 443}, {Low: 8000, High: 8080}}})
+	ports := got.(map[string]any)["ports"]
+	if want := []any{float64(443), "8000-8080"}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("ports = %#v, want %#v", ports, want)
+	}
+}
+
+func TestMsgpackTimestamp(t *testing.T) {
+	when := time.Date(2262, 4, 11, 23, 47, 16, 854775807, time.UTC)
+	data, err := MarshalMsgpack(when)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != 0xc7 || data[1] != 12 || data[2] != 0xff {
+		t.Fatalf("header = % x, want c7 0c ff", data[:3])
+	}
+	d := &msgpackDecoder{buf: data}
+	decoded, err := d.decode(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.(time.Time).Equal(when) {
+		t.Errorf("decoded %v, want %v", decoded, when)
+	}
+
+	// The 32- and 64-bit forms other encoders use
+	for _, data := range [][]byte{
+		{0xd6, 0xff, 0x68, 0xf4, 0xd2, 0xc0},
+		{0xd7, 0xff, 0x00, 0x00, 0x00, 0x00, 0x68, 0xf4, 0xd2, 0xc0},
+	} {
+		d := &msgpackDecoder{buf: data}
+		decoded, err := d.decode(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := time.Unix(0x68f4d2c0, 0); !decoded.(time.Time).Equal(want) {
+			t.Errorf("% x decoded to %v, want %v", data, decoded, want)
+		}
+	}
+}
+
+func TestUnmarshalMsgpackRequest(t *testing.T) {
+	req := ClientRequest{Type: "subscribe", RequestID: "r7", Filter: &NodeFilter{}}
+	data, err := MarshalMsgpack(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got ClientRequest
+	if err := UnmarshalMsgpack(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != "subscribe" || got.RequestID != "r7" || got.Filter == nil {
+		t.Errorf("decoded %+v", got)
+	}
+
+	bad := map[string][]byte{
+		"truncated":      data[:len(data)-1],
+		"trailing":       append(append([]byte(nil), data...), 0xc0),
+		"unknown ext":    {0xd6, 0x01, 0, 0, 0, 0},
+		"non-string key": {0x81, 0x01, 0x02},
+		"huge array":     {0xdd, 0xff, 0xff, 0xff, 0xff},
+		"too deep":       append(make([]byte, 0, 64), bytesRepeat(0x91, msgpackMaxDepth+2)...),
+	}
+	for name, data := range bad {
+		var v any
+		if err := UnmarshalMsgpack(data, &v); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func bytesRepeat(b byte, n int) []byte {
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = b
+	}
+	return out
+}
+
+func TestMarshalMsgpackRejectsUnsupported(t *testing.T) {
+	for name, v := range map[string]any{
+		"int keys": map[int]string{1: "a"},
+		"channel":  make(chan int),
+		"func":     func() {},
+	} {
+		if _, err := MarshalMsgpack(v); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func benchmarkMessage() WSMessage {
+	return WSMessage{Type: "connections_update", Seq: 1 << 50, Connections: sampleEdges(500)}
+}
+
+func BenchmarkWSMessageJSON(b *testing.B) {
+	msg := benchmarkMessage()
+	b.ReportAllocs()
+	for b.Loop() {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(data)))
+	}
+}
+
+func BenchmarkWSMessageMsgpack(b *testing.B) {
+	msg := benchmarkMessage()
+	b.ReportAllocs()
+	for b.Loop() {
+		data, err := MarshalMsgpack(msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(data)))
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// netnsDir is where "ip netns" keeps the namespaces it names
+const netnsDir = "/var/run/netns"
+
+// netnsIDPrefix starts the node ID of every network namespace
+const netnsIDPrefix = "netns:"
+
+// netNamespace is a network namespace on this host
+type netNamespace struct {
+	Inode uint64
+	Name  string // from netnsDir, "" for unnamed namespaces
+	Path  string // bind mount in netnsDir, to enter it when no process is in it
+	PIDs  []int  // processes in it, sorted
+}
+
+// Label is the namespace's name, or its inode as "net:[4026532281]"
+func (ns *netNamespace) Label() string {
+	if ns.Name != "" {
+		return ns.Name
+	}
+	return fmt.Sprintf("net:[%d]", ns.Inode)
+}
+
+// selected reports whether the namespace is in a NETOPS_NETNS list of
+// names, labels, inodes and "host". An empty list selects every one.
+func (ns *netNamespace) selected(list []string, host uint64) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, entry := range list {
+		switch entry {
+		case "host":
+			if ns.Inode == host {
+				return true
+			}
+		case ns.Name, ns.Label(), strconv.FormatUint(ns.Inode, 10):
+			return true
+		}
+	}
+	return false
+}
+
+// hostNetns is the inode of the host's network namespace: the one init is
+// in, or the backend's own when init's can't be read. In a container
+// without the host's PID namespace that is the container's.
+func hostNetns() uint64 {
+	return cmp.Or(netnsInode("1"), netnsInode("self"))
+}
+
+// listNamespaces finds the network namespaces processes are in and the
+// ones named in netnsDir, keeping those in list
+func listNamespaces(list []string) ([]*netNamespace, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	byInode := make(map[uint64]*netNamespace)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		inode := netnsInode(entry.Name())
+		if inode == 0 {
+			continue // exited, or not ours to read
+		}
+		ns, ok := byInode[inode]
+		if !ok {
+			ns = &netNamespace{Inode: inode}
+			byInode[inode] = ns
+		}
+		ns.PIDs = append(ns.PIDs, pid)
+	}
+	named, err := namedNamespaces()
+	if err != nil && !os.IsNotExist(err) {
+		slog.Warn("Listing named network namespaces failed", "component", "collector", "dir", netnsDir, "error", err)
+	}
+	for _, n := range named {
+		if ns, ok := byInode[n.Inode]; ok {
+			ns.Name, ns.Path = n.Name, n.Path
+		} else {
+			byInode[n.Inode] = n
+		}
+	}
+
+	host := hostNetns()
+	namespaces := make([]*netNamespace, 0, len(byInode))
+	for _, ns := range byInode {
+		if ns.selected(list, host) {
+			slices.Sort(ns.PIDs)
+			namespaces = append(namespaces, ns)
+		}
+	}
+	slices.SortFunc(namespaces, func(a, b *netNamespace) int { return cmp.Compare(a.Inode, b.Inode) })
+	return namespaces, nil
+}
+
+// readNamespaceSockets lists a namespace's TCP sockets through the first
+// of its processes that can still be read or, when none can, by entering
+// its bind mount. Processes exit between listing and reading.
+func readNamespaceSockets(ns *netNamespace) ([]procSocket, error) {
+	var err error
+	for _, pid := range ns.PIDs {
+		var sockets []procSocket
+		if sockets, err = readProcTCP(pid); err == nil {
+			return sockets, nil
+		}
+	}
+	if ns.Path == "" && err != nil {
+		return nil, err
+	}
+	return readNetnsTCP(ns.Path)
+}
+
+// nsSocket is a socket read from a namespace, with the node it belongs to
+type nsSocket struct {
+	procSocket
+	origin string // node ID, "" for this host
+	netns  string // namespace label
+	pid    int    // holding process, 0 if unknown
+}
+
+// namespaceConnections turns sockets read from several namespaces into
+// connections. Traffic to another namespace's address on this host ends
+// at that namespace's node and is drawn once, from the client side;
+// everything else is filtered like the ss collector's sockets.
+func namespaceConnections(sockets []nsSocket, includePrivate bool) []Connection {
+	addrs := namespaceAddrs(sockets)
+	names := make(map[int]string)
+	connections := []Connection{}
+	for _, s := range sockets {
+		conn := Connection{
+			LocalIP:    s.Local.Addr().String(),
+			LocalPort:  int(s.Local.Port()),
+			RemoteIP:   s.Remote.Addr().String(),
+			RemotePort: int(s.Remote.Port()),
+			State:      s.State,
+			Origin:     s.origin,
+			PID:        s.pid,
+			Netns:      s.netns,
+		}
+		if s.pid != 0 {
+			if _, ok := names[s.pid]; !ok {
+				names[s.pid] = processName(s.pid)
+			}
+			conn.Process = names[s.pid]
+		}
+		if !isPeerConnection(&conn) {
+			continue
+		}
+		if target, ok := addrs[conn.RemoteIP]; ok {
+			if target == conn.Origin || conn.RemotePort > conn.LocalPort {
+				continue
+			}
+			conn.Target = target
+			connections = append(connections, conn)
+			continue
+		}
+		if includePrivate || shouldInclude(&conn) {
+			connections = append(connections, conn)
+		}
+	}
+	return connections
+}
+
+// namespaceAddrs maps the addresses of sockets outside this host's
+// namespace to their node
+func namespaceAddrs(sockets []nsSocket) map[string]string {
+	addrs := make(map[string]string)
+	for _, s := range sockets {
+		if s.origin != "" && s.State != "LISTEN" && !s.Local.Addr().IsLoopback() && !s.Local.Addr().IsUnspecified() {
+			addrs[s.Local.Addr().String()] = s.origin
+		}
+	}
+	return addrs
+}
+
+// nodeAddress is the lowest address addrs gives node id, so it stays the
+// same from scan to scan
+func nodeAddress(addrs map[string]string, id string) string {
+	address := ""
+	for ip, owner := range addrs {
+		if owner == id && (address == "" || ip < address) {
+			address = ip
+		}
+	}
+	return address
+}
+
+// NetnsCollector reports the sockets of every selected network namespace
+// on this host. The host's own namespace is this machine, as with the ss
+// collector; each other namespace becomes an internal node that is the
+// origin of its connections.
+type NetnsCollector struct {
+	list           []string // NETOPS_NETNS, empty for all
+	includePrivate bool
+
+	nodes map[string]*NetworkNode // by node ID, for DescribeOrigin
+	mu    sync.RWMutex
+}
+
+// NewNetnsCollector captures the namespaces in list, or all when it is
+// empty. includePrivate keeps connections to private addresses outside
+// this host.
+func NewNetnsCollector(list []string, includePrivate bool) *NetnsCollector {
+	return &NetnsCollector{
+		list:           list,
+		includePrivate: includePrivate,
+		nodes:          make(map[string]*NetworkNode),
+	}
+}
+
+func (c *NetnsCollector) Name() string { return "netns" }
+
+func (c *NetnsCollector) Collect() ([]Connection, error) {
+	namespaces, err := listNamespaces(c.list)
+	if err != nil {
+		return nil, fmt.Errorf("list network namespaces: %w", err)
+	}
+	host := hostNetns()
+
+	var sockets []nsSocket
+	nodes := make(map[string]*NetworkNode)
+	for _, ns := range namespaces {
+		table, err := readNamespaceSockets(ns)
+		if err != nil {
+			slog.Debug("Reading namespace sockets failed", "component", "collector", "netns", ns.Label(), "error", err)
+			continue
+		}
+		origin := ""
+		if ns.Inode != host {
+			origin = netnsIDPrefix + ns.Label()
+			nodes[origin] = &NetworkNode{
+				ID:       origin,
+				Name:     netnsNodeName(ns),
+				Type:     "endpoint",
+				Status:   "online",
+				Internal: true,
+				Netns:    ns.Label(),
+			}
+		}
+		owners := socketOwners(ns.PIDs)
+		for _, s := range table {
+			sockets = append(sockets, nsSocket{procSocket: s, origin: origin, netns: ns.Label(), pid: owners[s.Inode]})
+		}
+	}
+
+	addrs := namespaceAddrs(sockets)
+	for id, node := range nodes {
+		node.IPAddress = nodeAddress(addrs, id)
+	}
+	c.mu.Lock()
+	c.nodes = nodes
+	c.mu.Unlock()
+
+	return namespaceConnections(sockets, c.includePrivate), nil
+}
+
+// netnsNodeName names a namespace's node: its name from "ip netns", or
+// else the first process in it and its inode
+func netnsNodeName(ns *netNamespace) string {
+	if ns.Name != "" || len(ns.PIDs) == 0 {
+		return ns.Label()
+	}
+	if name := processName(ns.PIDs[0]); name != "" {
+		return name + " " + ns.Label()
+	}
+	return ns.Label()
+}
+
+// DescribeOrigin builds the node for a namespace
+func (c *NetnsCollector) DescribeOrigin(id string) *NetworkNode {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if node, ok := c.nodes[id]; ok {
+		n := *node
+		return &n
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// namedNamespaces lists the namespaces "ip netns" bind-mounted in netnsDir
+func namedNamespaces() ([]*netNamespace, error) {
+	entries, err := os.ReadDir(netnsDir)
+	if err != nil {
+		return nil, err
+	}
+	var namespaces []*netNamespace
+	for _, entry := range entries {
+		path := filepath.Join(netnsDir, entry.Name())
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || st.Ino == 0 {
+			continue
+		}
+		namespaces = append(namespaces, &netNamespace{Inode: st.Ino, Name: entry.Name(), Path: path})
+	}
+	return namespaces, nil
+}
+
+// readNetnsTCP enters the namespace bind-mounted at path on this thread
+// to read its socket tables (requires CAP_SYS_ADMIN)
+func readNetnsTCP(path string) ([]procSocket, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no process or name to enter the namespace by")
+	}
+	target, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer target.Close()
+
+	runtime.LockOSThread()
+	own, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, err
+	}
+	defer own.Close()
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("enter %s: %w", path, err)
+	}
+	// A thread that can't get back is left locked, so the runtime
+	// discards it instead of running other goroutines in the namespace
+	defer func() {
+		if unix.Setns(int(own.Fd()), unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+	return readTCPTables("/proc/thread-self/net")
+}
@@ -0,0 +1,122 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// newTestNetns creates a network namespace with a listener in it. It
+// returns a path that enters the namespace, like a bind mount in
+// netnsDir, and the listener's port.
+func newTestNetns(t *testing.T) (string, int) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("creating network namespaces needs root")
+	}
+	type result struct {
+		ns   *os.File
+		ln   net.Listener
+		err  error
+		skip bool
+	}
+	done := make(chan result)
+	go func() {
+		runtime.LockOSThread()
+		own, err := os.Open("/proc/thread-self/ns/net")
+		if err != nil {
+			runtime.UnlockOSThread()
+			done <- result{err: err}
+			return
+		}
+		defer own.Close()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			done <- result{err: err, skip: errors.Is(err, unix.EPERM)}
+			return
+		}
+		// As in readNetnsTCP, a thread that can't get back stays locked
+		// and is discarded. It may be the main thread, whose namespace
+		// /proc/<pid>/net shows.
+		defer func() {
+			if unix.Setns(int(own.Fd()), unix.CLONE_NEWNET) == nil {
+				runtime.UnlockOSThread()
+			}
+		}()
+		ns, err := os.Open("/proc/thread-self/ns/net")
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		// Sockets belong to the namespace of the thread creating them
+		ln, err := net.Listen("tcp4", "0.0.0.0:0")
+		done <- result{ns: ns, ln: ln, err: err}
+	}()
+	r := <-done
+	if r.skip {
+		t.Skipf("unshare: %v", r.err)
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	t.Cleanup(func() {
+		r.ln.Close()
+		r.ns.Close()
+	})
+	return fmt.Sprintf("/proc/self/fd/%d", r.ns.Fd()), r.ln.Addr().(*net.TCPAddr).Port
+}
+
+func hasListener(sockets []procSocket, port int) bool {
+	for _, s := range sockets {
+		if s.State == "LISTEN" && int(s.Local.Port()) == port {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReadNetnsTCP(t *testing.T) {
+	path, port := newTestNetns(t)
+	self := netnsInode("self")
+
+	sockets, err := readNetnsTCP(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasListener(sockets, port) {
+		t.Errorf("listener on %d missing from the namespace's sockets %v", port, sockets)
+	}
+	host, err := readProcTCP(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasListener(host, port) {
+		t.Errorf("listener on %d leaked into the host's sockets", port)
+	}
+	if got := netnsInode("self"); got != self {
+		t.Errorf("namespace changed to %d after reading, want %d", got, self)
+	}
+	if _, err := readNetnsTCP(os.DevNull); err == nil {
+		t.Error("entering a file that isn't a namespace succeeded")
+	}
+}
+
+func TestReadNamespaceSocketsFallsBackToPath(t *testing.T) {
+	path, port := newTestNetns(t)
+	// Every process in it has exited, as happens between listing and
+	// reading; the bind mount still gets in
+	sockets, err := readNamespaceSockets(&netNamespace{Path: path, PIDs: []int{1 << 30}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasListener(sockets, port) {
+		t.Errorf("listener on %d missing after falling back to %s", port, path)
+	}
+}
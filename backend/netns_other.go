@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// namedNamespaces finds nothing: network namespaces are Linux only
+func namedNamespaces() ([]*netNamespace, error) {
+	return nil, nil
+}
+
+// readNetnsTCP can't enter a namespace outside Linux
+func readNetnsTCP(path string) ([]procSocket, error) {
+	return nil, errors.New("network namespaces are only supported on Linux")
+}
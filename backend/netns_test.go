@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestNetnsSelected(t *testing.T) {
+	const host = 4026531840
+	named := &netNamespace{Inode: 4026532281, Name: "blue"}
+	unnamed := &netNamespace{Inode: 4026532300}
+	root := &netNamespace{Inode: host}
+
+	tests := []struct {
+		list []string
+		ns   *netNamespace
+		want bool
+	}{
+		{nil, unnamed, true},
+		{[]string{"blue"}, named, true},
+		{[]string{"blue"}, unnamed, false},
+		{[]string{"net:[4026532300]"}, unnamed, true},
+		{[]string{"4026532281"}, named, true},
+		{[]string{"host"}, root, true},
+		{[]string{"host"}, named, false},
+		{[]string{"red", "host"}, root, true},
+	}
+	for _, tt := range tests {
+		if got := tt.ns.selected(tt.list, host); got != tt.want {
+			t.Errorf("%s selected by %q = %v, want %v", tt.ns.Label(), tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestReadNamespaceSocketsSkipsExitedProcesses(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("reads /proc")
+	}
+	// PIDs past pid_max never exist, like a process that exited since
+	// the namespaces were listed
+	exited := 1 << 30
+	if _, err := readNamespaceSockets(&netNamespace{PIDs: []int{exited, os.Getpid()}}); err != nil {
+		t.Errorf("with one live process: %v", err)
+	}
+	if _, err := readNamespaceSockets(&netNamespace{PIDs: []int{exited}}); err == nil {
+		t.Error("with only exited processes and no bind mount: no error")
+	}
+	if _, err := readNamespaceSockets(&netNamespace{}); err == nil {
+		t.Error("with no process and no bind mount: no error")
+	}
+}
+
+func TestNamespaceConnections(t *testing.T) {
+	sock := func(local, remote, state string) procSocket {
+		return procSocket{Local: netip.MustParseAddrPort(local), Remote: netip.MustParseAddrPort(remote), State: state}
+	}
+	sockets := []nsSocket{
+		// blue's client to red's server, seen from both namespaces
+		{procSocket: sock("10.200.0.2:40000", "10.200.0.3:5432", "ESTAB"), origin: "netns:blue", netns: "blue"},
+		{procSocket: sock("10.200.0.3:5432", "10.200.0.2:40000", "ESTAB"), origin: "netns:red", netns: "red"},
+		{procSocket: sock("0.0.0.0:5432", "0.0.0.0:0", "LISTEN"), origin: "netns:red", netns: "red"},
+		// red out to the internet
+		{procSocket: sock("10.200.0.3:41000", "203.0.113.9:443", "ESTAB"), origin: "netns:red", netns: "red"},
+		// The host to a private address elsewhere
+		{procSocket: sock("192.168.1.10:42000", "192.168.1.20:22", "ESTAB"), netns: "net:[4026531840]"},
+		// Loopback inside a namespace
+		{procSocket: sock("127.0.0.1:43000", "127.0.0.1:8080", "ESTAB"), origin: "netns:blue", netns: "blue"},
+	}
+
+	var got []string
+	for _, c := range namespaceConnections(sockets, false) {
+		got = append(got, c.Origin+" "+c.LocalIP+" > "+c.RemoteIP+":"+strconv.Itoa(c.RemotePort)+" "+c.Target)
+	}
+	want := []string{
+		"netns:blue 10.200.0.2 > 10.200.0.3:5432 netns:red",
+		"netns:red 10.200.0.3 > 203.0.113.9:443 ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("connections:\n got %q\nwant %q", got, want)
+	}
+
+	if n := len(namespaceConnections(sockets, true)); n != 3 {
+		t.Errorf("%d connections with private addresses, want 3", n)
+	}
+	if got := nodeAddress(namespaceAddrs(sockets), "netns:red"); got != "10.200.0.3" {
+		t.Errorf("red's address = %q", got)
+	}
+}
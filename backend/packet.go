@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// Link types for captured frames (values from the pcap LINKTYPE_ registry)
+const (
+	LinkTypeNull     = 0   // BSD loopback, 4-byte address family header
+	LinkTypeEthernet = 1   // Ethernet II, optionally 802.1Q tagged
+	LinkTypeRaw      = 101 // raw IPv4/IPv6, no link header
+	LinkTypeLinuxSLL = 113 // Linux "cooked" capture
+)
+
+// IP protocol numbers
+const (
+	ProtoTCP = 6
+	ProtoUDP = 17
+)
+
+// Packet is a decoded IPv4/IPv6 TCP or UDP packet
+type Packet struct {
+	Timestamp time.Time
+	SrcIP     netip.Addr
+	DstIP     netip.Addr
+	Protocol  uint8
+	SrcPort   uint16
+	DstPort   uint16
+	TCPFlags  uint8
+	Seq       uint32 // TCP sequence number
+	Length    int    // IP datagram length in bytes
+	Payload   []byte // transport payload
+}
+
+// PacketSource yields raw frames from a live interface or a capture file
+type PacketSource interface {
+	ReadPacket() (data []byte, ts time.Time, err error)
+	LinkType() int
+	Close() error
+}
+
+// PacketTap reads a PacketSource and fans decoded packets out to handlers
+type PacketTap struct {
+	source   PacketSource
+	handlers []func(*Packet)
+}
+
+// NewPacketTap wraps a packet source
+func NewPacketTap(source PacketSource) *PacketTap {
+	return &PacketTap{source: source}
+}
+
+// Handle registers a handler; it must be called before Run
+func (t *PacketTap) Handle(handler func(*Packet)) {
+	t.handlers = append(t.handlers, handler)
+}
+
+// Run decodes packets until the source is exhausted or fails
+func (t *PacketTap) Run() error {
+	defer t.source.Close()
+	for {
+		data, ts, err := t.source.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		pkt := DecodePacket(t.source.LinkType(), data)
+		if pkt == nil {
+			continue
+		}
+		pkt.Timestamp = ts
+		for _, handler := range t.handlers {
+			handler(pkt)
+		}
+	}
+}
+
+// OpenPacketSource opens a pcap file when path is set, otherwise a live
+// capture on iface
+func OpenPacketSource(iface, path string) (PacketSource, error) {
+	if path != "" {
+		return OpenPcapFile(path)
+	}
+	if iface == "" {
+		return nil, errors.New("no capture interface or pcap file configured")
+	}
+	return OpenLiveCapture(iface)
+}
+
+// startPacketTap runs a tap in the background, logging when it stops
+func startPacketTap(tap *PacketTap) {
+	go func() {
+		if err := tap.Run(); err != nil {
+			slog.Error("Packet capture stopped", "component", "capture", "error", err)
+			return
+		}
+		slog.Info("Packet capture finished", "component", "capture")
+	}()
+}
+
+// DecodePacket strips the link header and decodes the IP and transport
+// headers. It returns nil for anything that isn't TCP or UDP over IP.
+func DecodePacket(linkType int, data []byte) *Packet {
+	switch linkType {
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return nil
+		}
+		etherType := binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		// Skip 802.1Q / 802.1ad VLAN tags
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(data) >= 4 {
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return nil
+		}
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil
+		}
+		data = data[16:]
+	case LinkTypeNull:
+		if len(data) < 4 {
+			return nil
+		}
+		data = data[4:]
+	case LinkTypeRaw:
+	default:
+		return nil
+	}
+	return decodeIP(data)
+}
+
+func decodeIP(data []byte) *Packet {
+	if len(data) < 1 {
+		return nil
+	}
+
+	pkt := &Packet{}
+	var transport []byte
+
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return nil
+		}
+		headerLen := int(data[0]&0x0f) * 4
+		totalLen := int(binary.BigEndian.Uint16(data[2:4]))
+		if headerLen < 20 || totalLen < headerLen || len(data) < headerLen {
+			return nil
+		}
+		// Only the first fragment carries the transport header
+		if binary.BigEndian.Uint16(data[6:8])&0x1fff != 0 {
+			return nil
+		}
+		pkt.Protocol = data[9]
+		pkt.SrcIP = netip.AddrFrom4([4]byte(data[12:16]))
+		pkt.DstIP = netip.AddrFrom4([4]byte(data[16:20]))
+		pkt.Length = totalLen
+		end := min(totalLen, len(data))
+		transport = data[headerLen:end]
+
+	case 6:
+		if len(data) < 40 {
+			return nil
+		}
+		payloadLen := int(binary.BigEndian.Uint16(data[4:6]))
+		next := data[6]
+		pkt.SrcIP = netip.AddrFrom16([16]byte(data[8:24]))
+		pkt.DstIP = netip.AddrFrom16([16]byte(data[24:40]))
+		pkt.Length = 40 + payloadLen
+		end := min(40+payloadLen, len(data))
+		transport = data[40:end]
+
+		// Walk the extension header chain
+		for {
+			switch next {
+			case 0, 43, 60: // hop-by-hop, routing, destination options
+				if len(transport) < 8 {
+					return nil
+				}
+				extLen := (int(transport[1]) + 1) * 8
+				if len(transport) < extLen {
+					return nil
+				}
+				next = transport[0]
+				transport = transport[extLen:]
+				continue
+			case 44: // fragment
+				if len(transport) < 8 {
+					return nil
+				}
+				if binary.BigEndian.Uint16(transport[2:4])&0xfff8 != 0 {
+					return nil
+				}
+				next = transport[0]
+				transport = transport[8:]
+				continue
+			}
+			break
+		}
+		pkt.Protocol = next
+
+	default:
+		return nil
+	}
+
+	switch pkt.Protocol {
+	case ProtoTCP:
+		if len(transport) < 20 {
+			return nil
+		}
+		offset := int(transport[12]>>4) * 4
+		if offset < 20 || len(transport) < offset {
+			return nil
+		}
+		pkt.SrcPort = binary.BigEndian.Uint16(transport[0:2])
+		pkt.DstPort = binary.BigEndian.Uint16(transport[2:4])
+		pkt.Seq = binary.BigEndian.Uint32(transport[4:8])
+		pkt.TCPFlags = transport[13]
+		pkt.Payload = transport[offset:]
+	case ProtoUDP:
+		if len(transport) < 8 {
+			return nil
+		}
+		pkt.SrcPort = binary.BigEndian.Uint16(transport[0:2])
+		pkt.DstPort = binary.BigEndian.Uint16(transport[2:4])
+		pkt.Payload = transport[8:]
+	default:
+		return nil
+	}
+
+	pkt.SrcIP = pkt.SrcIP.Unmap()
+	pkt.DstIP = pkt.DstIP.Unmap()
+	return pkt
+}
+
+// pcapFile reads the classic libpcap file format
+type pcapFile struct {
+	file     *os.File
+	reader   *bufio.Reader
+	order    binary.ByteOrder
+	nanos    bool
+	linkType int
+	header   [16]byte
+}
+
+// OpenPcapFile opens a classic (not pcapng) capture file
+func OpenPcapFile(path string) (PacketSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pcapFile{file: file, reader: bufio.NewReader(file)}
+	var header [24]byte
+	if _, err := io.ReadFull(p.reader, header[:]); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("read pcap header: %w", err)
+	}
+
+	switch binary.LittleEndian.Uint32(header[0:4]) {
+	case 0xa1b2c3d4:
+		p.order = binary.LittleEndian
+	case 0xa1b23c4d:
+		p.order, p.nanos = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		p.order = binary.BigEndian
+	case 0x4d3cb2a1:
+		p.order, p.nanos = binary.BigEndian, true
+	default:
+		file.Close()
+		return nil, fmt.Errorf("%s is not a pcap file", path)
+	}
+	p.linkType = int(p.order.Uint32(header[20:24]) & 0x0fffffff)
+	return p, nil
+}
+
+func (p *pcapFile) ReadPacket() ([]byte, time.Time, error) {
+	// A clean EOF only happens between records; anything cut short inside a
+	// record header or body is a truncated capture
+	if _, err := io.ReadFull(p.reader, p.header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = fmt.Errorf("read pcap record header: %w", err)
+		}
+		return nil, time.Time{}, err
+	}
+	sec := int64(p.order.Uint32(p.header[0:4]))
+	frac := int64(p.order.Uint32(p.header[4:8]))
+	capLen := p.order.Uint32(p.header[8:12])
+	if capLen > 1<<18 {
+		return nil, time.Time{}, fmt.Errorf("pcap record too large (%d bytes)", capLen)
+	}
+	if !p.nanos {
+		frac *= 1000
+	}
+
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(p.reader, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, time.Time{}, fmt.Errorf("read pcap record: %w", err)
+	}
+	return data, time.Unix(sec, frac), nil
+}
+
+func (p *pcapFile) LinkType() int { return p.linkType }
+
+func (p *pcapFile) Close() error { return p.file.Close() }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readPcap(t *testing.T, path string) (packets []*Packet, err error) {
+	t.Helper()
+	source, err := OpenPcapFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	for {
+		data, ts, err := source.ReadPacket()
+		if err != nil {
+			return packets, err
+		}
+		if pkt := DecodePacket(source.LinkType(), data); pkt != nil {
+			pkt.Timestamp = ts
+			packets = append(packets, pkt)
+		}
+	}
+}
+
+func TestPcapFile(t *testing.T) {
+	packets, err := readPcap(t, "testdata/capture/tls-http.pcap")
+	if err != io.EOF {
+		t.Fatalf("final error = %v, want io.EOF", err)
+	}
+	if len(packets) != 4 {
+		t.Fatalf("read %d packets, want 4", len(packets))
+	}
+
+	first := packets[0]
+	if first.SrcIP != netip.MustParseAddr("10.0.0.5") || first.DstIP != netip.MustParseAddr("93.184.216.34") {
+		t.Errorf("addresses = %s -> %s", first.SrcIP, first.DstIP)
+	}
+	if first.Protocol != ProtoTCP || first.SrcPort != 51000 || first.DstPort != 443 {
+		t.Errorf("transport = %d %d -> %d", first.Protocol, first.SrcPort, first.DstPort)
+	}
+	if first.TCPFlags != 0x02 || first.Seq != 1000 || len(first.Payload) != 0 {
+		t.Errorf("SYN = flags %#x seq %d payload %d", first.TCPFlags, first.Seq, len(first.Payload))
+	}
+	if first.Timestamp.Unix() != 1760870400 {
+		t.Errorf("timestamp = %v", first.Timestamp)
+	}
+	if got := packets[1].Timestamp.Nanosecond(); got != 1_000_000 {
+		t.Errorf("sub-second timestamp = %dns, want 1ms", got)
+	}
+}
+
+func TestPcapFileTruncated(t *testing.T) {
+	data, err := os.ReadFile("testdata/capture/tls-http.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	// Find where the last record starts
+	last := 24
+	for next := last; next < len(data); next += 16 + int(binary.LittleEndian.Uint32(data[next+8:])) {
+		last = next
+	}
+
+	// Cut inside the last record's header, then inside its body
+	for name, cut := range map[string]int{"header": last + 8, "body": len(data) - 10} {
+		path := filepath.Join(dir, name+".pcap")
+		if err := os.WriteFile(path, data[:cut], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		packets, err := readPcap(t, path)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%s: final error = %v, want io.ErrUnexpectedEOF", name, err)
+		}
+		if len(packets) != 3 {
+			t.Errorf("%s: read %d packets before the truncated record, want 3", name, len(packets))
+		}
+	}
+}
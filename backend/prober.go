@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// RTTStats summarizes one round of probes by one method. Times are in
+// milliseconds.
+type RTTStats struct {
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	Loss     float64 `json:"loss"` // percent of probes unanswered
+	Min      float64 `json:"min,omitempty"`
+	Avg      float64 `json:"avg,omitempty"`
+	P95      float64 `json:"p95,omitempty"`
+	Jitter   float64 `json:"jitter,omitempty"` // mean difference between consecutive RTTs
+}
+
+// NodeHealth is the latest connection-quality measurement of a node
+type NodeHealth struct {
+	TCP        *RTTStats `json:"tcp,omitempty"`  // connects to Port
+	Port       int       `json:"port,omitempty"` // observed remote service port
+	ICMP       *RTTStats `json:"icmp,omitempty"` // echo requests, where permitted
+	PathMTU    int       `json:"pathMtu,omitempty"`
+	MeasuredAt time.Time `json:"measuredAt"`
+}
+
+// newRTTStats computes the summary of sent probes with the given replies
+func newRTTStats(sent int, rtts []time.Duration) *RTTStats {
+	s := &RTTStats{Sent: sent, Received: len(rtts)}
+	if sent > 0 {
+		s.Loss = roundMillis(100 * float64(sent-len(rtts)) / float64(sent))
+	}
+	if len(rtts) == 0 {
+		return s
+	}
+
+	var sum, diffs time.Duration
+	for i, rtt := range rtts {
+		sum += rtt
+		if i > 0 {
+			diffs += (rtt - rtts[i-1]).Abs()
+		}
+	}
+	if len(rtts) > 1 {
+		s.Jitter = millis(diffs / time.Duration(len(rtts)-1))
+	}
+	sorted := slices.Sorted(slices.Values(rtts))
+	s.Min = millis(sorted[0])
+	s.Avg = millis(sum / time.Duration(len(rtts)))
+	// Nearest-rank percentile
+	s.P95 = millis(sorted[int(math.Ceil(0.95*float64(len(sorted))))-1])
+	return s
+}
+
+func millis(d time.Duration) float64 {
+	return roundMillis(float64(d) / float64(time.Millisecond))
+}
+
+func roundMillis(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// probePort picks the port to time TCP connects to: the remote side's port
+// when it looks like the service (this host dialed it), or 0 for inbound
+// and UDP flows, which are only pinged
+func probePort(conn Connection) int {
+	if conn.State == "UDP" || conn.RemotePort == 0 {
+		return 0
+	}
+	if conn.RemotePort < 1024 || conn.RemotePort < conn.LocalPort {
+		return conn.RemotePort
+	}
+	return 0
+}
+
+// peerSchedule runs a job against each tracked peer on its own jittered
+// schedule, with a bounded number of jobs running at once
+type peerSchedule struct {
+	interval time.Duration
+	workers  chan struct{}
+	run      func(ip string, port int)
+	forget   func(ip string) // optional, called when a peer is dropped
+
+	targets map[string]*scheduledPeer
+	mu      sync.Mutex
+}
+
+type scheduledPeer struct {
+	port    int
+	seen    time.Time // last time Track was called for it
+	next    time.Time
+	running bool
+}
+
+func newPeerSchedule(interval time.Duration, workers int, run func(ip string, port int)) *peerSchedule {
+	return &peerSchedule{
+		interval: interval,
+		workers:  make(chan struct{}, workers),
+		run:      run,
+		targets:  make(map[string]*scheduledPeer),
+	}
+}
+
+// Track adds a peer or refreshes it. A port of 0 keeps the one already
+// known, so a peer probed over TCP keeps that when it's also seen on an
+// inbound flow.
+func (s *peerSchedule) Track(ip string, port int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.targets[ip]
+	if !ok {
+		// Spread the first jobs out instead of starting every peer at once
+		t = &scheduledPeer{next: time.Now().Add(rand.N(min(s.interval, 10*time.Second)))}
+		s.targets[ip] = t
+	}
+	t.seen = time.Now()
+	if port != 0 {
+		t.port = port
+	}
+}
+
+// Run starts jobs as they come due and forgets peers that haven't been
+// tracked for as long as the map keeps nodes
+func (s *peerSchedule) Run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.mu.Lock()
+		for ip, t := range s.targets {
+			if now.Sub(t.seen) > nodeRemoveAfter && !t.running {
+				delete(s.targets, ip)
+				if s.forget != nil {
+					s.forget(ip)
+				}
+				continue
+			}
+			if t.running || now.Before(t.next) {
+				continue
+			}
+			select {
+			case s.workers <- struct{}{}:
+			default:
+				continue // every worker is busy; try again next tick
+			}
+			t.running = true
+			go func(ip string, port int) {
+				defer func() { <-s.workers }()
+				s.run(ip, port)
+
+				s.mu.Lock()
+				t.running = false
+				t.next = time.Now().Add(jitter(s.interval))
+				s.mu.Unlock()
+			}(ip, t.port)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// jitter varies d by up to 20% either way so jobs don't synchronize
+func jitter(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * (0.8 + 0.4*rand.Float64()))
+}
+
+// Prober measures latency and loss to the peers it is told about. Every
+// probe, across all peers, waits for the global rate limit.
+type Prober struct {
+	timeout  time.Duration
+	count    int // probes per method per round
+	tokens   *time.Ticker
+	icmp     atomic.Bool // cleared when the OS doesn't permit ping sockets
+	schedule *peerSchedule
+
+	// OnResult receives each finished round
+	OnResult func(ip string, health *NodeHealth)
+}
+
+// proberWorkers limits how many peers are probed at once
+const proberWorkers = 8
+
+// NewProber creates a prober sending at most rate probes per second
+func NewProber(interval, timeout time.Duration, count int, rate float64, useICMP bool) *Prober {
+	p := &Prober{
+		timeout: timeout,
+		count:   max(count, 1),
+		tokens:  time.NewTicker(time.Duration(float64(time.Second) / max(rate, 0.01))),
+	}
+	p.icmp.Store(useICMP)
+	p.schedule = newPeerSchedule(interval, proberWorkers, func(ip string, port int) {
+		health := p.Probe(ip, port)
+		if p.OnResult != nil {
+			p.OnResult(ip, health)
+		}
+	})
+	return p
+}
+
+// Track adds a peer to probe, with the service port to time connects to
+func (p *Prober) Track(ip string, port int) {
+	p.schedule.Track(ip, port)
+}
+
+// Run probes tracked peers as their rounds come due
+func (p *Prober) Run() {
+	p.schedule.Run()
+}
+
+// Probe runs one round against a peer: TCP connects when port is set and
+// ICMP echoes when permitted
+func (p *Prober) Probe(ip string, port int) *NodeHealth {
+	health := &NodeHealth{Port: port}
+	if port != 0 {
+		health.TCP, health.PathMTU = p.probeTCP(ip, port)
+	}
+	if p.icmp.Load() {
+		stats, err := p.probeICMP(ip)
+		if err != nil {
+			if p.icmp.CompareAndSwap(true, false) {
+				slog.Info("ICMP probing unavailable, using TCP connects only", "component", "prober", "error", err)
+			}
+		} else {
+			health.ICMP = stats
+		}
+	}
+	health.MeasuredAt = time.Now()
+	return health
+}
+
+// probeTCP times connection setup. A refused connection still answered,
+// so it counts as a reply.
+func (p *Prober) probeTCP(ip string, port int) (*RTTStats, int) {
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	var rtts []time.Duration
+	mtu := 0
+	for range p.count {
+		<-p.tokens.C
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", addr, p.timeout)
+		rtt := time.Since(start)
+		switch {
+		case err == nil:
+			if m := pathMTU(conn); m > 0 {
+				mtu = m
+			}
+			conn.Close()
+			rtts = append(rtts, rtt)
+		case errors.Is(err, syscall.ECONNREFUSED):
+			rtts = append(rtts, rtt)
+		}
+	}
+	return newRTTStats(p.count, rtts), mtu
+}
+
+// probeICMP sends echo requests from an unprivileged ping socket, which
+// Linux allows for groups in net.ipv4.ping_group_range
+func (p *Prober) probeICMP(ip string) (*RTTStats, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, err
+	}
+	network, proto := "udp4", 1
+	var echoType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if !addr.Unmap().Is4() {
+		network, proto = "udp6", 58
+		echoType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	conn, err := icmp.ListenPacket(network, "")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	dst := &net.UDPAddr{IP: addr.Unmap().AsSlice()}
+	buf := make([]byte, 1500)
+	var rtts []time.Duration
+	for seq := 1; seq <= p.count; seq++ {
+		<-p.tokens.C
+		msg := icmp.Message{Type: echoType, Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: seq, Data: []byte("netops")}}
+		data, err := msg.Marshal(nil)
+		if err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		if _, err := conn.WriteTo(data, dst); err != nil {
+			continue
+		}
+		conn.SetReadDeadline(start.Add(p.timeout))
+		for {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				break // timed out: lost
+			}
+			reply, err := icmp.ParseMessage(proto, buf[:n])
+			if err != nil || reply.Type != replyType {
+				continue
+			}
+			// The kernel picks the echo ID of ping sockets, so match on
+			// the sender and sequence number
+			echo, ok := reply.Body.(*icmp.Echo)
+			if !ok || echo.Seq != seq || peer.(*net.UDPAddr).IP.String() != dst.IP.String() {
+				continue
+			}
+			rtts = append(rtts, time.Since(start))
+			break
+		}
+	}
+	return newRTTStats(p.count, rtts), nil
+}
@@ -0,0 +1,31 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// pathMTU reads the kernel's path MTU for a connected TCP socket, or 0
+func pathMTU(conn net.Conn) int {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	mtu := 0
+	raw.Control(func(fd uintptr) {
+		level, opt := syscall.IPPROTO_IP, syscall.IP_MTU
+		if addr, ok := tcp.RemoteAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+			level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_MTU
+		}
+		if v, err := syscall.GetsockoptInt(int(fd), level, opt); err == nil {
+			mtu = v
+		}
+	})
+	return mtu
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// pathMTU is only read on Linux
+func pathMTU(conn net.Conn) int {
+	return 0
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestNewRTTStats(t *testing.T) {
+	ms := func(v ...float64) []time.Duration {
+		out := make([]time.Duration, len(v))
+		for i, x := range v {
+			out[i] = time.Duration(x * float64(time.Millisecond))
+		}
+		return out
+	}
+	var twenty []float64
+	for i := 20; i > 0; i-- {
+		twenty = append(twenty, float64(i))
+	}
+
+	tests := []struct {
+		name string
+		sent int
+		rtts []time.Duration
+		want RTTStats
+	}{
+		{"no probes", 0, nil, RTTStats{}},
+		{"all lost", 4, nil, RTTStats{Sent: 4, Loss: 100}},
+		{"one reply", 3, ms(7.5), RTTStats{Sent: 3, Received: 1, Loss: 66.667, Min: 7.5, Avg: 7.5, P95: 7.5}},
+		{"some lost", 5, ms(10, 30, 20, 40), RTTStats{Sent: 5, Received: 4, Loss: 20, Min: 10, Avg: 25, P95: 40, Jitter: 16.667}},
+		// The 19th of 20 sorted replies is the nearest-rank 95th percentile
+		{"percentile", 20, ms(twenty...), RTTStats{Sent: 20, Received: 20, Min: 1, Avg: 10.5, P95: 19, Jitter: 1}},
+	}
+	for _, tt := range tests {
+		if got := newRTTStats(tt.sent, tt.rtts); *got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+}
+
+func TestProbeTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	p := NewProber(time.Minute, time.Second, 3, 1000, false)
+	stats, mtu := p.probeTCP("127.0.0.1", ln.Addr().(*net.TCPAddr).Port)
+	if stats.Sent != 3 || stats.Received != 3 || stats.Loss != 0 {
+		t.Errorf("open port: %+v", *stats)
+	}
+	if stats.Min > stats.Avg || stats.Avg > stats.P95 {
+		t.Errorf("open port RTTs out of order: %+v", *stats)
+	}
+	if runtime.GOOS == "linux" && mtu <= 0 {
+		t.Errorf("path MTU = %d on loopback", mtu)
+	}
+
+	// A refused connect is still a reply from the host
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+	stats, mtu = p.probeTCP("127.0.0.1", port)
+	if stats.Sent != 3 || stats.Received != 3 || stats.Loss != 0 {
+		t.Errorf("closed port: %+v", *stats)
+	}
+	if mtu != 0 {
+		t.Errorf("closed port path MTU = %d, want 0", mtu)
+	}
+}
+
+func TestProbeSkipsTCPWithoutPort(t *testing.T) {
+	p := NewProber(time.Minute, time.Second, 1, 1000, false)
+	health := p.Probe("127.0.0.1", 0)
+	if health.TCP != nil || health.ICMP != nil || health.MeasuredAt.IsZero() {
+		t.Errorf("Probe without a port or ICMP = %+v", *health)
+	}
+}
+
+func TestProbePort(t *testing.T) {
+	tests := []struct {
+		conn Connection
+		want int
+	}{
+		{Connection{LocalPort: 51000, RemotePort: 443, State: "ESTABLISHED"}, 443},
+		{Connection{LocalPort: 51000, RemotePort: 8443, State: "ESTABLISHED"}, 8443},
+		{Connection{LocalPort: 22, RemotePort: 51000, State: "ESTABLISHED"}, 0}, // inbound
+		{Connection{LocalPort: 51000, RemotePort: 53, State: "UDP"}, 0},
+		{Connection{LocalPort: 51000, State: "SYN_SENT"}, 0},
+	}
+	for _, tt := range tests {
+		if got := probePort(tt.conn); got != tt.want {
+			t.Errorf("probePort(%+v) = %d, want %d", tt.conn, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// processIDPrefix starts the node ID of every local application
+const processIDPrefix = "process:"
+
+// processNodeID is the node a connection of this host belongs to: its
+// systemd service when it runs in one, so every worker of a server is one
+// node, or else its process name. It is "" when the owner is unknown.
+func processNodeID(conn Connection) string {
+	if conn.Unit != "" {
+		return processIDPrefix + strings.TrimSuffix(conn.Unit, ".service")
+	}
+	if conn.Process != "" {
+		return processIDPrefix + conn.Process
+	}
+	return ""
+}
+
+// ensureProcessNode adds the node for a local application, placed at this
+// host, or marks it seen
+func ensureProcessNode(hub *WSHub, store *NodeStore, id string, conn Connection) {
+	store.mu.Lock()
+	node, exists := store.Nodes[id]
+	if exists {
+		node.LastSeen = time.Now()
+		if node.Status == "online" {
+			store.mu.Unlock()
+			return
+		}
+		node.Status = "online"
+		update := copyNode(node)
+		store.mu.Unlock()
+		hub.BroadcastNodeUpdate(update)
+		return
+	}
+
+	node = &NetworkNode{
+		ID:        id,
+		Name:      strings.TrimPrefix(id, processIDPrefix),
+		Type:      "process",
+		Status:    "online",
+		Process:   conn.Process,
+		Unit:      conn.Unit,
+		FirstSeen: time.Now(),
+		LastSeen:  time.Now(),
+	}
+	if local, ok := store.Nodes["local"]; ok {
+		node.Location = local.Location
+	}
+	store.Nodes[id] = node
+	store.mu.Unlock()
+
+	slog.Info("New process added", "component", "monitor", "node_id", id, "process", conn.Process, "unit", conn.Unit)
+	hub.BroadcastNodeAdd(node)
+}
+
+// updateProcessNodes records the PIDs each application was seen with this
+// scan, and marks an application offline as soon as every process it had
+// has exited instead of waiting for it to time out. Callers hold store.mu.
+func updateProcessNodes(out *Outbox, store *NodeStore, pids map[string][]int) {
+	for id, node := range store.Nodes {
+		if node.Type != "process" {
+			continue
+		}
+		if seen, ok := pids[id]; ok {
+			seen = slices.Compact(slices.Sorted(slices.Values(seen)))
+			if !slices.Equal(seen, node.PIDs) {
+				node.PIDs = seen
+				out.BroadcastNodeUpdate(node)
+			}
+			continue
+		}
+		// Without PIDs it can't be told apart from an idle process
+		if node.Status == "offline" || len(node.PIDs) == 0 || slices.ContainsFunc(node.PIDs, processAlive) {
+			continue
+		}
+		node.Status = "offline"
+		node.Connections = 0
+		out.BroadcastNodeUpdate(node)
+		slog.Info("Process exited", "component", "monitor", "node_id", id, "pids", node.PIDs)
+	}
+}
@@ -0,0 +1,45 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// processUnit returns the systemd service a process runs in, or "" for
+// processes outside one
+func processUnit(pid int) string {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/cgroup")
+	if err != nil {
+		return ""
+	}
+	return cgroupUnit(string(data))
+}
+
+// cgroupUnit finds the service in a /proc/<pid>/cgroup file from its
+// cgroup v2 path ("0::/system.slice/postgresql.service"). The per-user
+// service manager (user@1000.service) doesn't count as the process's own
+// service.
+func cgroupUnit(data string) string {
+	for line := range strings.Lines(data) {
+		_, path, ok := strings.Cut(strings.TrimSpace(line), "::")
+		if !ok {
+			continue // cgroup v1 controller lines
+		}
+		parts := strings.Split(path, "/")
+		for i := len(parts) - 1; i >= 0; i-- {
+			if strings.HasSuffix(parts[i], ".service") && !strings.HasPrefix(parts[i], "user@") {
+				return parts[i]
+			}
+		}
+	}
+	return ""
+}
+
+// processAlive reports whether a process still exists
+func processAlive(pid int) bool {
+	_, err := os.Stat("/proc/" + strconv.Itoa(pid))
+	return err == nil
+}
@@ -0,0 +1,86 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestCgroupUnit(t *testing.T) {
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"system-service.cgroup", "postgresql.service"},
+		// A service that delegates subgroups to its workers
+		{"delegated.cgroup", "nginx.service"},
+		// Services of the per-user manager count, the manager itself doesn't
+		{"user-service.cgroup", "syncthing.service"},
+		{"user-app.cgroup", ""},
+		{"container.cgroup", ""},
+		// Hybrid hierarchies are read through their unified line
+		{"hybrid.cgroup", "sshd.service"},
+		{"v1-only.cgroup", ""},
+	}
+	for _, tt := range tests {
+		data, err := os.ReadFile(filepath.Join("testdata", "process", tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cgroupUnit(string(data)); got != tt.want {
+			t.Errorf("%s: unit %q, want %q", tt.file, got, tt.want)
+		}
+	}
+	if got := processUnit(1 << 30); got != "" {
+		t.Errorf("unit %q for a process that doesn't exist", got)
+	}
+}
+
+func TestUpdateProcessNodes(t *testing.T) {
+	// PIDs past pid_max never exist, like processes that have exited
+	exited := 1 << 30
+	store := NewNodeStore()
+	store.Nodes["process:nginx"] = &NetworkNode{ID: "process:nginx", Type: "process", Status: "online", PIDs: []int{1200}}
+	store.Nodes["process:curl"] = &NetworkNode{ID: "process:curl", Type: "process", Status: "online", PIDs: []int{exited}, Connections: 3}
+	store.Nodes["process:self"] = &NetworkNode{ID: "process:self", Type: "process", Status: "online", PIDs: []int{exited, os.Getpid()}}
+	store.Nodes["process:idle"] = &NetworkNode{ID: "process:idle", Type: "process", Status: "online"}
+	store.Nodes["process:gone"] = &NetworkNode{ID: "process:gone", Type: "process", Status: "offline", PIDs: []int{exited}}
+	store.Nodes["203.0.113.9"] = &NetworkNode{ID: "203.0.113.9", Type: "server", Status: "online"}
+
+	out := NewWSHub(16).NewOutbox()
+	updateProcessNodes(out, store, map[string][]int{"process:nginx": {1202, 1201, 1202}})
+
+	if got := store.Nodes["process:nginx"].PIDs; !reflect.DeepEqual(got, []int{1201, 1202}) {
+		t.Errorf("nginx PIDs = %v, want sorted and unique", got)
+	}
+	// Every PID exited: offline at once
+	if curl := store.Nodes["process:curl"]; curl.Status != "offline" || curl.Connections != 0 {
+		t.Errorf("exited process = %+v", curl)
+	}
+	// One of its processes still runs, or nothing says it stopped
+	for _, id := range []string{"process:self", "process:idle", "203.0.113.9"} {
+		if store.Nodes[id].Status != "online" {
+			t.Errorf("%s went offline", id)
+		}
+	}
+
+	var updated []string
+	for _, msg := range out.messages {
+		updated = append(updated, msg.Node.ID)
+	}
+	slices.Sort(updated)
+	if want := []string{"process:curl", "process:nginx"}; !reflect.DeepEqual(updated, want) {
+		t.Errorf("updates for %q, want %q", updated, want)
+	}
+
+	// The same PIDs again change nothing
+	out = NewWSHub(16).NewOutbox()
+	updateProcessNodes(out, store, map[string][]int{"process:nginx": {1201, 1202}})
+	if len(out.messages) != 0 {
+		t.Errorf("%d updates for an unchanged scan", len(out.messages))
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+// processUnit is only known from Linux cgroups
+func processUnit(pid int) string {
+	return ""
+}
+
+// processAlive can't tell without /proc, so processes are assumed to run
+// until their connections go away
+func processAlive(pid int) bool {
+	return true
+}
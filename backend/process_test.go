@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSSProcesses(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "process", "ss-tanp.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")[1:] // past the header
+
+	want := []Connection{
+		// Several processes share a socket; the first is kept
+		{LocalIP: "0.0.0.0", LocalPort: 80, RemoteIP: "0.0.0.0", State: "LISTEN", Process: "nginx", PID: 1201},
+		{LocalIP: "192.168.1.192", LocalPort: 37518, RemoteIP: "140.82.112.5", RemotePort: 443, State: "ESTAB", Process: "firefox", PID: 4242},
+		{LocalIP: "192.168.1.192", LocalPort: 22, RemoteIP: "192.168.1.20", RemotePort: 51000, State: "ESTAB", Process: "sshd", PID: 901},
+		// Sockets no process owns any more, or this user may not inspect
+		{LocalIP: "192.168.1.192", LocalPort: 41000, RemoteIP: "93.184.215.14", RemotePort: 80, State: "TIME-WAIT"},
+		{LocalIP: "::ffff:192.168.1.192", LocalPort: 8443, RemoteIP: "::ffff:203.0.113.9", RemotePort: 50123, State: "ESTAB", Process: "java", PID: 3100},
+		{LocalIP: "2001:db8::10", LocalPort: 44000, RemoteIP: "2606:4700::1111", RemotePort: 443, State: "ESTAB", Process: "curl (deleted)", PID: 77},
+		{LocalIP: "::1", LocalPort: 5432, RemoteIP: "::1", RemotePort: 40000, State: "ESTAB", Process: "postgres", PID: 1500},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("%d lines in the fixture, want %d", len(lines), len(want))
+	}
+	for i, line := range lines {
+		if got := parseNetstatLine(line); got == nil || !reflect.DeepEqual(*got, want[i]) {
+			t.Errorf("line %d: %+v, want %+v", i+1, got, want[i])
+		}
+	}
+}
+
+func TestParseSSUsers(t *testing.T) {
+	tests := []struct {
+		users string
+		name  string
+		pid   int
+	}{
+		{`users:(("firefox",pid=4242,fd=55))`, "firefox", 4242},
+		{`users:(("nginx",pid=1201,fd=6),("nginx",pid=1200,fd=6))`, "nginx", 1201},
+		{`users:(("systemd",pid=1`, "systemd", 1},
+		{`users:(("firefox",fd=55))`, "", 0},
+		{`users:()`, "", 0},
+	}
+	for _, tt := range tests {
+		if name, pid := parseSSUsers(tt.users); name != tt.name || pid != tt.pid {
+			t.Errorf("parseSSUsers(%s) = %q, %d; want %q, %d", tt.users, name, pid, tt.name, tt.pid)
+		}
+	}
+	if conn := parseNetstatLine("ESTAB 0 0"); conn != nil {
+		t.Errorf("short line parsed as %+v", conn)
+	}
+}
+
+func TestProcessNodeID(t *testing.T) {
+	tests := []struct {
+		conn Connection
+		want string
+	}{
+		// Every worker of a service is one node
+		{Connection{Process: "nginx", PID: 1201, Unit: "nginx.service"}, "process:nginx"},
+		{Connection{Process: "php-fpm8.2", Unit: "php8.2-fpm.service"}, "process:php8.2-fpm"},
+		{Connection{Process: "firefox", PID: 4242}, "process:firefox"},
+		{Connection{PID: 4242}, ""},
+		{Connection{}, ""},
+	}
+	for _, tt := range tests {
+		if got := processNodeID(tt.conn); got != tt.want {
+			t.Errorf("processNodeID(%+v) = %q, want %q", tt.conn, got, tt.want)
+		}
+	}
+}
+
+func TestEnsureProcessNode(t *testing.T) {
+	hub := NewWSHub(16)
+	store := NewNodeStore()
+	store.Nodes["local"] = &NetworkNode{ID: "local", Location: Location{Lat: 52.5, Lng: 13.4}}
+
+	conn := Connection{Process: "nginx", PID: 1201, Unit: "nginx.service"}
+	ensureProcessNode(hub, store, "process:nginx", conn)
+	node := store.Nodes["process:nginx"]
+	if node == nil || node.Name != "nginx" || node.Type != "process" || node.Unit != "nginx.service" ||
+		node.Status != "online" || node.Location != store.Nodes["local"].Location {
+		t.Fatalf("process node = %+v", node)
+	}
+
+	// An application that comes back is online again
+	node.Status = "offline"
+	ensureProcessNode(hub, store, "process:nginx", conn)
+	if node.Status != "online" || len(store.Nodes) != 2 {
+		t.Errorf("returning process: %+v, %d nodes", node, len(store.Nodes))
+	}
+}
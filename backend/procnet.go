@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// procSocket is one row of /proc/<pid>/net/tcp or tcp6
+type procSocket struct {
+	Local  netip.AddrPort
+	Remote netip.AddrPort
+	State  string // in ss's spelling: ESTAB, SYN-SENT, ...
+	Inode  uint64 // 0 for sockets no process holds, like TIME-WAIT
+}
+
+// tcpStates names the kernel's TCP states as ss does
+var tcpStates = map[string]string{
+	"01": "ESTAB",
+	"02": "SYN-SENT",
+	"03": "SYN-RECV",
+	"04": "FIN-WAIT-1",
+	"05": "FIN-WAIT-2",
+	"06": "TIME-WAIT",
+	"07": "UNCONN",
+	"08": "CLOSE-WAIT",
+	"09": "LAST-ACK",
+	"0A": "LISTEN",
+	"0B": "CLOSING",
+}
+
+// readProcTCP lists the TCP sockets of the network namespace pid is in.
+// Reading through /proc/<pid> shows that namespace's tables without
+// entering it.
+func readProcTCP(pid int) ([]procSocket, error) {
+	return readTCPTables(fmt.Sprintf("/proc/%d/net", pid))
+}
+
+// readTCPTables reads the tcp and tcp6 tables in a /proc net directory
+func readTCPTables(dir string) ([]procSocket, error) {
+	var sockets []procSocket
+	for _, name := range []string{"tcp", "tcp6"} {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			if name == "tcp6" && os.IsNotExist(err) {
+				continue // IPv6 disabled
+			}
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			if s, ok := parseProcTCPLine(scanner.Text()); ok {
+				sockets = append(sockets, s)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sockets, nil
+}
+
+// parseProcTCPLine parses a row such as
+//
+//	0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000 0 12345 1 ...
+func parseProcTCPLine(line string) (procSocket, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 10 {
+		return procSocket{}, false
+	}
+	local, ok1 := parseProcAddr(fields[1])
+	remote, ok2 := parseProcAddr(fields[2])
+	if !ok1 || !ok2 {
+		return procSocket{}, false
+	}
+	inode, _ := strconv.ParseUint(fields[9], 10, 64)
+	state, ok := tcpStates[fields[3]]
+	if !ok {
+		state = fields[3]
+	}
+	return procSocket{Local: local, Remote: remote, State: state, Inode: inode}, true
+}
+
+// parseProcAddr decodes "0100007F:1F90". The address is printed as 32-bit
+// words in host byte order.
+func parseProcAddr(s string) (netip.AddrPort, bool) {
+	addrHex, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	raw, err := hex.DecodeString(addrHex)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return netip.AddrPort{}, false
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	for i := 0; i < len(raw); i += 4 {
+		binary.NativeEndian.PutUint32(raw[i:], binary.BigEndian.Uint32(raw[i:]))
+	}
+	addr, _ := netip.AddrFromSlice(raw)
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port)), true
+}
+
+// netnsInode returns the inode identifying the network namespace of a
+// process ("self" for this one), or 0 if it can't be read
+func netnsInode(pid string) uint64 {
+	link, err := os.Readlink("/proc/" + pid + "/ns/net")
+	if err != nil {
+		return 0
+	}
+	// net:[4026531992]
+	inode, _ := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(link, "net:["), "]"), 10, 64)
+	return inode
+}
+
+// socketOwners maps socket inodes to the process holding them, among pids
+func socketOwners(pids []int) map[uint64]int {
+	owners := make(map[uint64]int)
+	for _, pid := range pids {
+		dir := fmt.Sprintf("/proc/%d/fd", pid)
+		fds, err := os.ReadDir(dir)
+		if err != nil {
+			continue // exited, or not ours to read
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(dir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(link[len("socket:["):len(link)-1], 10, 64)
+			if err == nil {
+				if _, ok := owners[inode]; !ok {
+					owners[inode] = pid
+				}
+			}
+		}
+	}
+	return owners
+}
+
+// processName returns a process's command name
+func processName(pid int) string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
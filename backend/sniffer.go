@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxClientHelloSize = 16 * 1024 // give up reassembling beyond this
+	serviceTTL         = 10 * time.Minute
+	maxServiceValues   = 8 // distinct values kept per field
+)
+
+// ServiceInfo is what passive capture learned about the service behind a
+// flow or an edge: requested names, negotiated protocols and client
+// fingerprints
+type ServiceInfo struct {
+	ServerNames []string `json:"serverNames,omitempty"` // TLS SNI
+	ALPN        []string `json:"alpn,omitempty"`
+	JA3         []string `json:"ja3,omitempty"`
+	JA4         []string `json:"ja4,omitempty"`
+	HTTPHosts   []string `json:"httpHosts,omitempty"`
+}
+
+// ClientHello holds the parts of a TLS ClientHello used for attribution
+// and fingerprinting
+type ClientHello struct {
+	Version             uint16
+	CipherSuites        []uint16
+	Extensions          []uint16
+	SupportedGroups     []uint16
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	SupportedVersions   []uint16
+	ServerName          string
+	ALPN                []string
+}
+
+type flowKey struct {
+	client, server netip.AddrPort
+}
+
+type serviceEntry struct {
+	info     ServiceInfo
+	lastSeen time.Time
+}
+
+// helloBuffer collects a ClientHello split over several TCP segments
+type helloBuffer struct {
+	data    []byte
+	nextSeq uint32
+	needed  int
+	started time.Time
+}
+
+// ServiceSniffer extracts TLS ClientHello and HTTP request metadata from a
+// PacketTap and attaches it to flows and remote addresses
+type ServiceSniffer struct {
+	flows     map[flowKey]*serviceEntry
+	remotes   map[string]*serviceEntry // server IP -> aggregate over flows
+	pending   map[flowKey]*helloBuffer
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+// NewServiceSniffer creates an empty sniffer
+func NewServiceSniffer() *ServiceSniffer {
+	return &ServiceSniffer{
+		flows:   make(map[flowKey]*serviceEntry),
+		remotes: make(map[string]*serviceEntry),
+		pending: make(map[flowKey]*helloBuffer),
+	}
+}
+
+// HandlePacket inspects client-to-server TCP payloads
+func (s *ServiceSniffer) HandlePacket(pkt *Packet) {
+	if pkt.Protocol != ProtoTCP || len(pkt.Payload) == 0 {
+		return
+	}
+	key := flowKey{
+		client: netip.AddrPortFrom(pkt.SrcIP, pkt.SrcPort),
+		server: netip.AddrPortFrom(pkt.DstIP, pkt.DstPort),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(pkt.Timestamp)
+
+	// Continuation of a ClientHello that spans segments
+	if buf, ok := s.pending[key]; ok {
+		if pkt.Seq != buf.nextSeq {
+			return // out of order or retransmit, wait for the expected segment
+		}
+		buf.data = append(buf.data, pkt.Payload...)
+		buf.nextSeq += uint32(len(pkt.Payload))
+		if len(buf.data) < buf.needed {
+			return
+		}
+		delete(s.pending, key)
+		s.recordHello(key, buf.data, pkt.Timestamp)
+		return
+	}
+
+	payload := pkt.Payload
+	switch {
+	case isTLSHandshake(payload):
+		needed := 5 + int(binary.BigEndian.Uint16(payload[3:5]))
+		if len(payload) < needed && needed <= maxClientHelloSize {
+			s.pending[key] = &helloBuffer{
+				data:    append([]byte(nil), payload...),
+				nextSeq: pkt.Seq + uint32(len(payload)),
+				needed:  needed,
+				started: pkt.Timestamp,
+			}
+			return
+		}
+		s.recordHello(key, payload, pkt.Timestamp)
+	case isHTTPRequest(payload):
+		if host := httpHost(payload); host != "" {
+			s.record(key, pkt.Timestamp, func(info *ServiceInfo) {
+				info.HTTPHosts = addUnique(info.HTTPHosts, host)
+			})
+		}
+	}
+}
+
+func (s *ServiceSniffer) recordHello(key flowKey, record []byte, ts time.Time) {
+	hello, err := ParseClientHello(record)
+	if err != nil {
+		return
+	}
+	ja3, ja4 := hello.JA3(), hello.JA4()
+	s.record(key, ts, func(info *ServiceInfo) {
+		if hello.ServerName != "" {
+			info.ServerNames = addUnique(info.ServerNames, hello.ServerName)
+		}
+		// Walk backwards so the client's preference order is kept
+		for i := len(hello.ALPN) - 1; i >= 0; i-- {
+			info.ALPN = addUnique(info.ALPN, hello.ALPN[i])
+		}
+		info.JA3 = addUnique(info.JA3, ja3)
+		info.JA4 = addUnique(info.JA4, ja4)
+	})
+}
+
+// record applies update to both the flow and the remote address entries
+func (s *ServiceSniffer) record(key flowKey, ts time.Time, update func(*ServiceInfo)) {
+	flow, ok := s.flows[key]
+	if !ok {
+		flow = &serviceEntry{}
+		s.flows[key] = flow
+	}
+	ip := key.server.Addr().String()
+	remote, ok := s.remotes[ip]
+	if !ok {
+		remote = &serviceEntry{}
+		s.remotes[ip] = remote
+	}
+	for _, entry := range []*serviceEntry{flow, remote} {
+		update(&entry.info)
+		entry.lastSeen = ts
+	}
+}
+
+// sweep drops stale entries at most once a minute
+func (s *ServiceSniffer) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, entry := range s.flows {
+		if now.Sub(entry.lastSeen) > serviceTTL {
+			delete(s.flows, key)
+		}
+	}
+	for ip, entry := range s.remotes {
+		if now.Sub(entry.lastSeen) > serviceTTL {
+			delete(s.remotes, ip)
+		}
+	}
+	for key, buf := range s.pending {
+		if now.Sub(buf.started) > 10*time.Second {
+			delete(s.pending, key)
+		}
+	}
+}
+
+// Annotate copies what is known about a captured socket onto it
+func (s *ServiceSniffer) Annotate(conn *Connection) {
+	local, err1 := netip.ParseAddr(conn.LocalIP)
+	remote, err2 := netip.ParseAddr(conn.RemoteIP)
+	if err1 != nil || err2 != nil {
+		return
+	}
+	key := flowKey{
+		client: netip.AddrPortFrom(local.Unmap(), uint16(conn.LocalPort)),
+		server: netip.AddrPortFrom(remote.Unmap(), uint16(conn.RemotePort)),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.flows[key]; ok {
+		info := entry.info.clone()
+		conn.Service = &info
+	}
+}
+
+// Remote returns everything learned about connections to ip
+func (s *ServiceSniffer) Remote(ip string) *ServiceInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.remotes[ip]
+	if !ok {
+		return nil
+	}
+	info := entry.info.clone()
+	return &info
+}
+
+func (i ServiceInfo) clone() ServiceInfo {
+	return ServiceInfo{
+		ServerNames: slices.Clone(i.ServerNames),
+		ALPN:        slices.Clone(i.ALPN),
+		JA3:         slices.Clone(i.JA3),
+		JA4:         slices.Clone(i.JA4),
+		HTTPHosts:   slices.Clone(i.HTTPHosts),
+	}
+}
+
+// addUnique puts value at the front of list, keeping at most maxServiceValues
+func addUnique(list []string, value string) []string {
+	if i := slices.Index(list, value); i >= 0 {
+		list = slices.Delete(list, i, i+1)
+	}
+	list = append([]string{value}, list...)
+	if len(list) > maxServiceValues {
+		list = list[:maxServiceValues]
+	}
+	return list
+}
+
+// isTLSHandshake reports whether payload starts a TLS handshake record
+// carrying a ClientHello
+func isTLSHandshake(payload []byte) bool {
+	return len(payload) >= 6 && payload[0] == 0x16 && payload[1] == 0x03 && payload[5] == 0x01
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "),
+	[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "),
+}
+
+func isHTTPRequest(payload []byte) bool {
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(payload, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpHost returns the Host header of a plaintext HTTP request, without port
+func httpHost(payload []byte) string {
+	headers := payload
+	if end := bytes.Index(payload, []byte("\r\n\r\n")); end >= 0 {
+		headers = payload[:end]
+	}
+	for _, line := range bytes.Split(headers, []byte("\r\n"))[1:] {
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok || !strings.EqualFold(string(bytes.TrimSpace(name)), "host") {
+			continue
+		}
+		host := strings.ToLower(string(bytes.TrimSpace(value)))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return host
+	}
+	return ""
+}
+
+// ParseClientHello parses a TLS record containing a ClientHello handshake
+func ParseClientHello(record []byte) (*ClientHello, error) {
+	if !isTLSHandshake(record) {
+		return nil, errors.New("not a TLS ClientHello record")
+	}
+	r := tlsReader(record[5:])
+	if t, _ := r.u8(); t != 1 {
+		return nil, errors.New("not a ClientHello")
+	}
+	bodyLen, ok := r.u24()
+	if !ok {
+		return nil, errors.New("truncated handshake header")
+	}
+	body, ok := r.bytes(bodyLen)
+	if !ok {
+		return nil, errors.New("truncated ClientHello")
+	}
+
+	b := tlsReader(body)
+	hello := &ClientHello{}
+	if hello.Version, ok = b.u16(); !ok {
+		return nil, errors.New("truncated ClientHello")
+	}
+	if _, ok = b.bytes(32); !ok { // random
+		return nil, errors.New("truncated ClientHello")
+	}
+	if _, ok = b.vector8(); !ok { // session id
+		return nil, errors.New("truncated session id")
+	}
+	suites, ok := b.vector16()
+	if !ok {
+		return nil, errors.New("truncated cipher suites")
+	}
+	hello.CipherSuites = suites.u16list()
+	if _, ok = b.vector8(); !ok { // compression methods
+		return nil, errors.New("truncated compression methods")
+	}
+	if len(b) == 0 {
+		return hello, nil // no extensions
+	}
+
+	exts, ok := b.vector16()
+	if !ok {
+		return nil, errors.New("truncated extensions")
+	}
+	for len(exts) > 0 {
+		extType, ok1 := exts.u16()
+		data, ok2 := exts.vector16()
+		if !ok1 || !ok2 {
+			return nil, errors.New("malformed extension")
+		}
+		hello.Extensions = append(hello.Extensions, extType)
+
+		switch extType {
+		case 0: // server_name
+			list, _ := data.vector16()
+			for len(list) > 0 {
+				nameType, _ := list.u8()
+				name, ok := list.vector16()
+				if !ok {
+					break
+				}
+				if nameType == 0 && hello.ServerName == "" {
+					hello.ServerName = strings.ToLower(string(name))
+				}
+			}
+		case 10: // supported_groups
+			groups, _ := data.vector16()
+			hello.SupportedGroups = groups.u16list()
+		case 11: // ec_point_formats
+			formats, _ := data.vector8()
+			hello.PointFormats = append([]uint8(nil), formats...)
+		case 13: // signature_algorithms
+			algs, _ := data.vector16()
+			hello.SignatureAlgorithms = algs.u16list()
+		case 16: // application_layer_protocol_negotiation
+			list, _ := data.vector16()
+			for len(list) > 0 {
+				proto, ok := list.vector8()
+				if !ok {
+					break
+				}
+				hello.ALPN = append(hello.ALPN, string(proto))
+			}
+		case 43: // supported_versions
+			versions, _ := data.vector8()
+			hello.SupportedVersions = versions.u16list()
+		}
+	}
+	return hello, nil
+}
+
+// isGREASE reports whether v is a GREASE placeholder (RFC 8701)
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	out := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+// JA3 returns the MD5 JA3 fingerprint of the ClientHello
+func (h *ClientHello) JA3() string {
+	formats := make([]uint16, len(h.PointFormats))
+	for i, f := range h.PointFormats {
+		formats[i] = uint16(f)
+	}
+	raw := fmt.Sprintf("%d,%s,%s,%s,%s",
+		h.Version,
+		joinDecimal(withoutGREASE(h.CipherSuites)),
+		joinDecimal(withoutGREASE(h.Extensions)),
+		joinDecimal(withoutGREASE(h.SupportedGroups)),
+		joinDecimal(formats))
+	sum := md5.Sum([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the JA4 fingerprint (TCP variant) of the ClientHello
+func (h *ClientHello) JA4() string {
+	// supported_versions, when present, overrides the legacy version field
+	version := h.Version
+	if versions := withoutGREASE(h.SupportedVersions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+	versionCode := map[uint16]string{
+		0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10", 0x0300: "s3",
+	}[version]
+	if versionCode == "" {
+		versionCode = "00"
+	}
+
+	sni := "i"
+	if h.ServerName != "" {
+		sni = "d"
+	}
+
+	ciphers := withoutGREASE(h.CipherSuites)
+	extensions := withoutGREASE(h.Extensions)
+
+	alpn := "00"
+	if len(h.ALPN) > 0 && h.ALPN[0] != "" {
+		first := h.ALPN[0]
+		alpn = string(first[0]) + string(first[len(first)-1])
+	}
+
+	partA := fmt.Sprintf("t%s%s%02d%02d%s", versionCode, sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	// Part B: sorted cipher suites
+	partB := "000000000000"
+	if len(ciphers) > 0 {
+		partB = truncatedSHA256(sortedHex(ciphers))
+	}
+
+	// Part C: sorted extensions without SNI and ALPN, then signature
+	// algorithms in their original order
+	var filtered []uint16
+	for _, ext := range extensions {
+		if ext != 0 && ext != 16 {
+			filtered = append(filtered, ext)
+		}
+	}
+	partC := "000000000000"
+	if len(filtered) > 0 {
+		input := sortedHex(filtered)
+		if sigs := withoutGREASE(h.SignatureAlgorithms); len(sigs) > 0 {
+			input += "_" + hexList(sigs)
+		}
+		partC = truncatedSHA256(input)
+	}
+
+	return partA + "_" + partB + "_" + partC
+}
+
+func hexList(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func sortedHex(values []uint16) string {
+	sorted := slices.Clone(values)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return hexList(sorted)
+}
+
+func truncatedSHA256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// tlsReader is a cursor over TLS wire-format data
+type tlsReader []byte
+
+func (r *tlsReader) u8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *tlsReader) u16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *tlsReader) u24() (int, bool) {
+	if len(*r) < 3 {
+		return 0, false
+	}
+	v := int((*r)[0])<<16 | int((*r)[1])<<8 | int((*r)[2])
+	*r = (*r)[3:]
+	return v, true
+}
+
+func (r *tlsReader) bytes(n int) (tlsReader, bool) {
+	if len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+func (r *tlsReader) vector8() (tlsReader, bool) {
+	n, ok := r.u8()
+	if !ok {
+		return nil, false
+	}
+	return r.bytes(int(n))
+}
+
+func (r *tlsReader) vector16() (tlsReader, bool) {
+	n, ok := r.u16()
+	if !ok {
+		return nil, false
+	}
+	return r.bytes(int(n))
+}
+
+func (r tlsReader) u16list() []uint16 {
+	out := make([]uint16, 0, len(r)/2)
+	for len(r) >= 2 {
+		out = append(out, binary.BigEndian.Uint16(r))
+		r = r[2:]
+	}
+	return out
+}
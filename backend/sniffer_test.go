@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// The fixture ClientHello carries GREASE values in the cipher suites,
+// extensions, groups and supported versions, SNI "Example.com" and ALPN
+// h2 + http/1.1
+const (
+	fixtureJA3 = "6891d14d023abcd4c1ed456f90cc9130"
+	fixtureJA4 = "t13d0507h2_e133e205ac38_1fdf4de06b7e"
+)
+
+func TestParseClientHello(t *testing.T) {
+	record, err := os.ReadFile("testdata/capture/clienthello.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello, err := ParseClientHello(record)
+	if err != nil {
+		t.Fatalf("ParseClientHello: %v", err)
+	}
+
+	if hello.Version != 0x0303 {
+		t.Errorf("version = %#04x, want 0x0303", hello.Version)
+	}
+	if hello.ServerName != "example.com" {
+		t.Errorf("server name = %q, want example.com", hello.ServerName)
+	}
+	if want := []string{"h2", "http/1.1"}; !reflect.DeepEqual(hello.ALPN, want) {
+		t.Errorf("ALPN = %v, want %v", hello.ALPN, want)
+	}
+	if want := []uint16{0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f}; !reflect.DeepEqual(hello.CipherSuites, want) {
+		t.Errorf("cipher suites = %#04x, want %#04x", hello.CipherSuites, want)
+	}
+	if want := []uint16{0x1a1a, 0, 23, 10, 11, 13, 16, 43}; !reflect.DeepEqual(hello.Extensions, want) {
+		t.Errorf("extensions = %v, want %v", hello.Extensions, want)
+	}
+	if want := []uint16{0x3a3a, 0x0304, 0x0303}; !reflect.DeepEqual(hello.SupportedVersions, want) {
+		t.Errorf("supported versions = %#04x, want %#04x", hello.SupportedVersions, want)
+	}
+
+	if got := hello.JA3(); got != fixtureJA3 {
+		t.Errorf("JA3 = %s, want %s", got, fixtureJA3)
+	}
+	if got := hello.JA4(); got != fixtureJA4 {
+		t.Errorf("JA4 = %s, want %s", got, fixtureJA4)
+	}
+}
+
+func TestParseClientHelloRejects(t *testing.T) {
+	record, err := os.ReadFile("testdata/capture/clienthello.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string][]byte{
+		"empty":          nil,
+		"not handshake":  append([]byte{0x17}, record[1:]...),
+		"server hello":   append(append([]byte(nil), record[:5]...), append([]byte{0x02}, record[6:]...)...),
+		"truncated body": record[:len(record)-20],
+		"header only":    record[:9],
+	}
+	for name, data := range tests {
+		if _, err := ParseClientHello(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestJA4WithoutSNIOrALPN(t *testing.T) {
+	hello := &ClientHello{
+		Version:      0x0303,
+		CipherSuites: []uint16{0x002f},
+	}
+	if got, want := hello.JA4(), "t12i010000_"+truncatedSHA256("002f")+"_000000000000"; got != want {
+		t.Errorf("JA4 = %s, want %s", got, want)
+	}
+}
+
+func TestHTTPHost(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{"GET / HTTP/1.1\r\nHost: example.org\r\n\r\n", "example.org"},
+		{"POST /api HTTP/1.1\r\nContent-Type: text/plain\r\nhost:  API.Example.org:8443 \r\n\r\nHost: body.example", "api.example.org"},
+		{"GET / HTTP/1.1\r\nHost: [2001:db8::1]:8080\r\n\r\n", "2001:db8::1"},
+		{"GET / HTTP/1.0\r\nAccept: */*\r\n\r\n", ""},
+		{"GET / HTTP/1.1", ""},
+	}
+	for _, tt := range tests {
+		if got := httpHost([]byte(tt.payload)); got != tt.want {
+			t.Errorf("httpHost(%q) = %q, want %q", tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestServiceSnifferPcap(t *testing.T) {
+	source, err := OpenPcapFile("testdata/capture/tls-http.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sniffer := NewServiceSniffer()
+	tap := NewPacketTap(source)
+	tap.Handle(sniffer.HandlePacket)
+	if err := tap.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	// The ClientHello is split over two segments with an unrelated HTTP
+	// request in between
+	tls := sniffer.Remote("93.184.216.34")
+	want := &ServiceInfo{
+		ServerNames: []string{"example.com"},
+		ALPN:        []string{"h2", "http/1.1"},
+		JA3:         []string{fixtureJA3},
+		JA4:         []string{fixtureJA4},
+	}
+	if !reflect.DeepEqual(tls, want) {
+		t.Errorf("TLS remote = %+v, want %+v", tls, want)
+	}
+
+	web := sniffer.Remote("192.0.2.80")
+	if web == nil || !reflect.DeepEqual(web.HTTPHosts, []string{"example.org"}) {
+		t.Errorf("HTTP remote = %+v, want host example.org", web)
+	}
+
+	conn := &Connection{LocalIP: "10.0.0.5", LocalPort: 51000, RemoteIP: "93.184.216.34", RemotePort: 443}
+	sniffer.Annotate(conn)
+	if conn.Service == nil || !reflect.DeepEqual(conn.Service.ServerNames, []string{"example.com"}) {
+		t.Errorf("Annotate = %+v, want SNI example.com", conn.Service)
+	}
+}
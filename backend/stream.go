@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// wsChecksumInterval is how often clients are sent a checksum of the state
+// they should have
+const wsChecksumInterval = 30 * time.Second
+
+// firstSeq numbers the first event of this run after every event of
+// earlier runs, so a client resuming against a restarted server is told to
+// take a snapshot instead of being replayed the wrong events. Microseconds
+// keep it within the integers JavaScript represents exactly.
+func firstSeq() uint64 {
+	return uint64(time.Now().UnixMicro())
+}
+
+// eventRing keeps the most recent numbered hub events so a reconnecting
+// client can be sent what it missed
+type eventRing struct {
+	events []WSMessage
+	next   int  // index the next event is written to
+	full   bool // the ring has wrapped
+}
+
+func newEventRing(size int) *eventRing {
+	return &eventRing{events: make([]WSMessage, max(size, 1))}
+}
+
+func (r *eventRing) add(msg WSMessage) {
+	r.events[r.next] = msg
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// since returns the events after seq, oldest first, or false when some of
+// them have already been overwritten
+func (r *eventRing) since(seq uint64) ([]WSMessage, bool) {
+	var ordered []WSMessage
+	if r.full {
+		ordered = append(ordered, r.events[r.next:]...)
+	}
+	ordered = append(ordered, r.events[:r.next]...)
+
+	if len(ordered) == 0 {
+		return nil, false
+	}
+	// A client ahead of us saw a previous run of the server
+	if ordered[0].Seq > seq+1 || seq > ordered[len(ordered)-1].Seq {
+		return nil, false
+	}
+	i := sort.Search(len(ordered), func(i int) bool { return ordered[i].Seq > seq })
+	return ordered[i:], true
+}
+
+// diffEdges compares the edges a client has with the edges it should have.
+// Changed edges (new traffic or service details) count as added.
+func diffEdges(have map[edgeKey]WSConnection, want []WSConnection) (added, removed []WSConnection, next map[edgeKey]WSConnection) {
+	next = make(map[edgeKey]WSConnection, len(want))
+	for _, edge := range want {
+		key := edgeKey{from: edge.From, to: edge.To}
+		next[key] = edge
+		if old, ok := have[key]; !ok || edgeChanged(old, edge) {
+			added = append(added, edge)
+		}
+	}
+	for key := range have {
+		if _, ok := next[key]; !ok {
+			removed = append(removed, WSConnection{From: key.from, To: key.to})
+		}
+	}
+	return added, removed, next
+}
+
+func edgeChanged(a, b WSConnection) bool {
+	if a.Latency != b.Latency || a.Violation != b.Violation {
+		return true
+	}
+	if (a.Traffic == nil) != (b.Traffic == nil) || (a.Traffic != nil && *a.Traffic != *b.Traffic) {
+		return true
+	}
+	return !reflect.DeepEqual(a.Service, b.Service)
+}
+
+// stateChecksum is the FNV-1a 32-bit hash of the sorted lines "n:<id>" for
+// every node and "e:<from>><to>" for every edge, each followed by a
+// newline. The frontend computes the same over its own state.
+func stateChecksum(nodes map[string]bool, edges map[edgeKey]WSConnection) string {
+	lines := make([]string, 0, len(nodes)+len(edges))
+	for id := range nodes {
+		lines = append(lines, "n:"+id)
+	}
+	for key := range edges {
+		lines = append(lines, "e:"+key.from+">"+key.to)
+	}
+	sort.Strings(lines)
+
+	h := fnv.New32a()
+	for _, line := range lines {
+		h.Write([]byte(line))
+		h.Write([]byte{'\n'})
+	}
+	return fmt.Sprintf("%08x", h.Sum32())
+}
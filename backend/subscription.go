@@ -0,0 +1,116 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// ClientRequest is a message a /ws client sends to the server:
+//
+//	{"type": "subscribe", "filter": {"types": ["server"], "minConnections": 2}}
+//	{"type": "unsubscribe"}
+//	{"type": "resync"}
+//	{"type": "node_detail", "id": "140.82.112.5"}
+//	{"type": "group", "by": "asn"}
+//	{"type": "expand", "id": "group:asn:13335"}
+//	{"type": "collapse", "id": "group:asn:13335"}
+//
+// Grouping by asn, prefix, owner, country or city replaces the nodes
+// sharing that attribute with one group node; "none" turns it off.
+// Expanding a group shows its members again, and node_detail on a group
+// lists them. RequestID is optional and is echoed in the reply.
+type ClientRequest struct {
+	Type      string      `json:"type"`
+	RequestID string      `json:"requestId,omitempty"`
+	Filter    *NodeFilter `json:"filter,omitempty"`
+	ID        string      `json:"id,omitempty"`
+	By        string      `json:"by,omitempty"` // grouping mode
+}
+
+// NodeFilter selects the nodes a client receives. Empty fields match
+// everything; a node must match every field that is set. The local node
+// always matches so edges from this host stay visible, and an edge is
+// only sent when both of its ends match.
+//
+// Processes keeps the traffic of the named local applications: their
+// process nodes, the peers they talk to, and traceroute hops.
+type NodeFilter struct {
+	Types          []string     `json:"types,omitempty"`     // node types
+	Status         []string     `json:"status,omitempty"`    // online, offline, ...
+	Countries      []string     `json:"countries,omitempty"` // ISO country codes
+	ASNs           []string     `json:"asns,omitempty"`      // "AS15169" or "15169"
+	BBox           *BoundingBox `json:"bbox,omitempty"`
+	MinConnections int          `json:"minConnections,omitempty"`
+	Processes      []string     `json:"processes,omitempty"` // local applications, see below
+	Zones          []string     `json:"zones,omitempty"`     // security zones
+}
+
+// BoundingBox is a map area in degrees. West may be greater than east for a
+// box crossing the antimeridian.
+type BoundingBox struct {
+	South float64 `json:"south"`
+	West  float64 `json:"west"`
+	North float64 `json:"north"`
+	East  float64 `json:"east"`
+}
+
+// Contains reports whether loc lies inside the box
+func (b *BoundingBox) Contains(loc Location) bool {
+	if loc.Lat < b.South || loc.Lat > b.North {
+		return false
+	}
+	if b.West <= b.East {
+		return loc.Lng >= b.West && loc.Lng <= b.East
+	}
+	return loc.Lng >= b.West || loc.Lng <= b.East
+}
+
+// Matches reports whether a node passes the filter. A nil filter matches
+// every node.
+func (f *NodeFilter) Matches(node *NetworkNode) bool {
+	if f == nil || node.ID == "local" {
+		return true
+	}
+	if len(f.Types) > 0 && !slices.Contains(f.Types, node.Type) {
+		return false
+	}
+	if len(f.Status) > 0 && !slices.Contains(f.Status, node.Status) {
+		return false
+	}
+	if len(f.Countries) > 0 && !slices.ContainsFunc(f.Countries, func(c string) bool {
+		return strings.EqualFold(c, node.Country)
+	}) {
+		return false
+	}
+	if len(f.Zones) > 0 && !slices.ContainsFunc(f.Zones, func(z string) bool {
+		return strings.EqualFold(z, node.SecurityZone)
+	}) {
+		return false
+	}
+	if len(f.Processes) > 0 && !node.Hop && !slices.ContainsFunc(f.Processes, func(app string) bool {
+		if node.Type == "process" {
+			return node.Name == app
+		}
+		return slices.Contains(node.Processes, app)
+	}) {
+		return false
+	}
+	if len(f.ASNs) > 0 && !slices.ContainsFunc(f.ASNs, func(asn string) bool {
+		return normalizeASN(asn) == normalizeASN(node.ASN)
+	}) {
+		return false
+	}
+	if f.BBox != nil && !f.BBox.Contains(node.Location) {
+		return false
+	}
+	return node.Connections >= f.MinConnections
+}
+
+// normalizeASN turns "AS15169", "as15169" and "15169" into "15169"
+func normalizeASN(asn string) string {
+	asn = strings.TrimSpace(asn)
+	if len(asn) > 2 && strings.EqualFold(asn[:2], "AS") {
+		return asn[2:]
+	}
+	return asn
+}
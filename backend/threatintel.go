@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Feed formats understood by the threat intel loader
+const (
+	FeedFormatPlain = "plain"   // one IP or CIDR per line
+	FeedFormatDROP  = "drop"    // Spamhaus DROP/EDROP: "CIDR ; SBL123"
+	FeedFormatAbuse = "abusech" // abuse.ch feodo/sslbl CSV exports
+	FeedFormatSTIX  = "stix"    // STIX 2.1 bundle with indicator objects
+)
+
+// Default scores by format, used when a feed entry carries no confidence of its own
+var defaultFeedScores = map[string]int{
+	FeedFormatPlain: 70,
+	FeedFormatDROP:  90,
+	FeedFormatAbuse: 100,
+	FeedFormatSTIX:  75,
+}
+
+// ThreatFeed is a single threat intel list loaded from disk
+type ThreatFeed struct {
+	Name     string
+	Path     string
+	Format   string
+	ModTime  time.Time
+	hosts    map[netip.Addr]int // exact addresses -> score
+	prefixes []threatPrefix     // CIDR entries
+}
+
+type threatPrefix struct {
+	prefix netip.Prefix
+	score  int
+}
+
+// ThreatMatch is the result of checking an IP against all feeds
+type ThreatMatch struct {
+	Score int
+	Feeds []string
+}
+
+// ThreatIntel holds the loaded feeds and matches IPs against them
+type ThreatIntel struct {
+	dir   string
+	feeds map[string]*ThreatFeed // path -> feed
+	mu    sync.RWMutex
+}
+
+// NewThreatIntel creates a matcher for the feed files in dir
+func NewThreatIntel(dir string) *ThreatIntel {
+	return &ThreatIntel{
+		dir:   dir,
+		feeds: make(map[string]*ThreatFeed),
+	}
+}
+
+// Reload loads new or modified feed files and drops deleted ones.
+// It reports whether anything changed.
+func (t *ThreatIntel) Reload() (bool, error) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return false, fmt.Errorf("read threat intel dir: %w", err)
+	}
+
+	changed := false
+	present := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(t.dir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		present[path] = true
+
+		t.mu.RLock()
+		existing, ok := t.feeds[path]
+		t.mu.RUnlock()
+		if ok && existing.ModTime.Equal(info.ModTime()) {
+			continue
+		}
+
+		feed, err := LoadThreatFeed(path)
+		if err != nil {
+			slog.Warn("Skipping threat feed", "component", "threatintel", "path", path, "error", err)
+			continue
+		}
+		feed.ModTime = info.ModTime()
+
+		t.mu.Lock()
+		t.feeds[path] = feed
+		t.mu.Unlock()
+		changed = true
+	}
+
+	t.mu.Lock()
+	for path := range t.feeds {
+		if !present[path] {
+			delete(t.feeds, path)
+			changed = true
+		}
+	}
+	t.mu.Unlock()
+
+	return changed, nil
+}
+
+// Match checks ip against every loaded feed
+func (t *ThreatIntel) Match(ip string) *ThreatMatch {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var match *ThreatMatch
+	for _, feed := range t.feeds {
+		score, ok := feed.lookup(addr)
+		if !ok {
+			continue
+		}
+		if match == nil {
+			match = &ThreatMatch{}
+		}
+		match.Feeds = append(match.Feeds, feed.Name)
+		if score > match.Score {
+			match.Score = score
+		}
+	}
+	if match == nil {
+		return nil
+	}
+
+	// Every additional feed that agrees raises confidence a little
+	match.Score += 5 * (len(match.Feeds) - 1)
+	if match.Score > 100 {
+		match.Score = 100
+	}
+	sort.Strings(match.Feeds)
+	return match
+}
+
+// Stats returns the number of feeds and total entries loaded
+func (t *ThreatIntel) Stats() (feeds, entries int) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, feed := range t.feeds {
+		entries += len(feed.hosts) + len(feed.prefixes)
+	}
+	return len(t.feeds), entries
+}
+
+func (f *ThreatFeed) lookup(addr netip.Addr) (int, bool) {
+	if score, ok := f.hosts[addr]; ok {
+		return score, true
+	}
+	for _, p := range f.prefixes {
+		if p.prefix.Contains(addr) {
+			return p.score, true
+		}
+	}
+	return 0, false
+}
+
+func (f *ThreatFeed) add(entry string, score int) {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return
+	}
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return
+		}
+		prefix = prefix.Masked()
+		if prefix.IsSingleIP() {
+			f.hosts[prefix.Addr().Unmap()] = score
+			return
+		}
+		f.prefixes = append(f.prefixes, threatPrefix{prefix: prefix, score: score})
+		return
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return
+	}
+	f.hosts[addr.Unmap()] = score
+}
+
+// LoadThreatFeed parses a feed file, detecting its format from name and content
+func LoadThreatFeed(path string) (*ThreatFeed, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	head, _ := reader.Peek(512)
+
+	feed := &ThreatFeed{
+		Name:   strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+		Path:   path,
+		Format: detectFeedFormat(path, head),
+		hosts:  make(map[netip.Addr]int),
+	}
+
+	switch feed.Format {
+	case FeedFormatSTIX:
+		err = parseSTIXFeed(feed, reader)
+	case FeedFormatAbuse:
+		err = parseAbuseCHFeed(feed, reader)
+	default:
+		err = parseListFeed(feed, reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return feed, nil
+}
+
+// detectFeedFormat picks a parser from the file extension and first bytes
+func detectFeedFormat(path string, head []byte) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	text := strings.TrimSpace(string(head))
+
+	switch {
+	case ext == ".json" || strings.HasPrefix(text, "{"):
+		return FeedFormatSTIX
+	case ext == ".csv":
+		return FeedFormatAbuse
+	case strings.HasPrefix(text, ";") || strings.Contains(text, " ; SBL"):
+		return FeedFormatDROP
+	}
+	return FeedFormatPlain
+}
+
+// parseListFeed handles plain IP/CIDR lists and Spamhaus DROP files.
+// Anything after ";" or "#" on a line is a comment.
+func parseListFeed(feed *ThreatFeed, r io.Reader) error {
+	score := defaultFeedScores[feed.Format]
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, ";#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		feed.add(fields[0], score)
+	}
+	return scanner.Err()
+}
+
+// parseAbuseCHFeed handles the abuse.ch CSV exports. Feodo Tracker names the
+// address column "dst_ip", SSLBL uses "DstIP"; both comment out the header
+// line with "#", so the header is recovered from the last comment line.
+func parseAbuseCHFeed(feed *ThreatFeed, r io.Reader) error {
+	score := defaultFeedScores[FeedFormatAbuse]
+	ipColumn := -1
+	lastComment := ""
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			lastComment = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+			continue
+		}
+
+		record, err := csv.NewReader(strings.NewReader(line)).Read()
+		if err != nil {
+			continue
+		}
+
+		if ipColumn < 0 {
+			// The header may be uncommented, or the last comment line
+			if col := abuseCHIPColumn(record); col >= 0 {
+				ipColumn = col
+				continue
+			}
+			if header, err := csv.NewReader(strings.NewReader(lastComment)).Read(); err == nil {
+				ipColumn = abuseCHIPColumn(header)
+			}
+			if ipColumn < 0 {
+				ipColumn = guessIPColumn(record)
+			}
+			if ipColumn < 0 {
+				continue
+			}
+		}
+
+		if ipColumn < len(record) {
+			feed.add(record[ipColumn], score)
+		}
+	}
+	return scanner.Err()
+}
+
+func abuseCHIPColumn(header []string) int {
+	for i, name := range header {
+		switch strings.ToLower(strings.Trim(strings.TrimSpace(name), `"`)) {
+		case "dst_ip", "dstip", "ip_address", "ip":
+			return i
+		}
+	}
+	return -1
+}
+
+func guessIPColumn(record []string) int {
+	for i, field := range record {
+		if _, err := netip.ParseAddr(strings.TrimSpace(field)); err == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// stixPatternRe pulls address values out of STIX patterns such as
+// [ipv4-addr:value = '198.51.100.1'] OR [ipv6-addr:value = '2001:db8::/32']
+var stixPatternRe = regexp.MustCompile(`ipv[46]-addr:value\s*=\s*'([^']+)'`)
+
+type stixBundle struct {
+	Type    string       `json:"type"`
+	Objects []stixObject `json:"objects"`
+}
+
+type stixObject struct {
+	Type        string `json:"type"`
+	Pattern     string `json:"pattern"`
+	PatternType string `json:"pattern_type"`
+	Confidence  *int   `json:"confidence"`
+	Revoked     bool   `json:"revoked"`
+	ValidUntil  string `json:"valid_until"`
+}
+
+// parseSTIXFeed loads indicator objects from a STIX 2.1 bundle
+func parseSTIXFeed(feed *ThreatFeed, r io.Reader) error {
+	var bundle stixBundle
+	if err := json.NewDecoder(r).Decode(&bundle); err != nil {
+		return fmt.Errorf("decode stix bundle: %w", err)
+	}
+	if bundle.Type != "bundle" {
+		return fmt.Errorf("not a stix bundle (type %q)", bundle.Type)
+	}
+
+	now := time.Now()
+	for _, obj := range bundle.Objects {
+		if obj.Type != "indicator" || obj.Revoked {
+			continue
+		}
+		if obj.PatternType != "" && obj.PatternType != "stix" {
+			continue
+		}
+		if obj.ValidUntil != "" {
+			if until, err := time.Parse(time.RFC3339, obj.ValidUntil); err == nil && until.Before(now) {
+				continue
+			}
+		}
+
+		score := defaultFeedScores[FeedFormatSTIX]
+		if obj.Confidence != nil {
+			score = *obj.Confidence
+		}
+		for _, m := range stixPatternRe.FindAllStringSubmatch(obj.Pattern, -1) {
+			feed.add(m[1], score)
+		}
+	}
+	return nil
+}
+
+// ApplyThreatMatch copies a match onto the node, reporting whether the
+// node's reputation changed
+func ApplyThreatMatch(node *NetworkNode, match *ThreatMatch) bool {
+	score := 0
+	var feeds []string
+	if match != nil {
+		score = match.Score
+		feeds = match.Feeds
+	}
+	if node.Reputation == score && strings.Join(node.ThreatFeeds, ",") == strings.Join(feeds, ",") {
+		return false
+	}
+	node.Reputation = score
+	node.ThreatFeeds = feeds
+	return true
+}
+
+// ThreatSeverity maps a reputation score to an alert severity
+func ThreatSeverity(score int) string {
+	switch {
+	case score >= 90:
+		return "critical"
+	case score >= 70:
+		return "high"
+	case score >= 40:
+		return "medium"
+	}
+	return "low"
+}
+
+// refreshThreatIntel periodically reloads the feeds and re-checks known nodes
+func refreshThreatIntel(intel *ThreatIntel, interval time.Duration, hub *WSHub, store *NodeStore) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		reloadThreatIntel(intel, hub, store)
+	}
+}
+
+// reloadThreatIntel re-reads the feeds and, if they changed, re-checks every
+// node against them
+func reloadThreatIntel(intel *ThreatIntel, hub *WSHub, store *NodeStore) (bool, error) {
+	changed, err := intel.Reload()
+	if err != nil {
+		slog.Error("Threat intel reload failed", "component", "threatintel", "error", err)
+		return false, err
+	}
+	if !changed {
+		return false, nil
+	}
+
+	feeds, entries := intel.Stats()
+	slog.Info("Threat intel reloaded", "component", "threatintel", "feeds", feeds, "entries", entries)
+
+	out := hub.NewOutbox()
+	store.mu.Lock()
+	for _, node := range store.Nodes {
+		if node.ID == "local" {
+			continue
+		}
+		wasListed := len(node.ThreatFeeds) > 0
+		match := intel.Match(node.IPAddress)
+		if !ApplyThreatMatch(node, match) {
+			continue
+		}
+		out.BroadcastNodeUpdate(node)
+		if match != nil && !wasListed {
+			raiseThreatAlert(out, node)
+		}
+	}
+	store.mu.Unlock()
+	out.Flush()
+	return true, nil
+}
+
+// raiseThreatAlert publishes an alert for a node that matched threat feeds
+func raiseThreatAlert(b Broadcaster, node *NetworkNode) {
+	alertMsg := fmt.Sprintf("Threat intel match: %s (%s) listed in %s, reputation %d",
+		node.Name, node.IPAddress, strings.Join(node.ThreatFeeds, ", "), node.Reputation)
+	slog.Warn("Threat intel match", "component", "threatintel", "node_id", node.ID, "ip", node.IPAddress,
+		"feeds", node.ThreatFeeds, "reputation", node.Reputation)
+	b.BroadcastAlert(NewAlert("threat-intel", node.ID, ThreatSeverity(node.Reputation), alertMsg))
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const threatFixtures = "testdata/threatintel"
+
+func TestDetectFeedFormat(t *testing.T) {
+	tests := []struct {
+		path string
+		head string
+		want string
+	}{
+		{"feeds/indicators.json", "", FeedFormatSTIX},
+		{"feeds/bundle.txt", `  {"type": "bundle"}`, FeedFormatSTIX},
+		{"feeds/feodo.csv", "# first_seen_utc,dst_ip", FeedFormatAbuse},
+		{"feeds/drop.txt", "; Spamhaus DROP List", FeedFormatDROP},
+		{"feeds/edrop", "192.0.2.0/24 ; SBL1\n", FeedFormatDROP},
+		{"feeds/blocklist.txt", "# comment\n198.51.100.1\n", FeedFormatPlain},
+		{"feeds/empty", "", FeedFormatPlain},
+	}
+	for _, tt := range tests {
+		if got := detectFeedFormat(tt.path, []byte(tt.head)); got != tt.want {
+			t.Errorf("detectFeedFormat(%q, %q) = %q, want %q", tt.path, tt.head, got, tt.want)
+		}
+	}
+}
+
+func TestLoadThreatFeed(t *testing.T) {
+	tests := []struct {
+		file     string
+		format   string
+		hosts    map[string]int
+		prefixes []string
+		absent   []string
+	}{
+		{
+			file:     "blocklist.txt",
+			format:   FeedFormatPlain,
+			hosts:    map[string]int{"198.51.100.7": 70},
+			prefixes: []string{"203.0.113.0/24", "2001:db8:bad::/48"},
+		},
+		{
+			file:     "drop.txt",
+			format:   FeedFormatDROP,
+			hosts:    map[string]int{},
+			prefixes: []string{"192.0.2.0/24", "203.0.113.0/25"},
+		},
+		{
+			file:   "feodo.csv",
+			format: FeedFormatAbuse,
+			hosts:  map[string]int{"198.51.100.7": 100, "198.51.100.8": 100},
+		},
+		{
+			file:   "indicators.json",
+			format: FeedFormatSTIX,
+			// Confidence overrides the default score; revoked, expired and
+			// non-STIX indicators are skipped
+			hosts:  map[string]int{"198.51.100.7": 60, "2001:db8:feed::1": 60},
+			absent: []string{"192.0.2.66", "192.0.2.77", "192.0.2.88"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			feed, err := LoadThreatFeed(filepath.Join(threatFixtures, tt.file))
+			if err != nil {
+				t.Fatalf("LoadThreatFeed: %v", err)
+			}
+			if feed.Format != tt.format {
+				t.Errorf("format = %q, want %q", feed.Format, tt.format)
+			}
+			if want := tt.file[:len(tt.file)-len(filepath.Ext(tt.file))]; feed.Name != want {
+				t.Errorf("name = %q, want %q", feed.Name, want)
+			}
+
+			hosts := make(map[string]int)
+			for addr, score := range feed.hosts {
+				hosts[addr.String()] = score
+			}
+			if !reflect.DeepEqual(hosts, tt.hosts) {
+				t.Errorf("hosts = %v, want %v", hosts, tt.hosts)
+			}
+
+			var prefixes []string
+			for _, p := range feed.prefixes {
+				prefixes = append(prefixes, p.prefix.String())
+			}
+			if !reflect.DeepEqual(prefixes, tt.prefixes) {
+				t.Errorf("prefixes = %v, want %v", prefixes, tt.prefixes)
+			}
+
+			for _, ip := range tt.absent {
+				if _, ok := feed.lookup(netip.MustParseAddr(ip)); ok {
+					t.Errorf("%s should not be listed", ip)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadThreatFeedRejectsNonBundle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := os.WriteFile(path, []byte(`{"type": "report"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadThreatFeed(path); err == nil {
+		t.Fatal("expected an error for a non-bundle STIX document")
+	}
+}
+
+func TestThreatIntelMatch(t *testing.T) {
+	intel := NewThreatIntel(threatFixtures)
+	if _, err := intel.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	tests := []struct {
+		ip    string
+		score int
+		feeds []string
+	}{
+		// drop alone
+		{"192.0.2.1", 90, []string{"drop"}},
+		// blocklist 70 and drop 90: highest score plus 5 for the second feed
+		{"203.0.113.5", 95, []string{"blocklist", "drop"}},
+		// outside the DROP /25, so blocklist only
+		{"203.0.113.200", 70, []string{"blocklist"}},
+		// three feeds, capped at 100
+		{"198.51.100.7", 100, []string{"blocklist", "feodo", "indicators"}},
+		{"::ffff:198.51.100.8", 100, []string{"feodo"}},
+		{"2001:db8:feed::1", 60, []string{"indicators"}},
+		{"2001:db8:bad::42", 70, []string{"blocklist"}},
+	}
+	for _, tt := range tests {
+		match := intel.Match(tt.ip)
+		if match == nil {
+			t.Errorf("Match(%s) = nil, want score %d", tt.ip, tt.score)
+			continue
+		}
+		if match.Score != tt.score || !reflect.DeepEqual(match.Feeds, tt.feeds) {
+			t.Errorf("Match(%s) = %d %v, want %d %v", tt.ip, match.Score, match.Feeds, tt.score, tt.feeds)
+		}
+	}
+
+	for _, ip := range []string{"10.0.0.1", "198.51.100.9", "not-an-ip"} {
+		if match := intel.Match(ip); match != nil {
+			t.Errorf("Match(%s) = %+v, want nil", ip, match)
+		}
+	}
+}
+
+func TestThreatIntelReload(t *testing.T) {
+	dir := t.TempDir()
+	copyFixture := func(name string) {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(threatFixtures, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	intel := NewThreatIntel(dir)
+	copyFixture("blocklist.txt")
+	if changed, err := intel.Reload(); err != nil || !changed {
+		t.Fatalf("first Reload = %v, %v; want changed", changed, err)
+	}
+	if changed, _ := intel.Reload(); changed {
+		t.Error("Reload with no file changes reported a change")
+	}
+
+	// Hidden files are ignored
+	if err := os.WriteFile(filepath.Join(dir, ".partial"), []byte("192.0.2.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	copyFixture("drop.txt")
+	if changed, _ := intel.Reload(); !changed {
+		t.Error("Reload after adding a feed reported no change")
+	}
+	if feeds, entries := intel.Stats(); feeds != 2 || entries != 5 {
+		t.Errorf("Stats = %d feeds, %d entries; want 2, 5", feeds, entries)
+	}
+	if match := intel.Match("192.0.2.1"); match == nil || match.Feeds[0] != "drop" {
+		t.Errorf("Match after add = %+v, want drop", match)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "drop.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if changed, _ := intel.Reload(); !changed {
+		t.Error("Reload after removing a feed reported no change")
+	}
+	if feeds, _ := intel.Stats(); feeds != 1 {
+		t.Errorf("Stats = %d feeds after removal, want 1", feeds)
+	}
+	if match := intel.Match("192.0.2.1"); match != nil {
+		t.Errorf("Match after removal = %+v, want nil", match)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// certCheckInterval limits how often certificate files are checked for
+// rotation; the check happens on a TLS handshake
+const certCheckInterval = 10 * time.Second
+
+// CertReloader serves a certificate and key from disk, re-reading them
+// (and the client CA bundle) when the files change, so rotated
+// certificates are picked up without a restart
+type CertReloader struct {
+	certPath, keyPath, clientCAPath string
+
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  [3]time.Time
+	checked   time.Time
+	mu        sync.Mutex
+}
+
+// NewCertReloader loads the certificate, key and optional client CA bundle
+func NewCertReloader(certPath, keyPath, clientCAPath string) (*CertReloader, error) {
+	r := &CertReloader{certPath: certPath, keyPath: keyPath, clientCAPath: clientCAPath}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("load TLS certificate: %w", err)
+	}
+	var pool *x509.CertPool
+	if r.clientCAPath != "" {
+		if pool, err = loadCertPool(r.clientCAPath); err != nil {
+			return err
+		}
+	}
+	r.cert = &cert
+	r.clientCAs = pool
+	r.modTimes = r.stat()
+	return nil
+}
+
+func (r *CertReloader) stat() [3]time.Time {
+	var times [3]time.Time
+	for i, path := range []string{r.certPath, r.keyPath, r.clientCAPath} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			times[i] = info.ModTime()
+		}
+	}
+	return times
+}
+
+// current returns the certificate and client CAs, reloading them if the
+// files changed. A failed reload keeps serving the previous certificate.
+func (r *CertReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) >= certCheckInterval {
+		r.checked = time.Now()
+		if r.stat() != r.modTimes {
+			if err := r.load(); err != nil {
+				slog.Error("TLS certificate reload failed, keeping the previous one", "component", "tls", "error", err)
+			} else {
+				slog.Info("TLS certificate reloaded", "component", "tls", "path", r.certPath)
+			}
+		}
+	}
+	return r.cert, r.clientCAs
+}
+
+// ServerConfig builds the listener's TLS configuration. With a client CA
+// bundle, clients may present a certificate signed by it; browsers that
+// present none are still served, agents that do are authenticated by it.
+func (r *CertReloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, clientCAs := r.current()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if clientCAs != nil {
+				cfg.ClientCAs = clientCAs
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// VerifiesClients reports whether client certificates are checked
+func (r *CertReloader) VerifiesClients() bool {
+	return r != nil && r.clientCAPath != ""
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return pool, nil
+}
+
+// SetupTLS returns the certificate reloader for the server, or nil to serve
+// plain HTTP. In dev mode a local CA and a server certificate for this
+// host are generated in dir (and reused on later runs); the CA also
+// verifies agent client certificates unless a client CA is configured.
+func SetupTLS(cfg *Config) (*CertReloader, error) {
+	certPath, keyPath, clientCA := cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA
+	if cfg.TLSDev {
+		ca, err := LoadOrCreateDevCA(cfg.TLSDevDir)
+		if err != nil {
+			return nil, err
+		}
+		certPath = filepath.Join(cfg.TLSDevDir, "server.pem")
+		keyPath = filepath.Join(cfg.TLSDevDir, "server-key.pem")
+		if _, err := os.Stat(certPath); errors.Is(err, os.ErrNotExist) {
+			if err := ca.Issue(certPath, keyPath, "netops-backend", devServerNames(), false); err != nil {
+				return nil, err
+			}
+		}
+		if clientCA == "" {
+			clientCA = ca.CertPath
+		}
+		slog.Info("TLS dev mode: trust the CA in your browser to avoid certificate warnings", "component", "tls", "ca", ca.CertPath)
+	}
+	if certPath == "" && keyPath == "" {
+		return nil, nil
+	}
+	if certPath == "" || keyPath == "" {
+		return nil, errors.New("NETOPS_TLS_CERT and NETOPS_TLS_KEY must be set together")
+	}
+	return NewCertReloader(certPath, keyPath, clientCA)
+}
+
+// devServerNames are the names and addresses a dev certificate covers
+func devServerNames() []string {
+	names := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil {
+		names = append(names, hostname)
+	}
+	return append(names, interfaceAddresses()...)
+}
+
+// DevCA is a locally generated certificate authority for development
+type DevCA struct {
+	CertPath string
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+}
+
+// LoadOrCreateDevCA loads ca.pem and ca-key.pem from dir, generating them
+// on first use
+func LoadOrCreateDevCA(dir string) (*DevCA, error) {
+	certPath := filepath.Join(dir, "ca.pem")
+	keyPath := filepath.Join(dir, "ca-key.pem")
+
+	if pair, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: expected an ECDSA key", keyPath)
+		}
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		return &DevCA{CertPath: certPath, cert: cert, key: key}, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("load dev CA: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "NetOps Development CA", Organization: []string{"NetOps"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(5, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeCertAndKey(certPath, keyPath, der, key); err != nil {
+		return nil, err
+	}
+	slog.Info("Generated development CA", "component", "tls", "dir", dir)
+	return &DevCA{CertPath: certPath, cert: cert, key: key}, nil
+}
+
+// Issue writes a certificate signed by the CA. Server certificates cover
+// names (DNS names or IP addresses); client certificates carry the
+// agent ID as their common name.
+func (ca *DevCA) Issue(certPath, keyPath, commonName string, names []string, client bool) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"NetOps"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return err
+	}
+	return writeCertAndKey(certPath, keyPath, der, key)
+}
+
+func writeCertAndKey(certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	return serial
+}
+
+// issueAgentCert implements "netops-backend agent-cert <id>": it issues a
+// client certificate for an agent from the dev CA
+func issueAgentCert(cfg *Config, agentID string) {
+	ca, err := LoadOrCreateDevCA(cfg.TLSDevDir)
+	if err != nil {
+		fatal("Dev CA unavailable", "component", "tls", "error", err)
+	}
+	certPath, keyPath, err := ca.IssueAgent(cfg.TLSDevDir, agentID)
+	if err != nil {
+		fatal("Failed to issue agent certificate", "component", "tls", "error", err)
+	}
+	fmt.Printf("NETOPS_AGENT_CERT=%s\nNETOPS_AGENT_KEY=%s\nNETOPS_AGENT_CA=%s\n", certPath, keyPath, ca.CertPath)
+}
+
+// IssueAgent writes a client certificate for agentID into dir. The ID
+// becomes part of the file names, so it must be a plain name.
+func (ca *DevCA) IssueAgent(dir, agentID string) (certPath, keyPath string, err error) {
+	if !validAgentID(agentID) {
+		return "", "", fmt.Errorf("invalid agent ID %q", agentID)
+	}
+	certPath = filepath.Join(dir, "agent-"+agentID+".pem")
+	keyPath = filepath.Join(dir, "agent-"+agentID+"-key.pem")
+	if err := ca.Issue(certPath, keyPath, agentID, nil, true); err != nil {
+		return "", "", err
+	}
+	return certPath, keyPath, nil
+}
+
+// agentTLSConfig is the agent's client configuration: the CA it trusts for
+// the aggregator and the certificate it presents, when configured
+func agentTLSConfig(cfg *Config) (*tls.Config, error) {
+	if cfg.AgentCA == "" && cfg.AgentCert == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.AgentCA != "" {
+		pool, err := loadCertPool(cfg.AgentCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.AgentCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.AgentCert, cfg.AgentKey)
+		if err != nil {
+			return nil, fmt.Errorf("load agent certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
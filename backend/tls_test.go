@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDevCA(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateDevCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second load reuses the CA on disk
+	again, err := LoadOrCreateDevCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.cert.Equal(ca.cert) {
+		t.Error("reloading the dev CA generated a new one")
+	}
+	if info, err := os.Stat(filepath.Join(dir, "ca-key.pem")); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("CA key permissions = %v, %v; want 0600", info.Mode().Perm(), err)
+	}
+
+	certPath, keyPath := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+	if err := ca.Issue(certPath, keyPath, "netops-backend", []string{"localhost", "127.0.0.1"}, false); err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, err := loadCertPool(ca.CertPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"localhost", "127.0.0.1"} {
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Errorf("server certificate for %s: %v", name, err)
+		}
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err == nil {
+		t.Error("server certificate is valid for client auth")
+	}
+}
+
+func TestIssueAgentRejectsPaths(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateDevCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"", "../escape", "nested/agent", `win\agent`, "..", "a..b"} {
+		if _, _, err := ca.IssueAgent(dir, id); err == nil {
+			t.Errorf("IssueAgent(%q) succeeded", id)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("dir has %d entries after rejected IDs, want only the CA pair", len(entries))
+	}
+
+	certPath, _, err := ca.IssueAgent(dir, "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certPath != filepath.Join(dir, "agent-web-1.pem") {
+		t.Errorf("cert path = %s", certPath)
+	}
+}
+
+func TestCertReloaderRotation(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateDevCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+	if err := ca.Issue(certPath, keyPath, "first", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	reloader, err := NewCertReloader(certPath, keyPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName := func() string {
+		cert, _ := reloader.current()
+		parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+		return parsed.Subject.CommonName
+	}
+	if got := commonName(); got != "first" {
+		t.Fatalf("initial certificate = %s", got)
+	}
+
+	if err := ca.Issue(certPath, keyPath, "second", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	for _, path := range []string{certPath, keyPath} {
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Files are only checked every certCheckInterval
+	if got := commonName(); got != "first" {
+		t.Errorf("certificate changed before the check interval: %s", got)
+	}
+	reloader.checked = time.Time{}
+	if got := commonName(); got != "second" {
+		t.Errorf("rotated certificate = %s, want second", got)
+	}
+
+	// A broken rotation keeps the previous certificate
+	if err := os.WriteFile(certPath, []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	os.Chtimes(certPath, later, later)
+	reloader.checked = time.Time{}
+	if got := commonName(); got != "second" {
+		t.Errorf("certificate after failed reload = %s, want second", got)
+	}
+}
+
+func TestAgentMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateDevCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, serverKey := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+	if err := ca.Issue(serverCert, serverKey, "netops-backend", []string{"127.0.0.1"}, false); err != nil {
+		t.Fatal(err)
+	}
+	reloader, err := NewCertReloader(serverCert, serverKey, ca.CertPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentCert, agentKey, err := ca.IssueAgent(dir, "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agents := NewAgentCollector(nil, time.Minute)
+	server := httptest.NewUnstartedServer(agents.HandleAgent())
+	server.TLS = reloader.ServerConfig()
+	server.StartTLS()
+	defer server.Close()
+	url := "wss://" + server.Listener.Addr().(*net.TCPAddr).String()
+
+	cfg := &Config{AggregatorURL: url, AgentCA: ca.CertPath, AgentCert: agentCert, AgentKey: agentKey}
+	conn, err := dialAggregator(cfg, "web-1")
+	if err != nil {
+		t.Fatalf("dial with client certificate: %v", err)
+	}
+	if err := conn.WriteJSON(AgentBatch{Hostname: "web-1"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { _, ok := agents.live()["web-1"]; return ok })
+	conn.Close()
+
+	// The certificate decides the identity; claiming another is refused
+	if _, err := dialAggregator(cfg, "web-2"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("dial claiming another agent ID = %v, want HTTP 401", err)
+	}
+
+	// Without a certificate or token there is nothing to authorize
+	noCert := &Config{AggregatorURL: url, AgentCA: ca.CertPath}
+	if _, err := dialAggregator(noCert, "web-1"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("dial without a client certificate = %v, want HTTP 401", err)
+	}
+
+	// A certificate from another CA fails the handshake
+	other, err := LoadOrCreateDevCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rogueCert, rogueKey, err := other.IssueAgent(t.TempDir(), "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rogue := &Config{AggregatorURL: url, AgentCA: ca.CertPath, AgentCert: rogueCert, AgentKey: rogueKey}
+	if _, err := dialAggregator(rogue, "web-1"); err == nil {
+		t.Error("certificate from a foreign CA was accepted")
+	}
+}
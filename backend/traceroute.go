@@ -0,0 +1,632 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// TraceHop is one TTL of a traced path
+type TraceHop struct {
+	TTL      int     `json:"ttl"`
+	IP       string  `json:"ip,omitempty"`  // empty when no probe was answered
+	RTT      float64 `json:"rtt,omitempty"` // best round trip in milliseconds
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+}
+
+// TracePath is the route to a peer found by one traceroute
+type TracePath struct {
+	Target   string     `json:"target"`
+	Protocol string     `json:"protocol"`       // udp, icmp or tcp
+	Port     int        `json:"port,omitempty"` // destination port of UDP and TCP probes
+	Hops     []TraceHop `json:"hops"`
+	Reached  bool       `json:"reached"` // the last hop is the target itself
+	At       time.Time  `json:"at"`
+}
+
+const (
+	// traceUDPPort is the destination of UDP probes, the classic first
+	// traceroute port
+	traceUDPPort = 33434
+	// traceTCPPort is used for TCP probes to peers with no known service port
+	traceTCPPort = 80
+	// traceSilentHops ends a trace after this many hops in a row don't answer
+	traceSilentHops = 5
+	// tracerWorkers limits how many peers are traced at once
+	tracerWorkers = 2
+)
+
+// Tracer discovers the routers between this host and its peers. Probes
+// are Paris-style: every probe of a trace has the same flow identifier
+// (addresses, protocol, ports, or ICMP checksum), so per-flow load
+// balancers keep them on one path and the hops found form a real route.
+// Reading the ICMP errors routers send back needs a raw socket, so tracing
+// requires root or CAP_NET_RAW.
+type Tracer struct {
+	protocol string
+	timeout  time.Duration // wait for each probe
+	maxHops  int
+	queries  int // probes per hop
+	schedule *peerSchedule
+	denied   atomic.Bool // raw sockets not permitted; logged once
+
+	paths map[string]*TracePath
+	mu    sync.RWMutex
+
+	// OnPath receives each finished trace
+	OnPath func(path *TracePath)
+}
+
+// NewTracer creates a tracer retracing each tracked peer every interval
+func NewTracer(protocol string, interval, timeout time.Duration, maxHops, queries int) (*Tracer, error) {
+	if err := checkTraceProtocol(protocol); err != nil {
+		return nil, err
+	}
+	t := &Tracer{
+		protocol: protocol,
+		timeout:  timeout,
+		maxHops:  max(maxHops, 1),
+		queries:  max(queries, 1),
+		paths:    make(map[string]*TracePath),
+	}
+	t.schedule = newPeerSchedule(interval, tracerWorkers, func(ip string, port int) {
+		if _, err := t.Trace(ip, t.protocol, port); err != nil {
+			if !errors.Is(err, os.ErrPermission) {
+				slog.Debug("Traceroute failed", "component", "traceroute", "ip", ip, "error", err)
+			} else if t.denied.CompareAndSwap(false, true) {
+				slog.Warn("Traceroute needs root or CAP_NET_RAW", "component", "traceroute", "error", err)
+			}
+		}
+	})
+	t.schedule.forget = func(ip string) {
+		t.mu.Lock()
+		delete(t.paths, ip)
+		t.mu.Unlock()
+	}
+	return t, nil
+}
+
+func checkTraceProtocol(protocol string) error {
+	switch protocol {
+	case "udp", "icmp", "tcp":
+		return nil
+	}
+	return fmt.Errorf("unknown traceroute protocol %q (want udp, icmp or tcp)", protocol)
+}
+
+// Track adds a peer to trace. TCP traces go to its service port.
+func (t *Tracer) Track(ip string, port int) {
+	t.schedule.Track(ip, port)
+}
+
+// Run retraces tracked peers as they come due
+func (t *Tracer) Run() {
+	t.schedule.Run()
+}
+
+// Path returns the latest route to ip, or nil when it hasn't been traced
+func (t *Tracer) Path(ip string) *TracePath {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.paths[ip]
+}
+
+// Trace finds the route to ip now and keeps it as the peer's path
+func (t *Tracer) Trace(ip, protocol string, port int) (*TracePath, error) {
+	if err := checkTraceProtocol(protocol); err != nil {
+		return nil, err
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, err
+	}
+	addr = addr.Unmap()
+	switch {
+	case protocol == "udp":
+		port = traceUDPPort
+	case protocol == "icmp":
+		port = 0
+	case port == 0:
+		port = traceTCPPort
+	}
+
+	path, err := t.trace(addr, protocol, port)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.paths[ip] = path
+	t.mu.Unlock()
+	slog.Debug("Traced path", "component", "traceroute", "ip", ip, "protocol", protocol, "hops", len(path.Hops), "reached", path.Reached)
+	if t.OnPath != nil {
+		t.OnPath(path)
+	}
+	return path, nil
+}
+
+// traceReply is an ICMP answer matched to one of a trace's probes
+type traceReply struct {
+	seq     int // probe number
+	from    netip.Addr
+	at      time.Time
+	reached bool // the target answered
+	final   bool // nothing further will answer: the target, or an unreachable
+}
+
+// traceSession is one running trace, receiving every ICMP message on its
+// own raw socket and keeping those about its probes
+type traceSession struct {
+	dst     netip.Addr
+	port    int
+	proto   int // ICMP protocol number for parsing
+	raw     *icmp.PacketConn
+	replies chan traceReply
+	probe   traceProbe
+}
+
+// traceProbe sends one protocol's probes and recognizes the packets quoted
+// in ICMP errors as its own
+type traceProbe interface {
+	send(ttl, seq int) error
+	match(q quotedPacket) (seq int, ok bool)
+	close()
+}
+
+func (t *Tracer) trace(dst netip.Addr, protocol string, port int) (*TracePath, error) {
+	network, listen, proto := "ip4:icmp", "0.0.0.0", 1
+	if dst.Is6() {
+		network, listen, proto = "ip6:ipv6-icmp", "::", 58
+	}
+	raw, err := icmp.ListenPacket(network, listen)
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Close()
+
+	s := &traceSession{dst: dst, port: port, proto: proto, raw: raw, replies: make(chan traceReply, 16)}
+	switch protocol {
+	case "udp":
+		s.probe, err = newUDPTraceProbe(s)
+	case "icmp":
+		s.probe = newICMPTraceProbe(s)
+	case "tcp":
+		s.probe, err = newTCPTraceProbe(s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer s.probe.close()
+	go s.read()
+
+	path := &TracePath{Target: dst.String(), Protocol: protocol, Port: port}
+	seq, silent := 0, 0
+	for ttl := 1; ttl <= t.maxHops && silent < traceSilentHops; ttl++ {
+		hop := TraceHop{TTL: ttl}
+		var best time.Duration
+		final := false
+		for range t.queries {
+			seq++
+			start := time.Now()
+			if err := s.probe.send(ttl, seq); err != nil {
+				return nil, err
+			}
+			hop.Sent++
+			reply, ok := s.wait(seq, start.Add(t.timeout))
+			if !ok {
+				continue
+			}
+			hop.Received++
+			if hop.IP == "" {
+				hop.IP = reply.from.String()
+			}
+			if rtt := reply.at.Sub(start); best == 0 || rtt < best {
+				best = rtt
+			}
+			path.Reached = path.Reached || reply.reached
+			final = final || reply.final
+		}
+		hop.RTT = millis(best)
+		path.Hops = append(path.Hops, hop)
+		if final {
+			break
+		}
+		if hop.Received == 0 {
+			silent++
+		} else {
+			silent = 0
+		}
+	}
+	// Drop the unanswered hops after the last router that replied
+	for len(path.Hops) > 0 && path.Hops[len(path.Hops)-1].IP == "" {
+		path.Hops = path.Hops[:len(path.Hops)-1]
+	}
+	path.At = time.Now()
+	return path, nil
+}
+
+// wait returns the reply to probe seq, ignoring late replies to earlier ones
+func (s *traceSession) wait(seq int, deadline time.Time) (traceReply, bool) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		select {
+		case r := <-s.replies:
+			if r.seq == seq {
+				return r, true
+			}
+		case <-timer.C:
+			return traceReply{}, false
+		}
+	}
+}
+
+// deliver hands a reply to the waiting probe, dropping it if nobody is
+func (s *traceSession) deliver(r traceReply) {
+	select {
+	case s.replies <- r:
+	default:
+	}
+}
+
+// read matches ICMP messages to probes until the raw socket is closed
+func (s *traceSession) read() {
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := s.raw.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		at := time.Now()
+		ipAddr, ok := peer.(*net.IPAddr)
+		if !ok {
+			continue
+		}
+		from, ok := netip.AddrFromSlice(ipAddr.IP)
+		if !ok {
+			continue
+		}
+		from = from.Unmap()
+		msg, err := icmp.ParseMessage(s.proto, buf[:n])
+		if err != nil {
+			continue
+		}
+
+		var quoted []byte
+		unreachable := false
+		switch body := msg.Body.(type) {
+		case *icmp.Echo:
+			// Only ICMP probes are answered with echo replies
+			if p, ok := s.probe.(*icmpTraceProbe); ok && from == s.dst && body.ID == p.id &&
+				(msg.Type == ipv4.ICMPTypeEchoReply || msg.Type == ipv6.ICMPTypeEchoReply) {
+				s.deliver(traceReply{seq: body.Seq, from: from, at: at, reached: true, final: true})
+			}
+			continue
+		case *icmp.TimeExceeded:
+			quoted = body.Data
+		case *icmp.DstUnreach:
+			quoted, unreachable = body.Data, true
+		default:
+			continue
+		}
+		q, ok := parseQuotedPacket(quoted, s.dst.Is6())
+		if !ok || q.dst != s.dst {
+			continue
+		}
+		if seq, ok := s.probe.match(q); ok {
+			s.deliver(traceReply{seq: seq, from: from, at: at, reached: unreachable && from == s.dst, final: unreachable})
+		}
+	}
+}
+
+// quotedPacket holds the fields of a probe quoted in an ICMP error
+type quotedPacket struct {
+	proto   int // IP protocol of the probe
+	dst     netip.Addr
+	srcPort int // UDP and TCP
+	dstPort int
+	udpLen  int
+	tcpSeq  uint32
+	echoID  int // ICMP echo
+	echoSeq int
+}
+
+// parseQuotedPacket reads the IP header and first 8 transport bytes an
+// ICMP error carries. IPv6 extension headers are not followed.
+func parseQuotedPacket(data []byte, v6 bool) (quotedPacket, bool) {
+	var q quotedPacket
+	var transport []byte
+	if v6 {
+		if len(data) < 48 {
+			return q, false
+		}
+		q.proto = int(data[6])
+		q.dst = netip.AddrFrom16([16]byte(data[24:40]))
+		transport = data[40:]
+	} else {
+		if len(data) < 20 {
+			return q, false
+		}
+		ihl := int(data[0]&0x0f) * 4
+		if ihl < 20 || len(data) < ihl+8 {
+			return q, false
+		}
+		q.proto = int(data[9])
+		q.dst = netip.AddrFrom4([4]byte(data[16:20]))
+		transport = data[ihl:]
+	}
+	if len(transport) < 8 {
+		return q, false
+	}
+	switch q.proto {
+	case syscall.IPPROTO_UDP, syscall.IPPROTO_TCP:
+		q.srcPort = int(binary.BigEndian.Uint16(transport[0:2]))
+		q.dstPort = int(binary.BigEndian.Uint16(transport[2:4]))
+		q.udpLen = int(binary.BigEndian.Uint16(transport[4:6]))
+		q.tcpSeq = binary.BigEndian.Uint32(transport[4:8])
+	case 1, 58:
+		q.echoID = int(binary.BigEndian.Uint16(transport[4:6]))
+		q.echoSeq = int(binary.BigEndian.Uint16(transport[6:8]))
+	}
+	return q, true
+}
+
+// udpTraceProbe sends datagrams from one local port to one destination
+// port. The probe number is carried in the payload length, which comes
+// back in the quoted UDP header.
+type udpTraceProbe struct {
+	s     *traceSession
+	conn  *net.UDPConn
+	local int
+}
+
+func newUDPTraceProbe(s *traceSession) (*udpTraceProbe, error) {
+	network := "udp4"
+	if s.dst.Is6() {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTraceProbe{s: s, conn: conn, local: conn.LocalAddr().(*net.UDPAddr).Port}, nil
+}
+
+func (p *udpTraceProbe) send(ttl, seq int) error {
+	var err error
+	if p.s.dst.Is6() {
+		err = ipv6.NewConn(p.conn).SetHopLimit(ttl)
+	} else {
+		err = ipv4.NewConn(p.conn).SetTTL(ttl)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = p.conn.WriteToUDPAddrPort(make([]byte, seq), netip.AddrPortFrom(p.s.dst, uint16(p.s.port)))
+	return err
+}
+
+func (p *udpTraceProbe) match(q quotedPacket) (int, bool) {
+	if q.proto != syscall.IPPROTO_UDP || q.srcPort != p.local || q.dstPort != p.s.port {
+		return 0, false
+	}
+	return q.udpLen - 8, true
+}
+
+func (p *udpTraceProbe) close() {
+	p.conn.Close()
+}
+
+// icmpTraceProbe sends echo requests with a fixed ID. Two payload bytes
+// cancel out the sequence number in the checksum, which load balancers
+// hash on, so it stays the same for every probe.
+type icmpTraceProbe struct {
+	s  *traceSession
+	id int
+}
+
+func newICMPTraceProbe(s *traceSession) *icmpTraceProbe {
+	return &icmpTraceProbe{s: s, id: rand.IntN(0xffff) + 1}
+}
+
+func (p *icmpTraceProbe) send(ttl, seq int) error {
+	typ := icmp.Type(ipv4.ICMPTypeEcho)
+	var err error
+	if p.s.dst.Is6() {
+		typ = ipv6.ICMPTypeEchoRequest
+		err = p.s.raw.IPv6PacketConn().SetHopLimit(ttl)
+	} else {
+		err = p.s.raw.IPv4PacketConn().SetTTL(ttl)
+	}
+	if err != nil {
+		return err
+	}
+	data := binary.BigEndian.AppendUint16(nil, ^uint16(seq))
+	msg := icmp.Message{Type: typ, Body: &icmp.Echo{ID: p.id, Seq: seq, Data: append(data, "netops"...)}}
+	b, err := msg.Marshal(nil) // the kernel computes ICMPv6 checksums
+	if err != nil {
+		return err
+	}
+	_, err = p.s.raw.WriteTo(b, &net.IPAddr{IP: p.s.dst.AsSlice()})
+	return err
+}
+
+func (p *icmpTraceProbe) match(q quotedPacket) (int, bool) {
+	if (q.proto != 1 && q.proto != 58) || q.echoID != p.id {
+		return 0, false
+	}
+	return q.echoSeq, true
+}
+
+func (p *icmpTraceProbe) close() {}
+
+// tcpTraceProbe sends SYNs from a raw socket, all from one local port.
+// The probe number is the SYN's sequence number, which routers quote back
+// in time exceeded and the target acknowledges in its SYN-ACK or RST. The
+// kernel resets any connection the target accepts, as the port's socket
+// only listens.
+type tcpTraceProbe struct {
+	s     *traceSession
+	raw   net.PacketConn // receives every TCP segment sent to this host
+	hold  net.Listener   // keeps the local port from other sockets
+	src   netip.Addr
+	local int
+}
+
+func newTCPTraceProbe(s *traceSession) (*tcpTraceProbe, error) {
+	// The route's source address, needed for the TCP checksum; dialing
+	// UDP sends nothing
+	network := "udp4"
+	if s.dst.Is6() {
+		network = "udp6"
+	}
+	route, err := net.DialUDP(network, nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(s.dst, uint16(s.port))))
+	if err != nil {
+		return nil, err
+	}
+	src := route.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+	route.Close()
+
+	raw, err := listenTCPTrace(s.dst.Is6())
+	if err != nil {
+		return nil, err
+	}
+	hold, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, 0)))
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	p := &tcpTraceProbe{s: s, raw: raw, hold: hold, src: src, local: hold.Addr().(*net.TCPAddr).Port}
+	go p.read()
+	return p, nil
+}
+
+func (p *tcpTraceProbe) send(ttl, seq int) error {
+	var err error
+	if p.s.dst.Is6() {
+		err = ipv6.NewPacketConn(p.raw).SetHopLimit(ttl)
+	} else {
+		err = ipv4.NewPacketConn(p.raw).SetTTL(ttl)
+	}
+	if err != nil {
+		return err
+	}
+	syn := tcpSYN(p.src, p.s.dst, p.local, p.s.port, uint32(seq))
+	_, err = p.raw.WriteTo(syn, &net.IPAddr{IP: p.s.dst.AsSlice()})
+	return err
+}
+
+func (p *tcpTraceProbe) match(q quotedPacket) (int, bool) {
+	if q.proto != syscall.IPPROTO_TCP || q.srcPort != p.local || q.dstPort != p.s.port {
+		return 0, false
+	}
+	return int(q.tcpSeq), true
+}
+
+// read delivers the target's answers: a SYN-ACK or RST acknowledging a
+// probe's sequence number
+func (p *tcpTraceProbe) read() {
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := p.raw.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		at := time.Now()
+		ipAddr, ok := peer.(*net.IPAddr)
+		if !ok {
+			continue
+		}
+		from, ok := netip.AddrFromSlice(ipAddr.IP)
+		if !ok || from.Unmap() != p.s.dst {
+			continue
+		}
+		if seq, ok := parseTCPTraceReply(buf[:n], p.s.port, p.local); ok {
+			p.s.deliver(traceReply{seq: seq, from: p.s.dst, at: at, reached: true, final: true})
+		}
+	}
+}
+
+func (p *tcpTraceProbe) close() {
+	p.raw.Close()
+	p.hold.Close()
+}
+
+// TCP header flags
+const (
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+// tcpSYN builds a SYN segment with an MSS option, as SYNs without options
+// are dropped by some middleboxes
+func tcpSYN(src, dst netip.Addr, srcPort, dstPort int, seq uint32) []byte {
+	b := make([]byte, 24)
+	binary.BigEndian.PutUint16(b[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(b[2:], uint16(dstPort))
+	binary.BigEndian.PutUint32(b[4:], seq)
+	b[12] = 6 << 4 // header length in 32-bit words
+	b[13] = tcpFlagSYN
+	binary.BigEndian.PutUint16(b[14:], 65535) // window
+	copy(b[20:], []byte{2, 4, 0x05, 0xb4})    // MSS 1460
+	binary.BigEndian.PutUint16(b[16:], tcpChecksum(src, dst, b))
+	return b
+}
+
+// tcpChecksum is the Internet checksum of a segment and its IPv4 or IPv6
+// pseudo-header
+func tcpChecksum(src, dst netip.Addr, segment []byte) uint16 {
+	var pseudo []byte
+	pseudo = append(pseudo, src.AsSlice()...)
+	pseudo = append(pseudo, dst.AsSlice()...)
+	if src.Is4() {
+		pseudo = append(pseudo, 0, syscall.IPPROTO_TCP)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(segment)))
+	} else {
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(segment)))
+		pseudo = append(pseudo, 0, 0, 0, syscall.IPPROTO_TCP)
+	}
+	var sum uint32
+	for _, data := range [][]byte{pseudo, segment} {
+		for i := 0; i+1 < len(data); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(data[i:]))
+		}
+		if len(data)%2 == 1 {
+			sum += uint32(data[len(data)-1]) << 8
+		}
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// parseTCPTraceReply returns the probe a segment from the target answers:
+// a SYN-ACK or RST from the traced port to ours, acknowledging the probe's
+// sequence number plus one
+func parseTCPTraceReply(segment []byte, srcPort, dstPort int) (int, bool) {
+	if len(segment) < 20 ||
+		int(binary.BigEndian.Uint16(segment[0:])) != srcPort ||
+		int(binary.BigEndian.Uint16(segment[2:])) != dstPort {
+		return 0, false
+	}
+	flags := segment[13]
+	if flags&tcpFlagACK == 0 || flags&(tcpFlagSYN|tcpFlagRST) == 0 {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint32(segment[8:]) - 1), true
+}
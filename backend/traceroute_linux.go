@@ -0,0 +1,15 @@
+//go:build linux
+
+package main
+
+import "net"
+
+// listenTCPTrace opens the raw socket TCP probes are sent from. Linux
+// also passes it a copy of every TCP segment this host receives, which
+// is how the target's answers are seen.
+func listenTCPTrace(v6 bool) (net.PacketConn, error) {
+	if v6 {
+		return net.ListenPacket("ip6:tcp", "::")
+	}
+	return net.ListenPacket("ip4:tcp", "0.0.0.0")
+}
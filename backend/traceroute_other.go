@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// listenTCPTrace is only implemented on Linux, as other systems don't pass
+// TCP segments to raw sockets; use UDP or ICMP traces elsewhere
+func listenTCPTrace(v6 bool) (net.PacketConn, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// quoteIPv4 wraps a transport header in the IPv4 header an ICMP error quotes
+func quoteIPv4(src, dst netip.Addr, proto byte, transport []byte) []byte {
+	h := make([]byte, 20)
+	h[0] = 0x45
+	h[8] = 1 // TTL as it expired
+	h[9] = proto
+	copy(h[12:], src.AsSlice())
+	copy(h[16:], dst.AsSlice())
+	return append(h, transport[:8]...)
+}
+
+func quoteIPv6(src, dst netip.Addr, proto byte, transport []byte) []byte {
+	h := make([]byte, 40)
+	h[0] = 0x60
+	h[6] = proto
+	h[7] = 1
+	copy(h[8:], src.AsSlice())
+	copy(h[24:], dst.AsSlice())
+	return append(h, transport[:8]...)
+}
+
+func TestTCPTraceQuotedSeq(t *testing.T) {
+	tests := []struct {
+		src, dst netip.Addr
+		quote    func(src, dst netip.Addr, proto byte, transport []byte) []byte
+	}{
+		{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("198.51.100.7"), quoteIPv4},
+		{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8:feed::7"), quoteIPv6},
+	}
+	for _, tt := range tests {
+		s := &traceSession{dst: tt.dst, port: 443}
+		p := &tcpTraceProbe{s: s, src: tt.src, local: 40000}
+		data := tt.quote(tt.src, tt.dst, 6, tcpSYN(tt.src, tt.dst, 40000, 443, 17))
+		q, ok := parseQuotedPacket(data, tt.dst.Is6())
+		if !ok || q.dst != tt.dst {
+			t.Fatalf("%s: parseQuotedPacket = %+v, %v", tt.dst, q, ok)
+		}
+		if seq, ok := p.match(q); !ok || seq != 17 {
+			t.Errorf("%s: match = %d, %v; want probe 17", tt.dst, seq, ok)
+		}
+
+		// Another flow from the same host
+		data = tt.quote(tt.src, tt.dst, 6, tcpSYN(tt.src, tt.dst, 40001, 443, 17))
+		q, _ = parseQuotedPacket(data, tt.dst.Is6())
+		if _, ok := p.match(q); ok {
+			t.Errorf("%s: matched a SYN from another port", tt.dst)
+		}
+	}
+}
+
+func TestTCPChecksum(t *testing.T) {
+	for _, pair := range [][2]string{{"192.0.2.1", "198.51.100.7"}, {"2001:db8::1", "2001:db8:feed::7"}} {
+		src, dst := netip.MustParseAddr(pair[0]), netip.MustParseAddr(pair[1])
+		syn := tcpSYN(src, dst, 40000, 443, 0xdeadbeef)
+		// Summing a segment that includes its checksum gives zero
+		if sum := tcpChecksum(src, dst, syn); sum != 0 {
+			t.Errorf("%s: checksum over the SYN = %#04x, want 0", dst, sum)
+		}
+		if syn[13] != tcpFlagSYN || binary.BigEndian.Uint32(syn[4:]) != 0xdeadbeef {
+			t.Errorf("%s: SYN header % x", dst, syn)
+		}
+	}
+
+	// An odd trailing byte is summed as if padded with a zero
+	if got := tcpChecksum(netip.IPv4Unspecified(), netip.IPv4Unspecified(), []byte{0x01}); got != ^uint16(0x0100+6+1) {
+		t.Errorf("odd-length checksum = %#04x", got)
+	}
+}
+
+func TestParseTCPTraceReply(t *testing.T) {
+	segment := func(src, dst int, flags byte, ack uint32) []byte {
+		b := make([]byte, 20)
+		binary.BigEndian.PutUint16(b[0:], uint16(src))
+		binary.BigEndian.PutUint16(b[2:], uint16(dst))
+		binary.BigEndian.PutUint32(b[8:], ack)
+		b[12] = 5 << 4
+		b[13] = flags
+		return b
+	}
+	tests := []struct {
+		name string
+		data []byte
+		seq  int
+		ok   bool
+	}{
+		{"syn-ack", segment(443, 40000, tcpFlagSYN|tcpFlagACK, 8), 7, true},
+		{"refused", segment(443, 40000, tcpFlagRST|tcpFlagACK, 13), 12, true},
+		{"our own SYN", segment(40000, 443, tcpFlagSYN, 0), 0, false},
+		{"bare ack", segment(443, 40000, tcpFlagACK, 8), 0, false},
+		{"other port", segment(443, 40001, tcpFlagSYN|tcpFlagACK, 8), 0, false},
+		{"short", segment(443, 40000, tcpFlagSYN|tcpFlagACK, 8)[:12], 0, false},
+	}
+	for _, tt := range tests {
+		seq, ok := parseTCPTraceReply(tt.data, 443, 40000)
+		if ok != tt.ok || seq != tt.seq {
+			t.Errorf("%s: got %d, %v; want %d, %v", tt.name, seq, ok, tt.seq, tt.ok)
+		}
+	}
+}
+
+func TestTraceSessionWaitIgnoresStale(t *testing.T) {
+	s := &traceSession{replies: make(chan traceReply, 16)}
+	router := netip.MustParseAddr("192.0.2.254")
+	// A late reply to the previous hop's probe arrives first
+	s.deliver(traceReply{seq: 3, from: router})
+	s.deliver(traceReply{seq: 4, from: netip.MustParseAddr("192.0.2.1")})
+	r, ok := s.wait(4, time.Now().Add(time.Second))
+	if !ok || r.seq != 4 || r.from == router {
+		t.Errorf("wait(4) = %+v, %v", r, ok)
+	}
+
+	s.deliver(traceReply{seq: 4})
+	if r, ok := s.wait(5, time.Now().Add(20*time.Millisecond)); ok {
+		t.Errorf("wait(5) accepted %+v", r)
+	}
+}
+
+func TestTraceTCPLoopback(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("TCP traces are Linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("tracing needs root")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	tracer, err := NewTracer("tcp", time.Minute, time.Second, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, port := range []int{ln.Addr().(*net.TCPAddr).Port, closedPort} {
+		path, err := tracer.Trace("127.0.0.1", "tcp", port)
+		if errors.Is(err, os.ErrPermission) {
+			t.Skip("raw sockets not permitted")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !path.Reached || len(path.Hops) != 1 || path.Hops[0].IP != "127.0.0.1" || path.Hops[0].Received != 2 {
+			t.Errorf("port %d: path %+v", port, *path)
+		}
+	}
+}
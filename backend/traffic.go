@@ -0,0 +1,350 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	trafficWindow      = 60 // seconds of per-second buckets kept
+	trafficShortWindow = 10 // seconds averaged for the "current" rate
+	trafficIdleTTL     = 10 * time.Minute
+)
+
+// TrafficStats are byte and packet counters for a peer or an edge. In and
+// Out are from the local side's point of view; rates are per second.
+type TrafficStats struct {
+	BytesIn    uint64  `json:"bytesIn"`
+	BytesOut   uint64  `json:"bytesOut"`
+	PacketsIn  uint64  `json:"packetsIn"`
+	PacketsOut uint64  `json:"packetsOut"`
+	RateIn     float64 `json:"rateIn"`     // bytes/s over the last 10s
+	RateOut    float64 `json:"rateOut"`    // bytes/s over the last 10s
+	RateIn1m   float64 `json:"rateIn1m"`   // bytes/s over the last minute
+	RateOut1m  float64 `json:"rateOut1m"`  // bytes/s over the last minute
+	PacketRate float64 `json:"packetRate"` // packets/s both ways over the last 10s
+}
+
+type trafficBucket struct {
+	second     int64
+	bytesIn    uint64
+	bytesOut   uint64
+	packetsIn  uint64
+	packetsOut uint64
+}
+
+// trafficCounter keeps totals plus a ring of per-second buckets
+type trafficCounter struct {
+	total    trafficBucket
+	buckets  [trafficWindow]trafficBucket
+	lastSeen time.Time
+}
+
+func (c *trafficCounter) add(ts time.Time, inbound bool, bytes, packets uint64) {
+	sec := ts.Unix()
+	b := &c.buckets[sec%trafficWindow]
+	if b.second != sec {
+		*b = trafficBucket{second: sec}
+	}
+	if inbound {
+		b.bytesIn += bytes
+		b.packetsIn += packets
+		c.total.bytesIn += bytes
+		c.total.packetsIn += packets
+	} else {
+		b.bytesOut += bytes
+		b.packetsOut += packets
+		c.total.bytesOut += bytes
+		c.total.packetsOut += packets
+	}
+	if ts.After(c.lastSeen) {
+		c.lastSeen = ts
+	}
+}
+
+// sum adds up the buckets covering the window seconds before now
+func (c *trafficCounter) sum(now time.Time, window int64) trafficBucket {
+	var s trafficBucket
+	end := now.Unix()
+	for _, b := range c.buckets {
+		if b.second > end-window && b.second <= end {
+			s.bytesIn += b.bytesIn
+			s.bytesOut += b.bytesOut
+			s.packetsIn += b.packetsIn
+			s.packetsOut += b.packetsOut
+		}
+	}
+	return s
+}
+
+func (c *trafficCounter) stats(now time.Time) *TrafficStats {
+	short := c.sum(now, trafficShortWindow)
+	long := c.sum(now, trafficWindow)
+	return &TrafficStats{
+		BytesIn:    c.total.bytesIn,
+		BytesOut:   c.total.bytesOut,
+		PacketsIn:  c.total.packetsIn,
+		PacketsOut: c.total.packetsOut,
+		RateIn:     float64(short.bytesIn) / trafficShortWindow,
+		RateOut:    float64(short.bytesOut) / trafficShortWindow,
+		RateIn1m:   float64(long.bytesIn) / trafficWindow,
+		RateOut1m:  float64(long.bytesOut) / trafficWindow,
+		PacketRate: float64(short.packetsIn+short.packetsOut) / trafficShortWindow,
+	}
+}
+
+type edgeKey struct {
+	from, to string
+}
+
+// TopTalker is a remote peer ranked by recent throughput
+type TopTalker struct {
+	IP      string        `json:"ip"`
+	Traffic *TrafficStats `json:"traffic"`
+}
+
+// TrafficMeter accounts bytes and packets per remote IP and per edge, fed
+// either by a PacketTap or by conntrack counters
+type TrafficMeter struct {
+	// Replay computes rates against the newest packet timestamp rather than
+	// the wall clock, for pcap files captured in the past
+	Replay bool
+
+	clock    time.Time // newest timestamp added
+	remotes  map[string]*trafficCounter
+	edges    map[edgeKey]*trafficCounter
+	local    *localAddrs
+	previous map[string][2]ConntrackTuple // conntrack key -> last counters
+	mu       sync.Mutex
+}
+
+// NewTrafficMeter creates an empty meter
+func NewTrafficMeter() *TrafficMeter {
+	return &TrafficMeter{
+		remotes: make(map[string]*trafficCounter),
+		edges:   make(map[edgeKey]*trafficCounter),
+		local:   newLocalAddrs(),
+	}
+}
+
+// Add records traffic between a local endpoint and a remote peer. localID
+// is the node ID of the local side ("local" for this host).
+func (m *TrafficMeter) Add(ts time.Time, localID, remoteIP string, inbound bool, bytes, packets uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ts.After(m.clock) {
+		m.clock = ts
+	}
+	remote, ok := m.remotes[remoteIP]
+	if !ok {
+		remote = &trafficCounter{}
+		m.remotes[remoteIP] = remote
+	}
+	remote.add(ts, inbound, bytes, packets)
+
+	key := edgeKey{from: localID, to: remoteIP}
+	edge, ok := m.edges[key]
+	if !ok {
+		edge = &trafficCounter{}
+		m.edges[key] = edge
+	}
+	edge.add(ts, inbound, bytes, packets)
+}
+
+// HandlePacket accounts a captured packet
+func (m *TrafficMeter) HandlePacket(pkt *Packet) {
+	localID, remote, inbound, ok := m.classify(pkt.SrcIP, pkt.DstIP)
+	if !ok {
+		return
+	}
+	m.Add(pkt.Timestamp, localID, remote.String(), inbound, uint64(pkt.Length), 1)
+}
+
+// classify works out which side of a packet is local. Traffic to or from
+// this host's own addresses belongs to the "local" node; forwarded traffic
+// between a private and a public address (on a gateway) is attributed to
+// the private host.
+func (m *TrafficMeter) classify(src, dst netip.Addr) (localID string, remote netip.Addr, inbound, ok bool) {
+	switch {
+	case m.local.contains(src) && !m.local.contains(dst):
+		return "local", dst, false, true
+	case m.local.contains(dst) && !m.local.contains(src):
+		return "local", src, true, true
+	case isPrivateIP(src.AsSlice()) && !isPrivateIP(dst.AsSlice()):
+		return src.String(), dst, false, true
+	case isPrivateIP(dst.AsSlice()) && !isPrivateIP(src.AsSlice()):
+		return dst.String(), src, true, true
+	}
+	return "", netip.Addr{}, false, false
+}
+
+// now is the reference time for rates; callers hold m.mu
+func (m *TrafficMeter) now() time.Time {
+	if m.Replay {
+		return m.clock
+	}
+	return time.Now()
+}
+
+// Remote returns the counters for a remote peer
+func (m *TrafficMeter) Remote(ip string) *TrafficStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.remotes[ip]; ok {
+		return c.stats(m.now())
+	}
+	return nil
+}
+
+// Edge returns the counters for traffic between a local node and a peer
+func (m *TrafficMeter) Edge(from, to string) *TrafficStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.edges[edgeKey{from: from, to: to}]; ok {
+		return c.stats(m.now())
+	}
+	return nil
+}
+
+// TopTalkers returns the n remote peers with the highest current throughput
+func (m *TrafficMeter) TopTalkers(n int) []TopTalker {
+	m.mu.Lock()
+	now := m.now()
+	talkers := make([]TopTalker, 0, len(m.remotes))
+	for ip, c := range m.remotes {
+		talkers = append(talkers, TopTalker{IP: ip, Traffic: c.stats(now)})
+	}
+	m.mu.Unlock()
+
+	sort.Slice(talkers, func(i, j int) bool {
+		a, b := talkers[i].Traffic, talkers[j].Traffic
+		if ra, rb := a.RateIn+a.RateOut, b.RateIn+b.RateOut; ra != rb {
+			return ra > rb
+		}
+		return a.BytesIn+a.BytesOut > b.BytesIn+b.BytesOut
+	})
+	if n > 0 && len(talkers) > n {
+		talkers = talkers[:n]
+	}
+	return talkers
+}
+
+// Expire drops counters for peers idle longer than trafficIdleTTL
+func (m *TrafficMeter) Expire() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cutoff := m.now().Add(-trafficIdleTTL)
+	for ip, c := range m.remotes {
+		if c.lastSeen.Before(cutoff) {
+			delete(m.remotes, ip)
+		}
+	}
+	for key, c := range m.edges {
+		if c.lastSeen.Before(cutoff) {
+			delete(m.edges, key)
+		}
+	}
+}
+
+// PollConntrack feeds the meter from conntrack accounting counters, adding
+// the growth of each flow's counters since the previous read. It needs
+// net.netfilter.nf_conntrack_acct=1.
+func (m *TrafficMeter) PollConntrack(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		entries, err := ReadConntrack(path)
+		if err != nil {
+			slog.Error("Conntrack traffic accounting failed", "component", "traffic", "error", err)
+			continue
+		}
+		m.addConntrackDeltas(entries)
+	}
+}
+
+// addConntrackDeltas is only called from the poller, which owns m.previous
+func (m *TrafficMeter) addConntrackDeltas(entries []ConntrackEntry) {
+	now := time.Now()
+	first := m.previous == nil
+	current := make(map[string][2]ConntrackTuple, len(entries))
+
+	for i := range entries {
+		entry := &entries[i]
+		key := entry.Key()
+		current[key] = [2]ConntrackTuple{entry.Orig, entry.Reply}
+
+		// The first read only establishes a baseline
+		if first {
+			continue
+		}
+		prev := m.previous[key]
+		origBytes, origPackets := counterDelta(entry.Orig, prev[0])
+		replyBytes, replyPackets := counterDelta(entry.Reply, prev[1])
+		if origBytes == 0 && replyBytes == 0 {
+			continue
+		}
+
+		// The original direction was sent by the connection's initiator;
+		// the reply tuple's source is the real peer after any DNAT
+		localID, remote, inbound, ok := m.classify(entry.Orig.Src, entry.Reply.Src)
+		if !ok {
+			continue
+		}
+		m.Add(now, localID, remote.String(), inbound, origBytes, origPackets)
+		m.Add(now, localID, remote.String(), !inbound, replyBytes, replyPackets)
+	}
+
+	m.previous = current
+}
+
+// counterDelta returns the growth between two readings of a tuple, treating
+// a reset (a reused tuple) as a fresh flow
+func counterDelta(cur, prev ConntrackTuple) (bytes, packets uint64) {
+	if cur.Bytes < prev.Bytes || cur.Packets < prev.Packets {
+		return cur.Bytes, cur.Packets
+	}
+	return cur.Bytes - prev.Bytes, cur.Packets - prev.Packets
+}
+
+// localAddrs caches this host's interface addresses
+type localAddrs struct {
+	addrs   map[netip.Addr]bool
+	updated time.Time
+	mu      sync.Mutex
+}
+
+func newLocalAddrs() *localAddrs {
+	return &localAddrs{}
+}
+
+func (l *localAddrs) contains(addr netip.Addr) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.updated) > time.Minute {
+		l.refresh()
+	}
+	return l.addrs[addr]
+}
+
+func (l *localAddrs) refresh() {
+	l.updated = time.Now()
+	l.addrs = make(map[netip.Addr]bool)
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		slog.Warn("Failed to list interface addresses", "component", "traffic", "error", err)
+		return
+	}
+	for _, a := range ifaceAddrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			if addr, ok := netip.AddrFromSlice(ipnet.IP); ok {
+				l.addrs[addr.Unmap()] = true
+			}
+		}
+	}
+}
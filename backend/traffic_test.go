@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testLocalAddrs stands in for this host's interface addresses
+func testLocalAddrs(addrs ...string) *localAddrs {
+	l := &localAddrs{addrs: make(map[netip.Addr]bool), updated: time.Now().Add(time.Hour)}
+	for _, a := range addrs {
+		l.addrs[netip.MustParseAddr(a)] = true
+	}
+	return l
+}
+
+func TestTrafficCounterStats(t *testing.T) {
+	base := time.Unix(1_800_000_000, 0)
+	var c trafficCounter
+	// The packet at 55s reuses the bucket of the one a minute before it
+	c.add(base.Add(-5*time.Second), true, 100, 1)
+	c.add(base.Add(30*time.Second), true, 6000, 6)
+	c.add(base.Add(55*time.Second), false, 500, 1)
+	c.add(base.Add(59*time.Second), true, 1000, 2)
+
+	got := c.stats(base.Add(59 * time.Second))
+	want := &TrafficStats{
+		BytesIn:    7100,
+		BytesOut:   500,
+		PacketsIn:  9,
+		PacketsOut: 1,
+		// The last 10s: the packets at 55s and 59s
+		RateIn:     100,
+		RateOut:    50,
+		PacketRate: 0.3,
+		// The last minute no longer covers the packet at -5s
+		RateIn1m:  7000.0 / 60,
+		RateOut1m: 500.0 / 60,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("stats:\n got %+v\nwant %+v", got, want)
+	}
+	if !c.lastSeen.Equal(base.Add(59 * time.Second)) {
+		t.Errorf("lastSeen = %v", c.lastSeen)
+	}
+
+	// Rates fall to zero once the traffic is older than the windows
+	later := c.stats(base.Add(10 * time.Minute))
+	if later.RateIn != 0 || later.RateOut1m != 0 || later.PacketRate != 0 || later.BytesIn != 7100 {
+		t.Errorf("stats ten minutes later: %+v", later)
+	}
+}
+
+func TestTrafficMeterClassify(t *testing.T) {
+	m := NewTrafficMeter()
+	m.local = testLocalAddrs("192.0.2.10", "2001:db8::10")
+
+	tests := []struct {
+		src, dst string
+		localID  string
+		remote   string
+		inbound  bool
+		ok       bool
+	}{
+		{"192.0.2.10", "203.0.113.5", "local", "203.0.113.5", false, true},
+		{"203.0.113.5", "192.0.2.10", "local", "203.0.113.5", true, true},
+		{"2001:db8::10", "2606:4700::1111", "local", "2606:4700::1111", false, true},
+		// Forwarded by a gateway: the private host is the local side
+		{"192.168.1.50", "140.82.112.5", "192.168.1.50", "140.82.112.5", false, true},
+		{"140.82.112.5", "192.168.1.50", "192.168.1.50", "140.82.112.5", true, true},
+		// This host talking to a LAN host is still this host's traffic
+		{"192.0.2.10", "192.168.1.50", "local", "192.168.1.50", false, true},
+		{"192.168.1.50", "192.168.1.51", "", "", false, false},
+		{"203.0.113.5", "198.51.100.1", "", "", false, false},
+		{"192.0.2.10", "2001:db8::10", "", "", false, false},
+	}
+	for _, tt := range tests {
+		localID, remote, inbound, ok := m.classify(netip.MustParseAddr(tt.src), netip.MustParseAddr(tt.dst))
+		if ok != tt.ok {
+			t.Errorf("classify(%s, %s) ok = %v, want %v", tt.src, tt.dst, ok, tt.ok)
+			continue
+		}
+		if ok && (localID != tt.localID || remote.String() != tt.remote || inbound != tt.inbound) {
+			t.Errorf("classify(%s, %s) = %s, %s, inbound %v; want %s, %s, inbound %v",
+				tt.src, tt.dst, localID, remote, inbound, tt.localID, tt.remote, tt.inbound)
+		}
+	}
+}
+
+func TestTrafficMeterPackets(t *testing.T) {
+	m := NewTrafficMeter()
+	m.Replay = true
+	m.local = testLocalAddrs("192.0.2.10")
+	start := time.Unix(1_800_000_000, 0)
+
+	packet := func(at int, src, dst string, length int) {
+		m.HandlePacket(&Packet{Timestamp: start.Add(time.Duration(at) * time.Second),
+			SrcIP: netip.MustParseAddr(src), DstIP: netip.MustParseAddr(dst), Length: length})
+	}
+	packet(0, "192.0.2.10", "203.0.113.5", 400)
+	packet(1, "203.0.113.5", "192.0.2.10", 1500)
+	packet(2, "192.168.1.50", "203.0.113.5", 200)
+	packet(3, "198.51.100.1", "192.0.2.10", 100)
+	packet(4, "203.0.113.1", "198.51.100.2", 9999) // not ours
+
+	// The peer's counters cover every local side talking to it
+	if got := m.Remote("203.0.113.5"); got.BytesIn != 1500 || got.BytesOut != 600 || got.PacketsOut != 2 {
+		t.Errorf("remote 203.0.113.5 = %+v", got)
+	}
+	if got := m.Edge("local", "203.0.113.5"); got.BytesIn != 1500 || got.BytesOut != 400 {
+		t.Errorf("edge from local = %+v", got)
+	}
+	if got := m.Edge("192.168.1.50", "203.0.113.5"); got.BytesOut != 200 || got.BytesIn != 0 {
+		t.Errorf("edge from the LAN host = %+v", got)
+	}
+	if m.Remote("198.51.100.2") != nil || m.Edge("local", "198.51.100.9") != nil {
+		t.Error("counters for a peer never seen")
+	}
+	// Replayed rates are against the newest packet, not the wall clock
+	if got := m.Remote("198.51.100.1"); got.RateIn != 10 {
+		t.Errorf("replayed rate = %v, want 10", got.RateIn)
+	}
+
+	var ips []string
+	for _, talker := range m.TopTalkers(2) {
+		ips = append(ips, talker.IP)
+	}
+	if want := []string{"203.0.113.5", "198.51.100.1"}; !reflect.DeepEqual(ips, want) {
+		t.Errorf("top talkers %q, want %q", ips, want)
+	}
+	if n := len(m.TopTalkers(0)); n != 2 {
+		t.Errorf("%d talkers without a limit, want 2", n)
+	}
+
+	// Idle peers and edges are dropped
+	m.Add(start.Add(trafficIdleTTL+5*time.Second), "local", "198.51.100.1", true, 1, 1)
+	m.Expire()
+	if len(m.remotes) != 1 || len(m.edges) != 1 || m.Remote("198.51.100.1") == nil {
+		t.Errorf("after Expire: %d remotes, %d edges", len(m.remotes), len(m.edges))
+	}
+}
+
+func TestTrafficMeterConntrackDeltas(t *testing.T) {
+	m := NewTrafficMeter()
+	m.local = testLocalAddrs("203.0.113.7")
+	read := func(name string) []ConntrackEntry {
+		entries, err := ReadConntrack(filepath.Join("testdata", "traffic", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+
+	// The first read is only a baseline
+	m.addConntrackDeltas(read("nf_conntrack.1"))
+	if len(m.remotes) != 0 {
+		t.Fatalf("traffic counted from the first read: %v", m.remotes)
+	}
+	m.addConntrackDeltas(read("nf_conntrack.2"))
+
+	tests := []struct {
+		from, to string
+		want     TrafficStats
+	}{
+		{"192.168.1.50", "140.82.112.5", TrafficStats{BytesOut: 1000, PacketsOut: 5, BytesIn: 4000, PacketsIn: 4}},
+		// Counters that went down belong to a reused tuple, a new flow
+		{"192.168.1.51", "93.184.215.14", TrafficStats{BytesOut: 40, PacketsOut: 1, BytesIn: 60, PacketsIn: 1}},
+		// A flow first seen now counts in full
+		{"192.168.1.52", "1.1.1.1", TrafficStats{BytesOut: 70, PacketsOut: 1, BytesIn: 130, PacketsIn: 1}},
+		// DNAT to an internal server: the client's direction is inbound
+		{"192.168.1.60", "198.51.100.20", TrafficStats{BytesIn: 200, PacketsIn: 2, BytesOut: 600, PacketsOut: 3}},
+	}
+	for _, tt := range tests {
+		got := m.Edge(tt.from, tt.to)
+		if got == nil {
+			t.Errorf("%s > %s: no traffic", tt.from, tt.to)
+			continue
+		}
+		got = &TrafficStats{BytesIn: got.BytesIn, BytesOut: got.BytesOut, PacketsIn: got.PacketsIn, PacketsOut: got.PacketsOut}
+		if *got != tt.want {
+			t.Errorf("%s > %s = %+v, want %+v", tt.from, tt.to, *got, tt.want)
+		}
+	}
+	// A flow whose counters didn't move adds nothing
+	if m.Remote("203.0.113.99") != nil {
+		t.Error("idle flow counted")
+	}
+	if len(m.remotes) != len(tests) {
+		t.Errorf("%d remotes, want %d", len(m.remotes), len(tests))
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"math/bits"
+	"net/netip"
+)
+
+// PrefixTrie maps IP prefixes to values and finds the longest prefix that
+// contains an address. It is a path-compressed binary radix tree, one per
+// address family, so a lookup visits at most one node per distinct prefix
+// length on the way down.
+type PrefixTrie[T any] struct {
+	v4, v6 *trieNode[T]
+	size   int
+}
+
+type trieNode[T any] struct {
+	prefix netip.Prefix // masked
+	value  T
+	set    bool // false for branch points that hold no prefix of their own
+	child  [2]*trieNode[T]
+}
+
+// Insert adds or replaces the value for a prefix
+func (t *PrefixTrie[T]) Insert(prefix netip.Prefix, value T) {
+	prefix = normalizePrefix(prefix)
+	if !prefix.IsValid() {
+		return
+	}
+	n := &t.v4
+	if prefix.Addr().Is6() {
+		n = &t.v6
+	}
+	for {
+		node := *n
+		if node == nil {
+			*n = &trieNode[T]{prefix: prefix, value: value, set: true}
+			t.size++
+			return
+		}
+		common := commonPrefixLen(node.prefix, prefix)
+		if common == node.prefix.Bits() && common == prefix.Bits() {
+			if !node.set {
+				t.size++
+			}
+			node.value, node.set = value, true
+			return
+		}
+		if common == node.prefix.Bits() {
+			// node contains prefix
+			n = &node.child[addrBit(prefix.Addr(), common)]
+			continue
+		}
+
+		// Split: a new node at the bits both share becomes the parent
+		parent := &trieNode[T]{prefix: netip.PrefixFrom(prefix.Addr(), common).Masked()}
+		parent.child[addrBit(node.prefix.Addr(), common)] = node
+		if common == prefix.Bits() {
+			parent.value, parent.set = value, true
+		} else {
+			parent.child[addrBit(prefix.Addr(), common)] = &trieNode[T]{prefix: prefix, value: value, set: true}
+		}
+		*n = parent
+		t.size++
+		return
+	}
+}
+
+// Get returns the value stored for exactly this prefix
+func (t *PrefixTrie[T]) Get(prefix netip.Prefix) (T, bool) {
+	prefix = normalizePrefix(prefix)
+	n := t.v4
+	if prefix.Addr().Is6() {
+		n = t.v6
+	}
+	for n != nil && n.prefix.Bits() <= prefix.Bits() && n.prefix.Contains(prefix.Addr()) {
+		if n.prefix.Bits() == prefix.Bits() {
+			return n.value, n.set
+		}
+		n = n.child[addrBit(prefix.Addr(), n.prefix.Bits())]
+	}
+	var zero T
+	return zero, false
+}
+
+// Lookup returns the longest prefix containing addr and its value
+func (t *PrefixTrie[T]) Lookup(addr netip.Addr) (netip.Prefix, T, bool) {
+	addr = addr.Unmap()
+	n := t.v4
+	if addr.Is6() {
+		n = t.v6
+	}
+	var best *trieNode[T]
+	for n != nil && n.prefix.Contains(addr) {
+		if n.set {
+			best = n
+		}
+		if n.prefix.Bits() == addr.BitLen() {
+			break
+		}
+		n = n.child[addrBit(addr, n.prefix.Bits())]
+	}
+	if best == nil {
+		var zero T
+		return netip.Prefix{}, zero, false
+	}
+	return best.prefix, best.value, true
+}
+
+// Len is the number of prefixes stored
+func (t *PrefixTrie[T]) Len() int {
+	return t.size
+}
+
+// normalizePrefix masks a prefix and stores IPv4-mapped IPv6 prefixes as
+// IPv4
+func normalizePrefix(p netip.Prefix) netip.Prefix {
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p.Masked()
+}
+
+// addrBit returns bit i of addr, counting from the most significant
+func addrBit(addr netip.Addr, i int) int {
+	var b byte
+	if addr.Is4() {
+		a := addr.As4()
+		b = a[i/8]
+	} else {
+		a := addr.As16()
+		b = a[i/8]
+	}
+	return int(b>>(7-i%8)) & 1
+}
+
+// commonPrefixLen counts the leading bits two prefixes of the same family
+// share, up to the shorter one's length
+func commonPrefixLen(a, b netip.Prefix) int {
+	x, y := a.Addr().As16(), b.Addr().As16()
+	start := 0
+	if a.Addr().Is4() {
+		start = 12 // As16 holds IPv4 in the last four bytes
+	}
+	n := 0
+	for i := start; i < 16; i++ {
+		if d := x[i] ^ y[i]; d != 0 {
+			n += bits.LeadingZeros8(d)
+			break
+		}
+		n += 8
+	}
+	return min(n, a.Bits(), b.Bits())
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+)
+
+func TestPrefixTrieLongestMatch(t *testing.T) {
+	var trie PrefixTrie[string]
+	for _, p := range []string{"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.2.3/32", "2001:db8::/32", "2001:db8:1::/48"} {
+		trie.Insert(netip.MustParsePrefix(p), p)
+	}
+	tests := []struct{ addr, want string }{
+		{"10.1.2.3", "10.1.2.3/32"},
+		{"10.1.2.4", "10.1.2.0/24"},
+		{"10.1.3.1", "10.1.0.0/16"},
+		{"10.200.0.1", "10.0.0.0/8"},
+		{"192.0.2.1", "0.0.0.0/0"},
+		{"2001:db8:1::5", "2001:db8:1::/48"},
+		{"2001:db8:2::5", "2001:db8::/32"},
+		{"2001:db9::1", ""},
+		// IPv4-mapped addresses are looked up as IPv4
+		{"::ffff:10.1.2.4", "10.1.2.0/24"},
+	}
+	for _, tt := range tests {
+		prefix, value, ok := trie.Lookup(netip.MustParseAddr(tt.addr))
+		if tt.want == "" {
+			if ok {
+				t.Errorf("Lookup(%s) = %s, want no match", tt.addr, prefix)
+			}
+			continue
+		}
+		if !ok || value != tt.want || prefix.String() != tt.want {
+			t.Errorf("Lookup(%s) = %s %q %v, want %s", tt.addr, prefix, value, ok, tt.want)
+		}
+	}
+}
+
+func TestPrefixTrieSplitAndOverwrite(t *testing.T) {
+	var trie PrefixTrie[int]
+	// Siblings share 14 bits, so a branch point without a value joins them
+	trie.Insert(netip.MustParsePrefix("10.1.0.0/16"), 1)
+	trie.Insert(netip.MustParsePrefix("10.2.0.0/16"), 2)
+	if trie.Len() != 2 {
+		t.Errorf("Len = %d after two prefixes, want 2", trie.Len())
+	}
+	if _, _, ok := trie.Lookup(netip.MustParseAddr("10.3.0.1")); ok {
+		t.Error("the branch point matched an address")
+	}
+	if _, ok := trie.Get(netip.MustParsePrefix("10.0.0.0/14")); ok {
+		t.Error("Get returned the branch point")
+	}
+
+	// Setting the branch point's own prefix counts it once
+	trie.Insert(netip.MustParsePrefix("10.0.0.0/14"), 14)
+	if prefix, v, ok := trie.Lookup(netip.MustParseAddr("10.3.0.1")); !ok || v != 14 || prefix.Bits() != 14 {
+		t.Errorf("Lookup after filling the branch = %s %d %v", prefix, v, ok)
+	}
+
+	// Overwriting keeps the count; unmasked and mapped forms are the same prefix
+	trie.Insert(netip.MustParsePrefix("10.1.7.7/16"), 10)
+	trie.Insert(netip.MustParsePrefix("::ffff:10.2.0.0/112"), 20)
+	if trie.Len() != 3 {
+		t.Errorf("Len = %d after overwrites, want 3", trie.Len())
+	}
+	for p, want := range map[string]int{"10.1.0.0/16": 10, "10.2.0.0/16": 20, "10.0.0.0/14": 14} {
+		if v, ok := trie.Get(netip.MustParsePrefix(p)); !ok || v != want {
+			t.Errorf("Get(%s) = %d, %v; want %d", p, v, ok, want)
+		}
+	}
+
+	// A shorter prefix above existing ones becomes their parent
+	trie.Insert(netip.MustParsePrefix("8.0.0.0/5"), 5)
+	if _, v, _ := trie.Lookup(netip.MustParseAddr("12.0.0.1")); v != 5 {
+		t.Errorf("Lookup(12.0.0.1) = %d, want 5", v)
+	}
+	if _, v, _ := trie.Lookup(netip.MustParseAddr("10.1.0.1")); v != 10 {
+		t.Errorf("Lookup(10.1.0.1) = %d, want 10", v)
+	}
+}
+
+// TestPrefixTrieRandom compares lookups with a linear scan
+func TestPrefixTrieRandom(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	var trie PrefixTrie[netip.Prefix]
+	var prefixes []netip.Prefix
+	for range 500 {
+		// A narrow address range, so prefixes nest and share bits
+		a := [4]byte{10, byte(rng.IntN(4)), byte(rng.IntN(256)), byte(rng.IntN(256))}
+		p := netip.PrefixFrom(netip.AddrFrom4(a), 8+rng.IntN(25)).Masked()
+		trie.Insert(p, p)
+		prefixes = append(prefixes, p)
+	}
+	for range 2000 {
+		addr := netip.AddrFrom4([4]byte{10, byte(rng.IntN(4)), byte(rng.IntN(256)), byte(rng.IntN(256))})
+		var want netip.Prefix
+		for _, p := range prefixes {
+			if p.Contains(addr) && (!want.IsValid() || p.Bits() > want.Bits()) {
+				want = p
+			}
+		}
+		got, value, ok := trie.Lookup(addr)
+		if ok != want.IsValid() || got != want || (ok && value != want) {
+			t.Fatalf("Lookup(%s) = %s %v, want %s", addr, got, ok, want)
+		}
+	}
+}
@@ -1,15 +1,29 @@
 package main
 
-import "time"
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // Connection represents a network connection
 type Connection struct {
-	LocalIP    string `json:"localIp"`
-	LocalPort  int    `json:"localPort"`
-	RemoteIP   string `json:"remoteIp"`
-	RemotePort int    `json:"remotePort"`
-	State      string `json:"state"`
-	Process    string `json:"process,omitempty"`
+	LocalIP    string       `json:"localIp"`
+	LocalPort  int          `json:"localPort"`
+	RemoteIP   string       `json:"remoteIp"`
+	RemotePort int          `json:"remotePort"`
+	State      string       `json:"state"`
+	Process    string       `json:"process,omitempty"`
+	PID        int          `json:"pid,omitempty"`
+	Unit       string       `json:"unit,omitempty"`    // systemd service owning the process
+	Netns      string       `json:"netns,omitempty"`   // network namespace the socket is in, when collected per namespace
+	Origin     string       `json:"origin,omitempty"`  // node ID of the local side, empty for this host
+	Target     string       `json:"target,omitempty"`  // node ID of the remote side when it is an internal node
+	NATIP      string       `json:"natIp,omitempty"`   // translated source address seen by the remote
+	NATPort    int          `json:"natPort,omitempty"` // translated source port
+	Service    *ServiceInfo `json:"service,omitempty"` // from passive capture
 }
 
 // Location represents geographic coordinates
@@ -20,38 +34,100 @@ type Location struct {
 
 // NetworkNode represents a discovered network endpoint
 type NetworkNode struct {
-	ID          string    `json:"id"`
-	Name        string    `json:"name"`
-	IPAddress   string    `json:"ipAddress"`
-	Type        string    `json:"type"`
-	Location    Location  `json:"location"`
-	Owner       string    `json:"owner,omitempty"`
-	ASN         string    `json:"asn,omitempty"`
-	Status      string    `json:"status"`
-	Connections int       `json:"connections"`
-	Process     string    `json:"process,omitempty"`
-	FirstSeen   time.Time `json:"firstSeen"`
-	LastSeen    time.Time `json:"lastSeen"`
+	ID           string         `json:"id"`
+	Name         string         `json:"name"`
+	IPAddress    string         `json:"ipAddress"`
+	Type         string         `json:"type"`
+	Location     Location       `json:"location"`
+	Country      string         `json:"country,omitempty"` // ISO country code from GeoIP
+	City         string         `json:"city,omitempty"`
+	Owner        string         `json:"owner,omitempty"`
+	Hostname     string         `json:"hostname,omitempty"` // reverse DNS name
+	DNSNames     []string       `json:"dnsNames,omitempty"` // forward names seen resolving to this IP
+	ASN          string         `json:"asn,omitempty"`
+	Routing      *RoutingInfo   `json:"routing,omitempty"`      // announced prefix and origin AS from offline routing data
+	Cloud        *CloudInfo     `json:"cloud,omitempty"`        // published cloud/CDN range the address is in
+	SecurityZone string         `json:"securityZone,omitempty"` // zone from NETOPS_ZONES rules
+	Status       string         `json:"status"`
+	Internal     bool           `json:"internal,omitempty"` // a host inside the monitored network
+	Agent        string         `json:"agent,omitempty"`    // ID of the agent reporting this host
+	Hop          bool           `json:"hop,omitempty"`      // a router found by traceroute
+	Group        *GroupInfo     `json:"group,omitempty"`    // set on nodes standing in for a group
+	Connections  int            `json:"connections"`
+	Traffic      *TrafficStats  `json:"traffic,omitempty"` // bytes/packets to and from this peer
+	Health       *NodeHealth    `json:"health,omitempty"`  // latest latency/loss probe round
+	Process      string         `json:"process,omitempty"`
+	Processes    []string       `json:"processes,omitempty"`   // local applications talking to this peer
+	Unit         string         `json:"unit,omitempty"`        // systemd service of a process node
+	PIDs         []int          `json:"pids,omitempty"`        // running processes of a process node
+	Netns        string         `json:"netns,omitempty"`       // network namespace of a namespace node
+	Container    *ContainerInfo `json:"container,omitempty"`   // runtime and Kubernetes details of a container node
+	Reputation   int            `json:"reputation,omitempty"`  // threat intel score, 0-100
+	ThreatFeeds  []string       `json:"threatFeeds,omitempty"` // names of feeds listing this IP
+	FirstSeen    time.Time      `json:"firstSeen"`
+	LastSeen     time.Time      `json:"lastSeen"`
+
+	preCloudType    string // Type before ApplyCloud reclassified the node
+	preRoutingASN   string // ASN before ApplyRouting replaced it
+	preRoutingOwner string // Owner before ApplyRouting filled it in
 }
 
 // WSMessage represents a WebSocket message
 type WSMessage struct {
 	Type        string         `json:"type"`
+	Seq         uint64         `json:"seq,omitempty"` // event number, for resuming
 	Node        *NetworkNode   `json:"node,omitempty"`
 	Nodes       []*NetworkNode `json:"nodes,omitempty"`
 	Connections []WSConnection `json:"connections,omitempty"`
+	Added       []WSConnection `json:"added,omitempty"`   // connections_delta: new or changed edges
+	Removed     []WSConnection `json:"removed,omitempty"` // connections_delta: edges that went away
+	Checksum    string         `json:"checksum,omitempty"`
 	ID          string         `json:"id,omitempty"`
+	Alert       *Alert         `json:"alert,omitempty"`
+	Anomaly     *Anomaly       `json:"anomaly,omitempty"`
+	RequestID   string         `json:"requestId,omitempty"` // echoes the client request being answered
+	Error       string         `json:"error,omitempty"`
 }
 
 // WSConnection represents a connection relationship
 type WSConnection struct {
-	From string `json:"from"` // node id
-	To   string `json:"to"`   // node id
+	From    string        `json:"from"`              // node id
+	To      string        `json:"to"`                // node id
+	Service *ServiceInfo  `json:"service,omitempty"` // SNI, ALPN, fingerprints, HTTP hosts
+	Traffic *TrafficStats `json:"traffic,omitempty"` // throughput along this edge
+	Latency float64       `json:"latency,omitempty"` // traced round trip to the far end, ms
+	// Zone policy rule the edge breaks, as "from → to"
+	Violation string `json:"violation,omitempty"`
+}
+
+// Alert is a security event raised against a node
+type Alert struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	NodeID    string    `json:"nodeId"`
+	Severity  string    `json:"severity"` // low, medium, high, critical
+	Message   string    `json:"message"`
+}
+
+var alertSeq atomic.Uint64
+
+// NewAlert creates an alert with a unique ID
+func NewAlert(alertType, nodeID, severity, message string) *Alert {
+	return &Alert{
+		ID:        fmt.Sprintf("%s-%d", alertType, alertSeq.Add(1)),
+		Type:      alertType,
+		Timestamp: time.Now(),
+		NodeID:    nodeID,
+		Severity:  severity,
+		Message:   message,
+	}
 }
 
 // NodeStore manages active nodes
 type NodeStore struct {
 	Nodes map[string]*NetworkNode
+	mu    sync.RWMutex
 }
 
 func NewNodeStore() *NodeStore {
@@ -60,8 +136,37 @@ func NewNodeStore() *NodeStore {
 	}
 }
 
+// Get returns a copy of one node, or nil
+func (s *NodeStore) Get(id string) *NetworkNode {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if node, ok := s.Nodes[id]; ok {
+		n := *node
+		return &n
+	}
+	return nil
+}
+
+// Snapshot returns copies of all nodes, safe to serialize outside the lock
+func (s *NodeStore) Snapshot() []*NetworkNode {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	nodes := make([]*NetworkNode, 0, len(s.Nodes))
+	for _, node := range s.Nodes {
+		n := *node
+		nodes = append(nodes, &n)
+	}
+	return nodes
+}
+
 // LogMessage represents a log entry to be sent to clients
 type LogMessage struct {
-	Level   string `json:"level"`   // info, warn, error
-	Message string `json:"message"` // log message
+	Seq       uint64         `json:"seq,omitempty"` // increasing number, 0 for messages that aren't kept
+	Time      time.Time      `json:"time"`
+	Level     string         `json:"level"`   // debug, info, warn, error
+	Message   string         `json:"message"` // log message
+	Component string         `json:"component,omitempty"`
+	Fields    map[string]any `json:"fields,omitempty"` // ip, node_id, duration, ...
+
+	level slog.Level
 }
@@ -1,76 +1,567 @@
 package main
 
 import (
-	"log"
+	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for development
-	},
-}
+// Each /ws client has its own send queue and writer goroutine, so a slow
+// reader never holds up the hub or the other clients. A client whose queue
+// fills up is disconnected; it can resume when it reconnects.
+const (
+	wsClientBuffer = 256 // messages queued per client
+	wsWriteTimeout = 10 * time.Second
+)
+
+var (
+	errSlowClient   = errors.New("client is too slow, send queue full")
+	errClientClosed = errors.New("client connection closed")
+)
 
-// WSHub manages WebSocket connections
+// upgrader only accepts same-origin browsers until main installs
+// Auth.CheckOrigin
+var upgrader = websocket.Upgrader{}
+
+// WSHub manages WebSocket connections. Every broadcast event is numbered
+// and kept in a ring buffer so reconnecting clients can resume where they
+// left off.
 type WSHub struct {
-	clients    map[*websocket.Conn]bool
+	clients    map[*wsClient]bool
 	broadcast  chan WSMessage
-	register   chan *websocket.Conn
-	unregister chan *websocket.Conn
+	register   chan *wsClient
+	unregister chan *wsClient
+	seq        uint64         // number of the last event
+	ring       *eventRing     // recent events for resuming clients
+	edges      []WSConnection // current edges, for snapshots
 	mu         sync.RWMutex
 }
 
-func NewWSHub() *WSHub {
+// NewWSHub creates a hub that buffers the last backlog events
+func NewWSHub(backlog int) *WSHub {
 	return &WSHub{
-		clients:    make(map[*websocket.Conn]bool),
+		clients:    make(map[*wsClient]bool),
 		broadcast:  make(chan WSMessage, 256),
-		register:   make(chan *websocket.Conn),
-		unregister: make(chan *websocket.Conn),
+		register:   make(chan *wsClient),
+		unregister: make(chan *wsClient),
+		seq:        firstSeq() - 1,
+		ring:       newEventRing(backlog),
 	}
 }
 
 // Run starts the WebSocket hub
 func (h *WSHub) Run() {
+	checksums := time.NewTicker(wsChecksumInterval)
+	defer checksums.Stop()
+
 	for {
 		select {
 		case client := <-h.register:
 			h.mu.Lock()
 			h.clients[client] = true
 			h.mu.Unlock()
-			log.Printf("Client connected. Total clients: %d", len(h.clients))
+			slog.Info("Client connected", "component", "ws", "clients", len(h.clients))
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				client.Close()
-			}
+			delete(h.clients, client)
 			h.mu.Unlock()
-			log.Printf("Client disconnected. Total clients: %d", len(h.clients))
+			client.close()
+			slog.Info("Client disconnected", "component", "ws", "clients", len(h.clients))
 
 		case message := <-h.broadcast:
-			h.mu.RLock()
-			for client := range h.clients {
-				err := client.WriteJSON(message)
-				if err != nil {
-					log.Printf("Error sending to client: %v", err)
-					client.Close()
-					delete(h.clients, client)
-				}
+			h.mu.Lock()
+			h.seq++
+			message.Seq = h.seq
+			buffered := message
+			if message.Type == "connections_update" {
+				h.edges = message.Connections
+				// Resumed clients get an edge snapshot instead
+				buffered.Connections = nil
+			}
+			h.ring.add(buffered)
+			h.fanOut(func(c *wsClient) error { return c.deliver(message) })
+			h.mu.Unlock()
+
+		case <-checksums.C:
+			h.mu.Lock()
+			seq := h.seq
+			h.fanOut(func(c *wsClient) error { return c.sendChecksum(seq) })
+			h.mu.Unlock()
+		}
+	}
+}
+
+// fanOut queues a message for every client, dropping those that can't
+// take it; callers hold h.mu. Queueing never blocks.
+func (h *WSHub) fanOut(send func(*wsClient) error) {
+	for client := range h.clients {
+		if err := send(client); err != nil {
+			slog.Warn("Dropping WebSocket client", "component", "ws", "error", err)
+			client.close()
+			delete(h.clients, client)
+		}
+	}
+}
+
+// State returns the current edges and the number of the last event
+func (h *WSHub) State() ([]WSConnection, uint64) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.edges, h.seq
+}
+
+// Edges returns the current edges
+func (h *WSHub) Edges() []WSConnection {
+	edges, _ := h.State()
+	return edges
+}
+
+// Resume registers a client that has seen every event up to seq and sends
+// it the events it missed, then a snapshot of the edges. It reports false,
+// without registering the client, when those events are no longer
+// buffered and the client needs a full resync instead.
+func (h *WSHub) Resume(client *wsClient, store *NodeStore, seq uint64) bool {
+	nodes := store.Snapshot()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var missed []WSMessage
+	if seq != h.seq {
+		var ok bool
+		if missed, ok = h.ring.since(seq); !ok {
+			return false
+		}
+	}
+
+	// The client has the matching nodes, plus any the missed events touch
+	client.mu.Lock()
+	for _, node := range nodes {
+		if client.filter.Matches(node) {
+			client.visible[node.ID] = true
+		}
+	}
+	for _, msg := range missed {
+		if msg.Node != nil {
+			client.visible[msg.Node.ID] = true
+		} else if msg.Type == "node_remove" {
+			client.visible[msg.ID] = true
+		}
+	}
+	err := client.write(WSMessage{Type: "resumed", Seq: seq})
+	client.mu.Unlock()
+
+	for _, msg := range missed {
+		if err != nil {
+			break
+		}
+		if msg.Type != "connections_update" {
+			err = client.deliver(msg)
+		}
+	}
+	if err == nil {
+		err = client.sendEdges(h.edges, h.seq, "")
+	}
+	if err != nil {
+		client.close()
+		return true
+	}
+	h.clients[client] = true
+	slog.Info("Client resumed", "component", "ws", "missed", len(missed), "clients", len(h.clients))
+	return true
+}
+
+// wsClient is a /ws connection with its subscription. The hub only sends
+// it the nodes matching its filter, and tracks which nodes and edges it has
+// been sent so it can be sent only the changes.
+type wsClient struct {
+	conn       *websocket.Conn
+	msgpack    bool // negotiated the netops.msgpack subprotocol
+	send       chan []byte
+	closed     bool
+	filter     *NodeFilter
+	grouping   *Grouping // nil while nodes are sent individually
+	subscribed bool
+	visible    map[string]bool          // node IDs the client currently has
+	edges      map[edgeKey]WSConnection // edges the client currently has
+	mu         sync.Mutex               // guards the fields above and the send queue
+}
+
+// newWSClient wraps a connection and starts its writer
+func newWSClient(conn *websocket.Conn, msgpack bool) *wsClient {
+	c := &wsClient{
+		conn:       conn,
+		msgpack:    msgpack,
+		send:       make(chan []byte, wsClientBuffer),
+		subscribed: true,
+		visible:    make(map[string]bool),
+		edges:      make(map[edgeKey]WSConnection),
+	}
+	go c.writePump()
+	return c
+}
+
+// write encodes a message in the client's negotiated encoding and queues
+// it without blocking; callers hold c.mu
+func (c *wsClient) write(v any) error {
+	if c.closed {
+		return errClientClosed
+	}
+	var data []byte
+	var err error
+	if c.msgpack {
+		data, err = MarshalMsgpack(v)
+	} else {
+		data, err = json.Marshal(v)
+	}
+	if err != nil {
+		return err
+	}
+	select {
+	case c.send <- data:
+		return nil
+	default:
+		return errSlowClient
+	}
+}
+
+// writePump is the only writer of c.conn. It sends queued messages until
+// the queue is closed or a write fails, then closes the connection.
+func (c *wsClient) writePump() {
+	defer c.conn.Close()
+	kind := websocket.TextMessage
+	if c.msgpack {
+		kind = websocket.BinaryMessage
+	}
+	for data := range c.send {
+		c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if err := c.conn.WriteMessage(kind, data); err != nil {
+			return
+		}
+	}
+}
+
+// close stops the client: the writer sends what is already queued and
+// closes the connection. It is safe to call more than once.
+func (c *wsClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
+// deliver sends a broadcast event as far as the subscription allows.
+// Edge updates become connections_delta messages with only the edges
+// that were added, changed or removed.
+func (c *wsClient) deliver(msg WSMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.subscribed {
+		return nil
+	}
+	if c.grouping != nil && (msg.Type == "node_add" || msg.Type == "node_update" || msg.Type == "node_remove") {
+		return c.deliverGrouped(msg)
+	}
+
+	switch msg.Type {
+	case "node_add", "node_update":
+		id := msg.Node.ID
+		if !c.filter.Matches(msg.Node) {
+			if !c.visible[id] {
+				return nil
 			}
-			h.mu.RUnlock()
+			delete(c.visible, id)
+			return c.write(WSMessage{Type: "node_remove", Seq: msg.Seq, ID: id})
+		}
+		if !c.visible[id] {
+			// New to this client, e.g. a node that now matches its filter
+			c.visible[id] = true
+			msg.Type = "node_add"
+		}
+	case "node_remove":
+		if !c.visible[msg.ID] {
+			return nil
+		}
+		delete(c.visible, msg.ID)
+	case "connections_update":
+		added, removed, next := diffEdges(c.edges, c.visibleEdges(msg.Connections))
+		c.edges = next
+		if len(added) == 0 && len(removed) == 0 {
+			return nil
+		}
+		return c.write(WSMessage{Type: "connections_delta", Seq: msg.Seq, Added: added, Removed: removed})
+	case "alert":
+		if msg.Alert.NodeID != "" && c.grouping != nil {
+			// Point the alert at the group the node is shown in
+			alert := *msg.Alert
+			alert.NodeID = c.grouping.ShownAs(alert.NodeID)
+			msg.Alert = &alert
+		}
+		if msg.Alert.NodeID != "" && !c.visible[msg.Alert.NodeID] {
+			return nil
+		}
+	case "anomaly":
+		if c.grouping != nil {
+			anomaly := *msg.Anomaly
+			anomaly.NodeID = c.grouping.ShownAs(anomaly.NodeID)
+			msg.Anomaly = &anomaly
+		}
+		if !c.visible[msg.Anomaly.NodeID] {
+			return nil
 		}
 	}
+	return c.write(msg)
+}
+
+// deliverGrouped passes a node event through the client's grouping: the
+// node itself is sent when it is shown on its own, and the groups it left
+// or joined are updated; callers hold c.mu
+func (c *wsClient) deliverGrouped(msg WSMessage) error {
+	id, node := msg.ID, msg.Node
+	if node != nil {
+		id = node.ID
+		if !c.filter.Matches(node) {
+			node = nil
+		}
+	}
+	before, after := c.grouping.Set(id, node)
+
+	if after == id {
+		msg.Type = "node_update"
+		if !c.visible[id] {
+			c.visible[id] = true
+			msg.Type = "node_add"
+		}
+		if err := c.write(WSMessage{Type: msg.Type, Seq: msg.Seq, Node: node}); err != nil {
+			return err
+		}
+	} else if c.visible[id] {
+		delete(c.visible, id)
+		if err := c.write(WSMessage{Type: "node_remove", Seq: msg.Seq, ID: id}); err != nil {
+			return err
+		}
+	}
+
+	if before != "" && before != id {
+		if err := c.sendGroup(before, msg.Seq); err != nil {
+			return err
+		}
+	}
+	if after != "" && after != id && after != before {
+		return c.sendGroup(after, msg.Seq)
+	}
+	return nil
+}
+
+// sendGroup sends the current state of a group node; callers hold c.mu
+func (c *wsClient) sendGroup(id string, seq uint64) error {
+	group := c.grouping.Group(id)
+	if group == nil {
+		if !c.visible[id] {
+			return nil
+		}
+		delete(c.visible, id)
+		return c.write(WSMessage{Type: "node_remove", Seq: seq, ID: id})
+	}
+	kind := "node_update"
+	if !c.visible[id] {
+		c.visible[id] = true
+		kind = "node_add"
+	}
+	return c.write(WSMessage{Type: kind, Seq: seq, Node: group})
+}
+
+// visibleEdges keeps the edges whose ends the client has; callers hold c.mu
+func (c *wsClient) visibleEdges(edges []WSConnection) []WSConnection {
+	if c.grouping != nil {
+		edges = c.grouping.RollUpEdges(edges)
+	} else if c.filter == nil {
+		return edges
+	}
+	out := make([]WSConnection, 0, len(edges))
+	for _, edge := range edges {
+		if c.visible[edge.From] && c.visible[edge.To] {
+			out = append(out, edge)
+		}
+	}
+	return out
+}
+
+// sendEdges sends the client a full connections_update
+func (c *wsClient) sendEdges(edges []WSConnection, seq uint64, requestID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	visible := c.visibleEdges(edges)
+	_, _, c.edges = diffEdges(nil, visible)
+	return c.write(WSMessage{Type: "connections_update", Seq: seq, Connections: visible, RequestID: requestID})
+}
+
+// sendChecksum sends the checksum of the state the client should have
+func (c *wsClient) sendChecksum(seq uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.subscribed {
+		return nil
+	}
+	return c.write(WSMessage{Type: "checksum", Seq: seq, Checksum: stateChecksum(c.visible, c.edges)})
+}
+
+// resync sends the client every matching node, rolled up if it asked for
+// grouping, and the current edges
+func (c *wsClient) resync(store *NodeStore, hub *WSHub, requestID string) error {
+	// Snapshot before locking so the client is never locked while waiting
+	// for the hub or the store
+	edges, seq := hub.State()
+	nodes := store.Snapshot()
+
+	c.mu.Lock()
+	matched := make([]*NetworkNode, 0, len(nodes))
+	c.visible = make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		if c.filter.Matches(node) {
+			matched = append(matched, node)
+		}
+	}
+	if c.grouping != nil {
+		matched = c.grouping.Reset(matched)
+	}
+	for _, node := range matched {
+		c.visible[node.ID] = true
+	}
+
+	initialState := struct {
+		Type      string         `json:"type"`
+		Seq       uint64         `json:"seq"`
+		Nodes     []*NetworkNode `json:"nodes"`
+		RequestID string         `json:"requestId,omitempty"`
+	}{
+		Type:      "initial_state",
+		Seq:       seq,
+		Nodes:     matched,
+		RequestID: requestID,
+	}
+	err := c.write(initialState)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.sendEdges(edges, seq, requestID)
+}
+
+// reply answers a client request
+func (c *wsClient) reply(msg WSMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.write(msg)
+}
+
+// handleRequest acts on one message from the client
+func (c *wsClient) handleRequest(req *ClientRequest, hub *WSHub, store *NodeStore) error {
+	switch req.Type {
+	case "subscribe":
+		c.mu.Lock()
+		c.filter = req.Filter
+		c.subscribed = true
+		c.mu.Unlock()
+		return c.resync(store, hub, req.RequestID)
+
+	case "unsubscribe":
+		c.mu.Lock()
+		c.subscribed = false
+		c.visible = make(map[string]bool)
+		c.edges = make(map[edgeKey]WSConnection)
+		c.mu.Unlock()
+		return c.reply(WSMessage{Type: "unsubscribed", RequestID: req.RequestID})
+
+	case "resync":
+		return c.resync(store, hub, req.RequestID)
+
+	case "group":
+		c.mu.Lock()
+		switch {
+		case req.By == "" || req.By == "none":
+			c.grouping = nil
+		case validGroupBy(req.By):
+			c.grouping = NewGrouping(req.By)
+		default:
+			c.mu.Unlock()
+			return c.reply(WSMessage{Type: "error", RequestID: req.RequestID, Error: "unknown grouping " + req.By})
+		}
+		c.mu.Unlock()
+		return c.resync(store, hub, req.RequestID)
+
+	case "expand", "collapse":
+		c.mu.Lock()
+		if c.grouping == nil {
+			c.mu.Unlock()
+			return c.reply(WSMessage{Type: "error", RequestID: req.RequestID, Error: "nodes are not grouped"})
+		}
+		c.grouping.Expand(req.ID, req.Type == "expand")
+		c.mu.Unlock()
+		return c.resync(store, hub, req.RequestID)
+
+	case "node_detail":
+		if strings.HasPrefix(req.ID, groupIDPrefix) {
+			return c.groupDetail(req, hub)
+		}
+		node := store.Get(req.ID)
+		if node == nil {
+			return c.reply(WSMessage{Type: "error", RequestID: req.RequestID, Error: "unknown node " + req.ID})
+		}
+		var edges []WSConnection
+		for _, edge := range hub.Edges() {
+			if edge.From == req.ID || edge.To == req.ID {
+				edges = append(edges, edge)
+			}
+		}
+		return c.reply(WSMessage{Type: "node_detail", RequestID: req.RequestID, Node: node, Connections: edges})
+	}
+	return c.reply(WSMessage{Type: "error", RequestID: req.RequestID, Error: "unknown request type " + req.Type})
+}
+
+// groupDetail answers node_detail for a group with the group node, its
+// members and the edges touching them
+func (c *wsClient) groupDetail(req *ClientRequest, hub *WSHub) error {
+	c.mu.Lock()
+	var group *NetworkNode
+	var members []*NetworkNode
+	if c.grouping != nil {
+		group, members = c.grouping.Detail(req.ID)
+	}
+	c.mu.Unlock()
+	if group == nil {
+		return c.reply(WSMessage{Type: "error", RequestID: req.RequestID, Error: "unknown node " + req.ID})
+	}
+
+	ids := make(map[string]bool, len(members))
+	for _, member := range members {
+		ids[member.ID] = true
+	}
+	var edges []WSConnection
+	for _, edge := range hub.Edges() {
+		if ids[edge.From] || ids[edge.To] {
+			edges = append(edges, edge)
+		}
+	}
+	return c.reply(WSMessage{Type: "node_detail", RequestID: req.RequestID, Node: group, Nodes: members, Connections: edges})
 }
 
 // BroadcastNodeAdd sends node_add message
 func (h *WSHub) BroadcastNodeAdd(node *NetworkNode) {
 	h.broadcast <- WSMessage{
 		Type: "node_add",
-		Node: node,
+		Node: copyNode(node),
 	}
 }
 
@@ -78,7 +569,7 @@ func (h *WSHub) BroadcastNodeAdd(node *NetworkNode) {
 func (h *WSHub) BroadcastNodeUpdate(node *NetworkNode) {
 	h.broadcast <- WSMessage{
 		Type: "node_update",
-		Node: node,
+		Node: copyNode(node),
 	}
 }
 
@@ -98,145 +589,356 @@ func (h *WSHub) BroadcastConnectionUpdate(connections []WSConnection) {
 	}
 }
 
-// LogHub manages log streaming WebSocket connections
+// BroadcastAlert sends an alert message
+func (h *WSHub) BroadcastAlert(alert *Alert) {
+	h.broadcast <- WSMessage{
+		Type:  "alert",
+		Alert: alert,
+	}
+}
+
+// BroadcastAnomaly sends an anomaly message
+func (h *WSHub) BroadcastAnomaly(anomaly *Anomaly) {
+	h.broadcast <- WSMessage{
+		Type:    "anomaly",
+		Anomaly: anomaly,
+	}
+}
+
+// Broadcaster publishes events to WebSocket clients, either straight to the
+// WSHub or through an Outbox
+type Broadcaster interface {
+	BroadcastNodeAdd(node *NetworkNode)
+	BroadcastNodeUpdate(node *NetworkNode)
+	BroadcastNodeRemove(id string)
+	BroadcastAlert(alert *Alert)
+}
+
+// Outbox holds the broadcasts made while store.mu is held and sends them
+// once it has been released, so the store is never locked while waiting
+// for the hub. Nodes are copied as they are queued.
+type Outbox struct {
+	hub      *WSHub
+	messages []WSMessage
+}
+
+// NewOutbox creates an empty outbox for the hub
+func (h *WSHub) NewOutbox() *Outbox {
+	return &Outbox{hub: h}
+}
+
+// BroadcastNodeAdd queues a node_add message
+func (o *Outbox) BroadcastNodeAdd(node *NetworkNode) {
+	o.messages = append(o.messages, WSMessage{Type: "node_add", Node: copyNode(node)})
+}
+
+// BroadcastNodeUpdate queues a node_update message
+func (o *Outbox) BroadcastNodeUpdate(node *NetworkNode) {
+	o.messages = append(o.messages, WSMessage{Type: "node_update", Node: copyNode(node)})
+}
+
+// BroadcastNodeRemove queues a node_remove message
+func (o *Outbox) BroadcastNodeRemove(id string) {
+	o.messages = append(o.messages, WSMessage{Type: "node_remove", ID: id})
+}
+
+// BroadcastAlert queues an alert message
+func (o *Outbox) BroadcastAlert(alert *Alert) {
+	o.messages = append(o.messages, WSMessage{Type: "alert", Alert: alert})
+}
+
+// Flush sends the queued messages in order. Call it after releasing
+// store.mu.
+func (o *Outbox) Flush() {
+	for _, msg := range o.messages {
+		o.hub.broadcast <- msg
+	}
+	o.messages = nil
+}
+
+// copyNode snapshots a node so the hub can encode it while the store keeps mutating
+func copyNode(node *NetworkNode) *NetworkNode {
+	n := *node
+	return &n
+}
+
+// logClientBuffer is how many messages a /logs client may fall behind by
+// before it is disconnected
+const logClientBuffer = 256
+
+// LogHub keeps the most recent log messages and streams new ones to /logs
+// clients, each filtered by its own LogFilter
 type LogHub struct {
-	clients   map[*websocket.Conn]bool
-	broadcast chan LogMessage
-	register  chan *websocket.Conn
-	unregister chan *websocket.Conn
-	mu        sync.RWMutex
+	clients map[*logClient]bool
+	ring    []LogMessage
+	next    int  // index the next message is written to
+	full    bool // the ring has wrapped
+	seq     uint64
+	mu      sync.Mutex
+}
+
+// logClient is one /logs connection. Only its writer goroutine writes to
+// conn.
+type logClient struct {
+	conn   *websocket.Conn
+	filter LogFilter
+	send   chan LogMessage
 }
 
-func NewLogHub() *LogHub {
+// NewLogHub creates a hub that keeps the last size messages
+func NewLogHub(size int) *LogHub {
 	return &LogHub{
-		clients:    make(map[*websocket.Conn]bool),
-		broadcast:  make(chan LogMessage, 256),
-		register:   make(chan *websocket.Conn),
-		unregister: make(chan *websocket.Conn),
+		clients: make(map[*logClient]bool),
+		ring:    make([]LogMessage, max(size, 1)),
 	}
 }
 
-// Run starts the log hub
-func (h *LogHub) Run() {
-	for {
+// Publish numbers a message, keeps it and sends it to the clients whose
+// filter it matches. It never blocks: a client that has fallen too far
+// behind is dropped. It must not log, as it runs inside the log handler.
+func (h *LogHub) Publish(msg LogMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	msg.Seq = h.seq
+	h.ring[h.next] = msg
+	h.next = (h.next + 1) % len(h.ring)
+	if h.next == 0 {
+		h.full = true
+	}
+
+	for client := range h.clients {
+		if !client.filter.Matches(&msg) {
+			continue
+		}
 		select {
-		case client := <-h.register:
-			h.mu.Lock()
-			h.clients[client] = true
-			h.mu.Unlock()
-			log.Printf("Log client connected. Total log clients: %d", len(h.clients))
+		case client.send <- msg:
+		default:
+			delete(h.clients, client)
+			close(client.send)
+		}
+	}
+}
 
-		case client := <-h.unregister:
-			h.mu.Lock()
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				client.Close()
-			}
-			h.mu.Unlock()
-			log.Printf("Log client disconnected. Total log clients: %d", len(h.clients))
+// Query returns up to limit of the newest kept messages matching filter,
+// oldest first. A limit of 0 or less returns every match.
+func (h *LogHub) Query(filter LogFilter, limit int) []LogMessage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.query(filter, limit)
+}
 
-		case message := <-h.broadcast:
-			h.mu.RLock()
-			for client := range h.clients {
-				err := client.WriteJSON(message)
-				if err != nil {
-					log.Printf("Error sending log to client: %v", err)
-					client.Close()
-					delete(h.clients, client)
-				}
-			}
-			h.mu.RUnlock()
+// query walks the ring backwards from the newest message; callers hold h.mu
+func (h *LogHub) query(filter LogFilter, limit int) []LogMessage {
+	size := h.next
+	if h.full {
+		size = len(h.ring)
+	}
+	var out []LogMessage
+	for i := 1; i <= size && (limit <= 0 || len(out) < limit); i++ {
+		msg := &h.ring[(h.next-i+len(h.ring))%len(h.ring)]
+		if filter.Matches(msg) {
+			out = append(out, *msg)
 		}
 	}
+	slices.Reverse(out)
+	return out
 }
 
-// BroadcastLog sends a log message to all connected clients
-func (h *LogHub) BroadcastLog(level, message string) {
-	h.broadcast <- LogMessage{
-		Level:   level,
-		Message: message,
+// subscribe registers a client and returns up to backlog earlier messages
+// matching its filter. Both happen under one lock, so the client sees
+// every message exactly once.
+func (h *LogHub) subscribe(client *logClient, backlog int) []LogMessage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[client] = true
+	if backlog <= 0 {
+		return nil
 	}
+	return h.query(client.filter, backlog)
 }
 
-// HandleLogStream handles WebSocket connections for log streaming
+// unsubscribe removes a client if Publish hasn't already dropped it
+func (h *LogHub) unsubscribe(client *logClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[client] {
+		delete(h.clients, client)
+		close(client.send)
+	}
+}
+
+// setFilter changes what a client receives from now on
+func (h *LogHub) setFilter(client *logClient, filter LogFilter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	client.filter = filter
+}
+
+// logFilterRequest is what a /logs client sends to change its filter:
+//
+//	{"level": "warn", "components": ["dns", "capture"], "q": "timeout"}
+type logFilterRequest struct {
+	Level      string   `json:"level"`
+	Components []string `json:"components"`
+	Text       string   `json:"q"`
+}
+
+// defaultLogBacklog is how many earlier messages a new /logs client is
+// sent when it doesn't ask for a number
+const defaultLogBacklog = 200
+
+// HandleLogStream streams log messages. Query parameters filter them
+// (see parseLogFilter); backlog=N replays up to N earlier matches first.
 func HandleLogStream(logHub *LogHub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
+		filter, err := parseLogFilter(r.URL.Query())
 		if err != nil {
-			log.Printf("Log WebSocket upgrade failed: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-
-		// Register new client
-		logHub.register <- conn
-
-		// Send welcome message
-		welcomeMsg := LogMessage{
-			Level:   "info",
-			Message: "Connected to NetOps backend terminal stream",
+		backlog := defaultLogBacklog
+		if v := r.URL.Query().Get("backlog"); v != "" {
+			if backlog, err = strconv.Atoi(v); err != nil || backlog < 0 {
+				http.Error(w, "backlog must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
 		}
-		if err := conn.WriteJSON(welcomeMsg); err != nil {
-			log.Printf("Error sending welcome message: %v", err)
-			logHub.unregister <- conn
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			slog.Warn("Log WebSocket upgrade failed", "component", "logs", "error", err)
 			return
 		}
 
-		// Keep connection alive and handle close
+		client := &logClient{conn: conn, filter: filter, send: make(chan LogMessage, logClientBuffer)}
+		replay := logHub.subscribe(client, backlog)
+		slog.Debug("Log client connected", "component", "logs", "remote", r.RemoteAddr, "backlog", len(replay))
+
+		// Writer: welcome message, backlog, then live messages until the
+		// hub closes the channel
 		go func() {
-			defer func() {
-				logHub.unregister <- conn
-			}()
+			defer conn.Close()
+			welcome := LogMessage{
+				Time:      time.Now(),
+				Level:     "info",
+				Message:   "Connected to NetOps backend terminal stream",
+				Component: "logs",
+			}
+			if err := conn.WriteJSON(welcome); err != nil {
+				return
+			}
+			for _, msg := range replay {
+				if err := conn.WriteJSON(msg); err != nil {
+					return
+				}
+			}
+			for msg := range client.send {
+				if err := conn.WriteJSON(msg); err != nil {
+					return
+				}
+			}
+		}()
 
+		// Reader: filter changes, until the connection closes
+		go func() {
+			defer logHub.unsubscribe(client)
 			for {
-				_, _, err := conn.ReadMessage()
+				_, data, err := conn.ReadMessage()
 				if err != nil {
-					break
+					return
+				}
+				var req logFilterRequest
+				if json.Unmarshal(data, &req) != nil {
+					continue
 				}
+				next := LogFilter{Level: slog.LevelDebug, Components: req.Components, Text: req.Text}
+				if req.Level != "" && next.Level.UnmarshalText([]byte(req.Level)) != nil {
+					continue
+				}
+				logHub.setFilter(client, next)
 			}
 		}()
 	}
 }
 
-// HandleWebSocket handles WebSocket connections
+// Subprotocols a /ws client may request to choose the encoding. Without
+// one, messages are JSON text frames.
+const (
+	subprotocolJSON    = "netops.json"
+	subprotocolMsgpack = "netops.msgpack" // MessagePack binary frames
+)
+
+// HandleWebSocket handles WebSocket connections. Clients start subscribed
+// to everything and may narrow that down with ClientRequests.
 func HandleWebSocket(hub *WSHub, store *NodeStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
+		var header http.Header
+		protocol := ""
+		for _, p := range websocket.Subprotocols(r) {
+			if p == subprotocolJSON || p == subprotocolMsgpack {
+				protocol = p
+				header = http.Header{"Sec-Websocket-Protocol": {p}}
+				break
+			}
+		}
+
+		conn, err := upgrader.Upgrade(w, r, header)
 		if err != nil {
-			log.Printf("WebSocket upgrade failed: %v", err)
+			slog.Warn("WebSocket upgrade failed", "component", "ws", "error", err)
 			return
 		}
 
-		// Register new client
-		hub.register <- conn
-
-		// Send initial state
-		nodes := make([]*NetworkNode, 0, len(store.Nodes))
-		for _, node := range store.Nodes {
-			nodes = append(nodes, node)
+		// A reconnecting client passes the last sequence number it saw,
+		// and the filter it had, to be sent only what it missed
+		client := newWSClient(conn, protocol == subprotocolMsgpack)
+		query := r.URL.Query()
+		if f := query.Get("filter"); f != "" {
+			if err := json.Unmarshal([]byte(f), &client.filter); err != nil {
+				client.reply(WSMessage{Type: "error", Error: "invalid filter: " + err.Error()})
+				client.close()
+				return
+			}
 		}
-
-		initialState := struct {
-			Type  string         `json:"type"`
-			Nodes []*NetworkNode `json:"nodes"`
-		}{
-			Type:  "initial_state",
-			Nodes: nodes,
+		resumed := false
+		if v := query.Get("resume"); v != "" {
+			if seq, err := strconv.ParseUint(v, 10, 64); err == nil {
+				resumed = hub.Resume(client, store, seq)
+			}
 		}
 
-		if err := conn.WriteJSON(initialState); err != nil {
-			log.Printf("Error sending initial state: %v", err)
-			hub.unregister <- conn
-			return
+		if !resumed {
+			// Register new client and send initial state
+			hub.register <- client
+			if err := client.resync(store, hub, ""); err != nil {
+				slog.Warn("Error sending initial state", "component", "ws", "error", err)
+				hub.unregister <- client
+				return
+			}
 		}
 
-		// Keep connection alive and handle close
+		// Handle client requests until the connection closes
 		go func() {
 			defer func() {
-				hub.unregister <- conn
+				hub.unregister <- client
 			}()
 
 			for {
-				_, _, err := conn.ReadMessage()
+				kind, data, err := conn.ReadMessage()
+				if err != nil {
+					break
+				}
+				var req ClientRequest
+				if kind == websocket.BinaryMessage {
+					err = UnmarshalMsgpack(data, &req)
+				} else {
+					err = json.Unmarshal(data, &req)
+				}
+				if err != nil {
+					err = client.reply(WSMessage{Type: "error", Error: "invalid request: " + err.Error()})
+				} else {
+					err = client.handleRequest(&req, hub, store)
+				}
 				if err != nil {
 					break
 				}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func dialHub(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func hubClients(hub *WSHub) int {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	return len(hub.clients)
+}
+
+func TestWSHubDropsSlowClient(t *testing.T) {
+	hub := NewWSHub(16)
+	go hub.Run()
+	store := NewNodeStore()
+	server := httptest.NewServer(HandleWebSocket(hub, store))
+	defer server.Close()
+
+	fast := dialHub(t, server.URL)
+	defer fast.Close()
+	slow := dialHub(t, server.URL) // never reads
+	defer slow.Close()
+	waitFor(t, func() bool { return hubClients(hub) == 2 })
+
+	// Enough data to fill the slow client's socket buffers and its queue,
+	// sent in bursts the fast client can keep up with
+	progress := make(chan int, 1)
+	go func() {
+		defer close(progress)
+		for count := 0; ; {
+			var msg WSMessage
+			if err := fast.ReadJSON(&msg); err != nil {
+				return
+			}
+			if msg.Type == "node_add" || msg.Type == "node_update" {
+				count++
+				progress <- count
+			}
+		}
+	}()
+
+	node := &NetworkNode{ID: "203.0.113.1", Name: strings.Repeat("x", 16<<10)}
+	const burst, events = wsClientBuffer / 2, 8 * wsClientBuffer
+	for sent := burst; sent <= events; sent += burst {
+		for range burst {
+			hub.BroadcastNodeUpdate(node)
+		}
+		for count := 0; count < sent; {
+			select {
+			case c, ok := <-progress:
+				if !ok {
+					t.Fatalf("fast client disconnected after %d events", count)
+				}
+				count = c
+			case <-time.After(10 * time.Second):
+				t.Fatalf("fast client stalled at %d of %d events", count, sent)
+			}
+		}
+	}
+	waitFor(t, func() bool { return hubClients(hub) == 1 })
+}
+
+func TestOutboxDefersUntilFlush(t *testing.T) {
+	hub := NewWSHub(16)
+	out := hub.NewOutbox()
+	node := &NetworkNode{ID: "203.0.113.1", Status: "online"}
+	out.BroadcastNodeUpdate(node)
+	out.BroadcastAlert(NewAlert("threat-intel", node.ID, "high", "listed"))
+	out.BroadcastNodeRemove(node.ID)
+
+	// The node is copied when queued, as the store may change it after
+	// releasing its lock
+	node.Status = "offline"
+	if len(hub.broadcast) != 0 {
+		t.Fatal("outbox sent before Flush")
+	}
+
+	out.Flush()
+	var types []string
+	for range 3 {
+		msg := <-hub.broadcast
+		types = append(types, msg.Type)
+		if msg.Type == "node_update" && msg.Node.Status != "online" {
+			t.Errorf("queued node status = %s, want online", msg.Node.Status)
+		}
+	}
+	if got := strings.Join(types, ","); got != "node_update,alert,node_remove" {
+		t.Errorf("flushed %s", got)
+	}
+	out.Flush()
+	if len(hub.broadcast) != 0 {
+		t.Error("second Flush sent the messages again")
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Zones assigned when no rule matches a node
+const (
+	defaultInternalZone = "internal" // this host, internal hosts, processes and containers
+	defaultExternalZone = "internet"
+)
+
+// Zone policy actions
+const (
+	zoneAllow = "allow"
+	zoneDeny  = "deny"
+)
+
+// zoneFile is the JSON file NETOPS_ZONES points at:
+//
+//	{
+//	  "zones": [
+//	    {"name": "restricted", "cidrs": ["10.20.0.0/16"], "tags": ["namespace:payments"]},
+//	    {"name": "partner", "asns": ["AS64500"], "countries": ["DE"]},
+//	    {"name": "dmz", "cidrs": ["192.0.2.0/24"]},
+//	    {"name": "internal", "cidrs": ["10.0.0.0/8"], "providers": ["aws"]}
+//	  ],
+//	  "default": "internet",
+//	  "policy": [
+//	    {"from": "internet", "to": "restricted", "action": "deny"},
+//	    {"from": "restricted", "to": "*", "action": "deny"}
+//	  ],
+//	  "defaultAction": "allow"
+//	}
+type zoneFile struct {
+	Zones         []zoneDefinition `json:"zones"`
+	Default       string           `json:"default"` // zone of external nodes no rule matches
+	Policy        []zonePolicyRule `json:"policy"`
+	DefaultAction string           `json:"defaultAction"` // for zone pairs no rule covers
+}
+
+// zoneDefinition matches a node by any of its rules
+type zoneDefinition struct {
+	Name      string   `json:"name"`
+	CIDRs     []string `json:"cidrs"`
+	ASNs      []string `json:"asns"`
+	Countries []string `json:"countries"`
+	Providers []string `json:"providers"` // cloud providers from published ranges
+	Tags      []string `json:"tags"`
+}
+
+// zonePolicyRule allows or denies flows from one zone to another; "*"
+// matches any zone
+type zonePolicyRule struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Action string `json:"action"`
+}
+
+// zone is a compiled zoneDefinition
+type zone struct {
+	name      string
+	prefixes  []netip.Prefix
+	asns      map[string]bool
+	countries map[string]bool
+	providers map[string]bool
+	tags      map[string]bool
+}
+
+// zoneConfig is a loaded zone file
+type zoneConfig struct {
+	zones         []zone
+	fallback      string
+	policy        []zonePolicyRule
+	defaultAction string
+}
+
+// ZonePolicy assigns nodes to security zones and says which zone pairs may
+// talk. Zones are tried in file order, and the first that matches wins.
+type ZonePolicy struct {
+	path string
+
+	config    *zoneConfig
+	signature string
+	mu        sync.RWMutex
+}
+
+// NewZonePolicy creates a policy backed by the file at path; call Reload to
+// read it
+func NewZonePolicy(path string) *ZonePolicy {
+	return &ZonePolicy{path: path}
+}
+
+// Reload re-reads the zone file if it changed since the last load and
+// reports whether it did. A file with errors leaves the previous policy
+// in place.
+func (z *ZonePolicy) Reload() (bool, error) {
+	info, err := os.Stat(z.path)
+	if err != nil {
+		return false, err
+	}
+	signature := fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())
+	z.mu.RLock()
+	unchanged := z.config != nil && z.signature == signature
+	z.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(z.path)
+	if err != nil {
+		return false, err
+	}
+	config, err := parseZoneFile(data)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", z.path, err)
+	}
+	slog.Info("Security zones loaded", "component", "zones", "zones", len(config.zones), "policy_rules", len(config.policy))
+
+	z.mu.Lock()
+	z.config, z.signature = config, signature
+	z.mu.Unlock()
+	return true, nil
+}
+
+// parseZoneFile compiles a zone file, rejecting unknown fields, bad CIDRs,
+// actions other than allow and deny, and policy rules naming a zone that
+// is not defined, the default or "internal"
+func parseZoneFile(data []byte) (*zoneConfig, error) {
+	var file zoneFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, err
+	}
+
+	config := &zoneConfig{
+		fallback:      strings.ToLower(strings.TrimSpace(file.Default)),
+		defaultAction: strings.ToLower(strings.TrimSpace(file.DefaultAction)),
+	}
+	if config.fallback == "" {
+		config.fallback = defaultExternalZone
+	}
+	switch config.defaultAction {
+	case "":
+		config.defaultAction = zoneAllow
+	case zoneAllow, zoneDeny:
+	default:
+		return nil, fmt.Errorf("defaultAction %q is not allow or deny", file.DefaultAction)
+	}
+
+	for _, def := range file.Zones {
+		z := zone{
+			name:      strings.ToLower(strings.TrimSpace(def.Name)),
+			asns:      make(map[string]bool),
+			countries: make(map[string]bool),
+			providers: make(map[string]bool),
+			tags:      make(map[string]bool),
+		}
+		if z.name == "" || z.name == "*" {
+			return nil, errors.New("every zone needs a name")
+		}
+		for _, cidr := range def.CIDRs {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+			if err != nil {
+				// A bare address is a single-host prefix
+				addr, addrErr := netip.ParseAddr(strings.TrimSpace(cidr))
+				if addrErr != nil {
+					return nil, fmt.Errorf("zone %s: %w", z.name, err)
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			z.prefixes = append(z.prefixes, prefix.Masked())
+		}
+		for _, asn := range def.ASNs {
+			z.asns[normalizeASN(asn)] = true
+		}
+		for _, country := range def.Countries {
+			z.countries[strings.ToUpper(strings.TrimSpace(country))] = true
+		}
+		for _, provider := range def.Providers {
+			z.providers[strings.ToLower(strings.TrimSpace(provider))] = true
+		}
+		for _, tag := range def.Tags {
+			z.tags[strings.TrimSpace(tag)] = true
+		}
+		config.zones = append(config.zones, z)
+	}
+
+	known := map[string]bool{"*": true, defaultInternalZone: true, config.fallback: true}
+	for _, z := range config.zones {
+		known[z.name] = true
+	}
+	for _, rule := range file.Policy {
+		rule.From = strings.ToLower(strings.TrimSpace(rule.From))
+		rule.To = strings.ToLower(strings.TrimSpace(rule.To))
+		rule.Action = strings.ToLower(strings.TrimSpace(rule.Action))
+		if rule.From == "" || rule.To == "" {
+			return nil, errors.New("policy rules need a from and a to zone")
+		}
+		if rule.Action != zoneAllow && rule.Action != zoneDeny {
+			return nil, fmt.Errorf("policy %s → %s: action %q is not allow or deny", rule.From, rule.To, rule.Action)
+		}
+		for _, name := range []string{rule.From, rule.To} {
+			if !known[name] {
+				return nil, fmt.Errorf("policy %s → %s: unknown zone %q", rule.From, rule.To, name)
+			}
+		}
+		config.policy = append(config.policy, rule)
+	}
+	return config, nil
+}
+
+// Assign returns the zone a node belongs to
+func (z *ZonePolicy) Assign(node *NetworkNode) string {
+	z.mu.RLock()
+	config := z.config
+	z.mu.RUnlock()
+	if config == nil {
+		return ""
+	}
+
+	addr, err := netip.ParseAddr(node.IPAddress)
+	if err == nil {
+		addr = addr.Unmap()
+	}
+	asn := normalizeASN(node.ASN)
+	country := strings.ToUpper(node.Country)
+	provider := ""
+	if node.Cloud != nil {
+		provider = strings.ToLower(node.Cloud.Provider)
+	}
+	tags := nodeTags(node)
+
+	for _, zone := range config.zones {
+		if addr.IsValid() {
+			for _, prefix := range zone.prefixes {
+				if prefix.Contains(addr) {
+					return zone.name
+				}
+			}
+		}
+		if (asn != "" && zone.asns[asn]) || (country != "" && zone.countries[country]) || (provider != "" && zone.providers[provider]) {
+			return zone.name
+		}
+		for _, tag := range tags {
+			if zone.tags[tag] {
+				return zone.name
+			}
+		}
+	}
+	if node.ID == "local" || node.Internal || node.Type == "process" {
+		return defaultInternalZone
+	}
+	return config.fallback
+}
+
+// nodeTags are the labels zone rules can match on: the node type, "local",
+// "internal" or "external", "agent", "hop", "threat" for nodes on a threat
+// feed, and for containers "namespace:<name>" and each pod label as
+// "key=value"
+func nodeTags(node *NetworkNode) []string {
+	tags := []string{node.Type}
+	if node.ID == "local" {
+		tags = append(tags, "local")
+	}
+	if node.Internal || node.ID == "local" || node.Type == "process" {
+		tags = append(tags, "internal")
+	} else {
+		tags = append(tags, "external")
+	}
+	if node.Agent != "" {
+		tags = append(tags, "agent")
+	}
+	if node.Hop {
+		tags = append(tags, "hop")
+	}
+	if len(node.ThreatFeeds) > 0 {
+		tags = append(tags, "threat")
+	}
+	if c := node.Container; c != nil {
+		if c.Namespace != "" {
+			tags = append(tags, "namespace:"+c.Namespace)
+		}
+		for key, value := range c.Labels {
+			tags = append(tags, key+"="+value)
+		}
+	}
+	return tags
+}
+
+// Check returns the rule a flow from one zone to another breaks, as
+// "from → to", or "" when it is allowed. Rules are tried in file order.
+func (z *ZonePolicy) Check(from, to string) string {
+	z.mu.RLock()
+	config := z.config
+	z.mu.RUnlock()
+	if config == nil || from == "" || to == "" {
+		return ""
+	}
+	action := config.defaultAction
+	rule := from + " → " + to
+	for _, r := range config.policy {
+		if (r.From == "*" || r.From == from) && (r.To == "*" || r.To == to) {
+			action, rule = r.Action, r.From+" → "+r.To
+			break
+		}
+	}
+	if action == zoneDeny {
+		return rule
+	}
+	return ""
+}
+
+// ApplyZone sets a node's zone and reports whether it changed
+func ApplyZone(node *NetworkNode, zone string) bool {
+	if node.SecurityZone == zone {
+		return false
+	}
+	node.SecurityZone = zone
+	return true
+}
+
+// assignZones moves every node into the zone the rules give it now, as
+// its address, ASN and cloud details fill in or the rules change.
+// Callers hold store.mu.
+func assignZones(out *Outbox, store *NodeStore, zones *ZonePolicy) {
+	for _, node := range store.Nodes {
+		if ApplyZone(node, zones.Assign(node)) {
+			out.BroadcastNodeUpdate(node)
+		}
+	}
+}
+
+// raiseZoneAlert reports a flow between zones the policy denies. Callers
+// hold store.mu.
+func raiseZoneAlert(out *Outbox, from, to *NetworkNode, rule string) {
+	msg := fmt.Sprintf("Zone policy violation: %s (%s) → %s (%s) breaks %s",
+		from.Name, from.SecurityZone, to.Name, to.SecurityZone, rule)
+	slog.Warn("Zone policy violation", "component", "zones", "from", from.ID, "to", to.ID,
+		"from_zone", from.SecurityZone, "to_zone", to.SecurityZone, "rule", rule)
+	out.BroadcastAlert(NewAlert("zone-policy", to.ID, "high", msg))
+}
+
+// refreshZones re-reads the zone file every interval. Nodes are assigned
+// again on the next scan.
+func refreshZones(zones *ZonePolicy, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := zones.Reload(); err != nil {
+			slog.Error("Security zone reload failed", "component", "zones", "error", err)
+		}
+	}
+}
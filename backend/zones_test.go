@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadTestZones(t *testing.T) *ZonePolicy {
+	t.Helper()
+	zones := NewZonePolicy(filepath.Join("testdata", "zones", "zones.json"))
+	if changed, err := zones.Reload(); err != nil || !changed {
+		t.Fatalf("Reload = %v, %v", changed, err)
+	}
+	return zones
+}
+
+func TestZoneAssign(t *testing.T) {
+	zones := loadTestZones(t)
+	tests := []struct {
+		name string
+		node NetworkNode
+		want string
+	}{
+		// Zones are tried in file order: restricted's prefix sits inside
+		// internal's, and its address wins over partner's ASN
+		{"first zone wins", NetworkNode{IPAddress: "10.20.1.5", Internal: true}, "restricted"},
+		{"later zone", NetworkNode{IPAddress: "10.1.2.3", Internal: true}, "internal"},
+		{"prefix before ASN", NetworkNode{IPAddress: "10.20.0.9", ASN: "AS64500"}, "restricted"},
+		{"ASN without prefix", NetworkNode{IPAddress: "198.51.100.1", ASN: "64500"}, "partner"},
+		{"country", NetworkNode{IPAddress: "198.51.100.2", Country: "ch"}, "partner"},
+		{"mapped IPv4", NetworkNode{IPAddress: "::ffff:192.0.2.7"}, "dmz"},
+		{"single host", NetworkNode{IPAddress: "2001:db8::1"}, "dmz"},
+		{"provider", NetworkNode{IPAddress: "198.51.100.3", Cloud: &CloudInfo{Provider: "aws"}}, "internal"},
+		{"namespace tag", NetworkNode{IPAddress: "172.17.0.2", Internal: true, Container: &ContainerInfo{Namespace: "payments"}}, "restricted"},
+		{"threat tag", NetworkNode{IPAddress: "203.0.113.9", ThreatFeeds: []string{"spamhaus"}}, "quarantine"},
+		{"label tag", NetworkNode{Type: "container", Internal: true, Container: &ContainerInfo{Labels: map[string]string{"app": "legacy"}}}, "quarantine"},
+		// Nodes no zone matches
+		{"this host", NetworkNode{ID: "local", IPAddress: "127.0.0.1"}, "internal"},
+		{"internal host", NetworkNode{IPAddress: "172.16.0.4", Internal: true}, "internal"},
+		{"process", NetworkNode{ID: "proc:nginx", Type: "process"}, "internal"},
+		{"external", NetworkNode{IPAddress: "203.0.113.5", Type: "server"}, "outside"},
+		{"no address", NetworkNode{ID: "hop-3", Hop: true}, "outside"},
+	}
+	for _, tt := range tests {
+		if got := zones.Assign(&tt.node); got != tt.want {
+			t.Errorf("%s: zone %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// External nodes get internet when the file sets no default
+	zones.config.fallback = defaultExternalZone
+	if got := zones.Assign(&NetworkNode{IPAddress: "203.0.113.5"}); got != defaultExternalZone {
+		t.Errorf("external with the built-in default: %q", got)
+	}
+	if got := NewZonePolicy("unused").Assign(&NetworkNode{ID: "local"}); got != "" {
+		t.Errorf("zone %q before any file loaded", got)
+	}
+}
+
+func TestZoneCheck(t *testing.T) {
+	zones := loadTestZones(t)
+	tests := []struct {
+		from, to string
+		want     string
+	}{
+		{"outside", "restricted", "outside → restricted"},
+		// A wildcard destination
+		{"restricted", "dmz", "restricted → *"},
+		// Both "restricted → *" and "* → restricted" match; the first wins
+		{"restricted", "restricted", "restricted → *"},
+		{"dmz", "restricted", ""},
+		// "* → quarantine" comes before "internal → *"
+		{"internal", "quarantine", "* → quarantine"},
+		{"internal", "outside", ""},
+		// defaultAction
+		{"dmz", "outside", "dmz → outside"},
+		{"", "restricted", ""},
+		{"outside", "", ""},
+	}
+	for _, tt := range tests {
+		if got := zones.Check(tt.from, tt.to); got != tt.want {
+			t.Errorf("Check(%s, %s) = %q, want %q", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestParseZoneFileErrors(t *testing.T) {
+	tests := []struct {
+		file string
+		want string // in the error, "" for none
+	}{
+		{`{"zones": [{"name": "dmz"}], "policy": [{"from": "internet", "to": "dmz", "action": "deny"}]}`, ""},
+		{`{"policy": [{"from": "internal", "to": "*", "action": "allow"}]}`, ""},
+		{`{"default": "outside", "policy": [{"from": "Outside", "to": "internal", "action": "deny"}]}`, ""},
+		{`{"zones": [{"name": "dmz"}], "policy": [{"from": "dmz", "to": "restricted", "action": "deny"}]}`, `unknown zone "restricted"`},
+		{`{"zones": [{"name": "dmz"}], "policy": [{"from": "DMZ ", "to": "db", "action": "deny"}]}`, `dmz → db: unknown zone "db"`},
+		// internet is only known while it is the default
+		{`{"default": "outside", "policy": [{"from": "internet", "to": "*", "action": "deny"}]}`, `unknown zone "internet"`},
+		{`{"policy": [{"from": "*", "to": "*", "action": "block"}]}`, `action "block"`},
+		{`{"policy": [{"from": "*", "action": "deny"}]}`, "need a from and a to"},
+		{`{"zones": [{"name": "dmz", "cidrs": ["192.0.2.0/33"]}]}`, "zone dmz"},
+		{`{"zones": [{"name": " "}]}`, "needs a name"},
+		{`{"zones": [{"name": "dmz", "cidr": ["192.0.2.0/24"]}]}`, "unknown field"},
+		{`{"defaultAction": "reject"}`, "defaultAction"},
+	}
+	for _, tt := range tests {
+		_, err := parseZoneFile([]byte(tt.file))
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: %v", tt.file, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s: error %v, want %q", tt.file, err, tt.want)
+		}
+	}
+}
+
+func TestZoneReloadKeepsPolicyOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zones.json")
+	write := func(data string, mtime time.Time) {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mtime, mtime)
+	}
+	now := time.Now()
+	write(`{"zones": [{"name": "dmz", "cidrs": ["192.0.2.0/24"]}]}`, now)
+	zones := NewZonePolicy(path)
+	if changed, err := zones.Reload(); err != nil || !changed {
+		t.Fatalf("first Reload = %v, %v", changed, err)
+	}
+	if changed, _ := zones.Reload(); changed {
+		t.Error("Reload re-read an unchanged file")
+	}
+
+	write(`{"zones": [{"name": "dmz"}], "policy": [{"from": "dmz", "to": "db", "action": "deny"}]}`, now.Add(time.Minute))
+	if _, err := zones.Reload(); err == nil {
+		t.Fatal("Reload accepted a rule naming an unknown zone")
+	}
+	if got := zones.Assign(&NetworkNode{IPAddress: "192.0.2.1"}); got != "dmz" {
+		t.Errorf("zone %q after a rejected reload, want the previous dmz", got)
+	}
+}
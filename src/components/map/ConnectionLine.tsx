@@ -82,7 +82,10 @@ export function ConnectionLine({ connection, nodes, onSelect }: ConnectionLinePr
     return null
   }
 
-  const style = getConnectionStyle(connection.type)
+  // Flows the zone policy denies are drawn in red whatever their type
+  const style = connection.violation
+    ? { ...getConnectionStyle(connection.type), color: '#ff0055' }
+    : getConnectionStyle(connection.type)
   const opacity = getStatusOpacity(connection.status)
 
   // Create coordinates array [lng, lat]
@@ -147,6 +150,9 @@ export function ConnectionLine({ connection, nodes, onSelect }: ConnectionLinePr
                 <span>BW: {connection.bandwidth}Mbps</span>
               </div>
               <div className="capitalize mt-1">Status: {connection.status}</div>
+              {connection.violation && (
+                <div className="mt-1" style={{ color: '#ff0055' }}>Policy violation: {connection.violation}</div>
+              )}
             </div>
           </div>
         </div>
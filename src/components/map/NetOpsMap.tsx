@@ -20,6 +20,8 @@ function getDeviceIcon(type: NetworkNode['type']): string {
     case 'switch': return '🔀'
     case 'endpoint': return '💻'
     case 'load-balancer': return '⚖️'
+    case 'process': return '⚙️'
+    case 'container': return '📦'
     default: return '❓'
   }
 }
@@ -106,7 +108,7 @@ export function NetOpsMap() {
     nodes.forEach(node => {
       const position = nodePositions.get(node.id) || node.location
       const isOffset = position.lat !== node.location.lat || position.lng !== node.location.lng
-      const colors = getStatusColor(node.status)
+      const colors = getStatusColor(node.threatFeeds?.length ? 'critical' : node.status)
       const isIPv6 = node.ipAddress.includes(':')
       const ipVersion = isIPv6 ? 'IPv6' : 'IPv4'
       const ipVersionColor = isIPv6 ? '#bd00ff' : '#00d9ff'
@@ -22,6 +22,24 @@ function getZoneColors(type: SecurityZoneType['type']) {
         outline: '#00ff41',
         label: 'Internal',
       }
+    case 'partner':
+      return {
+        fill: 'rgba(0, 217, 255, 0.15)', // blue
+        outline: '#00d9ff',
+        label: 'Partner',
+      }
+    case 'internet':
+      return {
+        fill: 'rgba(255, 0, 85, 0.15)', // red
+        outline: '#ff0055',
+        label: 'Internet',
+      }
+    case 'restricted':
+      return {
+        fill: 'rgba(189, 0, 255, 0.15)', // purple
+        outline: '#bd00ff',
+        label: 'Restricted',
+      }
     case 'public':
       return {
         fill: 'rgba(255, 0, 85, 0.15)', // red
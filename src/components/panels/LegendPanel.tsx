@@ -74,6 +74,14 @@ export function LegendPanel() {
                   <span style={{ fontSize: '16px' }}>⚖️</span>
                   <span style={textStyle}>Load Balancer</span>
                 </div>
+                <div style={itemStyle}>
+                  <span style={{ fontSize: '16px' }}>⚙️</span>
+                  <span style={textStyle}>Process</span>
+                </div>
+                <div style={itemStyle}>
+                  <span style={{ fontSize: '16px' }}>📦</span>
+                  <span style={textStyle}>Container</span>
+                </div>
               </div>
             </div>
 
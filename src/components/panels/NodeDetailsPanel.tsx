@@ -9,6 +9,8 @@ function getDeviceIcon(type: NetworkNode['type']): string {
     case 'switch': return '🔀'
     case 'endpoint': return '💻'
     case 'load-balancer': return '⚖️'
+    case 'process': return '⚙️'
+    case 'container': return '📦'
     default: return '❓'
   }
 }
@@ -105,6 +107,13 @@ export function NodeDetailsPanel() {
             </div>
           </div>
 
+          {selectedNode.securityZone && (
+            <div>
+              <div style={{ color: '#a0a0a0', fontSize: '10px', marginBottom: '4px' }}>SECURITY ZONE</div>
+              <div style={{ color: '#ffb000', textTransform: 'uppercase' }}>{selectedNode.securityZone}</div>
+            </div>
+          )}
+
           {selectedNode.owner && (
             <div>
               <div style={{ color: '#a0a0a0', fontSize: '10px', marginBottom: '4px' }}>OWNER</div>
@@ -112,10 +121,38 @@ export function NodeDetailsPanel() {
             </div>
           )}
 
+          {selectedNode.cloud && (
+            <div>
+              <div style={{ color: '#a0a0a0', fontSize: '10px', marginBottom: '4px' }}>CLOUD</div>
+              <div style={{ color: '#00d9ff', textTransform: 'uppercase' }}>
+                {[selectedNode.cloud.provider, selectedNode.cloud.service, selectedNode.cloud.region].filter(Boolean).join(' / ')}
+              </div>
+              <div style={{ color: '#a0a0a0', fontSize: '11px', marginTop: '4px', fontFamily: 'monospace' }}>
+                {selectedNode.cloud.prefix}
+              </div>
+            </div>
+          )}
+
           {selectedNode.asn && (
             <div>
               <div style={{ color: '#a0a0a0', fontSize: '10px', marginBottom: '4px' }}>ASN</div>
               <div style={{ color: '#ffb000' }}>{selectedNode.asn}</div>
+              {selectedNode.routing && (
+                <div style={{ color: '#a0a0a0', fontSize: '11px', marginTop: '4px' }}>
+                  <div style={{ fontFamily: 'monospace' }}>{selectedNode.routing.prefix}</div>
+                  {selectedNode.routing.name && (
+                    <div>
+                      {selectedNode.routing.name}
+                      {selectedNode.routing.country && ` (${selectedNode.routing.country}${selectedNode.routing.rir ? `, ${selectedNode.routing.rir.toUpperCase()}` : ''})`}
+                    </div>
+                  )}
+                  {selectedNode.routing.upstreams && selectedNode.routing.upstreams.length > 0 && (
+                    <div>
+                      Upstreams: {selectedNode.routing.upstreams.map((up) => up.name ? `AS${up.asn} ${up.name}` : `AS${up.asn}`).join(', ')}
+                    </div>
+                  )}
+                </div>
+              )}
             </div>
           )}
 
@@ -161,6 +198,24 @@ export function NodeDetailsPanel() {
             </div>
           )}
 
+          {selectedNode.health && (
+            <div>
+              <div style={{ color: '#a0a0a0', fontSize: '10px', marginBottom: '4px' }}>LATENCY</div>
+              {([['TCP', selectedNode.health.tcp], ['ICMP', selectedNode.health.icmp]] as const).map(([label, stats]) => stats && (
+                <div key={label} style={{ color: stats.loss > 0 ? '#ffb000' : '#00ff41', fontFamily: 'monospace', fontSize: '11px' }}>
+                  {label}{label === 'TCP' && selectedNode.health?.port ? `/${selectedNode.health.port}` : ''}{' '}
+                  {stats.received > 0
+                    ? `${stats.min?.toFixed(1)}/${stats.avg?.toFixed(1)}/${stats.p95?.toFixed(1)} ms, jitter ${(stats.jitter ?? 0).toFixed(1)} ms`
+                    : 'no replies'}
+                  {`, ${stats.loss}% loss`}
+                </div>
+              ))}
+              {selectedNode.health.pathMtu && (
+                <div style={{ color: '#a0a0a0', fontSize: '11px' }}>Path MTU {selectedNode.health.pathMtu}</div>
+              )}
+            </div>
+          )}
+
           {selectedNode.process && (
             <div>
               <div style={{ color: '#a0a0a0', fontSize: '10px', marginBottom: '4px' }}>PROCESS</div>
@@ -177,6 +232,48 @@ export function NodeDetailsPanel() {
             </div>
           )}
 
+          {selectedNode.container && (
+            <div>
+              <div style={{ color: '#a0a0a0', fontSize: '10px', marginBottom: '4px' }}>CONTAINER</div>
+              <div style={{ color: '#00d9ff' }}>
+                {[selectedNode.container.namespace, selectedNode.container.pod, selectedNode.container.name].filter(Boolean).join(' / ')}
+              </div>
+              <div style={{ color: '#a0a0a0', fontSize: '11px', marginTop: '4px', fontFamily: 'monospace' }}>
+                {[selectedNode.container.image, selectedNode.container.runtime, selectedNode.container.id.slice(0, 12)].filter(Boolean).join(' · ')}
+              </div>
+              {selectedNode.container.labels && (
+                <div style={{ color: '#a0a0a0', fontSize: '11px', marginTop: '4px', fontFamily: 'monospace' }}>
+                  {Object.entries(selectedNode.container.labels).map(([k, v]) => `${k}=${v}`).join(', ')}
+                </div>
+              )}
+            </div>
+          )}
+
+          {selectedNode.netns && (
+            <div>
+              <div style={{ color: '#a0a0a0', fontSize: '10px', marginBottom: '4px' }}>NETWORK NAMESPACE</div>
+              <div style={{ color: '#a0a0a0', fontSize: '11px', fontFamily: 'monospace' }}>{selectedNode.netns}</div>
+            </div>
+          )}
+
+          {(selectedNode.unit || !!selectedNode.pids?.length) && (
+            <div>
+              <div style={{ color: '#a0a0a0', fontSize: '10px', marginBottom: '4px' }}>UNIT / PIDS</div>
+              <div style={{ color: '#a0a0a0', fontSize: '11px', fontFamily: 'monospace' }}>
+                {[selectedNode.unit, selectedNode.pids?.join(', ')].filter(Boolean).join(' · ')}
+              </div>
+            </div>
+          )}
+
+          {selectedNode.processes && selectedNode.processes.length > 0 && (
+            <div>
+              <div style={{ color: '#a0a0a0', fontSize: '10px', marginBottom: '4px' }}>APPLICATIONS</div>
+              <div style={{ color: '#00d9ff', fontSize: '11px', fontFamily: 'monospace' }}>
+                {selectedNode.processes.join(', ')}
+              </div>
+            </div>
+          )}
+
           <div>
             <div style={{ color: '#a0a0a0', fontSize: '10px', marginBottom: '4px' }}>COORDINATES</div>
             <div style={{ color: '#a0a0a0', fontSize: '11px' }}>
@@ -1,22 +1,36 @@
 import { useState, useEffect, useRef } from 'react'
 import { Terminal, Trash2 } from 'lucide-react'
+import { backendSocketURL } from '@/lib/utils'
+import type { LogMessage } from '@/lib/types'
 
 interface LogEntry {
   timestamp: string
-  level: 'info' | 'warn' | 'error'
+  level: 'debug' | 'info' | 'warn' | 'error'
   message: string
 }
 
+// formatLogMessage renders a structured backend log message on one line:
+// "[component] message key=value ..."
+function formatLogMessage(log: LogMessage) {
+  const fields = Object.entries(log.fields ?? {})
+    .map(([key, value]) => `${key}=${typeof value === 'string' ? value : JSON.stringify(value)}`)
+    .join(' ')
+  return [log.component && `[${log.component}]`, log.message, fields].filter(Boolean).join(' ')
+}
+
 export function TerminalPanel() {
   const [isOpen, setIsOpen] = useState(false)
   const [logs, setLogs] = useState<LogEntry[]>([])
   const terminalRef = useRef<HTMLDivElement>(null)
   const wsRef = useRef<WebSocket | null>(null)
+  const lastSeqRef = useRef(0)
 
   useEffect(() => {
     // Connect to backend log stream
     function connectLogStream() {
-      const ws = new WebSocket('ws://localhost:8081/logs')
+      // After a reconnect, only replay what was missed
+      const path = lastSeqRef.current ? `/logs?after=${lastSeqRef.current}` : '/logs'
+      const ws = new WebSocket(backendSocketURL(path))
 
       ws.onopen = () => {
         console.log('Terminal log stream connected')
@@ -25,8 +39,11 @@ export function TerminalPanel() {
 
       ws.onmessage = (event) => {
         try {
-          const logData = JSON.parse(event.data)
-          addLog(logData.level || 'info', logData.message)
+          const logData: LogMessage = JSON.parse(event.data)
+          if (logData.seq) {
+            lastSeqRef.current = logData.seq
+          }
+          addLog(logData.level || 'info', formatLogMessage(logData), logData.time)
         } catch {
           // If not JSON, treat as plain text
           addLog('info', event.data)
@@ -59,8 +76,8 @@ export function TerminalPanel() {
     }
   }, [logs])
 
-  const addLog = (level: LogEntry['level'], message: string) => {
-    const timestamp = new Date().toLocaleTimeString('en-US', {
+  const addLog = (level: LogEntry['level'], message: string, time?: string) => {
+    const timestamp = (time ? new Date(time) : new Date()).toLocaleTimeString('en-US', {
       hour12: false,
       hour: '2-digit',
       minute: '2-digit',
@@ -76,6 +93,7 @@ export function TerminalPanel() {
 
   const getLevelPrefix = (level: LogEntry['level']) => {
     switch (level) {
+      case 'debug': return '[DEBUG]'
       case 'info': return '[INFO]'
       case 'warn': return '[WARN]'
       case 'error': return '[ERROR]'
@@ -244,7 +262,7 @@ export function TerminalPanel() {
                   >
                     <span style={{ color: '#00d9ff', flexShrink: 0 }}>{log.timestamp}</span>
                     <span style={{
-                      color: log.level === 'info' ? '#00ff41' : log.level === 'warn' ? '#ffb000' : '#ff0055',
+                      color: log.level === 'debug' ? '#00d9ff' : log.level === 'info' ? '#00ff41' : log.level === 'warn' ? '#ffb000' : '#ff0055',
                       flexShrink: 0,
                       fontWeight: 'bold'
                     }}>
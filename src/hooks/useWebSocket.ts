@@ -1,18 +1,31 @@
 import { useEffect, useRef } from 'react'
 import { useNetOpsStore } from '@/lib/store'
 import type { NetworkNode, WSMessage } from '@/lib/types'
+import { backendSocketURL, stateChecksum } from '@/lib/utils'
 
-const WS_URL = 'ws://localhost:8081/ws'
+const WS_URL = backendSocketURL('/ws')
+
+type WireEdge = NonNullable<WSMessage['connections']>[number]
 
 export function useWebSocket() {
   const wsRef = useRef<WebSocket | null>(null)
   const reconnectTimeoutRef = useRef<ReturnType<typeof setTimeout> | undefined>(undefined)
-  const { addNode, updateNode, removeNode, clearNodes, setConnections } = useNetOpsStore()
+  // Last event number seen, to resume after a reconnect, and the edges as
+  // the server sent them, keyed "from>to", to apply deltas to
+  const lastSeqRef = useRef<number>(0)
+  const edgesRef = useRef<Map<string, WireEdge>>(new Map())
+  const { addNode, updateNode, removeNode, clearNodes, setConnections, addThreatEvent } = useNetOpsStore()
 
   useEffect(() => {
     function connect() {
-      console.log('Connecting to WebSocket:', WS_URL)
-      const ws = new WebSocket(WS_URL)
+      const url = new URL(WS_URL)
+      if (lastSeqRef.current) {
+        url.searchParams.set('resume', String(lastSeqRef.current))
+      }
+      console.log('Connecting to WebSocket:', url.pathname)
+      const ws = new WebSocket(url)
+
+      const publishEdges = () => setConnections(Array.from(edgesRef.current.values()))
 
       ws.onopen = () => {
         console.log('WebSocket connected')
@@ -22,11 +35,15 @@ export function useWebSocket() {
         try {
           const message: WSMessage = JSON.parse(event.data)
           console.log('WebSocket message:', message)
+          if (message.seq) {
+            lastSeqRef.current = Math.max(lastSeqRef.current, message.seq)
+          }
 
           switch (message.type) {
             case 'initial_state':
               // Clear existing nodes and load initial state
               clearNodes()
+              edgesRef.current.clear()
               if (message.nodes) {
                 message.nodes.forEach((node: NetworkNode) => {
                   addNode(node)
@@ -57,9 +74,46 @@ export function useWebSocket() {
               break
 
             case 'connections_update':
-              if (message.connections) {
-                setConnections(message.connections)
-                console.log('Connections updated:', message.connections.length)
+              // Full edge snapshot; an empty list is omitted
+              edgesRef.current = new Map(
+                (message.connections ?? []).map((edge) => [`${edge.from}>${edge.to}`, edge])
+              )
+              publishEdges()
+              console.log('Connections updated:', edgesRef.current.size)
+              break
+
+            case 'connections_delta':
+              message.added?.forEach((edge) => edgesRef.current.set(`${edge.from}>${edge.to}`, edge))
+              message.removed?.forEach((edge) => edgesRef.current.delete(`${edge.from}>${edge.to}`))
+              publishEdges()
+              break
+
+            case 'checksum': {
+              const nodeIds = useNetOpsStore.getState().nodes.map((node) => node.id)
+              const local = stateChecksum(nodeIds, Array.from(edgesRef.current.values()))
+              if (local !== message.checksum) {
+                console.warn('State drifted from the server, requesting a resync')
+                ws.send(JSON.stringify({ type: 'resync' }))
+              }
+              break
+            }
+
+            case 'resumed':
+              console.log('Resumed stream after event', message.seq)
+              break
+
+            case 'alert':
+              if (message.alert) {
+                addThreatEvent(message.alert)
+                console.log('Alert:', message.alert.message)
+              }
+              break
+
+            case 'anomaly':
+              if (message.anomaly) {
+                const { id, timestamp, nodeId, severity, message: text } = message.anomaly
+                addThreatEvent({ id, type: 'anomaly', timestamp, nodeId, severity, message: text })
+                console.log('Anomaly:', text)
               }
               break
 
@@ -93,7 +147,7 @@ export function useWebSocket() {
         wsRef.current.close()
       }
     }
-  }, [addNode, updateNode, removeNode, clearNodes, setConnections])
+  }, [addNode, updateNode, removeNode, clearNodes, setConnections, addThreatEvent])
 
   return wsRef.current
 }
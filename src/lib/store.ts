@@ -26,7 +26,10 @@ interface NetOpsStore {
   // Connection operations
   addConnection: (from: string, to: string, type: ConnectionType) => void
   removeConnection: (id: string) => void
-  setConnections: (connections: Array<{ from: string; to: string }>) => void
+  setConnections: (connections: Array<{ from: string; to: string; latency?: number; violation?: string }>) => void
+
+  // Threat operations
+  addThreatEvent: (event: ThreatEvent) => void
 
   // UI state
   selectNode: (node: NetworkNode | null) => void
@@ -48,9 +51,11 @@ export const useNetOpsStore = create<NetOpsStore>((set) => ({
   filteredZone: null,
 
   // Node operations
+  // Adding a node that is already known replaces it, so replayed events
+  // after a resume are harmless
   addNode: (node) =>
     set((state) => ({
-      nodes: [...state.nodes, node],
+      nodes: [...state.nodes.filter((n) => n.id !== node.id), node],
     })),
 
   updateNode: (id, updates) =>
@@ -102,12 +107,19 @@ export const useNetOpsStore = create<NetOpsStore>((set) => ({
         from: conn.from,
         to: conn.to,
         type: 'https',
-        latency: 0,
+        latency: conn.latency ?? 0,
         bandwidth: 1000,
         status: 'active',
+        violation: conn.violation,
       })),
     })),
 
+  // Threat operations
+  addThreatEvent: (event) =>
+    set((state) => ({
+      threatEvents: [...state.threatEvents.slice(-99), event],
+    })),
+
   // UI state
   selectNode: (node) =>
     set(() => ({
@@ -1,8 +1,8 @@
 // Core network topology types for NetOps Visual
 
-export type DeviceType = 'server' | 'firewall' | 'router' | 'switch' | 'endpoint' | 'load-balancer'
+export type DeviceType = 'server' | 'firewall' | 'router' | 'switch' | 'endpoint' | 'load-balancer' | 'process' | 'container'
 
-export type SecurityZoneType = 'dmz' | 'internal' | 'public' | 'private'
+export type SecurityZoneType = 'dmz' | 'internal' | 'partner' | 'internet' | 'restricted' | 'public' | 'private'
 
 export type NodeStatus = 'online' | 'offline' | 'warning' | 'critical'
 
@@ -30,16 +30,63 @@ export interface NetworkNode {
   ipAddress: string
   securityZone?: SecurityZoneType
   status: NodeStatus
+  internal?: boolean // host inside the monitored network (gateway mode)
+  agent?: string // ID of the agent reporting this host
+  hop?: boolean // a router found by traceroute
+  group?: GroupInfo // set on nodes standing in for a group of nodes
+  country?: string // ISO country code
+  city?: string
   metrics?: NetworkMetrics
   owner?: string
+  hostname?: string // reverse DNS name
+  dnsNames?: string[] // forward names seen resolving to this IP
   asn?: string
+  routing?: RoutingInfo // announced prefix and origin AS from offline routing data
+  cloud?: CloudInfo // published cloud/CDN range the address is in
   connections?: number
+  traffic?: TrafficStats
+  health?: NodeHealth // latest latency/loss probe round
   process?: string
+  processes?: string[] // local applications talking to this peer
+  unit?: string // systemd service of a process node
+  pids?: number[] // running processes of a process node
+  container?: ContainerInfo // runtime and Kubernetes details of a container node
+  netns?: string // network namespace of a namespace node
+  reputation?: number // threat intel score 0-100
+  threatFeeds?: string[] // threat intel feeds listing this node
   firstSeen?: string
   lastSeen?: string
   metadata?: Record<string, any>
 }
 
+// Published cloud or CDN range a node's address is in
+export interface CloudInfo {
+  provider: string // aws, azure, google, cloudflare, fastly, oracle, github, ...
+  service?: string // S3, CLOUDFRONT, AzureStorage, ...
+  region?: string
+  prefix: string
+}
+
+// What the container runtime and Kubernetes say about a container node
+export interface ContainerInfo {
+  id: string
+  name?: string
+  image?: string
+  runtime?: string // docker, containerd, crio or podman
+  pod?: string
+  namespace?: string // Kubernetes namespace
+  labels?: Record<string, string>
+}
+
+export type GroupBy = 'asn' | 'prefix' | 'owner' | 'country' | 'city'
+
+// A group node rolled up on the server from the nodes sharing an attribute
+export interface GroupInfo {
+  by: GroupBy
+  key: string // the value the members share
+  members: number
+}
+
 export interface Connection {
   id: string
   from: string // node id
@@ -48,6 +95,7 @@ export interface Connection {
   latency: number // milliseconds
   bandwidth: number // Mbps
   status: ConnectionStatus
+  violation?: string // zone policy rule the edge breaks, "from → to"
 }
 
 export interface SecurityZone {
@@ -60,13 +108,28 @@ export interface SecurityZone {
 
 export interface ThreatEvent {
   id: string
-  type: 'failed-login' | 'port-scan' | 'ddos' | 'intrusion'
+  type: 'failed-login' | 'port-scan' | 'ddos' | 'intrusion' | 'threat-intel' | 'zone-policy' | 'egress-policy' | 'anomaly'
   timestamp: string
   nodeId: string
   severity: 'low' | 'medium' | 'high' | 'critical'
   message: string
 }
 
+// Behaviour that doesn't fit a host or process's learned baseline
+export interface Anomaly {
+  id: string
+  timestamp: string
+  nodeId: string
+  origin: string
+  process?: string
+  kind: 'connections' | 'asn' | 'country' | 'port'
+  value: string
+  score: number // z-score of a connection count, or surprise in bits for a new value
+  expected?: number // usual connection count at this hour
+  severity: 'low' | 'medium' | 'high'
+  message: string
+}
+
 export interface NetworkTopology {
   name: string
   nodes: NetworkNode[]
@@ -75,10 +138,110 @@ export interface NetworkTopology {
   threatEvents?: ThreatEvent[]
 }
 
+export interface TrafficStats {
+  bytesIn: number
+  bytesOut: number
+  packetsIn: number
+  packetsOut: number
+  rateIn: number // bytes/s over the last 10s
+  rateOut: number
+  rateIn1m: number // bytes/s over the last minute
+  rateOut1m: number
+  packetRate: number // packets/s both ways
+}
+
+export interface RoutingInfo {
+  prefix: string // longest announced prefix covering the address
+  origin: number[] // origin ASNs, more than one when multi-origin
+  name?: string // origin AS name
+  country?: string // where the origin AS is registered
+  rir?: string
+  upstreams?: Array<{ asn: number; name?: string }> // transit providers
+}
+
+export interface RTTStats {
+  sent: number
+  received: number
+  loss: number // percent
+  min?: number // milliseconds
+  avg?: number
+  p95?: number
+  jitter?: number
+}
+
+export interface NodeHealth {
+  tcp?: RTTStats // connects to port
+  port?: number
+  icmp?: RTTStats
+  pathMtu?: number
+  measuredAt: string
+}
+
+export interface ServiceInfo {
+  serverNames?: string[] // TLS SNI
+  alpn?: string[]
+  ja3?: string[]
+  ja4?: string[]
+  httpHosts?: string[]
+}
+
 export interface WSMessage {
-  type: 'initial_state' | 'node_add' | 'node_update' | 'node_remove' | 'connections_update'
+  type:
+    | 'initial_state'
+    | 'node_add'
+    | 'node_update'
+    | 'node_remove'
+    | 'connections_update'
+    | 'connections_delta'
+    | 'alert'
+    | 'anomaly'
+    | 'node_detail'
+    | 'unsubscribed'
+    | 'checksum'
+    | 'resumed'
+    | 'error'
+  seq?: number // event number; reconnect with ?resume=<seq> to get missed events
   node?: NetworkNode
   nodes?: NetworkNode[]
-  connections?: Array<{ from: string; to: string }>
+  connections?: Array<{ from: string; to: string; service?: ServiceInfo; traffic?: TrafficStats; latency?: number; violation?: string }>
+  added?: Array<{ from: string; to: string; service?: ServiceInfo; traffic?: TrafficStats; latency?: number; violation?: string }> // new or changed edges
+  removed?: Array<{ from: string; to: string }>
+  checksum?: string
   id?: string
+  alert?: ThreatEvent
+  anomaly?: Anomaly
+  requestId?: string // echoes the ClientRequest being answered
+  error?: string
+}
+
+// Server-side filter for the /ws subscription; unset fields match everything
+export interface NodeFilter {
+  types?: DeviceType[]
+  status?: NodeStatus[]
+  countries?: string[]
+  asns?: string[]
+  bbox?: { south: number; west: number; north: number; east: number }
+  minConnections?: number
+  processes?: string[] // only these local applications' traffic
+  zones?: string[] // security zones
+}
+
+// Messages the client may send on /ws
+export type ClientRequest =
+  | { type: 'subscribe'; filter?: NodeFilter; requestId?: string }
+  | { type: 'unsubscribe'; requestId?: string }
+  | { type: 'resync'; requestId?: string }
+  | { type: 'node_detail'; id: string; requestId?: string } // for a group, the reply lists its members in nodes
+  | { type: 'group'; by: GroupBy | 'none'; requestId?: string }
+  | { type: 'expand'; id: string; requestId?: string } // show a group's members instead of the group
+  | { type: 'collapse'; id: string; requestId?: string }
+
+// Message on the /logs stream
+export interface LogMessage {
+  seq?: number // absent for messages the backend doesn't keep
+  time: string
+  level: 'debug' | 'info' | 'warn' | 'error'
+  message: string
+  component?: string
+  fields?: Record<string, unknown>
 }
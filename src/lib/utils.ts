@@ -4,3 +4,29 @@ import { twMerge } from "tailwind-merge"
 export function cn(...inputs: ClassValue[]) {
   return twMerge(clsx(inputs))
 }
+
+// backendSocketURL builds a backend WebSocket URL, adding the API token from
+// VITE_NETOPS_TOKEN when the backend requires authentication
+export function backendSocketURL(path: string) {
+  const url = new URL(path, 'ws://localhost:8081')
+  const token = import.meta.env.VITE_NETOPS_TOKEN
+  if (token) {
+    url.searchParams.set('access_token', token)
+  }
+  return url.toString()
+}
+
+// stateChecksum mirrors the backend's drift check: FNV-1a (32-bit) over the
+// sorted lines "n:<id>" for each node and "e:<from>><to>" for each edge,
+// each followed by a newline
+export function stateChecksum(nodeIds: string[], edges: Array<{ from: string; to: string }>) {
+  const lines = [...nodeIds.map((id) => `n:${id}`), ...edges.map((e) => `e:${e.from}>${e.to}`)]
+  lines.sort((a, b) => (a < b ? -1 : a > b ? 1 : 0))
+  const bytes = new TextEncoder().encode(lines.map((line) => line + '\n').join(''))
+  let hash = 0x811c9dc5
+  for (const byte of bytes) {
+    hash ^= byte
+    hash = Math.imul(hash, 0x01000193)
+  }
+  return (hash >>> 0).toString(16).padStart(8, '0')
+}